@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -8,90 +10,236 @@ import (
 	"os"
 	"time"
 
+	"github.com/caleberi/gostripe/internal/config"
 	"github.com/caleberi/gostripe/internal/driver"
+	"github.com/caleberi/gostripe/internal/encryption"
+	"github.com/caleberi/gostripe/internal/mailer"
+	"github.com/caleberi/gostripe/internal/migrate"
 	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/storage"
+	"github.com/caleberi/gostripe/internal/urlsigner"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 const version = "1.0.0"
 
-// configuration setup for the application which allows application
-// information management  retrieved from the system environment or configuration file
-type config struct {
-	port int
-	env  string
-	db   struct {
-		dns string
-	}
-	stripe struct {
-		key    string
-		secret string
-	}
-}
+// tokenSweepInterval is how often expired bearer tokens are deleted
+const tokenSweepInterval = time.Hour
 
 // creates basic setup properties for tha application which might be needed along the way
 type application struct {
-	config   config
-	infoLog  *log.Logger
-	errorLog *log.Logger
-	version  string
-	DB       models.DBModel
+	config    config.Config
+	infoLog   *log.Logger
+	errorLog  *log.Logger
+	version   string
+	DB        models.Models
+	dbs       *driver.DB
+	mailer    mailer.Mailer
+	signer    *urlsigner.Signer
+	encrypter *encryption.Encrypter
+	live      *config.Live
+	images    storage.Images
 }
 
 // serve function basically start the application server via `net/http`
 // Server construct
 func (app *application) serve() error {
+	mux := app.routes()
+	if err := app.verifyOpenAPI(mux); err != nil {
+		return err
+	}
 
 	srv := &http.Server{
-		Addr:              fmt.Sprintf(":%d", app.config.port),
-		Handler:           app.routes(),
+		Addr:              fmt.Sprintf(":%d", app.config.API.Port),
+		Handler:           mux,
 		ReadTimeout:       10 * time.Second,
 		IdleTimeout:       30 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
 		WriteTimeout:      5 * time.Second,
 	}
 
-	app.infoLog.Printf("starting API server on port %[1]d with url: http://localhost:%[1]d  ...", app.config.port)
+	app.infoLog.Printf("starting API server on port %[1]d with url: http://localhost:%[1]d  ...", app.config.API.Port)
 	return srv.ListenAndServe()
 }
 
 func main() {
 
-	var cfg config
-
-	flag.IntVar(&cfg.port, "port", 4000, "📌 app server port")
-	flag.StringVar(&cfg.env, "environment", "development", "📌 application runtime environment {production|developement|maintenace}")
-	flag.StringVar(&cfg.db.dns, "dsn", "caleb:secret@tcp(localhost:3306)/gostripe?parseTime=true&tls=false", "📌 database domain service name (DSN)")
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		printConfig(os.Args[3:])
+		return
+	}
 
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
 
-	// retrieve stripe setup from os package
-	cfg.stripe.key = os.Getenv("STRIPE_KEY")
-	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	// settings are merged from defaults, database.yml, the config file,
+	// the environment and flags; secrets come from the environment or the
+	// files named by *_FILE
+	cfg, err := config.Load("api", os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalln(err)
+	}
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
-	infoLog.Printf("db.dns :- %s ", cfg.db.dns)
-	// connect to the database
-	conn, err := driver.OpenDB(cfg.db.dns)
+	warnings, err := cfg.Validate()
 	if err != nil {
 		errorLog.Fatalln(err)
 	}
-	defer conn.Close()
+	for _, w := range warnings {
+		infoLog.Println(w)
+	}
+
+	infoLog.Printf("config: %s", cfg.Redacted())
+
+	live := config.NewLive(*cfg)
+	live.ReloadOnSIGHUP(infoLog, errorLog)
+
+	// connect to the primary and replicas, dialing with the current password
+	// so a rotated DB_PASSWORD_FILE applies to new connections
+	db, err := live.OpenDB()
+	if err != nil {
+		errorLog.Fatalln(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go db.Watch(ctx, time.Duration(cfg.DB.HealthInterval), infoLog.Printf)
+
+	if cfg.DB.Migrate {
+		m, err := migrate.New(db.Primary, db.Dialect)
+		if err != nil {
+			errorLog.Fatalln(err)
+		}
+		m.Log = infoLog.Printf
+		if _, err := m.Up(context.Background()); err != nil {
+			errorLog.Fatalln(err)
+		}
+	}
 
 	// initializing the application with obtained configuration
 	app := &application{
-		config:   cfg,
+		config:   *cfg,
 		infoLog:  infoLog,
 		errorLog: errorLog,
 		version:  version,
-		DB: models.DBModel{
-			DB: conn,
-		},
+		DB: models.NewModels(&models.DBModel{
+			DB:       db.Primary,
+			Dialect:  db.Dialect,
+			Reads:    db,
+			Timeout:  time.Duration(cfg.DB.QueryTimeout),
+			Observer: models.LogQueries(infoLog, time.Duration(cfg.DB.SlowQuery), middleware.GetReqID),
+		}),
+		dbs:       db,
+		mailer:    newMailer(cfg.Mail, infoLog),
+		signer:    &urlsigner.Signer{Secret: []byte(cfg.SigningKey)},
+		encrypter: &encryption.Encrypter{Key: []byte(cfg.EncryptionKey)},
+		live:      live,
+		images:    storage.Images{Dir: cfg.Images.Dir, MaxSize: cfg.Images.MaxSize},
 	}
 
+	go app.releaseReservations(ctx, time.Duration(cfg.Inventory.SweepInterval))
+	go app.deleteExpiredTokens(ctx, tokenSweepInterval)
+
 	if err := app.serve(); err != nil {
 		app.errorLog.Fatalln(err)
 	}
 
 }
+
+// deleteExpiredTokens removes bearer tokens past their expiry every interval
+// until ctx is done
+func (app *application) deleteExpiredTokens(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := app.DB.Users.DeleteExpiredTokens(ctx); err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+}
+
+// newMailer builds the mail transport selected by the -mailer flag
+func newMailer(cfg config.Mail, infoLog *log.Logger) mailer.Mailer {
+	switch cfg.Transport {
+	case "smtp":
+		return &mailer.SMTPMailer{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: string(cfg.SMTP.Password),
+			From:     cfg.From,
+		}
+	case "file":
+		return &mailer.FileMailer{From: cfg.From, Dir: cfg.Dir}
+	default:
+		return &mailer.LogMailer{From: cfg.From, Logger: infoLog}
+	}
+}
+
+// stripeKeys returns the current stripe keys, which a SIGHUP may have rotated
+func (app *application) stripeKeys() (key, secret string) {
+	cfg := app.live.Config()
+	return cfg.Stripe.Key, string(cfg.Stripe.Secret)
+}
+
+// printConfig implements `api config print`, which writes the effective
+// settings with secrets masked
+func printConfig(args []string) {
+	cfg, err := config.Load("api", args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalln(err)
+	}
+	if err := cfg.Print(os.Stdout); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runMigrate implements `api migrate`, which applies or reverts the embedded
+// migrations and exits
+func runMigrate(args []string) {
+	command, flags, err := migrate.ParseCommand(args)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	cfg, err := config.Load("api", flags)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalln(err)
+	}
+
+	conn, err := driver.OpenDB(cfg.DataSourceName())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+
+	m, err := migrate.New(conn, cfg.DB.Dialect)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	m.Log = log.Printf
+
+	if err := m.Run(context.Background(), os.Stdout, command); err != nil {
+		log.Fatalln(err)
+	}
+}
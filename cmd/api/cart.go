@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/validator"
+	"github.com/caleberi/gostripe/pkg/client"
+)
+
+// cartPayload is the body accepted when pricing a cart
+type cartPayload = client.CartPayload
+
+// PriceCart prices cart lines at the current widget prices and shipping
+// rates, so a client can show the total a payment intent for them will
+// charge
+func (app *application) PriceCart(w http.ResponseWriter, r *http.Request) {
+	var payload cartPayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	cart, err := models.PriceCart(r.Context(), app.DB.Widgets, cartLines(payload.Items), v)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	rates, err := app.DB.Shipping.ListShippingRates(r.Context())
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+	cart = cart.WithShipping(rates)
+
+	if err := app.writeJSON(w, http.StatusOK, cart); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// address converts an address of a request body, trimmed and with its
+// country upper cased; it returns nil when a is nil
+func address(a *client.Address, kind models.AddressKind) *models.Address {
+	if a == nil {
+		return nil
+	}
+	addr := models.Address{
+		Kind:       kind,
+		Name:       a.Name,
+		Line1:      a.Line1,
+		Line2:      a.Line2,
+		City:       a.City,
+		Region:     a.Region,
+		PostalCode: a.PostalCode,
+		Country:    a.Country,
+	}.Normalize()
+	return &addr
+}
+
+// cartLines converts the cart lines of a request body
+func cartLines(lines []client.CartLine) []models.CartLine {
+	out := make([]models.CartLine, len(lines))
+	for i, l := range lines {
+		out[i] = models.CartLine(l)
+	}
+	return out
+}
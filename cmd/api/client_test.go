@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	imagepng "image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/driver"
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/rbac"
+	"github.com/caleberi/gostripe/pkg/client"
+)
+
+// flaky answers the first requests it gets with the statuses in fail and
+// passes the rest to h, recording the Idempotency-Key of every request
+type flaky struct {
+	h    http.Handler
+	mu   sync.Mutex
+	fail []int
+	keys []string
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.keys = append(f.keys, r.Header.Get("Idempotency-Key"))
+	status := 0
+	if len(f.fail) > 0 {
+		status, f.fail = f.fail[0], f.fail[1:]
+	}
+	f.mu.Unlock()
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	f.h.ServeHTTP(w, r)
+}
+
+// requests returns the Idempotency-Keys of the requests served so far and forgets them
+func (f *flaky) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := f.keys
+	f.keys = nil
+	return keys
+}
+
+// newTestClient starts a server for h that is closed with the test and
+// returns a client for it that retries without waiting long
+func newTestClient(t *testing.T, h http.Handler) *client.Client {
+	t.Helper()
+
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	c := client.New(server.URL)
+	c.RetryWait = time.Millisecond
+	return c
+}
+
+// sameKey fails the test unless there are want keys, all equal and not empty
+func sameKey(t *testing.T, keys []string, want int) {
+	t.Helper()
+
+	if len(keys) != want {
+		t.Fatalf("%d requests, want %d", len(keys), want)
+	}
+	for _, k := range keys {
+		if k == "" || k != keys[0] {
+			t.Fatalf("idempotency keys %q differ between retries", keys)
+		}
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 3})
+	server := &flaky{h: app.routes()}
+	c := newTestClient(t, server)
+
+	server.fail = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	widget, err := c.GetWidget(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if widget.Name != "Gizmo" {
+		t.Errorf("widget = %+v", widget)
+	}
+	first := server.requests()
+	sameKey(t, first, 3)
+
+	server.fail = []int{http.StatusInternalServerError}
+	cart, err := c.PriceCart(context.Background(), []client.CartLine{{WidgetID: id, Quantity: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.Subtotal != 2000 {
+		t.Errorf("subtotal = %d, want 2000", cart.Subtotal)
+	}
+	second := server.requests()
+	sameKey(t, second, 2)
+	if first[0] == second[0] {
+		t.Error("two calls sent the same idempotency key")
+	}
+
+	server.fail = []int{500, 502, 503, 504}
+	_, err = c.GetWidget(context.Background(), id)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("after all retries failed: err = %v, want the last 504", err)
+	}
+	sameKey(t, server.requests(), 1+c.MaxRetries)
+}
+
+func TestClientDoesNotRetryNonIdempotentCalls(t *testing.T) {
+	app, store := newTestApplication(t)
+	addStaff(t, store, "admin@example.com")
+	server := &flaky{h: app.routes()}
+	c := newTestClient(t, server)
+
+	server.fail = []int{http.StatusServiceUnavailable}
+	_, err := c.CreateCustomer(context.Background(), client.CustomerPayload{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+	if !hasStatus(err, http.StatusServiceUnavailable) {
+		t.Errorf("create customer: err = %v, want a 503", err)
+	}
+	sameKey(t, server.requests(), 1)
+
+	server.fail = []int{http.StatusServiceUnavailable}
+	_, err = c.Authenticate(context.Background(), "admin@example.com", "password")
+	if !hasStatus(err, http.StatusServiceUnavailable) {
+		t.Errorf("authenticate: err = %v, want a 503", err)
+	}
+	sameKey(t, server.requests(), 1)
+
+	if _, err := c.CreateCustomer(context.Background(), client.CustomerPayload{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	sameKey(t, server.requests(), 1)
+}
+
+func TestClientErrors(t *testing.T) {
+	app, store := newTestApplication(t)
+	_, token := addStaff(t, store, "clerk@example.com")
+	c := newTestClient(t, app.routes())
+
+	_, err := c.CreateCustomer(context.Background(), client.CustomerPayload{FirstName: "Ada", LastName: "Lovelace", Email: "not-an-email"})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want a *client.Error", err)
+	}
+	if apiErr.StatusCode != http.StatusUnprocessableEntity || apiErr.Errors["email"] == "" || !client.IsValidation(err) {
+		t.Errorf("validation error = %+v", apiErr)
+	}
+
+	if _, err := c.GetWidget(context.Background(), 999); !client.IsNotFound(err) {
+		t.Errorf("missing widget: err = %v", err)
+	}
+
+	_, err = c.GetCustomer(context.Background(), 1)
+	if !client.IsUnauthorized(err) || !errors.As(err, &apiErr) || apiErr.Message == "" {
+		t.Errorf("no token: err = %v, want a 401 with a message", err)
+	}
+
+	c.Token = token
+	if _, err := c.GetCustomer(context.Background(), 1); !client.IsForbidden(err) {
+		t.Errorf("without permission: err = %v", err)
+	}
+}
+
+func TestClientAuthenticate(t *testing.T) {
+	app, store := newTestApplication(t)
+	widget := models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 3}
+	widget.ID = store.AddWidget(widget)
+	orderID := addOrder(t, store, widget, 2)
+	addStaff(t, store, "analyst@example.com", rbac.ViewReports)
+	c := newTestClient(t, app.routes())
+
+	token, err := c.Authenticate(context.Background(), "analyst@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Token = token.PlainText
+
+	order, err := c.GetOrder(context.Background(), orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.ID != orderID || order.Amount != 2000 || len(order.Items) != 1 {
+		t.Errorf("order = %+v", order)
+	}
+}
+
+// hasStatus reports whether err is a *client.Error with status
+func hasStatus(err error, status int) bool {
+	var apiErr *client.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+func TestClientDatabaseStats(t *testing.T) {
+	app, store := newTestApplication(t)
+	dsn := "sqlite:" + filepath.Join(t.TempDir(), "widgets.db")
+	db, err := driver.Open(func() string { return dsn }, nil, driver.DBConfiguration{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	app.dbs = db
+
+	_, clerk := addStaff(t, store, "clerk@example.com")
+	_, analyst := addStaff(t, store, "analyst@example.com", rbac.ViewReports)
+	c := newTestClient(t, app.routes())
+
+	c.Token = clerk
+	if _, err := c.GetDatabaseStats(context.Background()); !client.IsForbidden(err) {
+		t.Errorf("without permission: err = %v", err)
+	}
+
+	c.Token = analyst
+	nodes, err := c.GetDatabaseStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "primary" || !nodes[0].Primary || !nodes[0].Healthy || nodes[0].Checked.IsZero() {
+		t.Errorf("nodes = %+v", nodes)
+	}
+}
+
+func TestClientWidgets(t *testing.T) {
+	app, store := newTestApplication(t)
+	ordered := models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5}
+	ordered.ID = store.AddWidget(ordered)
+	addOrder(t, store, ordered, 1)
+	_, token := addStaff(t, store, "admin@example.com", rbac.ManageCatalog)
+	c := newTestClient(t, app.routes())
+
+	if _, err := c.CreateWidget(context.Background(), client.WidgetPayload{Name: "Gadget", Price: 2500}); !client.IsUnauthorized(err) {
+		t.Errorf("create without a token: err = %v", err)
+	}
+	c.Token = token
+
+	widget, err := c.CreateWidget(context.Background(), client.WidgetPayload{Name: "Gadget", Description: "A gadget", Price: 2500, InventoryLevel: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if widget.ID == 0 || widget.Name != "Gadget" || widget.InventoryLevel != 10 {
+		t.Errorf("created widget = %+v", widget)
+	}
+
+	list, err := c.ListWidgets(context.Background(), client.WidgetFilter{Search: "gadget", PageSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Widgets) != 1 || list.Widgets[0].ID != widget.ID || list.Metadata.TotalRecords != 1 || list.Metadata.PageSize != 1 {
+		t.Errorf("search = %+v", list)
+	}
+	list, err = c.ListWidgets(context.Background(), client.WidgetFilter{Sort: "-price", PageSize: 1, Page: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Widgets) != 1 || list.Widgets[0].ID != ordered.ID || list.Metadata.CurrentPage != 2 || list.Metadata.LastPage != 2 {
+		t.Errorf("second page by price = %+v", list)
+	}
+	if _, err := c.ListWidgets(context.Background(), client.WidgetFilter{Sort: "weight"}); !client.IsValidation(err) {
+		t.Errorf("bad sort: err = %v", err)
+	}
+
+	// two units sell while the widget is being edited from a level of 10
+	lines := []models.CartLine{{WidgetID: widget.ID, Quantity: 2}}
+	if err := store.CommitReservation(context.Background(), "pi_sale", lines); err != nil {
+		t.Fatal(err)
+	}
+	seen := 10
+	update := client.WidgetUpdate{
+		WidgetPayload: client.WidgetPayload{Name: "Gadget", Description: "A better gadget", Price: 3000, InventoryLevel: 15},
+		InventorySeen: &seen,
+	}
+	widget, err = c.UpdateWidget(context.Background(), widget.ID, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if widget.InventoryLevel != 13 || widget.Price != 3000 || widget.Description != "A better gadget" {
+		t.Errorf("updated widget = %+v, want 5 units added to the 8 left", widget)
+	}
+
+	// ten of the 13 units sell while another edit from 13 clears the stock
+	lines[0].Quantity = 10
+	if err := store.CommitReservation(context.Background(), "pi_second_sale", lines); err != nil {
+		t.Fatal(err)
+	}
+	seen, update.InventoryLevel = 13, 0
+	if _, err := c.UpdateWidget(context.Background(), widget.ID, update); !hasStatus(err, http.StatusConflict) {
+		t.Errorf("removing more units than are left: err = %v, want a 409", err)
+	}
+
+	update.InventorySeen = nil
+	widget, err = c.UpdateWidget(context.Background(), widget.ID, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if widget.InventoryLevel != 0 {
+		t.Errorf("inventory = %d, want 0", widget.InventoryLevel)
+	}
+
+	var png bytes.Buffer
+	if err := imagepng.Encode(&png, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	widget, err = c.UploadWidgetImage(context.Background(), widget.ID, "gadget.png", &png)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if widget.Image == "" {
+		t.Error("no image after the upload")
+	}
+	_, err = c.UploadWidgetImage(context.Background(), widget.ID, "gadget.txt", strings.NewReader("not an image"))
+	if !client.IsValidation(err) {
+		t.Errorf("text upload: err = %v", err)
+	}
+
+	if err := c.DeleteWidget(context.Background(), ordered.ID); !hasStatus(err, http.StatusConflict) {
+		t.Errorf("deleting an ordered widget: err = %v, want a 409", err)
+	}
+	if err := c.DeleteWidget(context.Background(), widget.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetWidget(context.Background(), widget.ID); !client.IsNotFound(err) {
+		t.Errorf("deleted widget: err = %v", err)
+	}
+}
+
+func TestClientListInventoryMovements(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5})
+	_, token := addStaff(t, store, "admin@example.com", rbac.ManageCatalog)
+	c := newTestClient(t, app.routes())
+	c.Token = token
+
+	widget, err := c.CreateWidget(context.Background(), client.WidgetPayload{Name: "Gadget", Price: 2500, InventoryLevel: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CommitReservation(context.Background(), "pi_sale", []models.CartLine{{WidgetID: widget.ID, Quantity: 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	movements, err := c.ListInventoryMovements(context.Background(), widget.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movements) != 2 {
+		t.Fatalf("movements = %+v, want the sale and the initial stock", movements)
+	}
+	sale, stock := movements[0], movements[1]
+	if sale.Quantity != -3 || sale.Reason != "sale" || sale.Reference != "pi_sale" || sale.WidgetID != widget.ID || sale.CreatedAt.IsZero() {
+		t.Errorf("newest movement = %+v, want the sale", sale)
+	}
+	if stock.Quantity != 4 || stock.Reason != "adjustment" {
+		t.Errorf("oldest movement = %+v, want the initial stock", stock)
+	}
+
+	if _, err := c.ListInventoryMovements(context.Background(), 999); !client.IsNotFound(err) {
+		t.Errorf("missing widget: err = %v", err)
+	}
+	if movements, err := c.ListInventoryMovements(context.Background(), id); err != nil || len(movements) != 0 {
+		t.Errorf("widget without movements: %+v, %v", movements, err)
+	}
+}
+
+func TestClientListOrders(t *testing.T) {
+	app, store := newTestApplication(t)
+	gizmo := models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5}
+	gizmo.ID = store.AddWidget(gizmo)
+	gadget := models.Widget{Name: "Gadget", Price: 2500, InventoryLevel: 5}
+	gadget.ID = store.AddWidget(gadget)
+	first := addOrder(t, store, gizmo, 1)
+	second := addOrder(t, store, gadget, 2)
+	third := addOrder(t, store, gizmo, 3)
+	_, token := addStaff(t, store, "admin@example.com", rbac.ViewReports)
+	c := newTestClient(t, app.routes())
+
+	if _, err := c.ListOrders(context.Background(), client.OrderFilter{}); !client.IsUnauthorized(err) {
+		t.Errorf("without a token: err = %v", err)
+	}
+	c.Token = token
+
+	// two pages of two, newest first
+	var ids []int
+	filter := client.OrderFilter{PageSize: 2}
+	for page := 1; ; page++ {
+		list, err := c.ListOrders(context.Background(), filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Metadata.PageSize != 2 {
+			t.Errorf("page %d: page size %d, want 2", page, list.Metadata.PageSize)
+		}
+		for _, o := range list.Orders {
+			ids = append(ids, o.ID)
+		}
+		if list.Metadata.NextCursor == "" {
+			break
+		}
+		if page == 2 {
+			t.Fatalf("a third page after %v", ids)
+		}
+		filter.Cursor = list.Metadata.NextCursor
+	}
+	if len(ids) != 3 || ids[0] != third || ids[1] != second || ids[2] != first {
+		t.Errorf("orders %v, want %v", ids, []int{third, second, first})
+	}
+
+	list, err := c.ListOrders(context.Background(), client.OrderFilter{WidgetID: gizmo.ID, MinAmount: 2000, Email: "ADA@"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Orders) != 1 {
+		t.Fatalf("filtered orders = %+v, want order %d", list.Orders, third)
+	}
+	o := list.Orders[0]
+	if o.ID != third || o.Amount != 3000 || o.Status != "Cleared" || o.Customer.Email != "ada@example.com" || o.Transaction.LastFour != "4242" || o.WidgetName != "Gizmo" || o.ItemCount != 1 {
+		t.Errorf("filtered order = %+v", o)
+	}
+
+	// dates are days in UTC, as the API reads them
+	today := time.Now().UTC()
+	if list, err := c.ListOrders(context.Background(), client.OrderFilter{From: today, To: today}); err != nil || len(list.Orders) != 3 {
+		t.Errorf("orders placed today: %+v, %v", list, err)
+	}
+	if list, err := c.ListOrders(context.Background(), client.OrderFilter{From: today.AddDate(0, 0, 1)}); err != nil || len(list.Orders) != 0 {
+		t.Errorf("orders placed from tomorrow: %+v, %v", list, err)
+	}
+
+	_, err = c.ListOrders(context.Background(), client.OrderFilter{MinAmount: 2000, MaxAmount: 1000})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Errors["max_amount"] == "" {
+		t.Errorf("max below min: err = %v, want a max_amount error", err)
+	}
+	if _, err := c.ListOrders(context.Background(), client.OrderFilter{Cursor: "not a cursor"}); !client.IsValidation(err) {
+		t.Errorf("bad cursor: err = %v", err)
+	}
+}
@@ -1,258 +1,931 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caleberi/gostripe/internal/cards"
 	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/totp"
+	"github.com/caleberi/gostripe/internal/urlsigner"
+	"github.com/caleberi/gostripe/internal/validator"
+	"github.com/caleberi/gostripe/pkg/client"
 	"github.com/go-chi/chi/v5"
 	"github.com/stripe/stripe-go/v72"
+	"golang.org/x/crypto/bcrypt"
 )
 
-// payload representation for stripe
-type stripePayload struct {
-	Currency      string `json:"currency"`
-	Amount        string `json:"amount"`
-	PaymentMethod string `json:"payment_method"`
-	Email         string `json:"email"`
-	LastFour      string `json:"last_four"`
-	Plan          string `json:"plan"`
-	ExpiryMonth   int    `json:"exp_month"`
-	ExpiryYear    int    `json:"exp_year"`
-	CardBrand     string `json:"card_brand"`
-	ProductID     string `json:"product_id"`
-	FirstName     string `json:"first_name"`
-	LastName      string `json:"last_name"`
-}
+// payload representation for stripe, shared with the public client so the two cannot drift
+type stripePayload = client.PaymentPayload
+
+// customerPayload is the body accepted when creating a customer
+type customerPayload = client.CustomerPayload
+
+// paymentIntentResponse is the part of a stripe payment intent the browser needs to confirm a payment
+type paymentIntentResponse = client.PaymentIntent
+
+// credentialsPayload is the body accepted by the authenticate endpoint
+type credentialsPayload = client.Credentials
+
+// terminalPayload is a virtual terminal payment already confirmed with stripe
+type terminalPayload = client.TerminalPayment
+
+// forgotPasswordPayload asks for a password reset link
+type forgotPasswordPayload = client.ForgotPasswordPayload
+
+// resetPasswordPayload sets a new password with a signed link
+type resetPasswordPayload = client.ResetPasswordPayload
 
 // how we expect our response to be after every response has been generated
-type jsonResponse struct {
-	OK      bool   `json:"ok"`
-	Message string `json:"message,omitempty"`
-	Content string `json:"content,omitempty"`
-	ID      string `json:"id,omitempty"`
+type jsonResponse = client.Response
+
+// validatePaymentIntent checks the fields a payment intent needs. A payment
+// for widgets, given as cart items or as a single product_id, is priced
+// with shipping into the returned cart; its total is what gets charged, in
+// the store currency, and an amount or currency sent along must match.
+// Widgets need a shipping address.
+func (app *application) validatePaymentIntent(ctx context.Context, p stripePayload) (*validator.Validator, models.Cart, error) {
+	v := validator.New()
+
+	var cart models.Cart
+	switch {
+	case p.ProductID != 0:
+		v.Check(len(p.Items) == 0, "items", "must not be given with product_id")
+		widget, err := app.checkProduct(ctx, v, p.ProductID, "")
+		if err != nil {
+			return nil, cart, err
+		}
+		v.Check(widget.ID == 0 || widget.Available() > 0, "product_id", "is out of stock")
+		if widget.ID != 0 {
+			cart = models.CartOf(widget)
+		}
+	case len(p.Items) > 0:
+		var err error
+		cart, err = models.PriceCart(ctx, app.DB.Widgets, cartLines(p.Items), v)
+		if err != nil {
+			return nil, cart, err
+		}
+	default:
+		v.Check(validator.IsCurrency(p.Currency), "currency", "must be an ISO 4217 currency code")
+		v.Check(validator.AmountInRange(p.Amount), "amount", "must be between 50 and 99999999")
+		return v, cart, nil
+	}
+
+	currency := app.config.Store.Currency
+	v.Check(p.Currency == "" || strings.EqualFold(p.Currency, currency), "currency", "must be "+currency+", the currency widgets are priced in")
+
+	if p.ShippingAddress == nil {
+		v.AddError("shipping_address", "must be provided to ship widgets")
+	} else {
+		address(p.ShippingAddress, models.AddressShipping).Validate(v, "shipping_address.")
+	}
+	if p.BillingAddress != nil {
+		address(p.BillingAddress, models.AddressBilling).Validate(v, "billing_address.")
+	}
+
+	rates, err := app.DB.Shipping.ListShippingRates(ctx)
+	if err != nil {
+		return nil, cart, err
+	}
+	cart = cart.WithShipping(rates)
+	v.Check(cart.Total <= validator.MaxAmount, "items", "must total no more than 99999999 with shipping")
+
+	v.Check(p.Amount == 0 || p.Amount == cart.Total, "amount", "must match the total of "+strconv.Itoa(cart.Total))
+	return v, cart, nil
+}
+
+// validateSubscription checks the fields needed to create a customer and
+// subscribe them to a plan. The plan is billed at the price of its widget,
+// which is returned, so the amount and currency sent must be that price.
+func (app *application) validateSubscription(ctx context.Context, p stripePayload) (*validator.Validator, models.Widget, error) {
+	v := validator.New()
+	v.Check(validator.IsCurrency(p.Currency), "currency", "must be an ISO 4217 currency code")
+	v.Check(validator.AmountInRange(p.Amount), "amount", "must be between 50 and 99999999")
+	v.Check(validator.IsEmail(p.Email), "email", "must be a valid email address")
+	v.Check(validator.NotBlank(p.FirstName), "first_name", "must be provided")
+	v.Check(validator.MaxChars(p.FirstName, validator.MaxNameLength), "first_name", "must not be more than 255 characters")
+	v.Check(validator.NotBlank(p.LastName), "last_name", "must be provided")
+	v.Check(validator.MaxChars(p.LastName, validator.MaxNameLength), "last_name", "must not be more than 255 characters")
+	v.Check(validator.NotBlank(p.PaymentMethod), "payment_method", "must be provided")
+	v.Check(len(p.LastFour) == 4, "last_four", "must be exactly 4 digits")
+	v.Check(validator.ValidExpiry(p.ExpiryMonth, p.ExpiryYear, time.Now()), "exp_month", "card expiry must be a valid future date")
+	v.Check(validator.NotBlank(p.Plan), "plan", "must be provided")
+
+	widget, err := app.checkProduct(ctx, v, p.ProductID, p.Plan)
+	if err != nil {
+		return nil, widget, err
+	}
+	if widget.ID != 0 {
+		currency := app.config.Store.Currency
+		v.Check(p.Amount == widget.Price, "amount", "must match the plan price of "+strconv.Itoa(widget.Price))
+		v.Check(strings.EqualFold(p.Currency, currency), "currency", "must be "+currency+", the currency widgets are priced in")
+	}
+	return v, widget, nil
+}
+
+// checkProduct records an error when productID is not an existing widget or,
+// when plan is given, when the widget is not the recurring product for that
+// plan. The widget is returned when it exists.
+func (app *application) checkProduct(ctx context.Context, v *validator.Validator, productID int, plan string) (models.Widget, error) {
+	widget, err := app.DB.Widgets.GetWidget(ctx, productID)
+	if errors.Is(err, sql.ErrNoRows) {
+		v.AddError("product_id", "does not exist")
+		return models.Widget{}, nil
+	}
+	if err != nil {
+		return models.Widget{}, err
+	}
+
+	if plan != "" && (!widget.IsRecurring || widget.PlanID != plan) {
+		v.AddError("plan", "does not exist for this product")
+	}
+	return widget, nil
 }
 
 // process each payment intent request
 func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request) {
 
 	var payload stripePayload
-	err := json.NewDecoder(r.Body).Decode(&payload)
+	err := app.readJSON(w, r, &payload)
 
 	if err != nil {
-		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
 		return
 	}
 
-	app.infoLog.Printf("payload :.. -> %v", payload)
-
-	// amount conversion for money
-	amount, err := strconv.Atoi(payload.Amount)
-
+	v, cart, err := app.validatePaymentIntent(r.Context(), payload)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.serverError(w, r)
 		return
 	}
 
-	// build card with secrets
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	amount, currency := payload.Amount, payload.Currency
+
+	// widgets are charged at the prices looked up here, in the currency
+	// they are priced in, and the order is recorded from the lines kept on
+	// the payment intent rather than from anything the browser posts
+	// afterwards
+	if len(cart.Items) > 0 {
+		amount, currency = cart.Total, app.config.Store.Currency
+	}
+
+	// build card with secrets; the idempotency key lets clients retry without charging twice
+	key, secret := app.stripeKeys()
 	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+		Secret:         secret,
+		Key:            key,
+		Currency:       currency,
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
 	}
 
-	ok := true
+	if len(cart.Items) > 0 {
+		card.Metadata = map[string]string{
+			models.CartMetadataKey:     models.FormatCartItems(cart.Items),
+			models.ShippingMetadataKey: strconv.Itoa(cart.Shipping),
+		}
+		a := address(payload.ShippingAddress, models.AddressShipping)
+		card.Shipping = &cards.Address{
+			Name:       a.Name,
+			Line1:      a.Line1,
+			Line2:      a.Line2,
+			City:       a.City,
+			State:      a.Region,
+			PostalCode: a.PostalCode,
+			Country:    a.Country,
+		}
+	}
 
-	paymentIntent, msg, err := card.Charge(payload.Currency, amount)
+	paymentIntent, msg, err := card.Charge(currency, amount)
 
 	if err != nil {
-		ok = false
+		app.errorLog.Println(err)
+		app.paymentFailed(w, r, msg)
+		return
 	}
 
-	if ok {
-		out, err := json.MarshalIndent(paymentIntent, "", "  ")
-		if err != nil {
-			app.errorLog.Println(err)
+	// hold the widgets until the customer pays or the reservations expire
+	if len(cart.Items) > 0 {
+		expires := time.Now().Add(time.Duration(app.config.Inventory.ReservationTTL))
+		err := app.DB.Inventory.ReserveInventory(r.Context(), paymentIntent.ID, cart.Lines(), expires)
+		if errors.Is(err, models.ErrOutOfStock) {
+			// the payment intent is never confirmed, so nobody is charged
+			app.conflict(w, r, "a widget sold out before it could be reserved")
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
-	} else {
-		j := jsonResponse{
-			OK:      false,
-			Message: msg,
-			Content: "",
-		}
-		out, err := json.MarshalIndent(j, "", "  ")
 		if err != nil {
 			app.errorLog.Println(err)
+			app.serverError(w, r)
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
+	}
+
+	resp := paymentIntentResponse{
+		ID:           paymentIntent.ID,
+		ClientSecret: paymentIntent.ClientSecret,
+		Amount:       int(paymentIntent.Amount),
+		Currency:     paymentIntent.Currency,
+		Status:       string(paymentIntent.Status),
+	}
+	if err := app.writeJSON(w, http.StatusCreated, resp); err != nil {
+		app.errorLog.Println(err)
 	}
 }
 
 func (app *application) GetWidgetById(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	widgetId, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		app.notFound(w, r)
+		return
+	}
 
-	widgetId, err := strconv.Atoi(id)
+	widget, err := app.DB.Widgets.GetWidget(r.Context(), widgetId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		app.notFound(w, r)
+		return
+	}
 
 	if err != nil {
 		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, widget); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// CreateCustomer stores a customer record without charging them
+func (app *application) CreateCustomer(w http.ResponseWriter, r *http.Request) {
+	var payload customerPayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.IsEmail(payload.Email), "email", "must be a valid email address")
+	v.Check(validator.NotBlank(payload.FirstName), "first_name", "must be provided")
+	v.Check(validator.MaxChars(payload.FirstName, validator.MaxNameLength), "first_name", "must not be more than 255 characters")
+	v.Check(validator.NotBlank(payload.LastName), "last_name", "must be provided")
+	v.Check(validator.MaxChars(payload.LastName, validator.MaxNameLength), "last_name", "must not be more than 255 characters")
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	id, err := app.SaveCustomer(r.Context(), payload.FirstName, payload.LastName, payload.Email)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	customer, err := app.DB.Customers.GetCustomer(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusCreated, customer); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// GetCustomer returns a single customer by id
+func (app *application) GetCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w, r)
 		return
 	}
 
-	widget, err := app.DB.GetWidget(widgetId)
+	customer, err := app.DB.Customers.GetCustomer(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.notFound(w, r)
+		return
+	}
 
 	if err != nil {
 		app.errorLog.Println(err)
+		app.serverError(w, r)
 		return
 	}
 
-	out, err := json.MarshalIndent(widget, "", "   ")
+	if err := app.writeJSON(w, http.StatusOK, customer); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// GetOrder returns a single order by id with its items, customer,
+// transaction and statuses
+func (app *application) GetOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w, r)
+		return
+	}
+
+	order, err := app.DB.Orders.GetOrderSummary(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.notFound(w, r)
+		return
+	}
 
 	if err != nil {
 		app.errorLog.Println(err)
+		app.serverError(w, r)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(out)
+	if err := app.writeJSON(w, http.StatusOK, order); err != nil {
+		app.errorLog.Println(err)
+	}
+}
 
+// DatabaseStats reports the health and connection pools of the databases
+func (app *application) DatabaseStats(w http.ResponseWriter, r *http.Request) {
+	if err := app.writeJSON(w, http.StatusOK, app.dbs.Stats()); err != nil {
+		app.errorLog.Println(err)
+	}
 }
 
 func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 	var data stripePayload
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err := app.readJSON(w, r, &data)
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
 
+	v, widget, err := app.validateSubscription(r.Context(), data)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
 		return
 	}
 
-	app.infoLog.Printf("Create Subscription for Email:[%s] , LastFour: [%s] , PaymentMethod: [%s] , Plan: [%s] \n", data.Email, data.LastFour, data.PaymentMethod, data.Plan)
+	app.infoLog.Printf("creating subscription to plan %s", data.Plan)
 
 	// build card with secrets
+	key, secret := app.stripeKeys()
 	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
+		Secret:   secret,
+		Key:      key,
 		Currency: data.Currency,
 	}
 
-	okay := true
-	var subscription *stripe.Subscription
-	txMsg := "Transaction Successful"
-
 	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.paymentFailed(w, r, msg)
+		return
+	}
 
+	subscription, msg, err := card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
 	if err != nil {
 		app.errorLog.Println(err)
-		okay = false
-		txMsg = msg
+		app.paymentFailed(w, r, msg)
+		return
 	}
 
-	if okay {
-		subscription, err = card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
+	// the customer is already subscribed, so record it even if the client
+	// goes away
+	if err := app.recordSubscription(context.WithoutCancel(r.Context()), data, widget, subscription.ID); err != nil {
+		app.errorLog.Printf("subscription %s not recorded: %v", subscription.ID, err)
+		app.serverError(w, r)
+		return
+	}
 
-		if err != nil {
-			app.errorLog.Println(err)
-			okay = false
-			txMsg = msg
-		}
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Transaction Successful",
+	}
 
-		app.infoLog.Printf("Subscription ID -> [{%s}]\n", subscription.ID)
+	if err := app.writeJSON(w, http.StatusOK, resp); err != nil {
+		app.errorLog.Println(err)
 	}
+}
 
-	if okay {
-		productID, _ := strconv.Atoi(data.ProductID)
-		customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
+func (app *application) SaveCustomer(ctx context.Context, firstName, lastName, email string) (int, error) {
+	customer := models.Customer{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     email,
+	}
+
+	id, err := app.DB.Customers.InsertCustomer(ctx, customer)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (app *application) SaveTransaction(ctx context.Context, txn models.Transaction) (int, error) {
+	id, err := app.DB.Transactions.InsertTransaction(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (app *application) SaveOrder(ctx context.Context, order models.Order, by models.Actor) (int, error) {
+	id, err := app.DB.Orders.InsertOrder(ctx, order, by)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// recordSubscription stores the customer, transaction and order of a
+// subscription to data.Plan at the price of widget, stopping at the first
+// save that fails
+func (app *application) recordSubscription(ctx context.Context, data stripePayload, widget models.Widget, subscriptionID string) error {
+	customerID, err := app.SaveCustomer(ctx, data.FirstName, data.LastName, data.Email)
+	if err != nil {
+		return err
+	}
+
+	txn := models.Transaction{
+		Amount:              widget.Price,
+		Currency:            app.config.Store.Currency,
+		LastFour:            data.LastFour,
+		ExpiryMonth:         data.ExpiryMonth,
+		ExpiryYear:          data.ExpiryYear,
+		TransactionStatusID: models.TxnCleared,
+		PaymentMethod:       data.PaymentMethod,
+		SubscriptionID:      subscriptionID,
+	}
+	txnID, err := app.SaveTransaction(ctx, txn)
+	if err != nil {
+		return err
+	}
+
+	// a subscription is always a single unit of its plan's widget
+	order := models.Order{
+		TransactionID: txnID,
+		CustomerID:    customerID,
+		StatusID:      models.OrderCleared,
+		Amount:        widget.Price,
+		Items:         []models.OrderItem{{WidgetID: widget.ID, Quantity: 1, Price: widget.Price, Amount: widget.Price}},
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+	_, err = app.SaveOrder(ctx, order, models.Actor{Source: "subscription"})
+	return err
+}
+
+// Authenticate checks an email and password against the users table and
+// issues a bearer token for the user
+func (app *application) Authenticate(w http.ResponseWriter, r *http.Request) {
+	var payload credentialsPayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.IsEmail(payload.Email), "email", "must be a valid email address")
+	v.Check(validator.NotBlank(payload.Password), "password", "must be provided")
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	id, err := app.DB.Users.Authenticate(r.Context(), payload.Email, payload.Password)
+	if errors.Is(err, models.ErrInvalidCredentials) {
+		app.invalidCredentials(w, r)
+		return
+	}
+
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	tf, err := app.DB.Users.GetTwoFactor(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	switch {
+	case tf.Enabled && payload.Code == "":
+		app.twoFactorRequired(w, r, "a two-factor code is required for this account")
+		return
+	case tf.Enabled && tf.Locked:
+		app.twoFactorLocked(w, r)
+		return
+	case tf.Enabled:
+		ok, err := app.verifyTwoFactor(r.Context(), id, tf, payload.Code)
 		if err != nil {
 			app.errorLog.Println(err)
-			okay = false
-			txMsg = msg
+			app.serverError(w, r)
+			return
 		}
-
-		amount, _ := strconv.Atoi(data.Amount)
-		txn := models.Transaction{
-			Amount:              amount,
-			Currency:            "usd",
-			LastFour:            data.LastFour,
-			ExpiryMonth:         data.ExpiryMonth,
-			ExpiryYear:          data.ExpiryYear,
-			TransactionStatusID: 2,
+		if !ok {
+			locked, err := app.DB.Users.RecordTwoFactorFailure(r.Context(), id)
+			if err != nil {
+				app.errorLog.Println(err)
+				app.serverError(w, r)
+				return
+			}
+			if locked {
+				app.twoFactorLocked(w, r)
+				return
+			}
+			app.invalidCredentials(w, r)
+			return
 		}
-		txnID, err := app.SaveTransaction(txn)
-
-		if err != nil {
+		if err := app.DB.Users.ClearTwoFactorFailures(r.Context(), id); err != nil {
 			app.errorLog.Println(err)
+			app.serverError(w, r)
 			return
 		}
+	case tf.Required:
+		app.twoFactorRequired(w, r, "enroll in two-factor authentication through the web frontend before requesting a token")
+		return
+	}
 
-		order := models.Order{
-			WidgetID:      productID,
-			TransactionID: txnID,
-			CustomerID:    customerID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
-		}
+	token, err := models.GenerateToken(id, time.Duration(app.config.API.TokenTTL))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
 
-		_, err = app.SaveOrder(order)
+	if err := app.DB.Users.InsertToken(r.Context(), token, models.User{ID: id}); err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
 
-		if err != nil {
+	if err := app.writeJSON(w, http.StatusCreated, token); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// verifyTwoFactor checks code as a TOTP code for the enrolled user and then
+// as one of their recovery codes, consuming whichever matched
+func (app *application) verifyTwoFactor(ctx context.Context, userID int, tf models.TwoFactor, code string) (bool, error) {
+	secret, err := app.encrypter.Decrypt(tf.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		return app.DB.Users.ConsumeTOTPStep(ctx, userID, step)
+	}
+
+	return app.DB.Users.UseRecoveryCode(ctx, userID, code)
+}
+
+// VirtualTerminalPaymentSucceeded records a payment taken through the virtual
+// terminal once stripe has confirmed it
+func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
+	var payload terminalPayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.AmountInRange(payload.Amount), "amount", "must be between 50 and 99999999")
+	v.Check(validator.IsCurrency(payload.Currency), "currency", "must be an ISO 4217 currency code")
+	v.Check(validator.IsEmail(payload.Email), "email", "must be a valid email address")
+	v.Check(validator.MaxChars(payload.FirstName, validator.MaxNameLength), "first_name", "must not be more than 255 characters")
+	v.Check(validator.MaxChars(payload.LastName, validator.MaxNameLength), "last_name", "must not be more than 255 characters")
+	v.Check(validator.NotBlank(payload.PaymentIntent), "payment_intent", "must be provided")
+	v.Check(validator.NotBlank(payload.PaymentMethod), "payment_method", "must be provided")
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	key, secret := app.stripeKeys()
+	card := cards.Card{
+		Secret: secret,
+		Key:    key,
+	}
+
+	pi, err := card.RetrivePaymentIntent(payload.PaymentIntent)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	// record what stripe charged, and only once it has
+	v.Check(pi.Status == stripe.PaymentIntentStatusSucceeded, "payment_intent", "has not succeeded")
+	v.Check(pi.Charges != nil && len(pi.Charges.Data) > 0, "payment_intent", "has no charge")
+	v.Check(int(pi.Amount) == payload.Amount, "amount", "does not match the payment intent")
+	v.Check(strings.EqualFold(string(pi.Currency), payload.Currency), "currency", "does not match the payment intent")
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	// a payment recorded before is answered with its transaction, so
+	// submitting it again does not record it twice
+	txn, err := app.DB.Transactions.GetTransactionByPaymentIntent(r.Context(), payload.PaymentIntent)
+	if err == nil {
+		if err := app.writeJSON(w, http.StatusCreated, txn); err != nil {
 			app.errorLog.Println(err)
-			return
 		}
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
 
+	pm, err := card.GetPaymentMethod(payload.PaymentMethod)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	txn = models.Transaction{
+		Amount:              int(pi.Amount),
+		Currency:            string(pi.Currency),
+		LastFour:            pm.Card.Last4,
+		ExpiryMonth:         int(pm.Card.ExpMonth),
+		ExpiryYear:          int(pm.Card.ExpYear),
+		BankReturnCode:      pi.Charges.Data[0].ID,
+		TransactionStatusID: models.TxnCleared,
+		PaymentMethod:       payload.PaymentMethod,
+		PaymenyIntent:       payload.PaymentIntent,
+	}
+
+	// the card was charged, so record it even if the client goes away
+	txn.ID, err = app.SaveTransaction(context.WithoutCancel(r.Context()), txn)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	app.infoLog.Printf("virtual terminal transaction %d recorded by user %d", txn.ID, user.ID)
+
+	if err := app.writeJSON(w, http.StatusCreated, txn); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// ForgotPassword mails a signed, expiring password reset link to a user. The
+// response is the same whether or not the email is known, so the endpoint
+// cannot be used to discover accounts.
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload forgotPasswordPayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.IsEmail(payload.Email), "email", "must be a valid email address")
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
 	}
 
 	resp := jsonResponse{
-		OK:      okay,
-		Message: txMsg,
+		OK:      true,
+		Message: "If the address belongs to an account, a reset link is on its way",
+	}
+
+	user, err := app.DB.Users.GetUserByEmail(r.Context(), payload.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := app.writeJSON(w, http.StatusAccepted, resp); err != nil {
+			app.errorLog.Println(err)
+		}
+		return
 	}
 
-	out, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	link := fmt.Sprintf("%s/reset-password?email=%s&fp=%s",
+		strings.TrimRight(app.config.API.Frontend, "/"), url.QueryEscape(user.Email), user.PasswordFingerprint())
+	signed, err := app.signer.Sign(link, time.Duration(app.config.API.ResetTTL))
+	if errors.Is(err, urlsigner.ErrNoSecret) {
+		app.resetUnavailable(w, r)
+		return
+	}
 
 	if err != nil {
 		app.errorLog.Println(err)
+		app.serverError(w, r)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(out)
+	data := struct {
+		Link   string
+		Expiry time.Duration
+	}{
+		Link:   signed,
+		Expiry: time.Duration(app.config.API.ResetTTL),
+	}
+
+	if err := app.sendMail(r.Context(), user.Email, "Reset your gostripe password", "password-reset", data); err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusAccepted, resp); err != nil {
+		app.errorLog.Println(err)
+	}
 }
 
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
+// ResetPassword sets a new password for the user named in a signed reset
+// link. The link must be unexpired and must still carry the fingerprint of
+// the user's current password, so it works only once.
+func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload resetPasswordPayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
 	}
 
-	id, err := app.DB.InsertCustomer(customer)
+	v := validator.New()
+	v.Check(validator.NotBlank(payload.Link), "link", "must be provided")
+	v.Check(validator.MinChars(payload.Password, validator.MinPasswordLength), "password", "must be at least 8 characters")
+	v.Check(len(payload.Password) <= validator.MaxPasswordLength, "password", "must not be more than 72 bytes")
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	err := app.signer.Verify(payload.Link)
+	switch {
+	case errors.Is(err, urlsigner.ErrNoSecret):
+		app.resetUnavailable(w, r)
+		return
+	case errors.Is(err, urlsigner.ErrExpired):
+		v.AddError("link", "has expired, please request a new one")
+	case err != nil:
+		v.AddError("link", "is not a valid reset link")
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	link, err := url.Parse(payload.Link)
 	if err != nil {
-		return 0, err
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.DB.Users.GetUserByEmail(r.Context(), link.Query().Get("email"))
+	if errors.Is(err, sql.ErrNoRows) {
+		v.AddError("link", "is not a valid reset link")
+		app.failedValidation(w, r, v)
+		return
 	}
-	return id, nil
-}
 
-func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
 	if err != nil {
-		return 0, err
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if link.Query().Get("fp") != user.PasswordFingerprint() {
+		v.AddError("link", "has already been used, please request a new one")
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(payload.Password), 12)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := app.DB.Users.UpdatePasswordForUser(r.Context(), user, string(hash)); err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Your password has been changed",
+	}
+	if err := app.writeJSON(w, http.StatusOK, resp); err != nil {
+		app.errorLog.Println(err)
 	}
-	return id, nil
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+// RefundOrder refunds a cleared order in full through stripe and marks the
+// order and its transaction as refunded
+func (app *application) RefundOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		return 0, err
+		app.notFound(w, r)
+		return
+	}
+
+	order, err := app.DB.Orders.GetOrder(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.notFound(w, r)
+		return
+	}
+
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := order.StatusID.Transition(models.OrderRefunded); err != nil {
+		v := validator.New()
+		v.AddError("status_id", "only cleared orders can be refunded")
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	txn, err := app.DB.Transactions.GetTransaction(r.Context(), order.TransactionID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	key, secret := app.stripeKeys()
+	card := cards.Card{
+		Secret:         secret,
+		Key:            key,
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
+	}
+
+	if _, err := card.Refund(txn.PaymenyIntent, order.Amount); err != nil {
+		app.errorLog.Println(err)
+		resp := jsonResponse{
+			OK:      false,
+			Message: "the refund was declined by the payment processor",
+		}
+		if err := app.writeJSON(w, http.StatusPaymentRequired, resp); err != nil {
+			app.errorLog.Println(err)
+		}
+		return
+	}
+
+	// the refund went through, so record it even if the client goes away
+	user := app.contextGetUser(r)
+	by := models.Actor{UserID: user.ID, Source: "refund"}
+	err = app.DB.Orders.UpdateOrderStatus(context.WithoutCancel(r.Context()), order, models.OrderRefunded, models.TxnRefunded, by)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		// someone changed the order while stripe refunded it
+		app.errorLog.Printf("order %d refunded but not recorded: %v", order.ID, err)
+		app.conflict(w, r, "the order changed status while it was refunded; check it before refunding again")
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	app.infoLog.Printf("order %d refunded by user %d", order.ID, user.ID)
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Order refunded",
+	}
+	if err := app.writeJSON(w, http.StatusOK, resp); err != nil {
+		app.errorLog.Println(err)
 	}
-	return id, nil
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/rbac"
+	"github.com/caleberi/gostripe/pkg/client"
+)
+
+func TestGetWidget(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 3})
+	mux := app.routes()
+
+	var widget models.Widget
+	decode(t, serve(t, mux, http.MethodGet, "/widgets/"+strconv.Itoa(id), "", nil), http.StatusOK, &widget)
+	if widget.ID != id || widget.Name != "Gizmo" || widget.Price != 1000 {
+		t.Errorf("widget = %+v", widget)
+	}
+
+	for _, path := range []string{"/widgets/999", "/widgets/gizmo"} {
+		decode(t, serve(t, mux, http.MethodGet, path, "", nil), http.StatusNotFound, nil)
+	}
+}
+
+func TestUpdateWidgetKeepsReservedStock(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5})
+	lines := []models.CartLine{{WidgetID: id, Quantity: 3}}
+	if err := store.ReserveInventory(context.Background(), "pi_pending", lines, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	_, token := addStaff(t, store, "catalog@example.com", rbac.ManageCatalog)
+	mux := app.routes()
+	path := "/admin/widgets/" + strconv.Itoa(id)
+
+	// two of the five units are free, so removing three would take one
+	// the pending order holds
+	payload := widgetUpdatePayload{widgetPayload: widgetPayload{Name: "Gizmo", Price: 1000, InventoryLevel: 2}}
+	decode(t, serve(t, mux, http.MethodPut, path, token, payload), http.StatusConflict, nil)
+
+	payload.InventoryLevel = 3
+	var widget models.Widget
+	decode(t, serve(t, mux, http.MethodPut, path, token, payload), http.StatusOK, &widget)
+	if widget.InventoryLevel != 3 || widget.ReservedLevel != 3 {
+		t.Errorf("inventory %d with %d reserved, want 3 with 3", widget.InventoryLevel, widget.ReservedLevel)
+	}
+}
+
+func TestCreateCustomer(t *testing.T) {
+	app, store := newTestApplication(t)
+	mux := app.routes()
+
+	var created models.Customer
+	payload := customerPayload{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}
+	decode(t, serve(t, mux, http.MethodPost, "/customers", "", payload), http.StatusCreated, &created)
+
+	stored, err := store.GetCustomer(context.Background(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != "ada@example.com" || stored.FirstName != "Ada" {
+		t.Errorf("stored customer = %+v", stored)
+	}
+
+	var resp jsonResponse
+	payload = customerPayload{FirstName: "", LastName: "Lovelace", Email: "not-an-email"}
+	decode(t, serve(t, mux, http.MethodPost, "/customers", "", payload), http.StatusUnprocessableEntity, &resp)
+	if resp.Errors["email"] == "" || resp.Errors["first_name"] == "" {
+		t.Errorf("errors = %v, want email and first_name", resp.Errors)
+	}
+
+	decode(t, serve(t, mux, http.MethodPost, "/customers", "", map[string]string{"nickname": "ada"}), http.StatusBadRequest, nil)
+}
+
+func TestPermissions(t *testing.T) {
+	app, store := newTestApplication(t)
+	customerID, err := store.InsertCustomer(context.Background(), models.Customer{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clerk := addStaff(t, store, "clerk@example.com")
+	_, analyst := addStaff(t, store, "analyst@example.com", rbac.ViewReports)
+	mux := app.routes()
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"unknown token", "AAAAAAAAAAAAAAAAAAAAAAAAAA", http.StatusUnauthorized},
+		{"without permission", clerk, http.StatusForbidden},
+		{"with permission", analyst, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decode(t, serve(t, mux, http.MethodGet, "/customers/"+strconv.Itoa(customerID), tt.token, nil), tt.want, nil)
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	app, store := newTestApplication(t)
+	addStaff(t, store, "admin@example.com", rbac.ViewReports)
+	mux := app.routes()
+
+	var token models.Token
+	creds := credentialsPayload{Email: "admin@example.com", Password: "password"}
+	decode(t, serve(t, mux, http.MethodPost, "/authenticate", "", creds), http.StatusCreated, &token)
+	if token.PlainText == "" {
+		t.Fatal("no token issued")
+	}
+	decode(t, serve(t, mux, http.MethodGet, "/orders", token.PlainText, nil), http.StatusOK, nil)
+
+	creds.Password = "wrong password"
+	decode(t, serve(t, mux, http.MethodPost, "/authenticate", "", creds), http.StatusUnauthorized, nil)
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	app, store := newTestApplication(t)
+	id, _ := addStaff(t, store, "admin@example.com")
+	secret := enrollTOTP(t, app, store, id)
+	mux := app.routes()
+
+	wrong := credentialsPayload{Email: "admin@example.com", Password: "password", Code: "not a code"}
+	for i := 1; i < models.MaxTwoFactorAttempts; i++ {
+		decode(t, serve(t, mux, http.MethodPost, "/authenticate", "", wrong), http.StatusUnauthorized, nil)
+	}
+
+	// a right code forgets the wrong ones before it
+	right := credentialsPayload{Email: "admin@example.com", Password: "password", Code: currentCode(t, secret)}
+	decode(t, serve(t, mux, http.MethodPost, "/authenticate", "", right), http.StatusCreated, nil)
+	for i := 1; i < models.MaxTwoFactorAttempts; i++ {
+		decode(t, serve(t, mux, http.MethodPost, "/authenticate", "", wrong), http.StatusUnauthorized, nil)
+	}
+
+	w := serve(t, mux, http.MethodPost, "/authenticate", "", wrong)
+	decode(t, w, http.StatusTooManyRequests, nil)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header on a locked login")
+	}
+
+	// the lock holds even for a right code
+	decode(t, serve(t, mux, http.MethodPost, "/authenticate", "", right), http.StatusTooManyRequests, nil)
+}
+
+func TestPriceCart(t *testing.T) {
+	app, store := newTestApplication(t)
+	gizmo := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, Weight: 1500, InventoryLevel: 5})
+	store.AddShippingRate(models.ShippingRate{Name: "Standard", Kind: models.RateFlat, Amount: 500})
+	store.AddShippingRate(models.ShippingRate{Name: "Heavy", Kind: models.RateWeight, Amount: 200})
+	store.AddShippingRate(models.ShippingRate{Name: "Free", Kind: models.RateFreeOver, Threshold: 5000})
+	mux := app.routes()
+
+	tests := []struct {
+		quantity int
+		shipping int
+	}{
+		// 3 kg started: 500 + 3 * 200
+		{2, 1100},
+		// 5000 reaches the free shipping threshold
+		{5, 0},
+	}
+	for _, tt := range tests {
+		var cart models.Cart
+		payload := cartPayload{Items: []client.CartLine{{WidgetID: gizmo, Quantity: tt.quantity}}}
+		decode(t, serve(t, mux, http.MethodPost, "/cart", "", payload), http.StatusOK, &cart)
+		if cart.Subtotal != 1000*tt.quantity || cart.Shipping != tt.shipping || cart.Total != cart.Subtotal+tt.shipping {
+			t.Errorf("%d units: subtotal %d, shipping %d, total %d", tt.quantity, cart.Subtotal, cart.Shipping, cart.Total)
+		}
+	}
+
+	var resp jsonResponse
+	payload := cartPayload{Items: []client.CartLine{{WidgetID: gizmo, Quantity: 6}}}
+	decode(t, serve(t, mux, http.MethodPost, "/cart", "", payload), http.StatusUnprocessableEntity, &resp)
+}
+
+func TestPaymentIntentValidation(t *testing.T) {
+	app, store := newTestApplication(t)
+	gizmo := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 1})
+	soldOut := store.AddWidget(models.Widget{Name: "Sold out", Price: 1000})
+	mux := app.routes()
+
+	shipTo := &client.Address{Name: "Ada Lovelace", Line1: "1 Analytical Way", City: "London", Country: "GB"}
+	tests := []struct {
+		name    string
+		payload stripePayload
+		field   string
+	}{
+		{"bad currency", stripePayload{Currency: "doubloons", Amount: 1000}, "currency"},
+		{"amount too small", stripePayload{Currency: "usd", Amount: 10}, "amount"},
+		{"unknown product", stripePayload{Currency: "usd", ProductID: 999, ShippingAddress: shipTo}, "product_id"},
+		{"sold out", stripePayload{Currency: "usd", ProductID: soldOut, ShippingAddress: shipTo}, "product_id"},
+		{"no shipping address", stripePayload{Currency: "usd", ProductID: gizmo}, "shipping_address"},
+		{"bad country", stripePayload{Currency: "usd", ProductID: gizmo, ShippingAddress: &client.Address{Name: "Ada", Line1: "1 Way", City: "London", Country: "Britain"}}, "shipping_address.country"},
+		{"wrong amount", stripePayload{Currency: "usd", ProductID: gizmo, Amount: 1, ShippingAddress: shipTo}, "amount"},
+		{"product and items", stripePayload{Currency: "usd", ProductID: gizmo, Items: []client.CartLine{{WidgetID: gizmo, Quantity: 1}}, ShippingAddress: shipTo}, "items"},
+		{"widget in another currency", stripePayload{Currency: "eur", ProductID: gizmo, ShippingAddress: shipTo}, "currency"},
+		{"cart in another currency", stripePayload{Currency: "gbp", Items: []client.CartLine{{WidgetID: gizmo, Quantity: 1}}, ShippingAddress: shipTo}, "currency"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp jsonResponse
+			decode(t, serve(t, mux, http.MethodPost, "/payment-intents", "", tt.payload), http.StatusUnprocessableEntity, &resp)
+			if resp.Errors[tt.field] == "" {
+				t.Errorf("errors = %v, want one for %s", resp.Errors, tt.field)
+			}
+		})
+	}
+}
+
+func TestSubscriptionValidation(t *testing.T) {
+	app, store := newTestApplication(t)
+	bronze := store.AddWidget(models.Widget{Name: "Bronze plan", Price: 2000, IsRecurring: true, PlanID: "price_bronze"})
+	mux := app.routes()
+
+	subscribe := stripePayload{
+		ProductID: bronze, Plan: "price_bronze", Amount: 2000, Currency: "usd",
+		FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com",
+		PaymentMethod: "pm_card_visa", LastFour: "4242", ExpiryMonth: 12, ExpiryYear: time.Now().Year() + 1,
+	}
+	tests := []struct {
+		name   string
+		change func(p *stripePayload)
+		field  string
+	}{
+		{"amount below the plan price", func(p *stripePayload) { p.Amount = 50 }, "amount"},
+		{"amount above the plan price", func(p *stripePayload) { p.Amount = 5000 }, "amount"},
+		{"another currency", func(p *stripePayload) { p.Currency = "eur" }, "currency"},
+		{"another plan", func(p *stripePayload) { p.Plan = "price_gold" }, "plan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := subscribe
+			tt.change(&payload)
+
+			var resp jsonResponse
+			decode(t, serve(t, mux, http.MethodPost, "/subscriptions", "", payload), http.StatusUnprocessableEntity, &resp)
+			if resp.Errors[tt.field] == "" {
+				t.Errorf("errors = %v, want one for %s", resp.Errors, tt.field)
+			}
+		})
+	}
+}
+
+func TestRefundOrderRejectsRefundedOrder(t *testing.T) {
+	app, store := newTestApplication(t)
+	widget := models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 3}
+	widget.ID = store.AddWidget(widget)
+	orderID := addOrder(t, store, widget, 1)
+	order, err := store.GetOrder(context.Background(), orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateOrderStatus(context.Background(), order, models.OrderRefunded, models.TxnRefunded, models.Actor{Source: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	_, token := addStaff(t, store, "support@example.com", rbac.RefundPayments)
+	mux := app.routes()
+
+	// the order is checked before stripe is called
+	decode(t, serve(t, mux, http.MethodPost, "/admin/orders/"+strconv.Itoa(orderID)+"/refund", token, nil), http.StatusUnprocessableEntity, nil)
+	decode(t, serve(t, mux, http.MethodPost, "/admin/orders/999/refund", token, nil), http.StatusNotFound, nil)
+}
+
+func TestUpdateFulfillment(t *testing.T) {
+	app, store := newTestApplication(t)
+	widget := models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 3}
+	widget.ID = store.AddWidget(widget)
+	orderID := addOrder(t, store, widget, 1)
+	_, token := addStaff(t, store, "warehouse@example.com", rbac.FulfillOrders)
+	mux := app.routes()
+	path := "/admin/orders/" + strconv.Itoa(orderID) + "/fulfillment"
+
+	steps := []struct {
+		name    string
+		payload fulfillmentPayload
+		want    int
+	}{
+		{"deliver before shipping", fulfillmentPayload{Status: "delivered"}, http.StatusUnprocessableEntity},
+		{"ship without tracking", fulfillmentPayload{Status: "shipped"}, http.StatusUnprocessableEntity},
+		{"ship", fulfillmentPayload{Status: "shipped", TrackingNumber: " 1Z999 "}, http.StatusOK},
+		{"deliver", fulfillmentPayload{Status: "delivered"}, http.StatusOK},
+		{"ship after delivery", fulfillmentPayload{Status: "shipped", TrackingNumber: "1Z000"}, http.StatusUnprocessableEntity},
+	}
+	for _, s := range steps {
+		decode(t, serve(t, mux, http.MethodPut, path, token, s.payload), s.want, nil)
+	}
+
+	order, err := store.GetOrder(context.Background(), orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Fulfillment != models.Delivered || order.TrackingNumber != "1Z999" {
+		t.Errorf("fulfillment %q with tracking %q, want delivered with 1Z999", order.Fulfillment, order.TrackingNumber)
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	app, store := newTestApplication(t)
+	gizmo := models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 10}
+	gizmo.ID = store.AddWidget(gizmo)
+	gadget := models.Widget{Name: "Gadget", Price: 2500, InventoryLevel: 10}
+	gadget.ID = store.AddWidget(gadget)
+	first := addOrder(t, store, gizmo, 1)
+	second := addOrder(t, store, gadget, 2)
+	_, token := addStaff(t, store, "analyst@example.com", rbac.ViewReports)
+	mux := app.routes()
+
+	var list orderList
+	decode(t, serve(t, mux, http.MethodGet, "/orders", token, nil), http.StatusOK, &list)
+	if len(list.Orders) != 2 || list.Orders[0].ID != second || list.Orders[1].ID != first {
+		t.Errorf("orders = %+v, want %d then %d", list.Orders, second, first)
+	}
+
+	decode(t, serve(t, mux, http.MethodGet, "/orders?widget_id="+strconv.Itoa(gizmo.ID), token, nil), http.StatusOK, &list)
+	if len(list.Orders) != 1 || list.Orders[0].ID != first {
+		t.Errorf("orders for widget %d = %+v", gizmo.ID, list.Orders)
+	}
+
+	decode(t, serve(t, mux, http.MethodGet, "/orders?status_id=99", token, nil), http.StatusUnprocessableEntity, nil)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/validator"
+)
+
+// maxBodyBytes caps the size of incoming JSON payloads
+const maxBodyBytes = 1 << 20
+
+// readJSON decodes a single JSON value from the request body into data,
+// rejecting unknown fields and trailing content
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(data); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			return fmt.Errorf("body contains an invalid value for field %q", typeErr.Field)
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+		default:
+			return err
+		}
+	}
+
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	return nil
+}
+
+// writeJSON writes data as indented JSON with the given status code
+func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}) error {
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(out)
+	return err
+}
+
+// badRequest reports a malformed request to the client
+func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorLog.Println(err)
+	resp := jsonResponse{
+		OK:      false,
+		Message: err.Error(),
+	}
+	if err := app.writeJSON(w, http.StatusBadRequest, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// failedValidation reports per-field validation errors to the client
+func (app *application) failedValidation(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: "validation failed",
+		Errors:  v.Errors,
+	}
+	if err := app.writeJSON(w, http.StatusUnprocessableEntity, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// notFound reports a missing resource to the client
+func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: "the requested resource could not be found",
+	}
+	if err := app.writeJSON(w, http.StatusNotFound, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// invalidCredentials reports a failed login
+func (app *application) invalidCredentials(w http.ResponseWriter, r *http.Request) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: "invalid authentication credentials",
+	}
+	if err := app.writeJSON(w, http.StatusUnauthorized, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// twoFactorRequired reports a login that needs a second factor the request
+// did not supply, explaining what is missing in message
+func (app *application) twoFactorRequired(w http.ResponseWriter, r *http.Request, message string) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: message,
+	}
+	if err := app.writeJSON(w, http.StatusUnauthorized, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// twoFactorLocked reports a login refused because too many wrong two-factor
+// codes locked the account for a while
+func (app *application) twoFactorLocked(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(models.TwoFactorLockout.Seconds())))
+	resp := jsonResponse{
+		OK:      false,
+		Message: "too many incorrect two-factor codes, try again later",
+	}
+	if err := app.writeJSON(w, http.StatusTooManyRequests, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// invalidAuthenticationToken reports a missing, malformed or expired bearer token
+func (app *application) invalidAuthenticationToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	resp := jsonResponse{
+		OK:      false,
+		Message: "invalid or missing authentication token",
+	}
+	if err := app.writeJSON(w, http.StatusUnauthorized, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// serverError reports an unexpected failure without leaking its details
+func (app *application) serverError(w http.ResponseWriter, r *http.Request) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: "the server encountered a problem and could not process your request",
+	}
+	if err := app.writeJSON(w, http.StatusInternalServerError, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// resetUnavailable reports that password reset is switched off because no signing key is configured
+func (app *application) resetUnavailable(w http.ResponseWriter, r *http.Request) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: "password reset is not available",
+	}
+	if err := app.writeJSON(w, http.StatusServiceUnavailable, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// notPermitted reports that the authenticated user lacks the permission an endpoint requires
+func (app *application) notPermitted(w http.ResponseWriter, r *http.Request) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: "your account does not have the permission required for this resource",
+	}
+	if err := app.writeJSON(w, http.StatusForbidden, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// conflict reports a request that clashes with the current state of a
+// resource, explaining how in message
+func (app *application) conflict(w http.ResponseWriter, r *http.Request, message string) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: message,
+	}
+	if err := app.writeJSON(w, http.StatusConflict, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// paymentFailed reports a charge the payment processor declined, passing on
+// its explanation in message
+func (app *application) paymentFailed(w http.ResponseWriter, r *http.Request, message string) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: message,
+	}
+	if err := app.writeJSON(w, http.StatusPaymentRequired, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
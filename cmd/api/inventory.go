@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/models"
+)
+
+// maxMovements is how many inventory movements are listed per widget
+const maxMovements = 100
+
+// releaseReservations returns the stock held by abandoned checkouts every
+// interval until ctx is done
+func (app *application) releaseReservations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := app.DB.Inventory.ReleaseExpiredReservations(ctx, now)
+			if err != nil {
+				app.errorLog.Println(err)
+				continue
+			}
+			if n > 0 {
+				app.infoLog.Printf("released %d expired inventory reservations", n)
+			}
+		}
+	}
+}
+
+// WidgetMovements lists the latest inventory movements of a widget
+func (app *application) WidgetMovements(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	movements, err := app.DB.Inventory.ListInventoryMovements(r.Context(), widget.ID, maxMovements)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if movements == nil {
+		movements = []models.InventoryMovement{}
+	}
+	if err := app.writeJSON(w, http.StatusOK, movements); err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"text/template"
+
+	"github.com/caleberi/gostripe/internal/mailer"
+)
+
+//go:embed templates
+var emailTemplateFS embed.FS
+
+// sendMail renders templates/<tmpl>.plain.gohtml and templates/<tmpl>.html.gohtml
+// with data and delivers the result to to
+func (app *application) sendMail(ctx context.Context, to, subject, tmpl string, data interface{}) error {
+	var plain, html bytes.Buffer
+
+	pt, err := template.ParseFS(emailTemplateFS, fmt.Sprintf("templates/%s.plain.gohtml", tmpl))
+	if err != nil {
+		return err
+	}
+	if err := pt.ExecuteTemplate(&plain, "body", data); err != nil {
+		return err
+	}
+
+	ht, err := htmltemplate.ParseFS(emailTemplateFS, fmt.Sprintf("templates/%s.html.gohtml", tmpl))
+	if err != nil {
+		return err
+	}
+	if err := ht.ExecuteTemplate(&html, "body", data); err != nil {
+		return err
+	}
+
+	return app.mailer.Send(ctx, mailer.Message{
+		To:      to,
+		Subject: subject,
+		Text:    plain.String(),
+		HTML:    html.String(),
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/rbac"
+)
+
+type contextKey string
+
+// userContextKey holds the authenticated models.User of a request
+const userContextKey = contextKey("user")
+
+// contextSetUser returns a copy of r carrying user
+func (app *application) contextSetUser(r *http.Request, user models.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser returns the user stored by Auth. It panics when called on a
+// request that did not pass through Auth, which is a programming error.
+func (app *application) contextGetUser(r *http.Request) models.User {
+	user, ok := r.Context().Value(userContextKey).(models.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+	return user
+}
+
+// Auth rejects requests without a valid, unexpired bearer token and puts the
+// token's user into the request context
+func (app *application) Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		header := r.Header.Get("Authorization")
+		parts := strings.Split(header, " ")
+		if len(parts) != 2 || parts[0] != "Bearer" || parts[1] == "" {
+			app.invalidAuthenticationToken(w, r)
+			return
+		}
+
+		user, err := app.DB.Users.GetUserForToken(r.Context(), parts[1])
+		if errors.Is(err, sql.ErrNoRows) {
+			app.invalidAuthenticationToken(w, r)
+			return
+		}
+
+		if err != nil {
+			app.errorLog.Println(err)
+			app.serverError(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, app.contextSetUser(r, user))
+	})
+}
+
+// requirePermission rejects requests whose authenticated user lacks perm. It
+// must run after Auth.
+func (app *application) requirePermission(perm rbac.Permission) func(http.Handler) http.Handler {
+	user := func(r *http.Request) (int, bool) {
+		u, ok := r.Context().Value(userContextKey).(models.User)
+		return u.ID, ok
+	}
+
+	return rbac.Require(app.DB.Users, user, rbac.Handlers{
+		Unauthenticated: http.HandlerFunc(app.invalidAuthenticationToken),
+		Forbidden:       http.HandlerFunc(app.notPermitted),
+		Error: func(w http.ResponseWriter, r *http.Request, err error) {
+			app.errorLog.Println(err)
+			app.serverError(w, r)
+		},
+	}, perm)
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/driver"
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/rbac"
+	"github.com/go-chi/chi/v5"
+)
+
+// apiPrefix is the mount point of the current API version
+const apiPrefix = "/api/v1"
+
+// endpoint describes one versioned API operation. The router and the OpenAPI
+// document are both built from the list returned by app.endpoints, so a route
+// cannot be served without being documented.
+type endpoint struct {
+	Method      string
+	Path        string
+	OperationID string
+	Summary     string
+	Tag         string
+	// Request is a zero value of the JSON body type, nil when there is no body
+	Request interface{}
+	// Upload, when set, makes the body a multipart form carrying a file in
+	// the field of that name instead of JSON
+	Upload string
+	// Query lists the optional query parameters the operation reads
+	Query []parameter
+	// Response is a zero value of the success body type, nil for a free-form object
+	Response interface{}
+	Status   int
+	// Auth requires a bearer token issued by the authenticate endpoint
+	Auth bool
+	// Permission, when set, is required of the authenticated user; it implies Auth
+	Permission rbac.Permission
+	// TooMany, when set, documents a 429 response with this description
+	TooMany string
+	// Conflict, when set, documents a 409 response with this description
+	Conflict string
+	Handler  http.HandlerFunc
+}
+
+// endpoints lists every operation served under apiPrefix
+func (app *application) endpoints() []endpoint {
+	return []endpoint{
+		{
+			Method: http.MethodGet, Path: "/widgets", Tag: "widgets",
+			OperationID: "listWidgets", Summary: "List, search and page through the catalog",
+			Query: []parameter{
+				queryParam("search", "string"),
+				queryParam("recurring", "boolean"),
+				queryParam("in_stock", "boolean"),
+				queryParam("min_price", "integer"),
+				queryParam("max_price", "integer"),
+				queryParam("sort", "string"),
+				queryParam("page", "integer"),
+				queryParam("page_size", "integer"),
+			},
+			Response: widgetList{}, Status: http.StatusOK,
+			Handler: app.ListWidgets,
+		},
+		{
+			Method: http.MethodGet, Path: "/widgets/{id}", Tag: "widgets",
+			OperationID: "getWidget", Summary: "Get a widget",
+			Response: models.Widget{}, Status: http.StatusOK,
+			Handler: app.GetWidgetById,
+		},
+		{
+			Method: http.MethodGet, Path: "/orders", Tag: "orders",
+			OperationID: "listOrders", Summary: "List and filter orders newest first, paged by cursor",
+			Query: []parameter{
+				queryParam("status_id", "integer"),
+				queryParam("fulfillment_status", "string"),
+				queryParam("from", "string"),
+				queryParam("to", "string"),
+				queryParam("email", "string"),
+				queryParam("widget_id", "integer"),
+				queryParam("min_amount", "integer"),
+				queryParam("max_amount", "integer"),
+				queryParam("cursor", "string"),
+				queryParam("page_size", "integer"),
+			},
+			Response: orderList{}, Status: http.StatusOK,
+			Permission: rbac.ViewReports,
+			Handler:    app.ListOrders,
+		},
+		{
+			Method: http.MethodGet, Path: "/orders/{id}", Tag: "orders",
+			OperationID: "getOrder", Summary: "Get an order with its items, customer and transaction",
+			Response: models.OrderSummary{}, Status: http.StatusOK,
+			Permission: rbac.ViewReports,
+			Handler:    app.GetOrder,
+		},
+		{
+			Method: http.MethodPost, Path: "/customers", Tag: "customers",
+			OperationID: "createCustomer", Summary: "Create a customer",
+			Request: customerPayload{}, Response: models.Customer{}, Status: http.StatusCreated,
+			Handler: app.CreateCustomer,
+		},
+		{
+			Method: http.MethodGet, Path: "/customers/{id}", Tag: "customers",
+			OperationID: "getCustomer", Summary: "Get a customer",
+			Response: models.Customer{}, Status: http.StatusOK,
+			Permission: rbac.ViewReports,
+			Handler:    app.GetCustomer,
+		},
+		{
+			Method: http.MethodPost, Path: "/cart", Tag: "cart",
+			OperationID: "priceCart", Summary: "Price cart lines at the current widget prices",
+			Request: cartPayload{}, Response: models.Cart{}, Status: http.StatusOK,
+			Handler: app.PriceCart,
+		},
+		{
+			Method: http.MethodPost, Path: "/payment-intents", Tag: "payment-intents",
+			OperationID: "createPaymentIntent", Summary: "Create a stripe payment intent, for cart items at their current prices or for a plain amount",
+			Request: stripePayload{}, Response: paymentIntentResponse{}, Status: http.StatusCreated,
+			Conflict: "A widget sold out while the payment intent was created",
+			Handler:  app.GetPaymentIntent,
+		},
+		{
+			Method: http.MethodPost, Path: "/subscriptions", Tag: "subscriptions",
+			OperationID: "createSubscription", Summary: "Create a customer and subscribe them to a plan",
+			Request: stripePayload{}, Response: jsonResponse{}, Status: http.StatusOK,
+			Handler: app.CreateCustomerAndSubscribeToPlan,
+		},
+		{
+			Method: http.MethodPost, Path: "/authenticate", Tag: "auth",
+			OperationID: "authenticate", Summary: "Exchange credentials, plus a two-factor code for enrolled users, for a bearer token",
+			Request: credentialsPayload{}, Response: models.Token{}, Status: http.StatusCreated,
+			TooMany: "Too many incorrect two-factor codes locked the account for a while",
+			Handler: app.Authenticate,
+		},
+		{
+			Method: http.MethodPost, Path: "/forgot-password", Tag: "auth",
+			OperationID: "forgotPassword", Summary: "Mail a password reset link",
+			Request: forgotPasswordPayload{}, Response: jsonResponse{}, Status: http.StatusAccepted,
+			Handler: app.ForgotPassword,
+		},
+		{
+			Method: http.MethodPost, Path: "/reset-password", Tag: "auth",
+			OperationID: "resetPassword", Summary: "Set a new password with a mailed reset link",
+			Request: resetPasswordPayload{}, Response: jsonResponse{}, Status: http.StatusOK,
+			Handler: app.ResetPassword,
+		},
+		{
+			Method: http.MethodPost, Path: "/admin/virtual-terminal-payments", Tag: "admin",
+			OperationID: "recordTerminalPayment", Summary: "Record a payment confirmed through the virtual terminal",
+			Request: terminalPayload{}, Response: models.Transaction{}, Status: http.StatusCreated,
+			Permission: rbac.ChargeTerminal,
+			Handler:    app.VirtualTerminalPaymentSucceeded,
+		},
+		{
+			Method: http.MethodPost, Path: "/admin/orders/{id}/refund", Tag: "admin",
+			OperationID: "refundOrder", Summary: "Refund a cleared order in full",
+			Response: jsonResponse{}, Status: http.StatusOK,
+			Permission: rbac.RefundPayments,
+			Conflict:   "The order changed status while it was refunded",
+			Handler:    app.RefundOrder,
+		},
+		{
+			Method: http.MethodPut, Path: "/admin/orders/{id}/fulfillment", Tag: "admin",
+			OperationID: "updateFulfillment", Summary: "Mark a cleared order shipped, or a shipped order delivered",
+			Request: fulfillmentPayload{}, Response: models.OrderSummary{}, Status: http.StatusOK,
+			Permission: rbac.FulfillOrders,
+			Conflict:   "The order changed while it was updated",
+			Handler:    app.UpdateFulfillment,
+		},
+		{
+			Method: http.MethodPost, Path: "/admin/widgets", Tag: "admin",
+			OperationID: "createWidget", Summary: "Add a widget to the catalog",
+			Request: widgetPayload{}, Response: models.Widget{}, Status: http.StatusCreated,
+			Permission: rbac.ManageCatalog,
+			Handler:    app.CreateWidget,
+		},
+		{
+			Method: http.MethodPut, Path: "/admin/widgets/{id}", Tag: "admin",
+			OperationID: "updateWidget", Summary: "Update a widget, keeping its image",
+			Request: widgetUpdatePayload{}, Response: models.Widget{}, Status: http.StatusOK,
+			Permission: rbac.ManageCatalog,
+			Conflict:   "Units were sold or reserved since inventory_seen and fewer are left than the update removes",
+			Handler:    app.UpdateWidget,
+		},
+		{
+			Method: http.MethodDelete, Path: "/admin/widgets/{id}", Tag: "admin",
+			OperationID: "deleteWidget", Summary: "Delete a widget that was never ordered",
+			Response: jsonResponse{}, Status: http.StatusOK,
+			Permission: rbac.ManageCatalog,
+			Conflict:   "The widget has orders",
+			Handler:    app.DeleteWidget,
+		},
+		{
+			Method: http.MethodPut, Path: "/admin/widgets/{id}/image", Tag: "admin",
+			OperationID: "uploadWidgetImage", Summary: "Replace the image of a widget with a png, jpeg, gif or webp file",
+			Upload: imageField, Response: models.Widget{}, Status: http.StatusOK,
+			Permission: rbac.ManageCatalog,
+			Handler:    app.UploadWidgetImage,
+		},
+		{
+			Method: http.MethodGet, Path: "/admin/widgets/{id}/inventory-movements", Tag: "admin",
+			OperationID: "listInventoryMovements", Summary: "The latest changes to the stock of a widget, newest first",
+			Response: []models.InventoryMovement{}, Status: http.StatusOK,
+			Permission: rbac.ManageCatalog,
+			Handler:    app.WidgetMovements,
+		},
+		{
+			Method: http.MethodGet, Path: "/admin/database", Tag: "admin",
+			OperationID: "getDatabaseStats", Summary: "Health, replication lag and pool statistics of the primary and replicas",
+			Response: []driver.NodeStats{}, Status: http.StatusOK,
+			Permission: rbac.ViewReports,
+			Handler:    app.DatabaseStats,
+		},
+		{
+			Method: http.MethodGet, Path: "/openapi.json", Tag: "meta",
+			OperationID: "getOpenAPI", Summary: "This OpenAPI document",
+			Status:  http.StatusOK,
+			Handler: app.OpenAPI,
+		},
+	}
+}
+
+// OpenAPI serves the OpenAPI 3 document describing the API
+func (app *application) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	if err := app.writeJSON(w, http.StatusOK, app.openAPIDocument()); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+type openAPIDoc struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       openAPIInfo                     `json:"info"`
+	Servers    []openAPIServer                 `json:"servers"`
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components openAPIComponents               `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*schema        `json:"schemas"`
+	SecuritySchemes map[string]securityScheme `json:"securitySchemes"`
+}
+
+type securityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+type operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Tags        []string              `json:"tags"`
+	Parameters  []parameter           `json:"parameters,omitempty"`
+	RequestBody *requestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	// Permission is the rbac permission the operation requires
+	Permission string `json:"x-permission,omitempty"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+// queryParam describes an optional query parameter of a primitive type
+func queryParam(name, typ string) parameter {
+	return parameter{Name: name, In: "query", Schema: &schema{Type: typ}}
+}
+
+type requestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type response struct {
+	Description string               `json:"description"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+
+	// goType is the struct type a component was built from
+	goType reflect.Type
+}
+
+var pathParamRX = regexp.MustCompile(`\{([^}]+)\}`)
+
+// openAPIDocument builds the OpenAPI 3 document from app.endpoints
+func (app *application) openAPIDocument() openAPIDoc {
+	doc := openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "gostripe API", Version: app.version},
+		Servers: []openAPIServer{{URL: apiPrefix}},
+		Paths:   make(map[string]map[string]operation),
+		Components: openAPIComponents{
+			Schemas: make(map[string]*schema),
+			SecuritySchemes: map[string]securityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer"},
+			},
+		},
+	}
+
+	errorSchema := schemaFor(reflect.TypeOf(jsonResponse{}), doc.Components.Schemas)
+
+	for _, e := range app.endpoints() {
+		op := operation{
+			OperationID: e.OperationID,
+			Summary:     e.Summary,
+			Tags:        []string{e.Tag},
+			Responses:   make(map[string]response),
+		}
+
+		pathParams := pathParamRX.FindAllStringSubmatch(e.Path, -1)
+		for _, m := range pathParams {
+			p := parameter{Name: m[1], In: "path", Required: true, Schema: &schema{Type: "string"}}
+			if m[1] == "id" {
+				p.Schema = &schema{Type: "integer"}
+			}
+			op.Parameters = append(op.Parameters, p)
+		}
+		op.Parameters = append(op.Parameters, e.Query...)
+
+		switch {
+		case e.Request != nil:
+			op.RequestBody = &requestBody{
+				Required: true,
+				Content: map[string]mediaType{
+					"application/json": {Schema: schemaFor(reflect.TypeOf(e.Request), doc.Components.Schemas)},
+				},
+			}
+		case e.Upload != "":
+			op.RequestBody = &requestBody{
+				Required: true,
+				Content: map[string]mediaType{
+					"multipart/form-data": {Schema: &schema{
+						Type:       "object",
+						Properties: map[string]*schema{e.Upload: {Type: "string", Format: "binary"}},
+						Required:   []string{e.Upload},
+					}},
+				},
+			}
+		}
+
+		if e.Request != nil {
+			op.Responses["400"] = response{
+				Description: "Malformed request body",
+				Content:     map[string]mediaType{"application/json": {Schema: errorSchema}},
+			}
+		}
+		if e.Request != nil || e.Upload != "" || len(e.Query) > 0 {
+			op.Responses["422"] = response{
+				Description: "Validation failed",
+				Content:     map[string]mediaType{"application/json": {Schema: errorSchema}},
+			}
+		}
+
+		if e.Auth || e.Permission != "" {
+			op.Security = []map[string][]string{{"bearerAuth": {}}}
+			op.Responses["401"] = response{
+				Description: "Missing, invalid or expired bearer token",
+				Content:     map[string]mediaType{"application/json": {Schema: errorSchema}},
+			}
+		}
+
+		if e.Permission != "" {
+			op.Permission = string(e.Permission)
+			op.Responses["403"] = response{
+				Description: "The user lacks the " + string(e.Permission) + " permission",
+				Content:     map[string]mediaType{"application/json": {Schema: errorSchema}},
+			}
+		}
+
+		if e.Conflict != "" {
+			op.Responses["409"] = response{
+				Description: e.Conflict,
+				Content:     map[string]mediaType{"application/json": {Schema: errorSchema}},
+			}
+		}
+
+		if e.TooMany != "" {
+			op.Responses["429"] = response{
+				Description: e.TooMany,
+				Content:     map[string]mediaType{"application/json": {Schema: errorSchema}},
+			}
+		}
+
+		if len(pathParams) > 0 {
+			op.Responses["404"] = response{
+				Description: "Resource not found",
+				Content:     map[string]mediaType{"application/json": {Schema: errorSchema}},
+			}
+		}
+
+		success := &schema{Type: "object"}
+		if e.Response != nil {
+			success = schemaFor(reflect.TypeOf(e.Response), doc.Components.Schemas)
+		}
+		op.Responses[fmt.Sprint(e.Status)] = response{
+			Description: http.StatusText(e.Status),
+			Content:     map[string]mediaType{"application/json": {Schema: success}},
+		}
+
+		if doc.Paths[e.Path] == nil {
+			doc.Paths[e.Path] = make(map[string]operation)
+		}
+		doc.Paths[e.Path][strings.ToLower(e.Method)] = op
+	}
+
+	return doc
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the JSON schema of t, registering named structs as
+// components and referring to them by $ref
+func schemaFor(t reflect.Type, components map[string]*schema) *schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Struct:
+		name := t.Name()
+		if c, ok := components[name]; ok && c.goType != t {
+			// a type of the same name from another package, such as a
+			// request body and the model it is stored as
+			name = path.Base(t.PkgPath()) + name
+		}
+		if _, ok := components[name]; !ok {
+			// reserve the name first so recursive types terminate
+			components[name] = &schema{goType: t}
+			components[name] = structSchema(t, components)
+			components[name].goType = t
+		}
+		return &schema{Ref: "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &schema{Type: "array", Items: schemaFor(t.Elem(), components)}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), components)}
+	default:
+		return &schema{Type: "string"}
+	}
+}
+
+// structSchema describes the exported, JSON visible fields of a struct type
+func structSchema(t reflect.Type, components map[string]*schema) *schema {
+	s := &schema{Type: "object", Properties: make(map[string]*schema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		// encoding/json promotes the fields of an untagged embedded struct,
+		// even an unexported one
+		if _, tagged := f.Tag.Lookup("json"); f.Anonymous && !tagged && f.Type.Kind() == reflect.Struct {
+			embedded := structSchema(f.Type, components)
+			for name, p := range embedded.Properties {
+				s.Properties[name] = p
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := f.Name
+		omitempty := false
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitempty = true
+				}
+			}
+		}
+
+		s.Properties[name] = schemaFor(f.Type, components)
+		if !omitempty {
+			s.Required = append(s.Required, name)
+		}
+	}
+	sort.Strings(s.Required)
+	return s
+}
+
+// verifyOpenAPI walks the routes registered on mux and reports any versioned
+// route missing from the OpenAPI document, and any documented operation that
+// is not routed
+func (app *application) verifyOpenAPI(mux chi.Routes) error {
+	doc := app.openAPIDocument()
+	routed := make(map[string]bool)
+	var problems []string
+
+	err := chi.Walk(mux, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if !strings.HasPrefix(route, apiPrefix+"/") {
+			return nil
+		}
+		path := strings.TrimPrefix(route, apiPrefix)
+		key := strings.ToLower(method) + " " + path
+		routed[key] = true
+		if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+			problems = append(problems, fmt.Sprintf("%s %s is routed but not documented", method, route))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			if !routed[method+" "+path] {
+				problems = append(problems, fmt.Sprintf("%s %s%s is documented but not routed", strings.ToUpper(method), apiPrefix, path))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("openapi document out of date: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
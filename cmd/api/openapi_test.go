@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/rbac"
+	"github.com/caleberi/gostripe/pkg/client"
+	"github.com/go-chi/chi/v5"
+)
+
+// servedDocument fetches the OpenAPI document the way a client sees it
+func servedDocument(t *testing.T, h http.Handler) openAPIDoc {
+	t.Helper()
+
+	var doc openAPIDoc
+	decode(t, serve(t, h, http.MethodGet, "/openapi.json", "", nil), http.StatusOK, &doc)
+	return doc
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	app, _ := newTestApplication(t)
+	mux := app.routes()
+	doc := servedDocument(t, mux)
+
+	routed := make(map[string]bool)
+	err := chi.Walk(mux, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		path := strings.TrimPrefix(route, apiPrefix)
+		routed[strings.ToLower(method)+" "+path] = true
+		if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("%s %s is routed but not documented", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			if !routed[method+" "+path] {
+				t.Errorf("%s %s is documented but not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+
+	if err := app.verifyOpenAPI(mux); err != nil {
+		t.Errorf("verifyOpenAPI: %v", err)
+	}
+
+	mux.Get(apiPrefix+"/undocumented", func(http.ResponseWriter, *http.Request) {})
+	if err := app.verifyOpenAPI(mux); err == nil || !strings.Contains(err.Error(), "/undocumented is routed but not documented") {
+		t.Errorf("verifyOpenAPI with an undocumented route: %v", err)
+	}
+}
+
+func TestOpenAPISchemasMatchTypes(t *testing.T) {
+	app, _ := newTestApplication(t)
+	doc := servedDocument(t, app.routes())
+
+	for _, e := range app.endpoints() {
+		op, ok := doc.Paths[e.Path][strings.ToLower(e.Method)]
+		if !ok {
+			t.Errorf("%s %s: not documented", e.Method, e.Path)
+			continue
+		}
+
+		if e.Request != nil {
+			if op.RequestBody == nil {
+				t.Errorf("%s: no request body documented", e.OperationID)
+			} else {
+				s := op.RequestBody.Content["application/json"].Schema
+				for _, p := range conform(doc, s, filled(reflect.TypeOf(e.Request)), "request", true) {
+					t.Errorf("%s: %s", e.OperationID, p)
+				}
+			}
+		}
+
+		resp, ok := op.Responses[strconv.Itoa(e.Status)]
+		if !ok {
+			t.Errorf("%s: no %d response documented", e.OperationID, e.Status)
+			continue
+		}
+		s := resp.Content["application/json"].Schema
+		if e.Response == nil {
+			if s == nil || s.Type != "object" {
+				t.Errorf("%s: free-form response documented as %+v", e.OperationID, s)
+			}
+			continue
+		}
+		for _, p := range conform(doc, s, filled(reflect.TypeOf(e.Response)), "response", true) {
+			t.Errorf("%s: %s", e.OperationID, p)
+		}
+	}
+}
+
+func TestOpenAPIDescribesResponses(t *testing.T) {
+	app, store := newTestApplication(t)
+	widget := models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5}
+	widget.ID = store.AddWidget(widget)
+	orderID := addOrder(t, store, widget, 1)
+	store.AddShippingRate(models.ShippingRate{Name: "Standard", Kind: models.RateFlat, Amount: 500})
+	_, token := addStaff(t, store, "admin@example.com", rbac.ViewReports, rbac.ManageCatalog, rbac.FulfillOrders)
+	mux := app.routes()
+	doc := servedDocument(t, mux)
+
+	order, err := store.GetOrder(context.Background(), orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	widgetPath := "/widgets/" + strconv.Itoa(widget.ID)
+	orderPath := "/orders/" + strconv.Itoa(orderID)
+	adminWidgetPath := "/admin/widgets/" + strconv.Itoa(widget.ID)
+	tests := []struct {
+		operation string
+		path      string
+		body      interface{}
+	}{
+		{"listWidgets", "/widgets", nil},
+		{"getWidget", widgetPath, nil},
+		{"listOrders", "/orders", nil},
+		{"getOrder", orderPath, nil},
+		{"createCustomer", "/customers", customerPayload{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}},
+		{"getCustomer", "/customers/" + strconv.Itoa(order.CustomerID), nil},
+		{"priceCart", "/cart", cartPayload{Items: []client.CartLine{{WidgetID: widget.ID, Quantity: 1}}}},
+		{"authenticate", "/authenticate", credentialsPayload{Email: "admin@example.com", Password: "password"}},
+		{"updateFulfillment", "/admin/orders/" + strconv.Itoa(orderID) + "/fulfillment", fulfillmentPayload{Status: "shipped", TrackingNumber: "1Z999"}},
+		{"createWidget", "/admin/widgets", widgetPayload{Name: "Gadget", Description: "A gadget", Price: 2500}},
+		{"listInventoryMovements", adminWidgetPath + "/inventory-movements", nil},
+		{"deleteWidget", adminWidgetPath, nil},
+	}
+
+	endpoints := make(map[string]endpoint)
+	for _, e := range app.endpoints() {
+		endpoints[e.OperationID] = e
+	}
+	for _, tt := range tests {
+		t.Run(tt.operation, func(t *testing.T) {
+			e, ok := endpoints[tt.operation]
+			if !ok {
+				t.Fatalf("no endpoint %s", tt.operation)
+			}
+
+			w := serve(t, mux, e.Method, tt.path, token, tt.body)
+			if tt.operation == "deleteWidget" {
+				// the widget was ordered, so only the conflict can be checked
+				decode(t, w, http.StatusConflict, nil)
+				return
+			}
+
+			var body interface{}
+			decode(t, w, e.Status, &body)
+			s := doc.Paths[e.Path][strings.ToLower(e.Method)].Responses[strconv.Itoa(e.Status)].Content["application/json"].Schema
+			for _, p := range conform(doc, s, body, "response", false) {
+				t.Error(p)
+			}
+		})
+	}
+}
+
+// filled returns the JSON encoding, decoded into plain values, of a value of
+// type t with every field set, so that omitempty fields are encoded too
+func filled(t reflect.Type) interface{} {
+	b, err := json.Marshal(fill(t, 0).Interface())
+	if err != nil {
+		panic(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// fill builds a non-zero value of type t, giving slices and maps a single
+// element and stopping at a fixed depth so recursive types terminate
+func fill(t reflect.Type, depth int) reflect.Value {
+	v := reflect.New(t).Elem()
+	if depth > 8 {
+		return v
+	}
+
+	if t == timeType {
+		v.Set(reflect.ValueOf(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)))
+		return v
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Ptr:
+		v.Set(fill(t.Elem(), depth+1).Addr())
+	case reflect.Slice:
+		v.Set(reflect.Append(v, fill(t.Elem(), depth+1)))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(t))
+		v.SetMapIndex(fill(t.Key(), depth+1), fill(t.Elem(), depth+1))
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" {
+				v.Field(i).Set(fill(t.Field(i).Type, depth+1))
+			}
+		}
+	}
+	return v
+}
+
+// conform reports where v, a decoded JSON value, does not match schema s. When
+// complete is set, every documented property must also be present in v.
+func conform(doc openAPIDoc, s *schema, v interface{}, at string, complete bool) []string {
+	if s == nil {
+		return []string{at + ": no schema"}
+	}
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		c, ok := doc.Components.Schemas[name]
+		if !ok {
+			return []string{fmt.Sprintf("%s: unknown component %s", at, s.Ref)}
+		}
+		return conform(doc, c, v, at, complete)
+	}
+	if v == nil {
+		// nil slices, maps and pointers encode as null
+		return nil
+	}
+
+	var problems []string
+	mismatch := func() []string {
+		return []string{fmt.Sprintf("%s: %T does not match type %q", at, v, s.Type)}
+	}
+
+	switch s.Type {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		if s.Properties != nil {
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				p, ok := s.Properties[k]
+				if !ok {
+					problems = append(problems, fmt.Sprintf("%s.%s is not documented", at, k))
+					continue
+				}
+				problems = append(problems, conform(doc, p, m[k], at+"."+k, complete)...)
+			}
+			for _, k := range s.Required {
+				if _, ok := m[k]; !ok {
+					problems = append(problems, fmt.Sprintf("%s.%s is required but missing", at, k))
+				}
+			}
+			if complete {
+				for k := range s.Properties {
+					if _, ok := m[k]; !ok {
+						problems = append(problems, fmt.Sprintf("%s.%s is documented but never sent", at, k))
+					}
+				}
+			}
+		}
+		if s.AdditionalProperties != nil {
+			for k, e := range m {
+				problems = append(problems, conform(doc, s.AdditionalProperties, e, at+"."+k, complete)...)
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for i, e := range a {
+			problems = append(problems, conform(doc, s.Items, e, fmt.Sprintf("%s[%d]", at, i), complete)...)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return mismatch()
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			return mismatch()
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return mismatch()
+		}
+	default:
+		return []string{fmt.Sprintf("%s: unknown type %q", at, s.Type)}
+	}
+	return problems
+}
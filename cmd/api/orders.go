@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/validator"
+	"github.com/caleberi/gostripe/pkg/client"
+	"github.com/go-chi/chi/v5"
+)
+
+// fulfillmentPayload marks an order shipped or delivered
+type fulfillmentPayload = client.FulfillmentPayload
+
+// orderList is a page of orders
+type orderList struct {
+	Orders   []models.OrderSummary `json:"orders"`
+	Metadata models.CursorMetadata `json:"metadata"`
+}
+
+// ListOrders returns a filtered page of orders, newest first
+func (app *application) ListOrders(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	filter := models.ParseOrderFilter(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	orders, metadata, err := app.DB.Orders.ListOrders(r.Context(), filter)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if orders == nil {
+		orders = []models.OrderSummary{}
+	}
+	if err := app.writeJSON(w, http.StatusOK, orderList{Orders: orders, Metadata: metadata}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// UpdateFulfillment marks a cleared order shipped with a tracking number,
+// or a shipped order delivered, and responds with the order
+func (app *application) UpdateFulfillment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w, r)
+		return
+	}
+
+	var payload fulfillmentPayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	update := models.FulfillmentUpdate{
+		Status:         models.Fulfillment(payload.Status),
+		TrackingNumber: strings.TrimSpace(payload.TrackingNumber),
+	}
+
+	v := validator.New()
+	update.Validate(v)
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	order, err := app.DB.Orders.GetOrder(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.notFound(w, r)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := order.FulfillmentTransition(update.Status); err != nil {
+		v.AddError("status", "cannot move a "+order.StatusID.String()+", "+string(order.Fulfillment)+" order to "+string(update.Status))
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	err = app.DB.Orders.UpdateFulfillment(r.Context(), id, update)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		app.conflict(w, r, "the order changed while it was updated; check it before trying again")
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	app.infoLog.Printf("order %d marked %s by user %d", id, update.Status, user.ID)
+
+	summary, err := app.DB.Orders.GetOrderSummary(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+	if err := app.writeJSON(w, http.StatusOK, summary); err != nil {
+		app.errorLog.Println(err)
+	}
+}
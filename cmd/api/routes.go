@@ -1,27 +1,35 @@
 package main
 
 import (
-	"net/http"
-
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 )
 
-func (app *application) routes() http.Handler {
+func (app *application) routes() *chi.Mux {
 	mux := chi.NewRouter()
 	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
+		AllowedOrigins:   app.config.API.CORSOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-oken"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-oken", "Idempotency-Key"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
+	mux.Use(middleware.RequestID)
 	mux.Use(middleware.Logger)
 	mux.Use(middleware.Recoverer)
-	mux.Post("/api/payment-intent", app.GetPaymentIntent)
-	mux.Get("/api/widget/{id}", app.GetWidgetById)
-	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+	mux.Route(apiPrefix, func(mux chi.Router) {
+		for _, e := range app.endpoints() {
+			switch {
+			case e.Permission != "":
+				mux.With(app.Auth, app.requirePermission(e.Permission)).Method(e.Method, e.Path, e.Handler)
+			case e.Auth:
+				mux.With(app.Auth).Method(e.Method, e.Path, e.Handler)
+			default:
+				mux.Method(e.Method, e.Path, e.Handler)
+			}
+		}
+	})
 	return mux
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/config"
+	"github.com/caleberi/gostripe/internal/encryption"
+	"github.com/caleberi/gostripe/internal/mailer"
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/models/memory"
+	"github.com/caleberi/gostripe/internal/rbac"
+	"github.com/caleberi/gostripe/internal/storage"
+	"github.com/caleberi/gostripe/internal/totp"
+	"github.com/caleberi/gostripe/internal/urlsigner"
+)
+
+// testKey is the signing and encryption key of test applications
+const testKey = "0123456789abcdef0123456789abcdef"
+
+// newTestApplication returns an application backed by an empty in-memory
+// store, with its logs discarded and images kept in a temporary directory
+func newTestApplication(t *testing.T) (*application, *memory.Store) {
+	t.Helper()
+
+	cfg := config.Defaults()
+	cfg.Images.Dir = t.TempDir()
+	cfg.SigningKey = testKey
+	cfg.EncryptionKey = testKey
+
+	discard := log.New(io.Discard, "", 0)
+	store := memory.New()
+	app := &application{
+		config:    cfg,
+		infoLog:   discard,
+		errorLog:  discard,
+		version:   version,
+		DB:        store.Models(),
+		mailer:    &mailer.LogMailer{From: cfg.Mail.From, Logger: discard},
+		signer:    &urlsigner.Signer{Secret: []byte(cfg.SigningKey)},
+		encrypter: &encryption.Encrypter{Key: []byte(cfg.EncryptionKey)},
+		live:      config.NewLive(cfg),
+		images:    storage.Images{Dir: cfg.Images.Dir, MaxSize: cfg.Images.MaxSize},
+	}
+	return app, store
+}
+
+// addStaff stores a user holding perms through a role of their own and
+// returns the user's id and a bearer token for them
+func addStaff(t *testing.T, store *memory.Store, email string, perms ...rbac.Permission) (int, string) {
+	t.Helper()
+
+	granted := make([]string, len(perms))
+	for i, p := range perms {
+		granted[i] = string(p)
+	}
+	roleID := store.AddRole(models.Role{Name: email}, granted...)
+
+	id, err := store.AddUser(models.User{FirstName: "Staff", LastName: "Member", Email: email}, "password", roleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := models.GenerateToken(id, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertToken(context.Background(), token, models.User{ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	return id, token.PlainText
+}
+
+// addOrder stores a cleared order for quantity units of a widget, with the
+// customer and transaction it needs, and returns its id
+func addOrder(t *testing.T, store *memory.Store, widget models.Widget, quantity int) int {
+	t.Helper()
+	ctx := context.Background()
+
+	customerID, err := store.InsertCustomer(ctx, models.Customer{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	amount := widget.Price * quantity
+	txnID, err := store.InsertTransaction(ctx, models.Transaction{
+		Amount:              amount,
+		Currency:            "usd",
+		LastFour:            "4242",
+		PaymenyIntent:       "pi_" + strconv.Itoa(customerID),
+		TransactionStatusID: models.TxnCleared,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := store.InsertOrder(ctx, models.Order{
+		TransactionID: txnID,
+		CustomerID:    customerID,
+		StatusID:      models.OrderCleared,
+		Amount:        amount,
+		Items:         []models.OrderItem{{WidgetID: widget.ID, Quantity: quantity, Price: widget.Price, Amount: amount}},
+	}, models.Actor{Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// serve sends a request to h, with body encoded as JSON when it is not nil
+// and token as a bearer token when it is not empty
+func serve(t *testing.T, h http.Handler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	r := httptest.NewRequest(method, apiPrefix+path, reader)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decode unmarshals the body of w into out, failing the test when the
+// status is not want
+func decode(t *testing.T, w *httptest.ResponseRecorder, want int, out interface{}) {
+	t.Helper()
+
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, want, w.Body)
+	}
+	if out == nil {
+		return
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+}
+
+// enrollTOTP completes two-factor enrollment for a user and returns their
+// plain TOTP secret
+func enrollTOTP(t *testing.T, app *application, store *memory.Store, userID int) string {
+	t.Helper()
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := app.encrypter.Encrypt(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetPendingTOTPSecret(context.Background(), userID, sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnableTOTP(context.Background(), userID, nil); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// currentCode returns the TOTP code for secret at the current time
+func currentCode(t *testing.T, secret string) string {
+	t.Helper()
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
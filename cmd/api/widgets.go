@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/storage"
+	"github.com/caleberi/gostripe/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// widgetPayload is the body of the create and update widget endpoints. The
+// image is uploaded separately.
+type widgetPayload struct {
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	Price          int    `json:"price"`
+	InventoryLevel int    `json:"inventory_level"`
+	IsRecurring    bool   `json:"is_recurring"`
+	PlanID         string `json:"plan_id"`
+	// Weight is the shipping weight of a unit in grams
+	Weight int `json:"weight"`
+}
+
+// widgetUpdatePayload is the body of the update widget endpoint
+type widgetUpdatePayload struct {
+	widgetPayload
+	// InventorySeen is the inventory level the edit started from. The
+	// difference between it and InventoryLevel is added to the current
+	// level, so units sold in the meantime stay sold; when it is left out,
+	// the edit starts from the current level.
+	InventorySeen *int `json:"inventory_seen,omitempty"`
+}
+
+// widgetList is a page of widgets
+type widgetList struct {
+	Widgets  []models.Widget `json:"widgets"`
+	Metadata models.Metadata `json:"metadata"`
+}
+
+// imageField is the multipart field the image upload is read from
+const imageField = "image"
+
+// ListWidgets returns a filtered, sorted page of the catalog
+func (app *application) ListWidgets(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	filter := models.ParseWidgetFilter(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	widgets, metadata, err := app.DB.Widgets.ListWidgets(r.Context(), filter)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if widgets == nil {
+		widgets = []models.Widget{}
+	}
+	if err := app.writeJSON(w, http.StatusOK, widgetList{Widgets: widgets, Metadata: metadata}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// CreateWidget adds a widget to the catalog
+func (app *application) CreateWidget(w http.ResponseWriter, r *http.Request) {
+	var payload widgetPayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	widget := models.Widget{}
+	payload.apply(&widget)
+
+	v := validator.New()
+	widget.Validate(v)
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	id, err := app.DB.Widgets.InsertWidget(r.Context(), widget)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	app.writeWidget(w, r, http.StatusCreated, id)
+}
+
+// UpdateWidget replaces the fields of a widget, keeping its image, and
+// applies the change to its inventory level made since inventory_seen
+func (app *application) UpdateWidget(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var payload widgetUpdatePayload
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	seen := widget.InventoryLevel
+	if payload.InventorySeen != nil {
+		seen = *payload.InventorySeen
+	}
+	payload.apply(&widget)
+
+	v := validator.New()
+	widget.Validate(v)
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	err := app.DB.Widgets.UpdateWidget(r.Context(), widget, widget.InventoryLevel-seen)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return
+	case errors.Is(err, models.ErrOutOfStock):
+		app.conflict(w, r, "units were sold or reserved since inventory_seen, so the inventory level would drop below the units held for pending orders")
+		return
+	case err != nil:
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	app.writeWidget(w, r, http.StatusOK, widget.ID)
+}
+
+// DeleteWidget removes a widget that was never ordered, and its image
+func (app *application) DeleteWidget(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.DB.Widgets.DeleteWidget(r.Context(), widget.ID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.notFound(w, r)
+		return
+	case errors.Is(err, models.ErrWidgetInUse):
+		app.conflict(w, r, "the widget has orders and cannot be deleted; set its inventory to 0 instead")
+		return
+	case err != nil:
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := app.images.Remove(widget.Image); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	resp := jsonResponse{OK: true, Message: "widget deleted"}
+	if err := app.writeJSON(w, http.StatusOK, resp); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// UploadWidgetImage replaces the image of a widget with the file in the
+// image field of a multipart form
+func (app *application) UploadWidgetImage(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	// leave room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, app.images.MaxSize+maxBodyBytes)
+	file, _, err := r.FormFile(imageField)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		v := validator.New()
+		if errors.As(err, &tooLarge) {
+			v.AddError(imageField, imageError(storage.ErrTooLarge, app.images.MaxSize))
+		} else {
+			v.AddError(imageField, "must be a file uploaded as multipart/form-data")
+		}
+		app.failedValidation(w, r, v)
+		return
+	}
+	defer file.Close()
+
+	name, err := app.images.Save(file)
+	if errors.Is(err, storage.ErrTooLarge) || errors.Is(err, storage.ErrUnsupportedType) {
+		v := validator.New()
+		v.AddError(imageField, imageError(err, app.images.MaxSize))
+		app.failedValidation(w, r, v)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := app.DB.Widgets.SetWidgetImage(r.Context(), widget.ID, name); err != nil {
+		app.errorLog.Println(err)
+		if err := app.images.Remove(name); err != nil {
+			app.errorLog.Println(err)
+		}
+		app.serverError(w, r)
+		return
+	}
+
+	if err := app.images.Remove(widget.Image); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.writeWidget(w, r, http.StatusOK, widget.ID)
+}
+
+// apply copies the payload onto w
+func (p widgetPayload) apply(w *models.Widget) {
+	w.Name = p.Name
+	w.Description = p.Description
+	w.Price = p.Price
+	w.InventoryLevel = p.InventoryLevel
+	w.IsRecurring = p.IsRecurring
+	w.PlanID = p.PlanID
+	w.Weight = p.Weight
+}
+
+// widgetFromURL loads the widget named by the id URL parameter, writing a
+// 404 and returning false when there is none
+func (app *application) widgetFromURL(w http.ResponseWriter, r *http.Request) (models.Widget, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w, r)
+		return models.Widget{}, false
+	}
+
+	widget, err := app.DB.Widgets.GetWidget(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.notFound(w, r)
+		return widget, false
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return widget, false
+	}
+	return widget, true
+}
+
+// writeWidget responds with the stored state of a widget just written
+func (app *application) writeWidget(w http.ResponseWriter, r *http.Request, status, id int) {
+	widget, err := app.DB.Widgets.GetWidget(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.serverError(w, r)
+		return
+	}
+
+	if err := app.writeJSON(w, status, widget); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// imageError explains a rejected upload
+func imageError(err error, maxSize int64) string {
+	if errors.Is(err, storage.ErrTooLarge) {
+		return "must not be larger than " + strconv.FormatInt(maxSize>>20, 10) + " MB"
+	}
+	return "must be a png, jpeg, gif or webp image"
+}
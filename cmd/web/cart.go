@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// cartKey is the session key the cart lines are kept under
+const cartKey = "cart"
+
+// ShowCart lists the cart with its current prices and, when every line can
+// be bought, the checkout form
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	td := &templateData{
+		Flash: app.Session.PopString(r.Context(), "flash"),
+		Error: app.Session.PopString(r.Context(), "error"),
+	}
+	app.renderCart(w, r, td, nil)
+}
+
+// PostCartItem adds a quantity of a widget to the cart
+func (app *application) PostCartItem(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.PostFormValue("widget_id"))
+	widget, err := app.DB.Widgets.GetWidget(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	quantity, ok := parseQuantity(r)
+	lines := app.cartLines(r.Context())
+	merged := models.MergeCartLines(append(lines, models.CartLine{WidgetID: id, Quantity: quantity}))
+	switch {
+	case !ok || quantity == 0:
+		app.Session.Put(r.Context(), "error", "Choose a quantity between 1 and "+strconv.Itoa(models.MaxLineQuantity))
+	case widget.IsRecurring:
+		app.Session.Put(r.Context(), "error", widget.Name+" is a subscription and cannot be added to the cart")
+	case len(merged) > models.MaxCartLines:
+		app.Session.Put(r.Context(), "error", "Your cart cannot hold more than "+strconv.Itoa(models.MaxCartLines)+" different widgets")
+	case lineQuantity(merged, id) > models.MaxLineQuantity:
+		app.Session.Put(r.Context(), "error", "Your cart cannot hold more than "+strconv.Itoa(models.MaxLineQuantity)+" of "+widget.Name)
+	default:
+		app.Session.Put(r.Context(), cartKey, merged)
+		app.Session.Put(r.Context(), "flash", "Added "+widget.Name+" to your cart")
+	}
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// PostCartItemQuantity changes the quantity of a widget in the cart; a
+// quantity of 0 removes it
+func (app *application) PostCartItemQuantity(w http.ResponseWriter, r *http.Request) {
+	quantity, ok := parseQuantity(r)
+	if !ok {
+		app.Session.Put(r.Context(), "error", "Choose a quantity between 0 and "+strconv.Itoa(models.MaxLineQuantity))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	app.setLineQuantity(w, r, quantity)
+}
+
+// PostRemoveCartItem removes a widget from the cart
+func (app *application) PostRemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	app.setLineQuantity(w, r, 0)
+}
+
+// CartCheckout records the order for a cart the customer has paid for. The
+// items come from the payment intent, so they are what was charged even
+// when the cart changed in another tab since.
+func (app *application) CartCheckout(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	v.Check(validator.NotBlank(r.PostFormValue("first_name")), "first_name", "must be provided")
+	v.Check(validator.NotBlank(r.PostFormValue("last_name")), "last_name", "must be provided")
+	billing, shipping := parseAddresses(r, v)
+
+	tx, err := app.GetTransactionData(r, v)
+	if !v.Valid() {
+		app.renderCart(w, r, &templateData{}, v)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(tx.Items) == 0 {
+		app.errorLog.Printf("cart checkout with payment intent %s that has no items", tx.PaymentIntentID)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	tx.BillingAddress, tx.ShippingAddress = billing, shipping
+
+	// the card was charged, so record the order even if the client goes away
+	if err := app.recordOrder(context.WithoutCancel(r.Context()), tx); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Remove(r.Context(), cartKey)
+	app.Session.Put(r.Context(), "receipt", tx)
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+}
+
+// renderCart shows the cart page with shipping, with the errors in v when
+// it is not nil.
+// Lines for widgets that no longer exist are dropped from the cart.
+func (app *application) renderCart(w http.ResponseWriter, r *http.Request, td *templateData, v *validator.Validator) {
+	data := make(map[string]interface{})
+	td.Data = data
+
+	var cart models.Cart
+	check := validator.New()
+	lines := app.cartLines(r.Context())
+	for len(lines) > 0 {
+		var err error
+		cart, err = models.PriceCart(r.Context(), app.DB.Widgets, lines, check)
+		if err != nil {
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if len(cart.Items) == len(lines) {
+			break
+		}
+		// price again without the missing widgets so the errors line up
+		// with the lines shown
+		lines = cart.Lines()
+		check = validator.New()
+		if len(lines) == 0 {
+			app.Session.Remove(r.Context(), cartKey)
+		} else {
+			app.Session.Put(r.Context(), cartKey, lines)
+		}
+	}
+
+	if len(lines) == 0 {
+		if err := app.renderTemplate(w, r, "cart", td, "stripe-js", "address-fields"); err != nil {
+			app.errorLog.Println(err)
+		}
+		return
+	}
+
+	rates, err := app.DB.Shipping.ListShippingRates(r.Context())
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data["cart"] = cart.WithShipping(rates)
+	// problems with the lines are shown next to them and stop the checkout
+	data["lineErrors"] = check.Errors
+	data["canCheckout"] = check.Valid()
+
+	if v != nil {
+		app.failedValidation(w, r, "cart", td, v, "stripe-js", "address-fields")
+		return
+	}
+	if err := app.renderTemplate(w, r, "cart", td, "stripe-js", "address-fields"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// setLineQuantity sets the quantity of the widget named by the id URL
+// parameter, removing it from the cart at 0, and shows the cart
+func (app *application) setLineQuantity(w http.ResponseWriter, r *http.Request, quantity int) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	var lines []models.CartLine
+	for _, l := range app.cartLines(r.Context()) {
+		if l.WidgetID == id {
+			l.Quantity = quantity
+		}
+		if l.Quantity > 0 {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		app.Session.Remove(r.Context(), cartKey)
+	} else {
+		app.Session.Put(r.Context(), cartKey, lines)
+	}
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// cartLines returns the lines of the cart in the session
+func (app *application) cartLines(ctx context.Context) []models.CartLine {
+	lines, _ := app.Session.Get(ctx, cartKey).([]models.CartLine)
+	return lines
+}
+
+// nameItems fills in the widget names of items decoded from a payment
+// intent. A widget that cannot be loaded keeps an empty name, since the
+// items are still what was paid for.
+func (app *application) nameItems(ctx context.Context, items []models.OrderItem) []models.OrderItem {
+	for i := range items {
+		widget, err := app.DB.Widgets.GetWidget(ctx, items[i].WidgetID)
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		items[i].Name = widget.Name
+	}
+	return items
+}
+
+// widgetCart returns the cart of a single unit of widget with shipping, as
+// the buy one page charges for it
+func (app *application) widgetCart(ctx context.Context, widget models.Widget) (models.Cart, error) {
+	rates, err := app.DB.Shipping.ListShippingRates(ctx)
+	if err != nil {
+		return models.Cart{}, err
+	}
+	return models.CartOf(widget).WithShipping(rates), nil
+}
+
+// parseAddresses reads the shipping address fields of a checkout form, and
+// the billing address fields unless billing_same is checked, in which case
+// the shipping address is billed. Problems are recorded in v under the
+// field names.
+func parseAddresses(r *http.Request, v *validator.Validator) (billing, shipping *models.Address) {
+	s := formAddress(r, "shipping_", models.AddressShipping)
+	s.Validate(v, "shipping_")
+
+	b := s
+	b.Kind = models.AddressBilling
+	if r.PostFormValue("billing_same") == "" {
+		b = formAddress(r, "billing_", models.AddressBilling)
+		b.Validate(v, "billing_")
+	}
+	return &b, &s
+}
+
+// formAddress reads the address fields named with prefix
+func formAddress(r *http.Request, prefix string, kind models.AddressKind) models.Address {
+	return models.Address{
+		Kind:       kind,
+		Name:       r.PostFormValue(prefix + "name"),
+		Line1:      r.PostFormValue(prefix + "line1"),
+		Line2:      r.PostFormValue(prefix + "line2"),
+		City:       r.PostFormValue(prefix + "city"),
+		Region:     r.PostFormValue(prefix + "region"),
+		PostalCode: r.PostFormValue(prefix + "postal_code"),
+		Country:    r.PostFormValue(prefix + "country"),
+	}.Normalize()
+}
+
+// parseQuantity reads the quantity field of the form, which defaults to 1
+func parseQuantity(r *http.Request) (int, bool) {
+	s := strings.TrimSpace(r.PostFormValue("quantity"))
+	if s == "" {
+		return 1, true
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil && n >= 0 && n <= models.MaxLineQuantity
+}
+
+// lineQuantity returns the quantity of a widget in lines
+func lineQuantity(lines []models.CartLine, widgetID int) int {
+	for _, l := range lines {
+		if l.WidgetID == widgetID {
+			return l.Quantity
+		}
+	}
+	return 0
+}
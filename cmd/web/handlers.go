@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/caleberi/gostripe/internal/cards"
 	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/totp"
+	"github.com/caleberi/gostripe/internal/urlsigner"
+	"github.com/caleberi/gostripe/internal/validator"
 	"github.com/go-chi/chi/v5"
+	qrcode "github.com/skip2/go-qrcode"
+	"github.com/stripe/stripe-go/v72"
 )
 
 type TransactionData struct {
@@ -22,9 +31,21 @@ type TransactionData struct {
 	ExpiryMonth     int
 	ExpiryYear      int
 	BankReturnCode  string
+	// Items are the widgets the payment intent was created for, empty for
+	// virtual terminal payments
+	Items []models.OrderItem
+	// Shipping is the part of PaymentAmount charged for shipping the items
+	// to ShippingAddress
+	Shipping        int
+	BillingAddress  *models.Address
+	ShippingAddress *models.Address
 }
 
-func (app *application) GetTransactionData(r *http.Request) (TransactionData, error) {
+// GetTransactionData reads the submitted payment form, checks it against the
+// shared validation rules and completes it with the card details held by stripe.
+// Failed rules are recorded on v and returned as a validator.Errors error
+// before stripe is contacted.
+func (app *application) GetTransactionData(r *http.Request, v *validator.Validator) (TransactionData, error) {
 	var tx TransactionData
 	err := r.ParseForm()
 	if err != nil {
@@ -40,20 +61,37 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	paymentAmount := r.Form.Get("payment_amount")
 	paymentCurrency := r.Form.Get("payment_currency")
 
-	amount, _ := strconv.Atoi(paymentAmount)
+	amount, err := strconv.Atoi(paymentAmount)
+	v.Check(err == nil && validator.AmountInRange(amount), "payment_amount", "must be between 50 and 99999999")
+	v.Check(validator.IsCurrency(paymentCurrency), "payment_currency", "must be an ISO 4217 currency code")
+	v.Check(validator.IsEmail(email), "cardholder_email", "must be a valid email address")
+	v.Check(validator.MaxChars(firstName, validator.MaxNameLength), "first_name", "must not be more than 255 characters")
+	v.Check(validator.MaxChars(lastName, validator.MaxNameLength), "last_name", "must not be more than 255 characters")
+	v.Check(validator.NotBlank(paymentIntent), "payment_intent", "must be provided")
+	v.Check(validator.NotBlank(paymentMethod), "payment_method", "must be provided")
 
-	// add validation to the incoming data
+	if !v.Valid() {
+		return tx, v.Err()
+	}
 
+	key, secret := app.stripeKeys()
 	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
+		Secret: secret,
+		Key:    key,
 	}
 
 	pi, err := card.RetrivePaymentIntent(paymentIntent)
 
 	if err != nil {
 		app.errorLog.Println(err)
-		return tx, nil
+		return tx, err
+	}
+
+	// record what stripe charged, and only once it has
+	v.Check(pi.Status == stripe.PaymentIntentStatusSucceeded, "payment_intent", "has not succeeded")
+	v.Check(pi.Charges != nil && len(pi.Charges.Data) > 0, "payment_intent", "has no charge")
+	if !v.Valid() {
+		return tx, v.Err()
 	}
 
 	pm, err := card.GetPaymentMethod(paymentMethod)
@@ -67,21 +105,56 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	expiryMonth := pm.Card.ExpMonth
 	expiryYear := pm.Card.ExpYear
 
+	v.Check(validator.ValidExpiry(int(expiryMonth), int(expiryYear), time.Now()), "payment_method", "card expiry must be a valid future date")
+	if !v.Valid() {
+		return tx, v.Err()
+	}
+
+	items, err := models.ParseCartItems(pi.Metadata[models.CartMetadataKey])
+	if err != nil {
+		app.errorLog.Println(err)
+		return tx, err
+	}
+
+	// payment intents created before shipping was charged carry none
+	shipping := 0
+	if s := pi.Metadata[models.ShippingMetadataKey]; s != "" {
+		shipping, err = strconv.Atoi(s)
+		if err != nil {
+			app.errorLog.Println(err)
+			return tx, err
+		}
+	}
+
 	tx = TransactionData{
 		FirstName:       firstName,
 		LastName:        lastName,
 		Email:           email,
 		PaymentIntentID: paymentIntent,
-		PaymentAmount:   amount,
+		PaymentMethodID: paymentMethod,
+		// record what stripe charged, whatever the form says
+		PaymentAmount:   int(pi.Amount),
+		PaymentCurrency: string(pi.Currency),
+		Items:           app.nameItems(r.Context(), items),
+		Shipping:        shipping,
 		LastFour:        lastFour,
 		ExpiryMonth:     int(expiryMonth),
 		ExpiryYear:      int(expiryYear),
-		PaymentCurrency: paymentCurrency,
 		BankReturnCode:  pi.Charges.Data[0].ID,
 	}
 	return tx, nil
 }
 
+// failedValidation re-renders page with the per-field errors in v
+func (app *application) failedValidation(w http.ResponseWriter, r *http.Request, page string, td *templateData, v *validator.Validator, partials ...string) {
+	td.FieldErrors = v.Errors
+	td.Error = "Please correct the errors below and try again"
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	if err := app.renderTemplate(w, r, page, td, partials...); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) VirtualTerminal(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "terminal", &templateData{}, "stripe-js"); err != nil {
 		app.errorLog.Println(err)
@@ -90,10 +163,17 @@ func (app *application) VirtualTerminal(w http.ResponseWriter, r *http.Request)
 
 func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
 
-	tx, err := app.GetTransactionData(r)
+	v := validator.New()
+	tx, err := app.GetTransactionData(r, v)
+
+	if !v.Valid() {
+		app.failedValidation(w, r, "terminal", &templateData{}, v, "stripe-js")
+		return
+	}
 
 	if err != nil {
 		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
@@ -104,20 +184,24 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		ExpiryMonth:         tx.ExpiryMonth,
 		ExpiryYear:          tx.ExpiryYear,
 		BankReturnCode:      tx.BankReturnCode,
-		TransactionStatusID: 2,
+		TransactionStatusID: models.TxnCleared,
 		PaymentMethod:       tx.PaymentMethodID,
 		PaymenyIntent:       tx.PaymentIntentID,
 	}
 
-	_, err = app.SaveTransaction(txn)
+	// the card was charged, so record it even if the client goes away
+	ctx := context.WithoutCancel(r.Context())
+	recorded, err := app.paymentRecorded(ctx, tx.PaymentIntentID)
+	if err == nil && !recorded {
+		_, err = app.SaveTransaction(ctx, txn)
+	}
 
 	if err != nil {
-		app.errorLog.Println(err)
+		app.errorLog.Printf("payment intent %s paid but not recorded: %v", tx.PaymentIntentID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	app.infoLog.Printf("data: [{%v}]", tx)
-
 	app.Session.Put(r.Context(), "receipt", tx)
 	http.Redirect(w, r, "/virtual-terminal-receipt", http.StatusSeeOther)
 
@@ -133,26 +217,83 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	err := r.ParseForm()
 	if err != nil {
 		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	widgetId, _ := strconv.Atoi(r.Form.Get("product_id"))
+	v := validator.New()
+	v.Check(validator.NotBlank(r.Form.Get("first_name")), "first_name", "must be provided")
+	v.Check(validator.NotBlank(r.Form.Get("last_name")), "last_name", "must be provided")
+
+	billing, shipping := parseAddresses(r, v)
 
-	tx, err := app.GetTransactionData(r)
+	widgetId, _ := strconv.Atoi(r.Form.Get("product_id"))
+	widget, err := app.DB.Widgets.GetWidget(r.Context(), widgetId)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorLog.Printf("payment submitted for unknown product %q", r.Form.Get("product_id"))
+		http.NotFound(w, r)
+		return
+	}
 
 	if err != nil {
 		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	customerID, err := app.SaveCustomer(tx.FirstName, tx.LastName, tx.Email)
+	tx, err := app.GetTransactionData(r, v)
+
+	if !v.Valid() {
+		cart, err := app.widgetCart(r.Context(), widget)
+		if err != nil {
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		data := make(map[string]interface{})
+		data["widget"] = widget
+		data["cart"] = cart
+		app.failedValidation(w, r, "buy-one", &templateData{Data: data}, v, "stripe-js", "address-fields")
+		return
+	}
 
 	if err != nil {
 		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// payment intents created before carts only carry the amount
+	if len(tx.Items) == 0 {
+		tx.Items = []models.OrderItem{{WidgetID: widget.ID, Name: widget.Name, Quantity: 1, Price: tx.PaymentAmount, Amount: tx.PaymentAmount}}
+	}
+	tx.BillingAddress, tx.ShippingAddress = billing, shipping
+
+	// the card was charged, so record the order even if the client goes away
+	if err := app.recordOrder(context.WithoutCancel(r.Context()), tx); err != nil {
+		app.errorLog.Printf("payment intent %s paid but not recorded: %v", tx.PaymentIntentID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	app.infoLog.Printf(":: Customer with ID : %d created ... ", customerID)
+	app.Session.Put(r.Context(), "receipt", tx)
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+
+}
+
+// recordOrder saves the transaction, customer and order of a paid payment
+// intent with its addresses and takes its items out of stock. A payment
+// intent recorded before, by a resubmitted payment form, is left as it is;
+// as the three are saved together, a recorded one always has its order.
+func (app *application) recordOrder(ctx context.Context, tx TransactionData) error {
+	recorded, err := app.paymentRecorded(ctx, tx.PaymentIntentID)
+	if err != nil {
+		return err
+	}
+	if recorded {
+		app.infoLog.Printf("payment intent %s is already recorded", tx.PaymentIntentID)
+		return nil
+	}
 
 	txn := models.Transaction{
 		Amount:              tx.PaymentAmount,
@@ -161,43 +302,58 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		ExpiryMonth:         tx.ExpiryMonth,
 		ExpiryYear:          tx.ExpiryYear,
 		BankReturnCode:      tx.BankReturnCode,
-		TransactionStatusID: 2,
+		TransactionStatusID: models.TxnCleared,
 		PaymentMethod:       tx.PaymentMethodID,
 		PaymenyIntent:       tx.PaymentIntentID,
 	}
 
-	txnID, err := app.SaveTransaction(txn)
-
-	if err != nil {
-		app.errorLog.Println(err)
-		return
+	customer := models.Customer{
+		FirstName: tx.FirstName,
+		LastName:  tx.LastName,
+		Email:     tx.Email,
 	}
 
-	app.infoLog.Printf(":: Transaction with ID : %d created ... ", txnID)
-
 	order := models.Order{
-		WidgetID:      widgetId,
-		TransactionID: txnID,
-		CustomerID:    customerID,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        tx.PaymentAmount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+		StatusID:        models.OrderCleared,
+		Amount:          tx.PaymentAmount,
+		ShippingAmount:  tx.Shipping,
+		Items:           tx.Items,
+		BillingAddress:  tx.BillingAddress,
+		ShippingAddress: tx.ShippingAddress,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
 	}
 
-	_, err = app.SaveOrder(order)
-
+	// the transaction, customer and order are stored together, so a failure
+	// leaves nothing behind and resubmitting the form records the order
+	orderID, err := app.DB.Orders.PlaceOrder(ctx, order, txn, customer, models.Actor{Source: "checkout"})
 	if err != nil {
-		app.errorLog.Println(err)
-		return
+		return err
 	}
 
-	app.infoLog.Printf("data: [{%v}]", tx)
+	app.infoLog.Printf(":: Order with ID : %d created ... ", orderID)
 
-	app.Session.Put(r.Context(), "receipt", tx)
-	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+	// take the widgets out of stock; the customer has paid, so a shortfall
+	// is for staff to resolve rather than a reason to lose the order
+	lines := models.Cart{Items: tx.Items}.Lines()
+	err = app.DB.Inventory.CommitReservation(ctx, tx.PaymentIntentID, lines)
+	if errors.Is(err, models.ErrOutOfStock) {
+		app.errorLog.Printf("payment intent %s oversold: %v", tx.PaymentIntentID, err)
+	} else if err != nil {
+		app.errorLog.Println(err)
+	}
 
+	return nil
+}
+
+// paymentRecorded reports whether the transaction of a payment intent is
+// already stored, as it is when a payment form is submitted again
+func (app *application) paymentRecorded(ctx context.Context, paymentIntent string) (bool, error) {
+	_, err := app.DB.Transactions.GetTransactionByPaymentIntent(ctx, paymentIntent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
@@ -226,50 +382,41 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	widgetID, err := strconv.Atoi(id)
 
 	if err != nil {
-		app.errorLog.Println(err)
+		http.NotFound(w, r)
 		return
 	}
 
-	widget, err := app.DB.GetWidget(widgetID)
+	widget, err := app.DB.Widgets.GetWidget(r.Context(), widgetID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
+	cart, err := app.widgetCart(r.Context(), widget)
 	if err != nil {
 		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	data := make(map[string]interface{})
 	data["widget"] = widget
+	data["cart"] = cart
 	if err := app.renderTemplate(w, r, "buy-one", &templateData{
 		Data: data,
-	}, "stripe-js"); err != nil {
+	}, "stripe-js", "address-fields"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
-func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+func (app *application) SaveTransaction(ctx context.Context, txn models.Transaction) (int, error) {
+	id, err := app.DB.Transactions.InsertTransaction(ctx, txn)
 	if err != nil {
 		return 0, err
 	}
@@ -277,9 +424,10 @@ func (app *application) SaveOrder(order models.Order) (int, error) {
 }
 
 func (app *application) RenderBronzePlan(w http.ResponseWriter, r *http.Request) {
-	widget, err := app.DB.GetWidget(2)
+	widget, err := app.DB.Widgets.GetWidget(r.Context(), 2)
 	if err != nil {
-		app.errorLog.Printf("%v", err)
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	data := make(map[string]interface{})
@@ -303,3 +451,580 @@ func (app *application) LoginPage(w http.ResponseWriter, r *http.Request) {
 		app.errorLog.Print(err)
 	}
 }
+
+// PostLoginPage checks the submitted credentials against the users table and
+// starts an authenticated session
+func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	email := r.Form.Get("email")
+	password := r.Form.Get("password")
+
+	v := validator.New()
+	v.Check(validator.IsEmail(email), "email", "must be a valid email address")
+	v.Check(validator.NotBlank(password), "password", "must be provided")
+	if !v.Valid() {
+		app.failedValidation(w, r, "login", &templateData{}, v)
+		return
+	}
+
+	id, err := app.DB.Users.Authenticate(r.Context(), email, password)
+	if errors.Is(err, models.ErrInvalidCredentials) {
+		w.WriteHeader(http.StatusUnauthorized)
+		if err := app.renderTemplate(w, r, "login", &templateData{Error: "Invalid email or password"}); err != nil {
+			app.errorLog.Println(err)
+		}
+		return
+	}
+
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	tf, err := app.DB.Users.GetTwoFactor(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// a fresh session token on every privilege change prevents session fixation
+	if err := app.Session.RenewToken(r.Context()); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// the password alone does not log in an enrolled user; they are held
+	// as pending until they supply a code
+	if tf.Enabled {
+		app.Session.Put(r.Context(), "pendingUserID", id)
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	app.completeLogin(w, r, id)
+}
+
+// completeLogin starts the authenticated session for id and sends the user
+// where they were headed
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, id int) {
+	app.Session.Put(r.Context(), "userID", id)
+	// the next page gets a fresh csrf token, so one seen before login is useless
+	app.Session.Remove(r.Context(), "csrfToken")
+
+	redirect := app.Session.PopString(r.Context(), "redirectAfterLogin")
+	if redirect == "" {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// Logout ends the authenticated session
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	if err := app.Session.Destroy(r.Context()); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	if err := app.Session.RenewToken(r.Context()); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// ForgotPassword shows the form that asks the api to mail a reset link
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "forgot-password", &templateData{}); err != nil {
+		app.errorLog.Print(err)
+	}
+}
+
+// ShowResetPassword shows the new password form for a valid reset link
+func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request) {
+	td := &templateData{}
+	link := r.URL.RequestURI()
+
+	err := app.signer.Verify(link)
+	switch {
+	case errors.Is(err, urlsigner.ErrExpired):
+		td.Error = "This reset link has expired, please request a new one"
+	case err != nil:
+		td.Error = "This reset link is not valid"
+	}
+
+	if err == nil {
+		user, err := app.DB.Users.GetUserByEmail(r.Context(), r.URL.Query().Get("email"))
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			td.Error = "This reset link is not valid"
+		case err != nil:
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		case r.URL.Query().Get("fp") != user.PasswordFingerprint():
+			td.Error = "This reset link has already been used, please request a new one"
+		}
+	}
+
+	if td.Error == "" {
+		td.Data = map[string]interface{}{
+			"link":  link,
+			"email": r.URL.Query().Get("email"),
+		}
+	}
+
+	if err := app.renderTemplate(w, r, "reset-password", td); err != nil {
+		app.errorLog.Print(err)
+	}
+}
+
+// TwoFactorLoginPage asks a user who passed the password check for their code
+func (app *application) TwoFactorLoginPage(w http.ResponseWriter, r *http.Request) {
+	if !app.Session.Exists(r.Context(), "pendingUserID") {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.renderTemplate(w, r, "two-factor-login", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// PostTwoFactorLogin completes a pending login with a TOTP or recovery code
+func (app *application) PostTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	id := app.Session.GetInt(r.Context(), "pendingUserID")
+	if id == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	code := r.Form.Get("code")
+
+	v := validator.New()
+	v.Check(validator.NotBlank(code), "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidation(w, r, "two-factor-login", &templateData{}, v)
+		return
+	}
+
+	tf, err := app.DB.Users.GetTwoFactor(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if tf.Locked {
+		app.twoFactorLocked(w, r)
+		return
+	}
+
+	ok, err := app.verifyTwoFactor(r.Context(), id, tf.Secret, code)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		// wrong codes are counted against the user rather than the session,
+		// so logging in again does not earn more guesses
+		locked, err := app.DB.Users.RecordTwoFactorFailure(r.Context(), id)
+		if err != nil {
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if locked {
+			app.twoFactorLocked(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusUnauthorized)
+		if err := app.renderTemplate(w, r, "two-factor-login", &templateData{Error: "Invalid code"}); err != nil {
+			app.errorLog.Println(err)
+		}
+		return
+	}
+
+	if err := app.DB.Users.ClearTwoFactorFailures(r.Context(), id); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.Session.RenewToken(r.Context()); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Remove(r.Context(), "pendingUserID")
+	app.completeLogin(w, r, id)
+}
+
+// twoFactorLocked ends a pending login whose user entered too many wrong
+// codes, sending them back to the login page
+func (app *application) twoFactorLocked(w http.ResponseWriter, r *http.Request) {
+	app.Session.Remove(r.Context(), "pendingUserID")
+	w.WriteHeader(http.StatusTooManyRequests)
+	if err := app.renderTemplate(w, r, "login", &templateData{Error: "Too many incorrect codes, please try again later"}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// verifyTwoFactor checks code as a TOTP code against the encrypted secret
+// and then as one of the user's recovery codes, consuming whichever matched
+func (app *application) verifyTwoFactor(ctx context.Context, userID int, secret, code string) (bool, error) {
+	plain, err := app.encrypter.Decrypt(secret)
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := totp.Validate(plain, code, time.Now()); ok {
+		return app.DB.Users.ConsumeTOTPStep(ctx, userID, step)
+	}
+
+	return app.DB.Users.UseRecoveryCode(ctx, userID, code)
+}
+
+// pendingTOTPSecret returns the plain TOTP secret a user is enrolling with,
+// creating and storing one on first use
+func (app *application) pendingTOTPSecret(ctx context.Context, userID int, tf models.TwoFactor) (string, error) {
+	if tf.Secret != "" {
+		return app.encrypter.Decrypt(tf.Secret)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := app.encrypter.Encrypt(secret)
+	if err != nil {
+		return "", err
+	}
+
+	if err := app.DB.Users.SetPendingTOTPSecret(ctx, userID, sealed); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// totpURI returns the otpauth URI enrolling secret for user
+func totpURI(user models.User, secret string) string {
+	return totp.URI("GoStripe", user.Email, secret)
+}
+
+// TwoFactorSetup shows the enrollment QR code, or the enrollment status of
+// a user who already completed it
+func (app *application) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	id := app.Session.GetInt(r.Context(), "userID")
+
+	user, err := app.DB.Users.GetUser(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	tf, err := app.DB.Users.GetTwoFactor(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["enabled"] = tf.Enabled
+	data["required"] = tf.Required
+
+	if !tf.Enabled {
+		secret, err := app.pendingTOTPSecret(r.Context(), id, tf)
+		if err != nil {
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		data["secret"] = secret
+		data["uri"] = totpURI(user, secret)
+	}
+
+	if err := app.renderTemplate(w, r, "two-factor-setup", &templateData{
+		Data:    data,
+		Warning: app.Session.PopString(r.Context(), "warning"),
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// TwoFactorQRCode renders the otpauth URI of a pending enrollment as a PNG
+func (app *application) TwoFactorQRCode(w http.ResponseWriter, r *http.Request) {
+	id := app.Session.GetInt(r.Context(), "userID")
+
+	user, err := app.DB.Users.GetUser(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	tf, err := app.DB.Users.GetTwoFactor(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// the secret of a completed enrollment is never shown again
+	if tf.Enabled || tf.Secret == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	secret, err := app.encrypter.Decrypt(tf.Secret)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	png, err := qrcode.Encode(totpURI(user, secret), qrcode.Medium, 256)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if _, err := w.Write(png); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// PostTwoFactorSetup completes enrollment once the user proves their
+// authenticator produces valid codes, and shows their recovery codes once
+func (app *application) PostTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	id := app.Session.GetInt(r.Context(), "userID")
+
+	if err := r.ParseForm(); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	tf, err := app.DB.Users.GetTwoFactor(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if tf.Enabled || tf.Secret == "" {
+		http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := app.encrypter.Decrypt(tf.Secret)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	v := validator.New()
+	step, ok := totp.Validate(secret, r.Form.Get("code"), time.Now())
+	v.Check(ok, "code", "does not match your authenticator, check the time on your device")
+	if ok {
+		fresh, err := app.DB.Users.ConsumeTOTPStep(r.Context(), id, step)
+		if err != nil {
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		v.Check(fresh, "code", "has already been used, wait for the next one")
+	}
+
+	if !v.Valid() {
+		user, err := app.DB.Users.GetUser(r.Context(), id)
+		if err != nil {
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		app.failedValidation(w, r, "two-factor-setup", &templateData{Data: map[string]interface{}{
+			"required": tf.Required,
+			"secret":   secret,
+			"uri":      totpURI(user, secret),
+		}}, v)
+		return
+	}
+
+	codes, err := models.GenerateRecoveryCodes()
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.DB.Users.EnableTOTP(r.Context(), id, codes); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.renderTemplate(w, r, "two-factor-setup", &templateData{
+		Flash: "Two-factor authentication is enabled",
+		Data: map[string]interface{}{
+			"enabled":        true,
+			"required":       tf.Required,
+			"recovery_codes": codes,
+		},
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// PostResetTwoFactor removes the two-factor enrollment of a user who lost
+// their authenticator, so they enroll again at their next login
+func (app *application) PostResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := app.DB.Users.ResetTOTP(r.Context(), userID); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	app.infoLog.Printf("two-factor authentication of user %d reset by user %d", userID, app.Session.GetInt(r.Context(), "userID"))
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication reset")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// Forbidden tells a logged in user they lack the permission a page requires
+func (app *application) Forbidden(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	if err := app.renderTemplate(w, r, "forbidden", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// CSRFFailed explains a form post rejected for a missing or wrong csrf token
+func (app *application) CSRFFailed(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	if err := app.renderTemplate(w, r, "forbidden", &templateData{
+		Error: "This form has expired or was submitted from another site. Go back, reload the page and try again.",
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AdminUsers lists every user with their roles for assignment
+func (app *application) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.DB.Users.AllUsers(r.Context())
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	roles, err := app.DB.Users.AllRoles(r.Context())
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// assigned is keyed by "<user id>:<role id>" so the template can tick checkboxes
+	assigned := make(map[string]bool)
+	for _, u := range users {
+		for _, role := range u.Roles {
+			assigned[fmt.Sprintf("%d:%d", u.ID, role.ID)] = true
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["users"] = users
+	data["roles"] = roles
+	data["assigned"] = assigned
+	data["self"] = app.Session.GetInt(r.Context(), "userID")
+
+	if err := app.renderTemplate(w, r, "admin-users", &templateData{
+		Data:  data,
+		Flash: app.Session.PopString(r.Context(), "flash"),
+		Error: app.Session.PopString(r.Context(), "error"),
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// PostUserRoles replaces the roles of a user with the ticked checkboxes
+func (app *application) PostUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// an admin removing their own admin role could lock everyone out
+	if userID == app.Session.GetInt(r.Context(), "userID") {
+		app.Session.Put(r.Context(), "error", "You cannot change your own roles")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	roles, err := app.DB.Users.AllRoles(r.Context())
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	known := make(map[int]bool)
+	for _, role := range roles {
+		known[role.ID] = true
+	}
+
+	var roleIDs []int
+	for _, value := range r.Form["role_id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil || !known[id] {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		roleIDs = append(roleIDs, id)
+	}
+
+	if err := app.DB.Users.SetUserRoles(r.Context(), userID, roleIDs); err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Roles updated")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/rbac"
+)
+
+func TestLogin(t *testing.T) {
+	app, store := newTestApplication(t)
+	addStaff(t, store, "admin@example.com", rbac.ViewReports)
+	c := newTestClient(t, app.routes())
+
+	status, _, body := c.postForm("/login", url.Values{"email": {"admin@example.com"}, "password": {"wrong password"}})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", status)
+	}
+	mustContain(t, body, "Invalid email or password")
+
+	// the login page sends the user back to the page that asked for it
+	status, header, _ := c.get("/admin/orders")
+	if status != http.StatusSeeOther || header.Get("Location") != "/login" {
+		t.Fatalf("anonymous admin page: status %d to %q", status, header.Get("Location"))
+	}
+	status, header, _ = c.postForm("/login", url.Values{"email": {"admin@example.com"}, "password": {"password"}})
+	if status != http.StatusSeeOther || header.Get("Location") != "/admin/orders" {
+		t.Fatalf("login: status %d to %q", status, header.Get("Location"))
+	}
+
+	status, _, body = c.get("/admin/orders")
+	if status != http.StatusOK {
+		t.Fatalf("admin orders after login: status %d", status)
+	}
+	mustContain(t, body, "No orders match")
+}
+
+func TestAdminPagesCheckPermissions(t *testing.T) {
+	app, store := newTestApplication(t)
+	addStaff(t, store, "clerk@example.com")
+	c := newTestClient(t, app.routes())
+	c.login("clerk@example.com")
+
+	for _, path := range []string{"/admin/orders", "/admin/widgets", "/admin/users", "/virtual-terminal"} {
+		if status, _, _ := c.get(path); status != http.StatusForbidden {
+			t.Errorf("%s: status %d, want %d", path, status, http.StatusForbidden)
+		}
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := addStaff(t, store, "admin@example.com", rbac.ViewReports)
+	secret := enrollTOTP(t, app, store, id)
+	c := newTestClient(t, app.routes())
+
+	wrong := url.Values{"code": {"not a code"}}
+	c.login("admin@example.com")
+	for i := 1; i < models.MaxTwoFactorAttempts; i++ {
+		if status, _, _ := c.postForm("/login/two-factor", wrong); status != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status %d", i, status)
+		}
+	}
+
+	// logging in again does not reset the count
+	c.login("admin@example.com")
+	status, _, body := c.postForm("/login/two-factor", wrong)
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("last wrong code: status %d", status)
+	}
+	mustContain(t, body, "Too many incorrect codes")
+
+	c.login("admin@example.com")
+	if status, _, _ := c.postForm("/login/two-factor", url.Values{"code": {currentCode(t, secret)}}); status != http.StatusTooManyRequests {
+		t.Errorf("right code while locked: status %d", status)
+	}
+	if status, _, _ := c.get("/admin/orders"); status != http.StatusSeeOther {
+		t.Errorf("admin page while locked: status %d", status)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5})
+	c := newTestClient(t, app.routes())
+
+	form := url.Values{"widget_id": {strconv.Itoa(id)}, "quantity": {"1"}, "csrf_token": {"forged"}}
+	if status, _, _ := c.postForm("/cart/items", form); status != http.StatusForbidden {
+		t.Errorf("forged token: status %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestCart(t *testing.T) {
+	app, store := newTestApplication(t)
+	gizmo := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5})
+	plan := store.AddWidget(models.Widget{Name: "Bronze plan", Price: 2000, IsRecurring: true, PlanID: "price_bronze"})
+	store.AddShippingRate(models.ShippingRate{Name: "Standard", Kind: models.RateFlat, Amount: 500})
+	c := newTestClient(t, app.routes())
+
+	status, header, _ := c.postForm("/cart/items", url.Values{"widget_id": {strconv.Itoa(gizmo)}, "quantity": {"2"}})
+	if status != http.StatusSeeOther || header.Get("Location") != "/cart" {
+		t.Fatalf("add to cart: status %d to %q", status, header.Get("Location"))
+	}
+	_, _, body := c.get("/cart")
+	mustContain(t, body, "Added Gizmo to your cart", "$ 20.00", "$ 5.00", "$ 25.00", `name="amount" id="amount" value="2500"`)
+
+	c.postForm("/cart/items", url.Values{"widget_id": {strconv.Itoa(plan)}, "quantity": {"1"}})
+	_, _, body = c.get("/cart")
+	mustContain(t, body, "Bronze plan is a subscription and cannot be added to the cart")
+
+	c.postForm("/cart/items/"+strconv.Itoa(gizmo)+"/delete", url.Values{})
+	_, _, body = c.get("/cart")
+	mustContain(t, body, "Your cart is empty")
+}
+
+func TestEditWidgetKeepsSales(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5})
+	addStaff(t, store, "admin@example.com", rbac.ManageCatalog)
+	c := newTestClient(t, app.routes())
+	c.login("admin@example.com")
+
+	path := "/admin/widgets/" + strconv.Itoa(id)
+	_, _, body := c.get(path)
+	mustContain(t, body, `name="inventory_seen" value="5"`)
+
+	// two units sell while the form is open
+	sell := func(reference string, quantity int) {
+		t.Helper()
+		if err := store.CommitReservation(context.Background(), reference, []models.CartLine{{WidgetID: id, Quantity: quantity}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sell("pi_first", 2)
+
+	form := func(level, seen int) url.Values {
+		return url.Values{"name": {"Gizmo"}, "price": {"12.50"}, "inventory_level": {strconv.Itoa(level)}, "inventory_seen": {strconv.Itoa(seen)}}
+	}
+	inventory := func() int {
+		t.Helper()
+		w, err := store.GetWidget(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.InventoryLevel
+	}
+
+	if status, _, _ := c.postForm(path, form(5, 5)); status != http.StatusSeeOther {
+		t.Fatalf("unchanged inventory: status %d", status)
+	}
+	if n := inventory(); n != 3 {
+		t.Errorf("after saving an unchanged level: inventory %d, want the 3 left", n)
+	}
+
+	if status, _, _ := c.postForm(path, form(10, 5)); status != http.StatusSeeOther {
+		t.Fatalf("added stock: status %d", status)
+	}
+	if n := inventory(); n != 8 {
+		t.Errorf("after adding 5 units: inventory %d, want 8", n)
+	}
+
+	// clearing the 8 seen after 6 more sold would take the level below zero
+	sell("pi_second", 6)
+	status, _, body := c.postForm(path, form(0, 8))
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("removing more than is left: status %d", status)
+	}
+	mustContain(t, body, "removes more units than are left", `name="inventory_seen" value="8"`)
+	if n := inventory(); n != 2 {
+		t.Errorf("after a rejected edit: inventory %d, want 2", n)
+	}
+}
+
+func TestRecordOrderOnce(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5})
+
+	tx := TransactionData{
+		FirstName:       "Ada",
+		LastName:        "Lovelace",
+		Email:           "ada@example.com",
+		PaymentIntentID: "pi_once",
+		PaymentMethodID: "pm_once",
+		PaymentAmount:   2000,
+		PaymentCurrency: "usd",
+		Items:           []models.OrderItem{{WidgetID: id, Name: "Gizmo", Quantity: 2, Price: 1000, Amount: 2000}},
+	}
+
+	// the payment form is submitted twice for one payment intent
+	for i := 0; i < 2; i++ {
+		if err := app.recordOrder(context.Background(), tx); err != nil {
+			t.Fatalf("recording %d: %v", i+1, err)
+		}
+	}
+
+	orders, _, err := store.ListOrders(context.Background(), models.OrderFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 {
+		t.Errorf("%d orders, want 1", len(orders))
+	}
+	w, err := store.GetWidget(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.InventoryLevel != 3 {
+		t.Errorf("inventory %d, want 3", w.InventoryLevel)
+	}
+
+	txn, err := store.GetTransactionByPaymentIntent(context.Background(), "pi_once")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.PaymentMethod != "pm_once" {
+		t.Errorf("payment method %q, want pm_once", txn.PaymentMethod)
+	}
+}
+
+// failingOrders fails the next order placed while fail is set, as a
+// database error part way through the checkout would
+type failingOrders struct {
+	models.OrderRepository
+	fail bool
+}
+
+func (o *failingOrders) PlaceOrder(ctx context.Context, order models.Order, txn models.Transaction, customer models.Customer, by models.Actor) (int, error) {
+	if o.fail {
+		o.fail = false
+		return 0, errors.New("connection reset")
+	}
+	return o.OrderRepository.PlaceOrder(ctx, order, txn, customer, by)
+}
+
+func TestRecordOrderAfterFailedSave(t *testing.T) {
+	app, store := newTestApplication(t)
+	id := store.AddWidget(models.Widget{Name: "Gizmo", Price: 1000, InventoryLevel: 5})
+	app.DB.Orders = &failingOrders{OrderRepository: store, fail: true}
+
+	tx := TransactionData{
+		FirstName:       "Ada",
+		LastName:        "Lovelace",
+		Email:           "ada@example.com",
+		PaymentIntentID: "pi_retry",
+		PaymentMethodID: "pm_retry",
+		PaymentAmount:   2000,
+		PaymentCurrency: "usd",
+		Items:           []models.OrderItem{{WidgetID: id, Name: "Gizmo", Quantity: 2, Price: 1000, Amount: 2000}},
+	}
+
+	if err := app.recordOrder(context.Background(), tx); err == nil {
+		t.Fatal("recording with a failing save: no error")
+	}
+	if _, err := store.GetTransactionByPaymentIntent(context.Background(), "pi_retry"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("transaction after the failed save: err = %v, want none recorded", err)
+	}
+
+	// the customer submits the payment form again
+	if err := app.recordOrder(context.Background(), tx); err != nil {
+		t.Fatalf("resubmitting: %v", err)
+	}
+
+	txn, err := store.GetTransactionByPaymentIntent(context.Background(), "pi_retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, _, err := store.ListOrders(context.Background(), models.OrderFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 {
+		t.Fatalf("%d orders, want 1", len(orders))
+	}
+	order, err := store.GetOrder(context.Background(), orders[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.TransactionID != txn.ID || order.Amount != 2000 {
+		t.Errorf("order = %+v, want 2000 paid by transaction %d", order, txn.ID)
+	}
+	if _, err := store.GetCustomer(context.Background(), order.CustomerID); err != nil {
+		t.Errorf("customer %d: %v", order.CustomerID, err)
+	}
+	w, err := store.GetWidget(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.InventoryLevel != 3 {
+		t.Errorf("inventory %d, want 3", w.InventoryLevel)
+	}
+}
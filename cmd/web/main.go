@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
-	"text/template"
+	"strings"
 	"time"
 
+	"github.com/alexedwards/scs/mysqlstore"
+	"github.com/alexedwards/scs/sqlite3store"
 	"github.com/alexedwards/scs/v2"
+	"github.com/caleberi/gostripe/internal/config"
 	"github.com/caleberi/gostripe/internal/driver"
+	"github.com/caleberi/gostripe/internal/encryption"
+	"github.com/caleberi/gostripe/internal/migrate"
 	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/storage"
+	"github.com/caleberi/gostripe/internal/urlsigner"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 const version = "1.0.0"
@@ -20,33 +32,24 @@ const cssVersion = "1"
 
 var session *scs.SessionManager
 
-type config struct {
-	port int
-	env  string
-	api  string
-	db   struct {
-		dns string
-	}
-	stripe struct {
-		key    string
-		secret string
-	}
-}
-
 type application struct {
-	config        config
+	config        config.Config
 	infoLog       *log.Logger
 	errorLog      *log.Logger
 	templateCache map[string]*template.Template
 	version       string
-	DB            models.DBModel
+	DB            models.Models
 	Session       *scs.SessionManager
+	signer        *urlsigner.Signer
+	encrypter     *encryption.Encrypter
+	live          *config.Live
+	images        storage.Images
 }
 
 func (app *application) serve() error {
 
 	srv := &http.Server{
-		Addr:              fmt.Sprintf(":%d", app.config.port),
+		Addr:              fmt.Sprintf(":%d", app.config.Web.Port),
 		Handler:           app.routes(),
 		ReadTimeout:       10 * time.Second,
 		IdleTimeout:       30 * time.Second,
@@ -54,54 +57,204 @@ func (app *application) serve() error {
 		WriteTimeout:      5 * time.Second,
 	}
 
-	app.infoLog.Printf("starting http server on port %[1]d with url: http://localhost:%[1]d  ...", app.config.port)
+	app.infoLog.Printf("starting http server on port %[1]d with url: http://localhost:%[1]d  ...", app.config.Web.Port)
 	return srv.ListenAndServe()
 }
 
 func main() {
 	gob.Register(TransactionData{})
+	gob.Register([]models.CartLine{})
 
-	var cfg config
-
-	flag.IntVar(&cfg.port, "port", 3000, "📌 app server port")
-	flag.StringVar(&cfg.env, "environment", "development", "📌 application runtime environment")
-	flag.StringVar(&cfg.api, "api", "http://localhost:4001", "📌 api endpoint entry for application")
-	flag.StringVar(&cfg.db.dns, "dsn", "root:root@tcp(localhost:3306)/gostripe?parseTime=true&tls=false", "📌 database domain service name (DSN)")
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		printConfig(os.Args[3:])
+		return
+	}
 
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
 
-	cfg.stripe.key = os.Getenv("STRIPE_KEY")
-	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg, err := config.Load("web", os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalln(err)
+	}
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
-	conn, err := driver.OpenDB(cfg.db.dns)
+	warnings, err := cfg.Validate()
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	for _, w := range warnings {
+		infoLog.Println(w)
+	}
+
+	infoLog.Printf("config: %s", cfg.Redacted())
 
+	live := config.NewLive(*cfg)
+	live.ReloadOnSIGHUP(infoLog, errorLog)
+
+	// connect to the primary and replicas, dialing with the current password
+	// so a rotated DB_PASSWORD_FILE applies to new connections
+	db, err := live.OpenDB()
 	if err != nil {
 		errorLog.Fatal(err)
 	}
+	defer db.Close()
 
-	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go db.Watch(ctx, time.Duration(cfg.DB.HealthInterval), infoLog.Printf)
+
+	if cfg.DB.Migrate {
+		m, err := migrate.New(db.Primary, db.Dialect)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		m.Log = infoLog.Printf
+		if _, err := m.Up(context.Background()); err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	session, err = newSessionManager(cfg.Web.Session, db.Primary, db.Dialect)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	if store, ok := session.Store.(interface{ StopCleanup() }); ok {
+		defer store.StopCleanup()
+	}
 
-	session = scs.New()
-	session.Lifetime = 24 * time.Hour
+	if cfg.Env == "production" && !cfg.Web.Session.Cookie.Secure {
+		infoLog.Println("-cookie-secure is off, session cookies will be sent over plain http")
+	}
 
 	tc := make(map[string]*template.Template)
 
 	app := &application{
-		config:        cfg,
+		config:        *cfg,
 		templateCache: tc,
 		infoLog:       infoLog,
 		errorLog:      errorLog,
 		version:       version,
-		DB: models.DBModel{
-			DB: conn,
-		},
-		Session: session,
+		DB: models.NewModels(&models.DBModel{
+			DB:       db.Primary,
+			Dialect:  db.Dialect,
+			Reads:    db,
+			Timeout:  time.Duration(cfg.DB.QueryTimeout),
+			Observer: models.LogQueries(infoLog, time.Duration(cfg.DB.SlowQuery), middleware.GetReqID),
+		}),
+		Session:   session,
+		signer:    &urlsigner.Signer{Secret: []byte(cfg.SigningKey)},
+		encrypter: &encryption.Encrypter{Key: []byte(cfg.EncryptionKey)},
+		live:      live,
+		images:    storage.Images{Dir: cfg.Images.Dir, MaxSize: cfg.Images.MaxSize},
 	}
 
 	if err := app.serve(); err != nil {
 		app.errorLog.Fatalln(err)
 	}
 }
+
+// newSessionManager builds the session manager described by cfg. The
+// database store shares sessions between web replicas and survives restarts.
+func newSessionManager(cfg config.Session, db *sql.DB, dialect driver.Dialect) (*scs.SessionManager, error) {
+	sm := scs.New()
+	sm.Lifetime = time.Duration(cfg.Lifetime)
+	sm.Cookie.Name = cfg.Cookie.Name
+	sm.Cookie.Domain = cfg.Cookie.Domain
+	sm.Cookie.Secure = cfg.Cookie.Secure
+	sm.Cookie.HttpOnly = cfg.Cookie.HTTPOnly
+
+	switch strings.ToLower(cfg.Cookie.SameSite) {
+	case "lax":
+		sm.Cookie.SameSite = http.SameSiteLaxMode
+	case "strict":
+		sm.Cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers reject SameSite=None cookies that are not also Secure
+		if !cfg.Cookie.Secure {
+			return nil, errors.New("-cookie-samesite none requires -cookie-secure")
+		}
+		sm.Cookie.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unknown -cookie-samesite %q", cfg.Cookie.SameSite)
+	}
+
+	switch cfg.Store {
+	case "database", "mysql": // mysql was the only store before other databases were supported
+		switch dialect {
+		case driver.Postgres:
+			sm.Store = newPostgresStore(db, time.Duration(cfg.Cleanup))
+		case driver.SQLite:
+			sm.Store = sqlite3store.NewWithCleanupInterval(db, time.Duration(cfg.Cleanup))
+		default:
+			sm.Store = mysqlstore.NewWithCleanupInterval(db, time.Duration(cfg.Cleanup))
+		}
+	case "memory":
+	default:
+		return nil, fmt.Errorf("unknown -session-store %q", cfg.Store)
+	}
+
+	return sm, nil
+}
+
+// stripeKeys returns the current stripe keys, which a SIGHUP may have rotated
+func (app *application) stripeKeys() (key, secret string) {
+	cfg := app.live.Config()
+	return cfg.Stripe.Key, string(cfg.Stripe.Secret)
+}
+
+// printConfig implements `web config print`, which writes the effective
+// settings with secrets masked
+func printConfig(args []string) {
+	cfg, err := config.Load("web", args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalln(err)
+	}
+	if err := cfg.Print(os.Stdout); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runMigrate implements `web migrate`, which applies or reverts the embedded
+// migrations and exits
+func runMigrate(args []string) {
+	command, flags, err := migrate.ParseCommand(args)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	cfg, err := config.Load("web", flags)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalln(err)
+	}
+
+	conn, err := driver.OpenDB(cfg.DataSourceName())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+
+	m, err := migrate.New(conn, cfg.DB.Dialect)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	m.Log = log.Printf
+
+	if err := m.Run(context.Background(), os.Stdout, command); err != nil {
+		log.Fatalln(err)
+	}
+}
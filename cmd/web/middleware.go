@@ -1,7 +1,150 @@
 package main
 
-import "net/http"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/caleberi/gostripe/internal/rbac"
+)
 
 func SessionLoader(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
+
+// Auth redirects anonymous visitors to the login page, remembering where
+// they were headed for a GET request
+func (app *application) Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.IsAuthenticated(r) {
+			if r.Method == http.MethodGet {
+				app.Session.Put(r.Context(), "redirectAfterLogin", r.URL.RequestURI())
+			}
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		// authenticated pages must never be served from a shared cache
+		w.Header().Add("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IsAuthenticated reports whether the request belongs to a logged in user
+func (app *application) IsAuthenticated(r *http.Request) bool {
+	return app.Session.Exists(r.Context(), "userID")
+}
+
+// requirePermission serves the forbidden page to logged in users without
+// perm. It must run after Auth.
+func (app *application) requirePermission(perm rbac.Permission) func(http.Handler) http.Handler {
+	user := func(r *http.Request) (int, bool) {
+		id := app.Session.GetInt(r.Context(), "userID")
+		return id, id != 0
+	}
+
+	return rbac.Require(app.DB.Users, user, rbac.Handlers{
+		Unauthenticated: http.RedirectHandler("/login", http.StatusSeeOther),
+		Forbidden:       http.HandlerFunc(app.Forbidden),
+		Error: func(w http.ResponseWriter, r *http.Request, err error) {
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		},
+	}, perm)
+}
+
+// RequireTwoFactor sends users whose role requires two-factor authentication
+// to enrollment until they complete it. It must run after Auth.
+func (app *application) RequireTwoFactor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tf, err := app.DB.Users.GetTwoFactor(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+		if err != nil {
+			app.errorLog.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if tf.Required && !tf.Enabled {
+			app.Session.Put(r.Context(), "warning", "Your role requires two-factor authentication, please enroll to continue")
+			http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// form body limits: maxFormBytes is allowed on top of the largest image
+// upload, and multipart parts past maxFormMemory are spooled to disk
+const (
+	maxFormBytes  = 1 << 20
+	maxFormMemory = 8 << 20
+)
+
+// csrfExempt lists path prefixes whose POSTs come from other servers rather
+// than our forms. Stripe webhooks authenticate with their signature header.
+var csrfExempt = []string{"/webhooks/"}
+
+// CSRF rejects state-changing requests that do not echo the session's
+// synchronizer token in the csrf_token form field or the X-CSRF-Token header.
+// It must run after SessionLoader.
+func (app *application) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, prefix := range csrfExempt {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		// forms are small apart from image uploads, which get their own check
+		r.Body = http.MaxBytesReader(w, r.Body, app.config.Images.MaxSize+maxFormBytes)
+
+		want := app.Session.GetString(r.Context(), "csrfToken")
+		got := r.Header.Get("X-CSRF-Token")
+		if got == "" {
+			err := r.ParseMultipartForm(maxFormMemory)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			got = r.PostFormValue("csrf_token")
+		}
+
+		if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			app.infoLog.Printf("csrf token mismatch on %s %s", r.Method, r.URL.Path)
+			app.CSRFFailed(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken returns the synchronizer token of the session, creating it on first use
+func (app *application) csrfToken(r *http.Request) string {
+	token := app.Session.GetString(r.Context(), "csrfToken")
+	if token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		app.errorLog.Println(err)
+		return ""
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	app.Session.Put(r.Context(), "csrfToken", token)
+	return token
+}
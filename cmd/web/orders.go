@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// AdminOrders lists orders newest first with filters, one page at a time
+func (app *application) AdminOrders(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	v := validator.New()
+	filter := models.ParseOrderFilter(q, v)
+
+	td := &templateData{
+		Flash: app.Session.PopString(r.Context(), "flash"),
+		Error: app.Session.PopString(r.Context(), "error"),
+	}
+	if !v.Valid() {
+		// show the latest orders rather than an error page for a bad link
+		td.FieldErrors = v.Errors
+		filter = models.OrderFilter{}
+	}
+
+	orders, metadata, err := app.DB.Orders.ListOrders(r.Context(), filter)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	statuses, err := app.DB.Orders.AllStatuses(r.Context())
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["orders"] = orders
+	data["statuses"] = statuses
+	data["fulfillments"] = []models.Fulfillment{models.Unfulfilled, models.Shipped, models.Delivered}
+	data["filter"] = filter
+	if filter.Cursor != "" {
+		data["firstPage"] = withQuery(q, "cursor", "")
+	}
+	if metadata.NextCursor != "" {
+		data["nextPage"] = withQuery(q, "cursor", metadata.NextCursor)
+	}
+	td.Data = data
+
+	if err := app.renderTemplate(w, r, "admin-orders", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AdminOrder shows an order with its items, customer, payment, addresses,
+// fulfillment and status history
+func (app *application) AdminOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	app.renderOrder(w, r, id, nil)
+}
+
+// PostOrderFulfillment marks an order shipped with the tracking number in
+// the form, or delivered
+func (app *application) PostOrderFulfillment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	update := models.FulfillmentUpdate{
+		Status:         models.Fulfillment(r.PostFormValue("status")),
+		TrackingNumber: strings.TrimSpace(r.PostFormValue("tracking_number")),
+	}
+	v := validator.New()
+	update.Validate(v)
+	if !v.Valid() {
+		app.renderOrder(w, r, id, v)
+		return
+	}
+
+	err = app.DB.Orders.UpdateFulfillment(r.Context(), id, update)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, models.ErrIllegalTransition):
+		app.Session.Put(r.Context(), "error", "This order cannot be marked "+string(update.Status)+" now; it may have changed since you opened it")
+	case err != nil:
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	default:
+		app.infoLog.Printf("order %d marked %s by user %d", id, update.Status, app.Session.GetInt(r.Context(), "userID"))
+		app.Session.Put(r.Context(), "flash", "Order marked "+string(update.Status))
+	}
+	http.Redirect(w, r, "/admin/orders/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// renderOrder shows the order with id, with the errors in v when it is not
+// nil
+func (app *application) renderOrder(w http.ResponseWriter, r *http.Request, id int, v *validator.Validator) {
+	order, err := app.DB.Orders.GetOrderSummary(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["order"] = order
+
+	td := &templateData{
+		Flash: app.Session.PopString(r.Context(), "flash"),
+		Error: app.Session.PopString(r.Context(), "error"),
+		Data:  data,
+	}
+	if v != nil {
+		app.failedValidation(w, r, "admin-order", td, v)
+		return
+	}
+	if err := app.renderTemplate(w, r, "admin-order", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
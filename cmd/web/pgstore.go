@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// postgresStore keeps sessions in the sessions table of a Postgres database.
+// It implements scs.Store over database/sql, which the scs postgres store
+// does not support with the pgx driver.
+type postgresStore struct {
+	db          *sql.DB
+	stopCleanup chan bool
+}
+
+// newPostgresStore returns a store that deletes expired sessions every
+// cleanupInterval, or never when it is 0
+func newPostgresStore(db *sql.DB, cleanupInterval time.Duration) *postgresStore {
+	s := &postgresStore{db: db}
+	if cleanupInterval > 0 {
+		s.stopCleanup = make(chan bool)
+		go s.startCleanup(cleanupInterval)
+	}
+	return s
+}
+
+// Find returns the data of an unexpired session
+func (s *postgresStore) Find(token string) ([]byte, bool, error) {
+	var b []byte
+	err := s.db.QueryRow(`SELECT data FROM sessions WHERE token = $1 AND current_timestamp < expiry`, token).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Commit adds or replaces a session
+func (s *postgresStore) Commit(token string, b []byte, expiry time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry`, token, b, expiry)
+	return err
+}
+
+// Delete removes a session
+func (s *postgresStore) Delete(token string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token = $1`, token)
+	return err
+}
+
+func (s *postgresStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.db.Exec(`DELETE FROM sessions WHERE expiry < current_timestamp`); err != nil {
+				log.Println(err)
+			}
+		case <-s.stopCleanup:
+			return
+		}
+	}
+}
+
+// StopCleanup stops the background cleanup
+func (s *postgresStore) StopCleanup() {
+	if s.stopCleanup != nil {
+		s.stopCleanup <- true
+	}
+}
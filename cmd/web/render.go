@@ -3,9 +3,11 @@ package main
 import (
 	"embed"
 	"fmt"
+	"html/template"
 	"net/http"
+	"net/url"
 	"strings"
-	"text/template"
+	"time"
 )
 
 type templateData struct {
@@ -17,12 +19,17 @@ type templateData struct {
 	Warning              string
 	CSRFToken            string
 	IsAuthenticated      bool
+	Permissions          map[string]bool
 	Error                string
+	FieldErrors          map[string]string
 	CSSVersion           string
 	AppVersion           string
 	API                  string
-	StripeSecretKey      string
 	StripePublishableKey string
+	// Currency is the ISO 4217 code widgets are priced and charged in
+	Currency string
+	// CartUnits is the number of units in the visitor's cart
+	CartUnits int
 }
 
 var functions = template.FuncMap{
@@ -30,15 +37,133 @@ var functions = template.FuncMap{
 		f := float32(val) / float32(100)
 		return fmt.Sprintf("$ %.2f", f)
 	},
+	"formatAmount":       formatAmount,
+	"formatCurrencyCode": formatCurrencyCode,
+	"formatDate":         formatDate,
+	"formatDateTime":     formatDateTime,
+	"pluralize":          pluralize,
+	"safeURL":            safeURL,
+	"staticURL":          staticURL,
+	"trustedHTML":        trustedHTML,
+	"widgetImage":        widgetImage,
+}
+
+// formatAmount formats cents as a plain decimal amount such as "10.50",
+// the way staff type prices into forms
+func formatAmount(cents int) string {
+	return fmt.Sprintf("%.2f", float64(cents)/100)
+}
+
+// formatCurrencyCode formats amount, given in the smallest unit of the ISO
+// 4217 currency code as stripe stores it, e.g. 1050 usd as "$10.50"
+func formatCurrencyCode(amount int, code string) string {
+	code = strings.ToUpper(code)
+
+	decimals := 2
+	switch code {
+	case "BIF", "CLP", "DJF", "GNF", "JPY", "KMF", "KRW", "MGA", "PYG", "RWF", "UGX", "VND", "VUV", "XAF", "XOF", "XPF":
+		decimals = 0
+	case "BHD", "JOD", "KWD", "OMR", "TND":
+		decimals = 3
+	}
+
+	value := float64(amount)
+	for i := 0; i < decimals; i++ {
+		value /= 10
+	}
+
+	if symbol, ok := currencySymbols[code]; ok {
+		return fmt.Sprintf("%s%.*f", symbol, decimals, value)
+	}
+	return fmt.Sprintf("%s %.*f", code, decimals, value)
+}
+
+// currencySymbols holds the symbols of the currencies we commonly charge in;
+// others are prefixed with their code
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"CAD": "CA$",
+	"AUD": "A$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"NGN": "₦",
+	"INR": "₹",
+}
+
+// formatDate formats t as a date such as "19 Oct 2026", or nothing for the zero time
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("02 Jan 2006")
+}
+
+// formatDateTime formats t as a UTC date and time such as "19 Oct 2026 at 14:05 UTC"
+func formatDateTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("02 Jan 2006 at 15:04 MST")
+}
+
+// pluralize returns n followed by singular or plural to agree with it, e.g. "3 widgets"
+func pluralize(n int, singular, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
+// safeURL passes relative, http, https and mailto URLs through unchanged
+// and replaces anything else, such as a javascript: URL, with "#"
+func safeURL(raw string) template.URL {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "#"
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return template.URL(u.String())
+	}
+	return "#"
+}
+
+// staticURL returns the URL of a file under /static with the css version
+// appended, so a release invalidates cached copies
+func staticURL(path string) string {
+	return "/static/" + strings.TrimPrefix(path, "/") + "?v=" + url.QueryEscape(cssVersion)
+}
+
+// trustedHTML renders s without escaping. Only use it for HTML authored by
+// staff, such as widget descriptions; never for anything a customer typed.
+func trustedHTML(s string) template.HTML {
+	return template.HTML(s)
 }
 
 //go:embed templates
 var templateFS embed.FS
 
 func (app *application) addDefaultData(td *templateData, r *http.Request) *templateData {
-	td.API = app.config.api
-	td.StripePublishableKey = app.config.stripe.key
-	td.StripeSecretKey = app.config.stripe.secret
+	td.API = app.config.Web.API
+	td.StripePublishableKey, _ = app.stripeKeys()
+	td.Currency = app.config.Store.Currency
+	td.IsAuthenticated = app.IsAuthenticated(r)
+	td.CSRFToken = app.csrfToken(r)
+	for _, l := range app.cartLines(r.Context()) {
+		td.CartUnits += l.Quantity
+	}
+	td.Permissions = make(map[string]bool)
+	if td.IsAuthenticated {
+		perms, err := app.DB.Users.PermissionsForUser(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		for _, p := range perms {
+			td.Permissions[p] = true
+		}
+	}
 	return td
 }
 
@@ -47,7 +172,7 @@ func (app *application) renderTemplate(w http.ResponseWriter, r *http.Request, p
 	var err error
 	templateToRender := fmt.Sprintf("templates/%s.gohtml", page)
 	_, exist := app.templateCache[templateToRender]
-	if app.config.env == "production" && exist {
+	if app.config.Env == "production" && exist {
 		t = app.templateCache[templateToRender]
 	} else {
 		t, err = app.parseTemplate(partials, page, templateToRender)
@@ -74,29 +199,15 @@ func (app *application) parseTemplate(partials []string, page, templateToRender
 	var t *template.Template
 	var err error
 
-	// building partials
-	if len(partials) > 0 {
-		for i, p := range partials {
-			partials[i] = fmt.Sprintf("templates/partials/%s.gohtml", p)
-		}
+	// base first, then the partials, then the page that uses them
+	patterns := []string{"templates/base.gohtml"}
+	for _, p := range partials {
+		patterns = append(patterns, fmt.Sprintf("templates/partials/%s.gohtml", p))
 	}
+	patterns = append(patterns, templateToRender)
 
 	path := fmt.Sprintf("%s.gohtml", page)
-	if len(partials) > 0 {
-		t, err = template.New(path).Funcs(functions).ParseFS(
-			templateFS,
-			"templates/base.gohtml",
-			strings.Join(partials, ","),
-			templateToRender,
-		)
-	} else {
-		t, err = template.New(path).Funcs(functions).ParseFS(
-			templateFS,
-			"templates/base.gohtml",
-			templateToRender,
-		)
-	}
-
+	t, err = template.New(path).Funcs(functions).ParseFS(templateFS, patterns...)
 	if err != nil {
 		app.errorLog.Println(err)
 		return nil, err
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/models/memory"
+	"github.com/caleberi/gostripe/internal/rbac"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// volatile matches the parts of a page that change from run to run, with
+// what they are replaced by before comparing against a golden file
+var volatile = []struct {
+	rx   *regexp.Regexp
+	with string
+}{
+	{csrfRX, `name="csrf_token" value="CSRF_TOKEN"`},
+	{regexp.MustCompile(`\d{2} [A-Z][a-z]{2} \d{4} at \d{2}:\d{2} UTC`), "DATE_TIME"},
+	{regexp.MustCompile(`\d{2} [A-Z][a-z]{2} \d{4}`), "DATE"},
+	{regexp.MustCompile(`expires=\d+`), "expires=EXPIRES"},
+	{regexp.MustCompile(`fp=[0-9a-f]+`), "fp=FINGERPRINT"},
+	{regexp.MustCompile(`signature=[0-9a-f]+`), "signature=SIGNATURE"},
+}
+
+func TestPages(t *testing.T) {
+	app, store := newTestApplication(t)
+	fixture := addPageFixtures(t, app, store)
+	mux := app.routes()
+
+	anonymous := newTestClient(t, mux)
+	admin := newTestClient(t, mux)
+	admin.login("admin@example.com")
+	clerk := newTestClient(t, mux)
+	clerk.login("clerk@example.com")
+	enrolled := newTestClient(t, mux)
+	enrolled.login("enrolled@example.com")
+
+	shopper := newTestClient(t, mux)
+	shopper.postForm("/cart/items", url.Values{"widget_id": {strconv.Itoa(fixture.widgetID)}, "quantity": {"2"}})
+
+	resetLink, err := app.signer.Sign("/reset-password?email="+url.QueryEscape("admin@example.com")+"&fp="+fixture.admin.PasswordFingerprint(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		page   string
+		client *testClient
+		path   string
+		status int
+	}{
+		{"home", anonymous, "/", http.StatusOK},
+		{"login", anonymous, "/login", http.StatusOK},
+		{"forgot-password", anonymous, "/forgot-password", http.StatusOK},
+		{"reset-password", anonymous, resetLink, http.StatusOK},
+		{"buy-one", anonymous, "/widgets/" + strconv.Itoa(fixture.widgetID), http.StatusOK},
+		{"bronze-plan", anonymous, "/plans/bronze-plan", http.StatusOK},
+		{"receipt-plan", anonymous, "/receipt/bronze", http.StatusOK},
+		{"cart", shopper, "/cart", http.StatusOK},
+		{"two-factor-login", enrolled, "/login/two-factor", http.StatusOK},
+		{"two-factor-setup", admin, "/account/two-factor", http.StatusOK},
+		{"forbidden", clerk, "/admin/orders", http.StatusForbidden},
+		{"terminal", admin, "/virtual-terminal", http.StatusOK},
+		{"admin-orders", admin, "/admin/orders", http.StatusOK},
+		{"admin-order", admin, "/admin/orders/" + strconv.Itoa(fixture.orderID), http.StatusOK},
+		{"admin-users", admin, "/admin/users", http.StatusOK},
+		{"admin-widgets", admin, "/admin/widgets", http.StatusOK},
+		{"admin-widget", admin, "/admin/widgets/" + strconv.Itoa(fixture.widgetID), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.page, func(t *testing.T) {
+			tt.client.t = t
+			status, _, body := tt.client.get(tt.path)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+			golden(t, tt.page, body)
+		})
+	}
+
+	// receipts are shown once from the session, after a payment was recorded
+	receipts := []struct {
+		page    string
+		handler http.HandlerFunc
+		tx      TransactionData
+	}{
+		{"receipt", app.Receipt, fixture.receipt},
+		{"virtual-terminal-receipt", app.VirtualTerminalReceipt, fixture.terminalReceipt},
+	}
+	for _, tt := range receipts {
+		t.Run(tt.page, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/"+tt.page, nil)
+			ctx, err := app.Session.Load(r.Context(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.Session.Put(ctx, "receipt", tt.tx)
+
+			w := httptest.NewRecorder()
+			tt.handler(w, r.WithContext(ctx))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			golden(t, tt.page, w.Body.String())
+		})
+	}
+}
+
+// pageFixtures are the records the pages under test show
+type pageFixtures struct {
+	admin           models.User
+	widgetID        int
+	orderID         int
+	receipt         TransactionData
+	terminalReceipt TransactionData
+}
+
+// addPageFixtures fills store with a catalog, an order and staff users:
+// admin@example.com holds every permission, clerk@example.com none and
+// enrolled@example.com has two-factor authentication enabled
+func addPageFixtures(t *testing.T, app *application, store *memory.Store) pageFixtures {
+	t.Helper()
+	ctx := context.Background()
+
+	var f pageFixtures
+	f.widgetID = store.AddWidget(models.Widget{Name: "Gizmo", Description: "A <b>fine</b> gizmo", Price: 1000, Weight: 500, InventoryLevel: 5})
+	store.AddWidget(models.Widget{Name: "Bronze plan", Description: "Three gizmos a month", Price: 2000, IsRecurring: true, PlanID: "price_bronze"})
+	store.AddShippingRate(models.ShippingRate{Name: "Standard", Kind: models.RateFlat, Amount: 500})
+
+	adminID := addStaff(t, store, "admin@example.com",
+		rbac.ChargeTerminal, rbac.RefundPayments, rbac.ManageUsers, rbac.ViewReports, rbac.ManageCatalog, rbac.FulfillOrders)
+	addStaff(t, store, "clerk@example.com")
+	enrolledID := addStaff(t, store, "enrolled@example.com")
+	enrollTOTP(t, app, store, enrolledID)
+
+	// a fixed pending secret keeps the enrollment page the same between runs
+	sealed, err := app.encrypter.Encrypt("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetPendingTOTPSecret(ctx, adminID, sealed); err != nil {
+		t.Fatal(err)
+	}
+	f.admin, err = store.GetUser(ctx, adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	customerID, err := store.InsertCustomer(ctx, models.Customer{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txnID, err := store.InsertTransaction(ctx, models.Transaction{
+		Amount:              2500,
+		Currency:            "usd",
+		LastFour:            "4242",
+		ExpiryMonth:         12,
+		ExpiryYear:          2030,
+		BankReturnCode:      "ch_fixture",
+		PaymentMethod:       "pm_fixture",
+		PaymenyIntent:       "pi_fixture",
+		TransactionStatusID: models.TxnCleared,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := &models.Address{Name: "Ada Lovelace", Line1: "12 St James's Square", City: "London", PostalCode: "SW1Y 4JH", Country: "GB"}
+	item := models.OrderItem{WidgetID: f.widgetID, Name: "Gizmo", Quantity: 2, Price: 1000, Amount: 2000}
+	f.orderID, err = store.InsertOrder(ctx, models.Order{
+		TransactionID:   txnID,
+		CustomerID:      customerID,
+		StatusID:        models.OrderCleared,
+		Amount:          2500,
+		ShippingAmount:  500,
+		Items:           []models.OrderItem{item},
+		BillingAddress:  address,
+		ShippingAddress: address,
+	}, models.Actor{Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.receipt = TransactionData{
+		FirstName:       "Ada",
+		LastName:        "Lovelace",
+		Email:           "ada@example.com",
+		PaymentIntentID: "pi_fixture",
+		PaymentMethodID: "pm_fixture",
+		PaymentAmount:   2500,
+		PaymentCurrency: "usd",
+		LastFour:        "4242",
+		ExpiryMonth:     12,
+		ExpiryYear:      2030,
+		BankReturnCode:  "ch_fixture",
+		Items:           []models.OrderItem{item},
+		Shipping:        500,
+		BillingAddress:  address,
+		ShippingAddress: address,
+	}
+	f.terminalReceipt = f.receipt
+	f.terminalReceipt.Items, f.terminalReceipt.Shipping = nil, 0
+	f.terminalReceipt.BillingAddress, f.terminalReceipt.ShippingAddress = nil, nil
+	return f
+}
+
+// golden compares body, with its volatile parts replaced, to the golden
+// file of page, rewriting the file instead when the -update flag is set
+func golden(t *testing.T, page, body string) {
+	t.Helper()
+
+	for _, v := range volatile {
+		body = v.rx.ReplaceAllString(body, v.with)
+	}
+
+	path := filepath.Join("testdata", page+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -update to create it", err)
+	}
+	if body != string(want) {
+		t.Errorf("%s differs from %s:\n%s", page, path, diffLines(string(want), body))
+	}
+}
+
+// diffLines returns the first line where got departs from want, with the
+// lines around it, which is enough to find a change in a rendered page
+func diffLines(want, got string) string {
+	w, g := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := 0; i < len(w) || i < len(g); i++ {
+		if i < len(w) && i < len(g) && w[i] == g[i] {
+			continue
+		}
+		var b strings.Builder
+		for _, side := range []struct {
+			prefix string
+			lines  []string
+		}{{"- ", w}, {"+ ", g}} {
+			for j := i - 2; j < i+3 && j < len(side.lines); j++ {
+				if j >= 0 {
+					b.WriteString(side.prefix + side.lines[j] + "\n")
+				}
+			}
+		}
+		return "at line " + strconv.Itoa(i+1) + ":\n" + b.String()
+	}
+	return ""
+}
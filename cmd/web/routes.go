@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"github.com/caleberi/gostripe/internal/rbac"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -11,22 +12,77 @@ func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 	fileServer := http.FileServer(http.Dir("./static"))
 	mux.Use(SessionLoader)
+	mux.Use(middleware.RequestID)
 	mux.Use(middleware.Logger)
 	mux.Use(middleware.Recoverer)
+	mux.Use(app.CSRF)
 	mux.Get("/", app.RenderHomePage)
-	mux.Get("/virtual-terminal", app.VirtualTerminal)
-	mux.Post("/virtual-terminal-payment-succeeded", app.VirtualTerminalPaymentSucceeded)
-	mux.Get("/virtual-terminal-receipt", app.VirtualTerminalReceipt)
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/plans/bronze-plan", app.RenderBronzePlan)
 	mux.Get("/receipt", app.Receipt)
 	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
+	mux.Handle("/images/*", app.images.Handler())
 	mux.Get("/widgets/{id}", app.ChargeOnce)
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/items", app.PostCartItem)
+	mux.Post("/cart/items/{id}", app.PostCartItemQuantity)
+	mux.Post("/cart/items/{id}/delete", app.PostRemoveCartItem)
+	mux.Post("/cart/checkout", app.CartCheckout)
 
 	// auth routes
 
 	mux.Get("/login", app.LoginPage)
+	mux.Post("/login", app.PostLoginPage)
+	mux.Post("/logout", app.Logout)
+	mux.Get("/login/two-factor", app.TwoFactorLoginPage)
+	mux.Post("/login/two-factor", app.PostTwoFactorLogin)
+	mux.Get("/forgot-password", app.ForgotPassword)
+	mux.Get("/reset-password", app.ShowResetPassword)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.Auth)
+		mux.Get("/account/two-factor", app.TwoFactorSetup)
+		mux.Post("/account/two-factor", app.PostTwoFactorSetup)
+		mux.Get("/account/two-factor/qr.png", app.TwoFactorQRCode)
+	})
+
+	// pages below require a logged in user holding the named permission,
+	// enrolled in two-factor authentication when their role requires it
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.Auth, app.RequireTwoFactor, app.requirePermission(rbac.ChargeTerminal))
+		mux.Get("/virtual-terminal", app.VirtualTerminal)
+		mux.Post("/virtual-terminal-payment-succeeded", app.VirtualTerminalPaymentSucceeded)
+		mux.Get("/virtual-terminal-receipt", app.VirtualTerminalReceipt)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.Auth, app.RequireTwoFactor, app.requirePermission(rbac.ManageUsers))
+		mux.Get("/admin/users", app.AdminUsers)
+		mux.Post("/admin/users/{id}/roles", app.PostUserRoles)
+		mux.Post("/admin/users/{id}/two-factor/reset", app.PostResetTwoFactor)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.Auth, app.RequireTwoFactor, app.requirePermission(rbac.ManageCatalog))
+		mux.Get("/admin/widgets", app.AdminWidgets)
+		mux.Get("/admin/widgets/new", app.NewWidget)
+		mux.Post("/admin/widgets", app.PostNewWidget)
+		mux.Get("/admin/widgets/{id}", app.EditWidget)
+		mux.Post("/admin/widgets/{id}", app.PostEditWidget)
+		mux.Post("/admin/widgets/{id}/delete", app.PostDeleteWidget)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.Auth, app.RequireTwoFactor, app.requirePermission(rbac.ViewReports))
+		mux.Get("/admin/orders", app.AdminOrders)
+		mux.Get("/admin/orders/{id}", app.AdminOrder)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.Auth, app.RequireTwoFactor, app.requirePermission(rbac.FulfillOrders))
+		mux.Post("/admin/orders/{id}/fulfillment", app.PostOrderFulfillment)
+	})
 
 	return mux
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/caleberi/gostripe/internal/config"
+	"github.com/caleberi/gostripe/internal/encryption"
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/models/memory"
+	"github.com/caleberi/gostripe/internal/rbac"
+	"github.com/caleberi/gostripe/internal/storage"
+	"github.com/caleberi/gostripe/internal/totp"
+	"github.com/caleberi/gostripe/internal/urlsigner"
+)
+
+// testKey is the signing and encryption key of test applications
+const testKey = "0123456789abcdef0123456789abcdef"
+
+func TestMain(m *testing.M) {
+	gob.Register(TransactionData{})
+	gob.Register([]models.CartLine{})
+	os.Exit(m.Run())
+}
+
+// newTestApplication returns an application backed by an empty in-memory
+// store, keeping sessions in memory and discarding its logs. It replaces
+// the package session manager, so tests using it must not run in parallel.
+func newTestApplication(t *testing.T) (*application, *memory.Store) {
+	t.Helper()
+
+	cfg := config.Defaults()
+	cfg.Images.Dir = t.TempDir()
+	cfg.Stripe.Key = "pk_test_key"
+	cfg.SigningKey = testKey
+	cfg.EncryptionKey = testKey
+
+	session = scs.New()
+
+	discard := log.New(io.Discard, "", 0)
+	store := memory.New()
+	app := &application{
+		config:        cfg,
+		infoLog:       discard,
+		errorLog:      discard,
+		templateCache: make(map[string]*template.Template),
+		version:       version,
+		DB:            store.Models(),
+		Session:       session,
+		signer:        &urlsigner.Signer{Secret: []byte(cfg.SigningKey)},
+		encrypter:     &encryption.Encrypter{Key: []byte(cfg.EncryptionKey)},
+		live:          config.NewLive(cfg),
+		images:        storage.Images{Dir: cfg.Images.Dir, MaxSize: cfg.Images.MaxSize},
+	}
+	return app, store
+}
+
+// addStaff stores a user with the password "password" holding perms
+// through a role of their own and returns the user's id
+func addStaff(t *testing.T, store *memory.Store, email string, perms ...rbac.Permission) int {
+	t.Helper()
+
+	granted := make([]string, len(perms))
+	for i, p := range perms {
+		granted[i] = string(p)
+	}
+	roleID := store.AddRole(models.Role{Name: email}, granted...)
+
+	id, err := store.AddUser(models.User{FirstName: "Staff", LastName: "Member", Email: email}, "password", roleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+var csrfRX = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// testClient is a browser for a test server: it keeps cookies, does not
+// follow redirects and echoes the csrf token of the last page it loaded
+type testClient struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+	csrf   string
+}
+
+// newTestClient starts a server for h that is closed with the test
+func newTestClient(t *testing.T, h http.Handler) *testClient {
+	t.Helper()
+
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{
+		t:      t,
+		server: server,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// get loads path and returns the status code, headers and body
+func (c *testClient) get(path string) (int, http.Header, string) {
+	c.t.Helper()
+
+	resp, err := c.client.Get(c.server.URL + path)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read(resp)
+}
+
+// postForm submits form to path with the csrf token of the last page
+// loaded, or of /login when no page was
+func (c *testClient) postForm(path string, form url.Values) (int, http.Header, string) {
+	c.t.Helper()
+
+	if c.csrf == "" {
+		c.get("/login")
+	}
+	if form.Get("csrf_token") == "" {
+		form.Set("csrf_token", c.csrf)
+	}
+
+	resp, err := c.client.PostForm(c.server.URL+path, form)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read(resp)
+}
+
+// login signs in as email with the password "password"
+func (c *testClient) login(email string) {
+	c.t.Helper()
+
+	status, header, body := c.postForm("/login", url.Values{"email": {email}, "password": {"password"}})
+	if status != http.StatusSeeOther {
+		c.t.Fatalf("login as %s: status %d, body: %s", email, status, body)
+	}
+	// the session gets a new csrf token after login
+	c.csrf = ""
+	c.get(header.Get("Location"))
+}
+
+func (c *testClient) read(resp *http.Response) (int, http.Header, string) {
+	c.t.Helper()
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body := string(b)
+	if m := csrfRX.FindStringSubmatch(body); m != nil {
+		c.csrf = m[1]
+	}
+	return resp.StatusCode, resp.Header, body
+}
+
+// mustContain fails the test when body lacks any of want
+func mustContain(t *testing.T, body string, want ...string) {
+	t.Helper()
+
+	for _, w := range want {
+		if !strings.Contains(body, w) {
+			t.Errorf("body does not contain %q", w)
+		}
+	}
+}
+
+// enrollTOTP completes two-factor enrollment for a user and returns their
+// plain TOTP secret
+func enrollTOTP(t *testing.T, app *application, store *memory.Store, userID int) string {
+	t.Helper()
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := app.encrypter.Encrypt(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetPendingTOTPSecret(context.Background(), userID, sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnableTOTP(context.Background(), userID, nil); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// currentCode returns the TOTP code for secret at the current time
+func currentCode(t *testing.T, secret string) string {
+	t.Helper()
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
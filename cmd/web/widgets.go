@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"github.com/caleberi/gostripe/internal/storage"
+	"github.com/caleberi/gostripe/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// recentMovements is how many inventory movements the widget page lists
+const recentMovements = 20
+
+// widgetImage returns the URL of a widget image, falling back to the stock
+// picture for widgets without one
+func widgetImage(name string) string {
+	if name == "" {
+		return staticURL("widget.png")
+	}
+	return storage.URL(name)
+}
+
+// AdminWidgets lists the catalog with filters, sorting and pagination
+func (app *application) AdminWidgets(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	v := validator.New()
+	filter := models.ParseWidgetFilter(q, v)
+
+	td := &templateData{
+		Flash: app.Session.PopString(r.Context(), "flash"),
+		Error: app.Session.PopString(r.Context(), "error"),
+	}
+	if !v.Valid() {
+		// show the whole catalog rather than an error page for a bad link
+		td.FieldErrors = v.Errors
+		filter = models.WidgetFilter{}
+	}
+
+	widgets, metadata, err := app.DB.Widgets.ListWidgets(r.Context(), filter)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// sortLinks toggles the direction of the column already sorted by
+	sortLinks := make(map[string]string)
+	for key := range models.WidgetSorts {
+		sort := key
+		if filter.Sort == key {
+			sort = "-" + key
+		}
+		sortLinks[key] = withQuery(q, "sort", sort, "page", "")
+	}
+
+	data := make(map[string]interface{})
+	data["widgets"] = widgets
+	data["metadata"] = metadata
+	data["filter"] = filter
+	data["sortLinks"] = sortLinks
+	if metadata.CurrentPage > metadata.FirstPage {
+		data["prevPage"] = withQuery(q, "page", strconv.Itoa(metadata.CurrentPage-1))
+	}
+	if metadata.CurrentPage < metadata.LastPage {
+		data["nextPage"] = withQuery(q, "page", strconv.Itoa(metadata.CurrentPage+1))
+	}
+	td.Data = data
+
+	if err := app.renderTemplate(w, r, "admin-widgets", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// NewWidget shows an empty widget form
+func (app *application) NewWidget(w http.ResponseWriter, r *http.Request) {
+	app.renderWidgetForm(w, r, models.Widget{}, nil)
+}
+
+// PostNewWidget adds the widget in the form to the catalog, with its image
+// when one was chosen
+func (app *application) PostNewWidget(w http.ResponseWriter, r *http.Request) {
+	var widget models.Widget
+	v := validator.New()
+	parseWidgetForm(r, &widget, v)
+	widget.Validate(v)
+
+	image, ok := app.saveWidgetImage(w, r, v)
+	if !ok {
+		return
+	}
+	if !v.Valid() {
+		app.discardImage(image)
+		app.renderWidgetForm(w, r, widget, v)
+		return
+	}
+
+	widget.Image = image
+	id, err := app.DB.Widgets.InsertWidget(r.Context(), widget)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.discardImage(image)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Widget added")
+	http.Redirect(w, r, "/admin/widgets/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// EditWidget shows the form of an existing widget
+func (app *application) EditWidget(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+	app.renderWidgetForm(w, r, widget, nil)
+}
+
+// PostEditWidget saves the form of an existing widget, replacing its image
+// when a new one was chosen
+func (app *application) PostEditWidget(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	// the change staff made is measured from the level the form showed, so
+	// saving a form opened before some sales does not put the sold units back
+	seen, err := strconv.Atoi(r.PostFormValue("inventory_seen"))
+	if err != nil {
+		seen = widget.InventoryLevel
+	}
+
+	v := validator.New()
+	parseWidgetForm(r, &widget, v)
+	widget.Validate(v)
+
+	image, ok := app.saveWidgetImage(w, r, v)
+	if !ok {
+		return
+	}
+	if !v.Valid() {
+		app.discardImage(image)
+		app.renderWidgetForm(w, r, widget, v)
+		return
+	}
+
+	old := widget.Image
+	if image != "" {
+		widget.Image = image
+	}
+
+	err = app.DB.Widgets.UpdateWidget(r.Context(), widget, widget.InventoryLevel-seen)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.discardImage(image)
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, models.ErrOutOfStock) {
+		app.discardImage(image)
+		widget.Image = old
+		v.AddError("inventory_level", "removes more units than are left, as some were sold or reserved while you were editing")
+		app.renderWidgetForm(w, r, widget, v)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.discardImage(image)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if image != "" {
+		app.discardImage(old)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Widget saved")
+	http.Redirect(w, r, "/admin/widgets/"+strconv.Itoa(widget.ID), http.StatusSeeOther)
+}
+
+// PostDeleteWidget removes a widget that was never ordered
+func (app *application) PostDeleteWidget(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.DB.Widgets.DeleteWidget(r.Context(), widget.ID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, models.ErrWidgetInUse):
+		app.Session.Put(r.Context(), "error", "This widget has orders and cannot be deleted; set its inventory to 0 to stop selling it")
+		http.Redirect(w, r, "/admin/widgets/"+strconv.Itoa(widget.ID), http.StatusSeeOther)
+		return
+	case err != nil:
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	app.discardImage(widget.Image)
+	app.Session.Put(r.Context(), "flash", "Widget deleted")
+	http.Redirect(w, r, "/admin/widgets", http.StatusSeeOther)
+}
+
+// widgetFromURL loads the widget named by the id URL parameter, serving a
+// 404 and returning false when there is none
+func (app *application) widgetFromURL(w http.ResponseWriter, r *http.Request) (models.Widget, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return models.Widget{}, false
+	}
+
+	widget, err := app.DB.Widgets.GetWidget(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return widget, false
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return widget, false
+	}
+	return widget, true
+}
+
+// renderWidgetForm shows the add or edit form of widget, with the errors in
+// v when it is not nil
+func (app *application) renderWidgetForm(w http.ResponseWriter, r *http.Request, widget models.Widget, v *validator.Validator) {
+	data := make(map[string]interface{})
+	data["widget"] = widget
+	if widget.ID != 0 {
+		// a form shown again after errors still measures the change to the
+		// inventory level from the level it was opened with
+		seen := r.PostFormValue("inventory_seen")
+		if _, err := strconv.Atoi(seen); err != nil {
+			seen = strconv.Itoa(widget.InventoryLevel)
+		}
+		data["inventorySeen"] = seen
+
+		movements, err := app.DB.Inventory.ListInventoryMovements(r.Context(), widget.ID, recentMovements)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		data["movements"] = movements
+	}
+	td := &templateData{
+		Data:  data,
+		Flash: app.Session.PopString(r.Context(), "flash"),
+		Error: app.Session.PopString(r.Context(), "error"),
+	}
+
+	if v != nil {
+		app.failedValidation(w, r, "admin-widget", td, v)
+		return
+	}
+	if err := app.renderTemplate(w, r, "admin-widget", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// saveWidgetImage stores the file in the image field of the form, returning
+// an empty name when none was chosen. A rejected file is recorded in v; ok
+// is false when an error response has already been written.
+func (app *application) saveWidgetImage(w http.ResponseWriter, r *http.Request, v *validator.Validator) (name string, ok bool) {
+	file, _, err := r.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return "", true
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return "", false
+	}
+	defer file.Close()
+
+	name, err = app.images.Save(file)
+	switch {
+	case errors.Is(err, storage.ErrTooLarge):
+		v.AddError("image", "must not be larger than "+strconv.FormatInt(app.images.MaxSize>>20, 10)+" MB")
+		return "", true
+	case errors.Is(err, storage.ErrUnsupportedType):
+		v.AddError("image", "must be a png, jpeg, gif or webp image")
+		return "", true
+	case err != nil:
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return "", false
+	}
+	return name, true
+}
+
+// discardImage removes a stored image, logging failures since the widget
+// change has been made or abandoned either way
+func (app *application) discardImage(name string) {
+	if err := app.images.Remove(name); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// parseWidgetForm copies the submitted widget fields onto widget. The price
+// is entered in dollars and stored in cents, the weight in grams.
+func parseWidgetForm(r *http.Request, widget *models.Widget, v *validator.Validator) {
+	widget.Name = strings.TrimSpace(r.PostFormValue("name"))
+	widget.Description = r.PostFormValue("description")
+	widget.IsRecurring = r.PostFormValue("is_recurring") != ""
+	widget.PlanID = strings.TrimSpace(r.PostFormValue("plan_id"))
+
+	price, err := strconv.ParseFloat(strings.TrimSpace(r.PostFormValue("price")), 64)
+	if err != nil || math.IsNaN(price) || math.Abs(price) > math.MaxInt32/100 {
+		v.AddError("price", "must be an amount such as 10.00")
+	} else {
+		widget.Price = int(math.Round(price * 100))
+	}
+
+	weight := strings.TrimSpace(r.PostFormValue("weight"))
+	if weight == "" {
+		widget.Weight = 0
+	} else if n, err := strconv.Atoi(weight); err != nil {
+		v.AddError("weight", "must be a whole number of grams")
+	} else {
+		widget.Weight = n
+	}
+
+	inventory, err := strconv.Atoi(strings.TrimSpace(r.PostFormValue("inventory_level")))
+	if err != nil {
+		v.AddError("inventory_level", "must be a whole number")
+	} else {
+		widget.InventoryLevel = inventory
+	}
+}
+
+// withQuery returns the current path's query q with the given key, value
+// pairs replaced; an empty value removes its key
+func withQuery(q url.Values, pairs ...string) string {
+	out := make(url.Values, len(q))
+	for k, vs := range q {
+		out[k] = vs
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			out.Del(pairs[i])
+		} else {
+			out.Set(pairs[i], pairs[i+1])
+		}
+	}
+	return "?" + out.Encode()
+}
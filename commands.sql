@@ -1 +0,0 @@
-GRANT ALL ON  widgets.* TO 'caleb'@'%' IDENTIFIED BY 'secret';
\ No newline at end of file
@@ -5,6 +5,7 @@ import (
 	"github.com/stripe/stripe-go/v72/customer"
 	"github.com/stripe/stripe-go/v72/paymentintent"
 	"github.com/stripe/stripe-go/v72/paymentmethod"
+	"github.com/stripe/stripe-go/v72/refund"
 	"github.com/stripe/stripe-go/v72/sub"
 )
 
@@ -14,6 +15,25 @@ type Card struct {
 	Secret   string
 	Key      string
 	Currency string
+	// IdempotencyKey, when set, is forwarded to stripe so a retried request
+	// does not create a second payment intent
+	IdempotencyKey string
+	// Metadata is attached to the payment intents created with the card
+	Metadata map[string]string
+	// Shipping, when set, is the address the payment intents created with
+	// the card ship to
+	Shipping *Address
+}
+
+// Address is a postal address; Country is an ISO 3166-1 alpha-2 code
+type Address struct {
+	Name       string
+	Line1      string
+	Line2      string
+	City       string
+	State      string
+	PostalCode string
+	Country    string
 }
 
 type Transaction struct {
@@ -35,6 +55,25 @@ func (card *Card) CreatePaymentIntent(currency string, amount int) (*stripe.Paym
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(currency),
 	}
+	if card.IdempotencyKey != "" {
+		params.SetIdempotencyKey(card.IdempotencyKey)
+	}
+	for k, v := range card.Metadata {
+		params.AddMetadata(k, v)
+	}
+	if a := card.Shipping; a != nil {
+		params.Shipping = &stripe.ShippingDetailsParams{
+			Name: stripe.String(a.Name),
+			Address: &stripe.AddressParams{
+				Line1:      stripe.String(a.Line1),
+				Line2:      stripe.String(a.Line2),
+				City:       stripe.String(a.City),
+				State:      stripe.String(a.State),
+				PostalCode: stripe.String(a.PostalCode),
+				Country:    stripe.String(a.Country),
+			},
+		}
+	}
 
 	paymentIntent, err := paymentintent.New(params)
 	if err != nil {
@@ -42,7 +81,7 @@ func (card *Card) CreatePaymentIntent(currency string, amount int) (*stripe.Paym
 		if stripeErr, ok := err.(*stripe.Error); ok {
 			msg = cardErrorMessage(stripeErr.Code)
 		}
-		return nil, msg, nil
+		return nil, msg, err
 	}
 	return paymentIntent, "", nil
 }
@@ -96,7 +135,7 @@ func (card *Card) RetrivePaymentIntent(id string) (*stripe.PaymentIntent, error)
 	return pi, nil
 }
 
-func (card *Card) SubscribeToPlan(customer *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+func (card *Card) SubscribeToPlan(customer *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, string, error) {
 	stripeCustomerID := customer.ID
 	items := []*stripe.SubscriptionItemsParams{
 		{Plan: stripe.String(plan)},
@@ -111,9 +150,13 @@ func (card *Card) SubscribeToPlan(customer *stripe.Customer, plan, email, last4,
 	params.AddExpand("latest_invoice.payment_intent")
 	subscription, err := sub.New(params)
 	if err != nil {
-		return nil, err
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return nil, msg, err
 	}
-	return subscription, nil
+	return subscription, "", nil
 }
 
 func (card *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
@@ -138,3 +181,22 @@ func (card *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, er
 
 	return customer, "", nil
 }
+
+// Refund refunds amount of a captured payment intent
+func (card *Card) Refund(paymentIntent string, amount int) (*stripe.Refund, error) {
+	stripe.Key = card.Secret
+
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(paymentIntent),
+		Amount:        stripe.Int64(int64(amount)),
+	}
+	if card.IdempotencyKey != "" {
+		params.SetIdempotencyKey(card.IdempotencyKey)
+	}
+
+	r, err := refund.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
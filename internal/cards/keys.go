@@ -0,0 +1,46 @@
+package cards
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckKeys validates the stripe publishable key and secret key a binary was
+// started with. It returns an error for a key in the wrong slot, or for live
+// keys in the development environment, and warnings for problems that should
+// not stop startup: a missing key, or a test key mixed with a live one.
+func CheckKeys(key, secret, env string) (warnings []string, err error) {
+	switch {
+	case strings.HasPrefix(secret, "pk_"):
+		return nil, fmt.Errorf("STRIPE_SECRET holds a publishable key (pk_...), the keys are swapped")
+	case secret != "" && !strings.HasPrefix(secret, "sk_") && !strings.HasPrefix(secret, "rk_"):
+		return nil, fmt.Errorf("STRIPE_SECRET is not a stripe secret key (sk_... or rk_...)")
+	case strings.HasPrefix(key, "sk_"), strings.HasPrefix(key, "rk_"):
+		return nil, fmt.Errorf("STRIPE_KEY holds a secret key, the keys are swapped")
+	case key != "" && !strings.HasPrefix(key, "pk_"):
+		return nil, fmt.Errorf("STRIPE_KEY is not a stripe publishable key (pk_...)")
+	}
+
+	if key == "" {
+		warnings = append(warnings, "STRIPE_KEY is not set, card payments will fail")
+	}
+	if secret == "" {
+		warnings = append(warnings, "STRIPE_SECRET is not set, card payments will fail")
+	}
+
+	keyLive, secretLive := isLive(key), isLive(secret)
+	if env == "development" && (keyLive || secretLive) {
+		return nil, fmt.Errorf("live stripe keys are not allowed with -environment=development")
+	}
+
+	if key != "" && secret != "" && keyLive != secretLive {
+		warnings = append(warnings, "STRIPE_KEY and STRIPE_SECRET mix test and live mode keys")
+	}
+
+	return warnings, nil
+}
+
+// isLive reports whether a stripe key belongs to live mode
+func isLive(key string) bool {
+	return strings.Contains(key, "_live_")
+}
@@ -0,0 +1,584 @@
+// Package config loads the settings of the web and api binaries and keeps
+// secrets out of logs.
+//
+// Settings are merged from, in increasing order of precedence:
+//
+//  1. built-in defaults
+//  2. the environment's section of database.yml
+//  3. the environment's section of the config file, YAML or TOML
+//  4. environment variables
+//  5. command line flags
+//
+// Secrets never come from flags. Every secret NAME is read from the file
+// named by NAME_FILE when that is set, so orchestrators can mount secrets as
+// files, and from the NAME environment variable otherwise.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/cards"
+	"github.com/caleberi/gostripe/internal/driver"
+	"github.com/caleberi/gostripe/internal/validator"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Secret is a sensitive setting. It prints as [redacted] through fmt and
+// encoding so it cannot leak into logs by accident; convert it with
+// string() where the value is needed.
+type Secret string
+
+// String implements fmt.Stringer
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// GoString implements fmt.GoStringer so %#v redacts too
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Duration is a time.Duration written as "30m" or "24h" in config files and flags
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// String implements flag.Value
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+// Set implements flag.Value
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
+
+// Environments lists the accepted values of -environment
+var Environments = []string{"development", "test", "staging", "production"}
+
+// Config holds the settings of both binaries
+type Config struct {
+	// Env selects the section of the config files; it is set by -environment or GOSTRIPE_ENV
+	Env    string `yaml:"-" toml:"-"`
+	Web    Web    `yaml:"web" toml:"web"`
+	API    API    `yaml:"api" toml:"api"`
+	DB     DB     `yaml:"database" toml:"database"`
+	Stripe Stripe `yaml:"-" toml:"-"`
+	Mail   Mail   `yaml:"mail" toml:"mail"`
+	Images Images `yaml:"images" toml:"images"`
+	Store  Store  `yaml:"store" toml:"store"`
+	// Inventory is used by the api, which creates and sweeps reservations
+	Inventory Inventory `yaml:"inventory" toml:"inventory"`
+	// SigningKey signs password reset links
+	SigningKey Secret `yaml:"-" toml:"-"`
+	// EncryptionKey seals TOTP secrets at rest
+	EncryptionKey Secret `yaml:"-" toml:"-"`
+}
+
+// Web holds the settings of the web frontend
+type Web struct {
+	Port int `yaml:"port" toml:"port"`
+	// API is the url the browser calls the api on
+	API     string  `yaml:"api" toml:"api"`
+	Session Session `yaml:"session" toml:"session"`
+}
+
+// Session holds the session store and cookie settings of the web frontend
+type Session struct {
+	// Store is database, which keeps sessions in the application database,
+	// or memory for single instance development
+	Store    string   `yaml:"store" toml:"store"`
+	Lifetime Duration `yaml:"lifetime" toml:"lifetime"`
+	// Cleanup is how often expired sessions are deleted from the database
+	Cleanup Duration `yaml:"cleanup" toml:"cleanup"`
+	Cookie  Cookie   `yaml:"cookie" toml:"cookie"`
+}
+
+// Cookie holds the attributes of the session cookie
+type Cookie struct {
+	Name     string `yaml:"name" toml:"name"`
+	Domain   string `yaml:"domain" toml:"domain"`
+	Secure   bool   `yaml:"secure" toml:"secure"`
+	HTTPOnly bool   `yaml:"http_only" toml:"http_only"`
+	// SameSite is lax, strict or none
+	SameSite string `yaml:"same_site" toml:"same_site"`
+}
+
+// API holds the settings of the api
+type API struct {
+	Port     int      `yaml:"port" toml:"port"`
+	TokenTTL Duration `yaml:"token_ttl" toml:"token_ttl"`
+	// CORSOrigins are the origins allowed to call the api from a browser
+	CORSOrigins []string `yaml:"cors_origins" toml:"cors_origins"`
+	// Frontend is the url of the web frontend, used in links sent by email
+	Frontend string   `yaml:"frontend" toml:"frontend"`
+	ResetTTL Duration `yaml:"reset_ttl" toml:"reset_ttl"`
+}
+
+// DB holds the database settings. The fields match database.yml; DSN,
+// when set, is used as is instead of the individual fields.
+type DB struct {
+	DSN      string         `yaml:"dsn" toml:"dsn"`
+	Dialect  driver.Dialect `yaml:"dialect" toml:"dialect"`
+	Host     string         `yaml:"host" toml:"host"`
+	Port     int            `yaml:"port" toml:"port"`
+	Database string         `yaml:"database" toml:"database"`
+	User     string         `yaml:"user" toml:"user"`
+	// Password is folded into DSN while loading. Afterwards it only holds
+	// DB_PASSWORD, which replaces the password in DSN.
+	Password Secret `yaml:"password,omitempty" toml:"password,omitempty"`
+	// Pool is the most open connections per database
+	Pool            int      `yaml:"pool" toml:"pool"`
+	MaxIdle         int      `yaml:"max_idle" toml:"max_idle"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	ConnMaxIdleTime Duration `yaml:"conn_max_idle_time" toml:"conn_max_idle_time"`
+	// Replicas serve read-only queries. DB_PASSWORD applies to them too.
+	Replicas []Replica `yaml:"replicas" toml:"replicas"`
+	// MaxReplicaLag is the replication lag beyond which reads go to the primary
+	MaxReplicaLag Duration `yaml:"max_replica_lag" toml:"max_replica_lag"`
+	// HealthInterval is how often every database is pinged
+	HealthInterval Duration `yaml:"health_interval" toml:"health_interval"`
+	// QueryTimeout bounds each model method on top of the request context
+	QueryTimeout Duration `yaml:"query_timeout" toml:"query_timeout"`
+	// SlowQuery is the duration from which statements are logged, 0 for none
+	SlowQuery Duration `yaml:"slow_query" toml:"slow_query"`
+	// Migrate applies pending migrations at startup
+	Migrate bool `yaml:"migrate" toml:"migrate"`
+}
+
+// Replica is a read replica
+type Replica struct {
+	// Name labels the replica in logs and stats
+	Name string `yaml:"name" toml:"name"`
+	DSN  string `yaml:"dsn" toml:"dsn"`
+}
+
+// Stripe holds the stripe API keys
+type Stripe struct {
+	Key    string `yaml:"-" toml:"-"`
+	Secret Secret `yaml:"-" toml:"-"`
+}
+
+// Mail holds the outgoing mail settings of the api
+type Mail struct {
+	// Transport is smtp, file or log
+	Transport string `yaml:"transport" toml:"transport"`
+	// Dir is where the file transport writes messages
+	Dir  string `yaml:"dir" toml:"dir"`
+	From string `yaml:"from" toml:"from"`
+	SMTP SMTP   `yaml:"smtp" toml:"smtp"`
+}
+
+// Images holds where uploaded widget images are stored. The web frontend
+// serves them from the same directory, so both binaries must share it.
+type Images struct {
+	Dir string `yaml:"dir" toml:"dir"`
+	// MaxSize is the largest upload accepted, in bytes
+	MaxSize int64 `yaml:"max_size" toml:"max_size"`
+}
+
+// Store holds the settings of the shop
+type Store struct {
+	// Currency is the lower case ISO 4217 code widgets are priced and
+	// charged in
+	Currency string `yaml:"currency" toml:"currency"`
+}
+
+// Inventory holds how long checkouts hold stock
+type Inventory struct {
+	// ReservationTTL is how long a payment intent holds the units it is for
+	ReservationTTL Duration `yaml:"reservation_ttl" toml:"reservation_ttl"`
+	// SweepInterval is how often expired reservations are released
+	SweepInterval Duration `yaml:"sweep_interval" toml:"sweep_interval"`
+}
+
+// SMTP holds the settings of the smtp mail transport
+type SMTP struct {
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	Username string `yaml:"username" toml:"username"`
+	Password Secret `yaml:"-" toml:"-"`
+}
+
+// Defaults returns the built-in settings, suitable for local development
+func Defaults() Config {
+	var c Config
+	c.Env = "development"
+
+	c.Web.Port = 3000
+	c.Web.API = "http://localhost:4001"
+	c.Web.Session.Store = "database"
+	c.Web.Session.Lifetime = Duration(24 * time.Hour)
+	c.Web.Session.Cleanup = Duration(5 * time.Minute)
+	c.Web.Session.Cookie.Name = "session"
+	c.Web.Session.Cookie.HTTPOnly = true
+	c.Web.Session.Cookie.SameSite = "lax"
+
+	c.API.Port = 4001
+	c.API.TokenTTL = Duration(24 * time.Hour)
+	c.API.CORSOrigins = []string{"http://localhost:3000"}
+	c.API.Frontend = "http://localhost:3000"
+	c.API.ResetTTL = Duration(30 * time.Minute)
+
+	c.DB.Dialect = driver.MySQL
+	c.DB.Host = "localhost"
+	c.DB.Port = 3306
+	c.DB.Database = "widgets"
+	c.DB.User = "root"
+	c.DB.MaxIdle = 2
+	c.DB.ConnMaxLifetime = Duration(time.Hour)
+	c.DB.ConnMaxIdleTime = Duration(5 * time.Minute)
+	c.DB.MaxReplicaLag = Duration(5 * time.Second)
+	c.DB.HealthInterval = Duration(30 * time.Second)
+	c.DB.QueryTimeout = Duration(3 * time.Second)
+	c.DB.SlowQuery = Duration(500 * time.Millisecond)
+
+	c.Mail.Transport = "log"
+	c.Mail.Dir = "./tmp/mail"
+	c.Mail.From = "gostripe <no-reply@gostripe.local>"
+	c.Mail.SMTP.Host = "localhost"
+	c.Mail.SMTP.Port = 1025
+
+	c.Images.Dir = "./static/widgets"
+	c.Images.MaxSize = 5 << 20
+
+	c.Store.Currency = "usd"
+
+	c.Inventory.ReservationTTL = Duration(15 * time.Minute)
+	c.Inventory.SweepInterval = Duration(time.Minute)
+
+	return c
+}
+
+// LoadSecrets reads the secrets from the environment and *_FILE paths
+func (c *Config) LoadSecrets() error {
+	var err error
+	load := func(name string) string {
+		if err != nil {
+			return ""
+		}
+		var v string
+		v, err = Lookup(name)
+		return v
+	}
+
+	c.Stripe.Key = load("STRIPE_KEY")
+	c.Stripe.Secret = Secret(load("STRIPE_SECRET"))
+	c.DB.Password = Secret(load("DB_PASSWORD"))
+	c.Mail.SMTP.Password = Secret(load("SMTP_PASSWORD"))
+	c.SigningKey = Secret(load("SIGNING_KEY"))
+	c.EncryptionKey = Secret(load("ENCRYPTION_KEY"))
+	return err
+}
+
+// Validate checks the settings and returns warnings for problems that
+// should not stop startup
+func (c *Config) Validate() ([]string, error) {
+	known := false
+	for _, env := range Environments {
+		known = known || env == c.Env
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown environment %q, want one of %s", c.Env, strings.Join(Environments, ", "))
+	}
+
+	for name, port := range map[string]int{"web.port": c.Web.Port, "api.port": c.API.Port, "mail.smtp.port": c.Mail.SMTP.Port} {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%s %d is out of range", name, port)
+		}
+	}
+
+	supported := false
+	for _, d := range driver.Dialects {
+		supported = supported || d == c.DB.Dialect
+	}
+	if !supported {
+		return nil, fmt.Errorf("unsupported database dialect %q", c.DB.Dialect)
+	}
+
+	if _, _, err := dsnPassword(c.DB.DSN); err != nil {
+		return nil, fmt.Errorf("invalid dsn: %w", err)
+	}
+
+	if c.DB.QueryTimeout <= 0 {
+		return nil, errors.New("db query_timeout must be positive")
+	}
+
+	if c.DB.HealthInterval <= 0 {
+		return nil, errors.New("db health_interval must be positive")
+	}
+
+	for i, r := range c.DB.Replicas {
+		if r.Name == "" {
+			return nil, fmt.Errorf("replica %d has no name", i+1)
+		}
+		if driver.DialectOf(r.DSN) != c.DB.Dialect {
+			return nil, fmt.Errorf("replica %s is not a %s database", r.Name, c.DB.Dialect)
+		}
+		if _, _, err := dsnPassword(r.DSN); err != nil {
+			return nil, fmt.Errorf("invalid dsn of replica %s: %w", r.Name, err)
+		}
+	}
+
+	if c.Images.Dir == "" {
+		return nil, errors.New("images dir must be set")
+	}
+	if c.Images.MaxSize <= 0 {
+		return nil, errors.New("images max_size must be positive")
+	}
+
+	if !validator.IsCurrency(c.Store.Currency) || c.Store.Currency != strings.ToLower(c.Store.Currency) {
+		return nil, fmt.Errorf("store currency %q is not a lower case ISO 4217 code such as usd", c.Store.Currency)
+	}
+
+	if c.Inventory.ReservationTTL <= 0 {
+		return nil, errors.New("inventory reservation_ttl must be positive")
+	}
+	if c.Inventory.SweepInterval <= 0 {
+		return nil, errors.New("inventory sweep_interval must be positive")
+	}
+
+	switch c.Mail.Transport {
+	case "smtp", "file", "log":
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q, want smtp, file or log", c.Mail.Transport)
+	}
+
+	warnings, err := cards.CheckKeys(c.Stripe.Key, string(c.Stripe.Secret), c.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.SigningKey == "" {
+		warnings = append(warnings, "SIGNING_KEY is not set, password reset is disabled")
+	}
+	if c.EncryptionKey == "" {
+		warnings = append(warnings, "ENCRYPTION_KEY is not set, two-factor enrollment and verification are disabled")
+	}
+
+	return warnings, nil
+}
+
+// DataSourceName returns the DSN with DB.Password applied
+func (c *Config) DataSourceName() string {
+	if c.DB.Password == "" {
+		return c.DB.DSN
+	}
+
+	_, with, err := dsnPassword(c.DB.DSN)
+	if err != nil {
+		return c.DB.DSN
+	}
+	return with(string(c.DB.Password))
+}
+
+// ReplicaDataSourceNames returns the replica DSNs with DB.Password applied
+func (c *Config) ReplicaDataSourceNames() []string {
+	dsns := make([]string, len(c.DB.Replicas))
+	for i, r := range c.DB.Replicas {
+		dsns[i] = r.DSN
+		if c.DB.Password == "" {
+			continue
+		}
+		if _, with, err := dsnPassword(r.DSN); err == nil {
+			dsns[i] = with(string(c.DB.Password))
+		}
+	}
+	return dsns
+}
+
+// PoolConfig returns the connection pool settings
+func (db DB) PoolConfig() driver.DBConfiguration {
+	return driver.DBConfiguration{
+		MaxOpenConns:    db.Pool,
+		MaxIdleConns:    db.MaxIdle,
+		ConnMaxLifetime: time.Duration(db.ConnMaxLifetime),
+		ConnMaxIdleTime: time.Duration(db.ConnMaxIdleTime),
+	}
+}
+
+// dsnPassword parses dsn in the syntax of its dialect and returns its
+// password and a function that rewrites dsn with another one. SQLite has
+// no passwords, so its DSNs are never rewritten.
+func dsnPassword(dsn string) (password string, with func(string) string, err error) {
+	switch driver.DialectOf(dsn) {
+	case driver.Postgres:
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", nil, err
+		}
+		if u.User == nil {
+			return "", func(string) string { return dsn }, nil
+		}
+		password, _ = u.User.Password()
+		return password, func(p string) string {
+			v := *u
+			v.User = url.UserPassword(u.User.Username(), p)
+			return v.String()
+		}, nil
+
+	case driver.MySQL:
+		scheme := ""
+		if strings.HasPrefix(dsn, "mysql://") {
+			scheme = "mysql://"
+		}
+		cfg, err := mysql.ParseDSN(strings.TrimPrefix(dsn, scheme))
+		if err != nil {
+			return "", nil, err
+		}
+		return cfg.Passwd, func(p string) string {
+			v := cfg.Clone()
+			v.Passwd = p
+			return scheme + v.FormatDSN()
+		}, nil
+
+	default:
+		return "", func(string) string { return dsn }, nil
+	}
+}
+
+// buildDSN assembles a DSN in the syntax of db.Dialect from the
+// database.yml style fields
+func (db DB) buildDSN() string {
+	switch db.Dialect {
+	case driver.Postgres:
+		u := url.URL{
+			Scheme: "postgres",
+			User:   url.User(db.User),
+			Host:   net.JoinHostPort(db.Host, strconv.Itoa(db.Port)),
+			Path:   "/" + db.Database,
+		}
+		if db.Password != "" {
+			u.User = url.UserPassword(db.User, string(db.Password))
+		}
+		return u.String()
+	case driver.SQLite:
+		return "sqlite:" + db.Database
+	default:
+		dsn := mysql.NewConfig()
+		dsn.User = db.User
+		dsn.Passwd = string(db.Password)
+		dsn.Net = "tcp"
+		dsn.Addr = net.JoinHostPort(db.Host, strconv.Itoa(db.Port))
+		dsn.DBName = db.Database
+		dsn.ParseTime = true
+		return dsn.FormatDSN()
+	}
+}
+
+// Redacted describes the main settings with every secret hidden, for logging
+func (c *Config) Redacted() string {
+	return fmt.Sprintf("environment=%s web.port=%d api.port=%d dsn=%s stripe.key=%s stripe.secret=%s signing_key=%s encryption_key=%s",
+		c.Env, c.Web.Port, c.API.Port, RedactDSN(c.DataSourceName()), c.Stripe.Key, c.Stripe.Secret, c.SigningKey, c.EncryptionKey)
+}
+
+// RedactDSN hides the password of a DSN
+func RedactDSN(dsn string) string {
+	password, with, err := dsnPassword(dsn)
+	if err != nil {
+		return "[unparseable dsn]"
+	}
+	if password == "" {
+		return dsn
+	}
+	return with("xxxxx")
+}
+
+// Lookup returns the secret name from the file named by name_FILE when that
+// variable is set, and from the environment variable name otherwise. A
+// trailing newline in the file is ignored.
+func Lookup(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_FILE: %w", name, err)
+	}
+
+	v := strings.TrimRight(string(b), "\r\n")
+	if v == "" {
+		return "", errors.New(name + "_FILE names an empty file")
+	}
+	return v, nil
+}
+
+// registerFlags defines the flags of program, "web" or "api", on fs bound to c
+func (c *Config) registerFlags(fs *flag.FlagSet, program string) {
+	fs.StringVar(&c.Env, "environment", c.Env, "📌 application runtime environment: "+strings.Join(Environments, ", "))
+	fs.StringVar(&c.DB.DSN, "dsn", c.DB.DSN, "📌 database domain service name (DSN), overrides database.yml")
+	fs.BoolVar(&c.DB.Migrate, "migrate", c.DB.Migrate, "📌 apply pending database migrations before serving")
+	fs.Var(&c.DB.QueryTimeout, "query-timeout", "📌 longest a model method may spend on the database")
+	fs.Var(&c.DB.SlowQuery, "slow-query", "📌 log statements running at least this long, 0 to disable")
+	fs.StringVar(&c.Images.Dir, "images-dir", c.Images.Dir, "📌 directory uploaded widget images are stored in")
+
+	switch program {
+	case "web":
+		fs.IntVar(&c.Web.Port, "port", c.Web.Port, "📌 app server port")
+		fs.StringVar(&c.Web.API, "api", c.Web.API, "📌 api endpoint entry for application")
+		fs.StringVar(&c.Web.Session.Store, "session-store", c.Web.Session.Store, "📌 where sessions are kept: database or memory (single instance development only)")
+		fs.Var(&c.Web.Session.Lifetime, "session-lifetime", "📌 how long a session lasts")
+		fs.Var(&c.Web.Session.Cleanup, "session-cleanup", "📌 how often expired sessions are deleted from the database")
+		fs.StringVar(&c.Web.Session.Cookie.Name, "cookie-name", c.Web.Session.Cookie.Name, "📌 name of the session cookie")
+		fs.StringVar(&c.Web.Session.Cookie.Domain, "cookie-domain", c.Web.Session.Cookie.Domain, "📌 domain of the session cookie, empty for the host that set it")
+		fs.BoolVar(&c.Web.Session.Cookie.Secure, "cookie-secure", c.Web.Session.Cookie.Secure, "📌 only send the session cookie over https")
+		fs.BoolVar(&c.Web.Session.Cookie.HTTPOnly, "cookie-httponly", c.Web.Session.Cookie.HTTPOnly, "📌 hide the session cookie from javascript")
+		fs.StringVar(&c.Web.Session.Cookie.SameSite, "cookie-samesite", c.Web.Session.Cookie.SameSite, "📌 SameSite mode of the session cookie: lax, strict or none")
+	case "api":
+		fs.IntVar(&c.API.Port, "port", c.API.Port, "📌 app server port")
+		fs.Var(&c.API.TokenTTL, "token-ttl", "📌 lifetime of bearer tokens issued by /api/v1/authenticate")
+		fs.Var((*list)(&c.API.CORSOrigins), "cors-origins", "📌 comma separated origins allowed to call the api from a browser")
+		fs.StringVar(&c.API.Frontend, "frontend", c.API.Frontend, "📌 url of the web frontend, used in links sent by email")
+		fs.Var(&c.API.ResetTTL, "reset-ttl", "📌 lifetime of password reset links")
+		fs.Var(&c.Inventory.ReservationTTL, "reservation-ttl", "📌 how long an unpaid checkout holds the stock it is for")
+		fs.StringVar(&c.Mail.Transport, "mailer", c.Mail.Transport, "📌 mail transport {smtp|file|log}")
+		fs.StringVar(&c.Mail.Dir, "mail-dir", c.Mail.Dir, "📌 directory the file mailer writes messages to")
+		fs.StringVar(&c.Mail.From, "mail-from", c.Mail.From, "📌 sender address of outgoing mail")
+		fs.StringVar(&c.Mail.SMTP.Host, "smtp-host", c.Mail.SMTP.Host, "📌 smtp server host")
+		fs.IntVar(&c.Mail.SMTP.Port, "smtp-port", c.Mail.SMTP.Port, "📌 smtp server port")
+		fs.StringVar(&c.Mail.SMTP.Username, "smtp-username", c.Mail.SMTP.Username, "📌 smtp username, empty for unauthenticated servers")
+	}
+}
+
+// list is a comma separated flag value
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = strings.Split(s, ",")
+	return nil
+}
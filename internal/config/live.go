@@ -0,0 +1,97 @@
+package config
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/driver"
+)
+
+// Live holds the running configuration and lets its secrets be reloaded
+// while the process runs. It is safe for concurrent use.
+type Live struct {
+	mu  sync.RWMutex
+	cfg Config
+}
+
+// NewLive returns a Live holding cfg
+func NewLive(cfg Config) *Live {
+	return &Live{cfg: cfg}
+}
+
+// Config returns a copy of the current configuration
+func (l *Live) Config() Config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+// Reload reads the secrets again and swaps them in when they validate. The
+// environment of a running process cannot change, so rotation takes effect
+// through *_FILE paths.
+func (l *Live) Reload() ([]string, error) {
+	cfg := l.Config()
+	if err := cfg.LoadSecrets(); err != nil {
+		return nil, err
+	}
+
+	warnings, err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	l.cfg = cfg
+	l.mu.Unlock()
+	return warnings, nil
+}
+
+// ReloadOnSIGHUP reloads the secrets every time the process receives SIGHUP,
+// keeping the previous ones when the new ones are invalid
+func (l *Live) ReloadOnSIGHUP(infoLog, errorLog *log.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for range c {
+			warnings, err := l.Reload()
+			if err != nil {
+				errorLog.Printf("config reload failed, keeping the previous secrets: %v", err)
+				continue
+			}
+			for _, w := range warnings {
+				infoLog.Println(w)
+			}
+			cfg := l.Config()
+			infoLog.Printf("config reloaded: %s", cfg.Redacted())
+		}
+	}()
+}
+
+// OpenDB connects to the primary database and its replicas with the pool
+// settings of the configuration. Every pool dials with the current
+// password, so a reloaded DB_PASSWORD_FILE applies to new connections.
+func (l *Live) OpenDB() (*driver.DB, error) {
+	cfg := l.Config()
+
+	replicas := make([]driver.Replica, len(cfg.DB.Replicas))
+	for i, r := range cfg.DB.Replicas {
+		i := i
+		replicas[i] = driver.Replica{
+			Name: r.Name,
+			DSN: func() string {
+				c := l.Config()
+				return c.ReplicaDataSourceNames()[i]
+			},
+		}
+	}
+
+	return driver.Open(func() string {
+		c := l.Config()
+		return c.DataSourceName()
+	}, replicas, cfg.DB.PoolConfig(), time.Duration(cfg.DB.MaxReplicaLag))
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caleberi/gostripe/internal/driver"
+	"gopkg.in/yaml.v3"
+)
+
+// default locations of the config files, relative to the working directory
+const (
+	defaultConfigFile   = "gostripe.yml"
+	defaultDatabaseFile = "database.yml"
+)
+
+// envOverrides maps environment variables to the settings they override
+var envOverrides = map[string]func(c *Config, v string) error{
+	"DSN":           func(c *Config, v string) error { c.DB.DSN = v; return nil },
+	"DB_REPLICAS":   setReplicas,
+	"WEB_PORT":      func(c *Config, v string) error { return setInt(&c.Web.Port, v) },
+	"API_PORT":      func(c *Config, v string) error { return setInt(&c.API.Port, v) },
+	"API_URL":       func(c *Config, v string) error { c.Web.API = v; return nil },
+	"FRONTEND_URL":  func(c *Config, v string) error { c.API.Frontend = v; return nil },
+	"CORS_ORIGINS":  func(c *Config, v string) error { return (*list)(&c.API.CORSOrigins).Set(v) },
+	"MAILER":        func(c *Config, v string) error { c.Mail.Transport = v; return nil },
+	"SMTP_HOST":     func(c *Config, v string) error { c.Mail.SMTP.Host = v; return nil },
+	"SMTP_PORT":     func(c *Config, v string) error { return setInt(&c.Mail.SMTP.Port, v) },
+	"SMTP_USERNAME": func(c *Config, v string) error { c.Mail.SMTP.Username = v; return nil },
+	"IMAGES_DIR":    func(c *Config, v string) error { c.Images.Dir = v; return nil },
+	"CURRENCY":      func(c *Config, v string) error { c.Store.Currency = v; return nil },
+}
+
+// setReplicas reads DB_REPLICAS, a comma separated list of DSNs or
+// name=DSN pairs
+func setReplicas(c *Config, v string) error {
+	c.DB.Replicas = nil
+	for i, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		r := Replica{Name: fmt.Sprintf("replica%d", i+1), DSN: item}
+		if name, dsn, ok := strings.Cut(item, "="); ok && !strings.ContainsAny(name, "@:/") {
+			r.Name, r.DSN = name, dsn
+		}
+		c.DB.Replicas = append(c.DB.Replicas, r)
+	}
+	return nil
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+// Load builds the configuration of program, "web" or "api", from the
+// layers described in the package documentation. args are the command line
+// arguments without the program name. Besides the program's own flags it
+// accepts -config and -database-config naming the config files; missing
+// files at the default locations are skipped.
+func Load(program string, args []string) (*Config, error) {
+	// the first pass only finds the environment and the config files, and
+	// reports unknown flags with the built-in defaults in the usage text
+	defaults := Defaults()
+	if env := os.Getenv("GOSTRIPE_ENV"); env != "" {
+		defaults.Env = env
+	}
+
+	fs := flag.NewFlagSet(program, flag.ContinueOnError)
+	configFile := fs.String("config", defaultConfigFile, "📌 config file, .yml, .yaml or .toml, with a section per environment")
+	databaseFile := fs.String("database-config", defaultDatabaseFile, "📌 database.yml with a section per environment")
+	defaults.registerFlags(fs, program)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	cfg := Defaults()
+	cfg.Env = defaults.Env
+
+	if err := readSection(*databaseFile, cfg.Env, &cfg.DB, explicit["database-config"]); err != nil {
+		return nil, err
+	}
+	if err := readSection(*configFile, cfg.Env, &cfg, explicit["config"]); err != nil {
+		return nil, err
+	}
+
+	// the password of database.yml is folded into the DSN here, so that
+	// afterwards DB.Password only carries DB_PASSWORD
+	if cfg.DB.DSN == "" {
+		cfg.DB.DSN = cfg.DB.buildDSN()
+	}
+	cfg.DB.Password = ""
+
+	for name, apply := range envOverrides {
+		if v, ok := os.LookupEnv(name); ok {
+			if err := apply(&cfg, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	// the second pass applies only the flags given on the command line
+	fs = flag.NewFlagSet(program, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.String("config", "", "")
+	fs.String("database-config", "", "")
+	cfg.registerFlags(fs, program)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// the scheme of the final DSN decides the dialect
+	cfg.DB.Dialect = driver.DialectOf(cfg.DB.DSN)
+
+	if err := cfg.LoadSecrets(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// readSection decodes the section env of the YAML or TOML file path into
+// dst. A missing file is an error only when required.
+func readSection(path, env string, dst interface{}, required bool) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		var sections map[string]toml.Primitive
+		md, err := toml.Decode(string(b), &sections)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		section, ok := sections[env]
+		if !ok {
+			return nil
+		}
+		if err := md.PrimitiveDecode(section, dst); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, env, err)
+		}
+	case ".yml", ".yaml":
+		var sections map[string]yaml.Node
+		if err := yaml.Unmarshal(b, &sections); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		section, ok := sections[env]
+		if !ok {
+			return nil
+		}
+		if err := section.Decode(dst); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, env, err)
+		}
+	default:
+		return fmt.Errorf("%s: unknown config file type, want .yml, .yaml or .toml", path)
+	}
+
+	return nil
+}
+
+// Print writes the effective settings as YAML with every secret masked
+func (c *Config) Print(w io.Writer) error {
+	view := *c
+	view.DB.DSN = RedactDSN(c.DataSourceName())
+	view.DB.Password = ""
+	view.DB.Replicas = make([]Replica, len(c.DB.Replicas))
+	for i, dsn := range c.ReplicaDataSourceNames() {
+		view.DB.Replicas[i] = Replica{Name: c.DB.Replicas[i].Name, DSN: RedactDSN(dsn)}
+	}
+
+	out := struct {
+		Environment string `yaml:"environment"`
+		Config      `yaml:",inline"`
+		Secrets     map[string]string `yaml:"secrets"`
+	}{
+		Environment: c.Env,
+		Config:      view,
+		Secrets: map[string]string{
+			"STRIPE_KEY":     c.Stripe.Key,
+			"STRIPE_SECRET":  c.Stripe.Secret.String(),
+			"DB_PASSWORD":    c.DB.Password.String(),
+			"SMTP_PASSWORD":  c.Mail.SMTP.Password.String(),
+			"SIGNING_KEY":    c.SigningKey.String(),
+			"ENCRYPTION_KEY": c.EncryptionKey.String(),
+		},
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(out); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,263 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DB is a primary database with optional read replicas. Writes and reads
+// that must see them go to Primary; read-only queries that tolerate a
+// little staleness go to Reader, which picks a healthy replica whose
+// replication lag is within MaxLag and falls back to the primary otherwise.
+type DB struct {
+	Primary *sql.DB
+	Dialect Dialect
+	// MaxLag is the replication lag beyond which a replica is skipped
+	MaxLag time.Duration
+
+	nodes []*node // the primary first, then the replicas
+	next  uint32
+}
+
+// node is one connection pool and its last health check
+type node struct {
+	name string
+	db   *sql.DB
+
+	mu      sync.RWMutex
+	healthy bool
+	lag     time.Duration
+	checked time.Time
+	err     error
+}
+
+// NodeStats reports the health and pool statistics of one database
+type NodeStats struct {
+	Name    string `json:"name"`
+	Primary bool   `json:"primary"`
+	Healthy bool   `json:"healthy"`
+	// LagSeconds is the replication lag of a replica at the last check
+	LagSeconds float64     `json:"lag_seconds"`
+	Checked    time.Time   `json:"checked_at"`
+	Error      string      `json:"error,omitempty"`
+	Pool       sql.DBStats `json:"pool"`
+}
+
+// Replica names a read replica and the DSN to dial it with
+type Replica struct {
+	// Name labels the replica in stats and logs and must not contain secrets
+	Name string
+	DSN  func() string
+}
+
+// Open connects to the primary and every replica, applying pool to each.
+// The DSN functions are called at dial time so rotated passwords apply to
+// new connections.
+func Open(primary func() string, replicas []Replica, pool DBConfiguration, maxLag time.Duration) (*DB, error) {
+	conn, err := OpenDBFunc(primary)
+	if err != nil {
+		return nil, err
+	}
+	pool.Apply(conn)
+
+	db := &DB{
+		Primary: conn,
+		Dialect: DialectOf(primary()),
+		MaxLag:  maxLag,
+		nodes:   []*node{{name: "primary", db: conn}},
+	}
+	db.check(context.Background(), db.nodes[0])
+
+	for _, replica := range replicas {
+		if d := DialectOf(replica.DSN()); d != db.Dialect {
+			db.Close()
+			return nil, fmt.Errorf("replica %s is %s, the primary is %s", replica.Name, d, db.Dialect)
+		}
+
+		// a replica that is down at startup is retried by the health checks
+		// instead of stopping the application
+		r := sql.OpenDB(dsnConnector{dsn: replica.DSN, drv: db.Dialect.driver()})
+		pool.Apply(r)
+		n := &node{name: replica.Name, db: r}
+		db.nodes = append(db.nodes, n)
+		db.check(context.Background(), n)
+	}
+
+	return db, nil
+}
+
+// Reader returns the pool to run a read-only query on
+func (db *DB) Reader() *sql.DB {
+	replicas := db.nodes[1:]
+	if len(replicas) == 0 {
+		return db.Primary
+	}
+
+	start := atomic.AddUint32(&db.next, 1)
+	for i := range replicas {
+		n := replicas[(int(start)+i)%len(replicas)]
+		n.mu.RLock()
+		ok := n.healthy && (db.MaxLag == 0 || n.lag <= db.MaxLag)
+		n.mu.RUnlock()
+		if ok {
+			return n.db
+		}
+	}
+	return db.Primary
+}
+
+// Stats returns the health and pool statistics of the primary and replicas
+func (db *DB) Stats() []NodeStats {
+	stats := make([]NodeStats, 0, len(db.nodes))
+	for i, n := range db.nodes {
+		n.mu.RLock()
+		s := NodeStats{
+			Name:       n.name,
+			Primary:    i == 0,
+			Healthy:    n.healthy,
+			LagSeconds: n.lag.Seconds(),
+			Checked:    n.checked,
+			Pool:       n.db.Stats(),
+		}
+		if n.err != nil {
+			s.Error = n.err.Error()
+		}
+		n.mu.RUnlock()
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// Watch pings every database each interval until ctx is done, recording
+// replication lag, and calls logf when a database goes down or comes back
+func (db *DB) Watch(ctx context.Context, interval time.Duration, logf func(format string, v ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, n := range db.nodes {
+				was := n.isHealthy()
+				db.check(ctx, n)
+				if now := n.isHealthy(); now != was && logf != nil {
+					if now {
+						logf("database %s is back", n.name)
+					} else {
+						logf("database %s is unhealthy: %v", n.name, n.lastErr())
+					}
+				}
+			}
+		}
+	}
+}
+
+// Close closes every pool
+func (db *DB) Close() error {
+	var errs []error
+	for _, n := range db.nodes {
+		if err := n.db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// check pings n and, for a replica, measures its replication lag
+func (db *DB) check(ctx context.Context, n *node) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := n.db.PingContext(ctx)
+
+	var lag time.Duration
+	if err == nil && n != db.nodes[0] {
+		lag, err = db.Dialect.replicationLag(ctx, n.db)
+	}
+
+	n.mu.Lock()
+	n.healthy = err == nil
+	n.lag = lag
+	n.err = err
+	n.checked = time.Now()
+	n.mu.Unlock()
+}
+
+func (n *node) isHealthy() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.healthy
+}
+
+func (n *node) lastErr() error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.err
+}
+
+// replicationLag asks a replica how far it is behind its primary
+func (d Dialect) replicationLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	switch d {
+	case Postgres:
+		var seconds float64
+		err := db.QueryRowContext(ctx, `
+			SELECT COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)`).Scan(&seconds)
+		return time.Duration(seconds * float64(time.Second)), err
+	case MySQL:
+		return mysqlReplicationLag(ctx, db)
+	default:
+		return 0, nil
+	}
+}
+
+// mysqlReplicationLag reads Seconds_Behind_Source, or Seconds_Behind_Master
+// before MySQL 8.0.22, from the replica status
+func mysqlReplicationLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, `SHOW REPLICA STATUS`)
+	if err != nil {
+		rows, err = db.QueryContext(ctx, `SHOW SLAVE STATUS`)
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		return 0, errors.New("not a replica")
+	}
+
+	values := make([]sql.NullString, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+
+	for i, col := range cols {
+		if col != "Seconds_Behind_Source" && col != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, errors.New("replication is stopped")
+		}
+		var seconds int64
+		if _, err := fmt.Sscan(values[i].String, &seconds); err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, errors.New("replica status has no lag column")
+}
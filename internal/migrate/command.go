@@ -0,0 +1,115 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Usage describes the migrate subcommand
+const Usage = `usage: migrate up | down [N] | to VERSION | status [flags]
+
+  up          apply every pending migration
+  down [N]    revert the last N migrations, 1 by default
+  to VERSION  apply or revert migrations until VERSION is the latest applied, 0 reverts all
+  status      list migrations and when they were applied`
+
+// Command is a parsed migrate subcommand
+type Command struct {
+	// Name is up, down, to or status
+	Name string
+	// Steps is the number of migrations down reverts
+	Steps int
+	// Version is the target of to
+	Version int64
+}
+
+// ParseCommand parses the arguments of the migrate subcommand. The flags
+// that follow the positional arguments are returned unparsed.
+func ParseCommand(args []string) (cmd Command, flags []string, err error) {
+	positional := args
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			positional, flags = args[:i], args[i:]
+			break
+		}
+	}
+
+	if len(positional) == 0 {
+		return cmd, nil, errors.New(Usage)
+	}
+	cmd.Name = positional[0]
+
+	switch {
+	case cmd.Name == "up" && len(positional) == 1,
+		cmd.Name == "status" && len(positional) == 1:
+	case cmd.Name == "down" && len(positional) == 1:
+		cmd.Steps = 1
+	case cmd.Name == "down" && len(positional) == 2:
+		cmd.Steps, err = strconv.Atoi(positional[1])
+		if err != nil || cmd.Steps < 1 {
+			return cmd, nil, fmt.Errorf("migrate: down wants a positive count, got %q", positional[1])
+		}
+	case cmd.Name == "to" && len(positional) == 2:
+		cmd.Version, err = strconv.ParseInt(positional[1], 10, 64)
+		if err != nil || cmd.Version < 0 {
+			return cmd, nil, fmt.Errorf("migrate: bad version %q", positional[1])
+		}
+	default:
+		return cmd, nil, errors.New(Usage)
+	}
+
+	return cmd, flags, nil
+}
+
+// Run executes cmd and reports the result on w
+func (m *Migrator) Run(ctx context.Context, w io.Writer, cmd Command) error {
+	switch cmd.Name {
+	case "up":
+		n, err := m.Up(ctx)
+		fmt.Fprintf(w, "applied %d migrations\n", n)
+		return err
+	case "down":
+		n, err := m.Down(ctx, cmd.Steps)
+		fmt.Fprintf(w, "reverted %d migrations\n", n)
+		return err
+	case "to":
+		n, err := m.To(ctx, cmd.Version)
+		fmt.Fprintf(w, "ran %d migrations\n", n)
+		return err
+	case "status":
+		return m.printStatus(ctx, w)
+	default:
+		return errors.New(Usage)
+	}
+}
+
+func (m *Migrator) printStatus(ctx context.Context, w io.Writer) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, s := range statuses {
+		state, at := "pending", ""
+		switch {
+		case s.Dirty:
+			state = "dirty"
+		case s.Applied && s.Name == "":
+			state = "applied, not embedded"
+		case s.Applied:
+			state = "applied"
+		}
+		if s.Applied {
+			at = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, at)
+	}
+	return tw.Flush()
+}
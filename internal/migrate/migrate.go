@@ -0,0 +1,510 @@
+// Package migrate applies the embedded database migrations and records them
+// in the schema_migrations table.
+//
+// Each dialect has its own directory, mysql/, postgres/ and sqlite/, of
+// VERSION_name.up.sql and VERSION_name.down.sql pairs, where VERSION is a
+// timestamp, and statements are separated by semicolons. Every directory
+// must hold the same versions.
+//
+// Postgres and SQLite run each migration in a transaction. MySQL commits DDL
+// implicitly, so a migration that fails half way leaves its version marked
+// dirty; fix the schema by hand, delete the row and run the migration again.
+//
+// The database user needs the CREATE, ALTER, DROP, INDEX and REFERENCES
+// privileges on the schema.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/driver"
+)
+
+//go:embed mysql/*.sql postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// lockName is the MySQL named lock held while migrations run
+const lockName = "gostripe_schema_migrations"
+
+// lockKey is the Postgres advisory lock held while migrations run
+const lockKey = 7031966100
+
+// lockTimeout is how long to wait for another instance to finish migrating
+const lockTimeout = 60 * time.Second
+
+// ErrDirty is returned when a previous migration failed part way
+var ErrDirty = errors.New("migrate: schema is dirty")
+
+// Migration is one embedded migration
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes a migration and whether it has been applied
+type Status struct {
+	Migration
+	Applied   bool
+	Dirty     bool
+	AppliedAt time.Time
+}
+
+// Migrator applies migrations to a database
+type Migrator struct {
+	DB         *sql.DB
+	Dialect    driver.Dialect
+	Migrations []Migration
+	// Log, when set, is called with a line for each migration applied or reverted
+	Log func(format string, v ...interface{})
+}
+
+// New returns a migrator for db with the embedded migrations of dialect
+func New(db *sql.DB, dialect driver.Dialect) (*Migrator, error) {
+	if dialect == "" {
+		dialect = driver.MySQL
+	}
+	migrations, err := Load(files, string(dialect))
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Dialect: dialect, Migrations: migrations}, nil
+}
+
+// Load reads the migrations in dir of fsys, sorted by version
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		i := strings.IndexByte(base, '_')
+		if i < 0 {
+			return nil, fmt.Errorf("migrate: %s: want VERSION_name.%s.sql", name, direction)
+		}
+		version, err := strconv.ParseInt(base[:i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %s: bad version: %w", name, err)
+		}
+
+		b, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: base[i+1:]}
+			byVersion[version] = m
+		} else if m.Name != base[i+1:] {
+			return nil, fmt.Errorf("migrate: version %d is used by %s and %s", version, m.Name, base[i+1:])
+		}
+
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" {
+			return nil, fmt.Errorf("migrate: %d_%s has no up migration", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Up applies every pending migration and returns how many ran
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	if len(m.Migrations) == 0 {
+		return 0, nil
+	}
+	return m.To(ctx, m.Migrations[len(m.Migrations)-1].Version)
+}
+
+// Down reverts the n most recently applied migrations and returns how many ran
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	var count int
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.Migrations) - 1; i >= 0 && count < n; i-- {
+			mg := m.Migrations[i]
+			if _, ok := applied[mg.Version]; !ok {
+				continue
+			}
+			if err := m.run(ctx, conn, mg, false); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// To migrates up or down so that exactly the migrations up to and including
+// version are applied, and returns how many ran. Version 0 reverts everything.
+func (m *Migrator) To(ctx context.Context, version int64) (int, error) {
+	if version != 0 && m.find(version) < 0 {
+		return 0, fmt.Errorf("migrate: unknown version %d", version)
+	}
+
+	var count int
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.Migrations) - 1; i >= 0; i-- {
+			mg := m.Migrations[i]
+			if _, ok := applied[mg.Version]; !ok || mg.Version <= version {
+				continue
+			}
+			if err := m.run(ctx, conn, mg, false); err != nil {
+				return err
+			}
+			count++
+		}
+
+		for _, mg := range m.Migrations {
+			if _, ok := applied[mg.Version]; ok || mg.Version > version {
+				continue
+			}
+			if err := m.run(ctx, conn, mg, true); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Status lists every known migration, and any applied version that is no
+// longer embedded, in version order
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := m.ensureTable(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, dirty, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make(map[int64]*Status)
+	for _, mg := range m.Migrations {
+		statuses[mg.Version] = &Status{Migration: mg}
+	}
+
+	for rows.Next() {
+		var s Status
+		if err := rows.Scan(&s.Version, &s.Dirty, &s.AppliedAt); err != nil {
+			return nil, err
+		}
+		if known, ok := statuses[s.Version]; ok {
+			known.Applied, known.Dirty, known.AppliedAt = true, s.Dirty, s.AppliedAt
+			continue
+		}
+		s.Applied = true
+		statuses[s.Version] = &s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]Status, 0, len(statuses))
+	for _, s := range statuses {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+
+	return list, nil
+}
+
+func (m *Migrator) find(version int64) int {
+	for i, mg := range m.Migrations {
+		if mg.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// locked runs fn on a single connection holding the migration lock, so that
+// instances starting together apply each migration once. SQLite serializes
+// writers itself and has no lock to take.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch m.Dialect {
+	case driver.MySQL:
+		var got sql.NullInt64
+		err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, lockName, int(lockTimeout/time.Second)).Scan(&got)
+		if err != nil {
+			return err
+		}
+		if got.Int64 != 1 {
+			return fmt.Errorf("migrate: another instance held the lock for more than %s", lockTimeout)
+		}
+		defer conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, lockName)
+
+	case driver.Postgres:
+		lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(lockCtx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+			if errors.Is(lockCtx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("migrate: another instance held the lock for more than %s", lockTimeout)
+			}
+			return err
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+	}
+
+	if err := m.ensureTable(ctx, conn); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// ensureTable creates schema_migrations. On first use it imports the
+// versions recorded by the soda tool in schema_migration, so databases
+// migrated with the old .fizz files are not migrated twice.
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT NOT NULL PRIMARY KEY,
+			dirty BOOLEAN NOT NULL DEFAULT FALSE,
+			applied_at TIMESTAMP NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations`).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migration`)
+	if err != nil {
+		// no soda history to import
+		return nil
+	}
+	var versions []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		version, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		_, err = conn.ExecContext(ctx, m.Dialect.Rebind(`INSERT INTO schema_migrations (version, dirty, applied_at) VALUES (?, FALSE, ?)`), version, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applied returns the applied versions, or ErrDirty if one is marked dirty
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]struct{}, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, dirty FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]struct{})
+	for rows.Next() {
+		var version int64
+		var dirty bool
+		if err := rows.Scan(&version, &dirty); err != nil {
+			return nil, err
+		}
+		if dirty {
+			return nil, fmt.Errorf("%w: version %d failed part way; repair it and delete its schema_migrations row", ErrDirty, version)
+		}
+		applied[version] = struct{}{}
+	}
+	return applied, rows.Err()
+}
+
+// run applies mg, or reverts it when up is false. Postgres and SQLite run
+// it in a transaction; MySQL marks the version dirty until every statement
+// has succeeded.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, mg Migration, up bool) error {
+	script, verb := mg.Up, "applied"
+	if !up {
+		script, verb = mg.Down, "reverted"
+		if strings.TrimSpace(script) == "" {
+			return fmt.Errorf("migrate: %d_%s cannot be reverted", mg.Version, mg.Name)
+		}
+	}
+
+	var err error
+	if m.Dialect == driver.MySQL {
+		err = m.runDirty(ctx, conn, mg, script, up)
+	} else {
+		err = m.runTx(ctx, conn, mg, script, up)
+	}
+	if err != nil {
+		return err
+	}
+
+	if m.Log != nil {
+		m.Log("migrate: %s %d_%s", verb, mg.Version, mg.Name)
+	}
+	return nil
+}
+
+func (m *Migrator) runTx(ctx context.Context, conn *sql.Conn, mg Migration, script string, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range Split(script) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migrate: %d_%s: %w", mg.Version, mg.Name, err)
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`INSERT INTO schema_migrations (version, dirty, applied_at) VALUES (?, FALSE, ?)`), mg.Version, time.Now())
+	} else {
+		_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`DELETE FROM schema_migrations WHERE version = ?`), mg.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) runDirty(ctx context.Context, conn *sql.Conn, mg Migration, script string, up bool) error {
+	var err error
+	if up {
+		_, err = conn.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty, applied_at) VALUES (?, TRUE, ?)`, mg.Version, time.Now())
+	} else {
+		_, err = conn.ExecContext(ctx, `UPDATE schema_migrations SET dirty = TRUE WHERE version = ?`, mg.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range Split(script) {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migrate: %d_%s: %w", mg.Version, mg.Name, err)
+		}
+	}
+
+	if up {
+		_, err = conn.ExecContext(ctx, `UPDATE schema_migrations SET dirty = FALSE WHERE version = ?`, mg.Version)
+	} else {
+		_, err = conn.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, mg.Version)
+	}
+	return err
+}
+
+// Split breaks a script into statements at semicolons outside quotes and
+// drops -- comments
+func Split(script string) []string {
+	var stmts []string
+	var b strings.Builder
+	var quote rune
+
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			b.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+			b.WriteRune(r)
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			b.WriteRune('\n')
+		case r == ';':
+			if s := strings.TrimSpace(b.String()); s != "" {
+				stmts = append(stmts, s)
+			}
+			b.Reset()
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if s := strings.TrimSpace(b.String()); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
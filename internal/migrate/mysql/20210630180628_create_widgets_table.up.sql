@@ -0,0 +1,12 @@
+CREATE TABLE widgets (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    description TEXT NOT NULL,
+    inventory_level INT NOT NULL,
+    price INT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB;
+
+INSERT INTO widgets (name, description, inventory_level, price, created_at, updated_at)
+VALUES ('Widget', 'A very nice widget.', 10, 1000, NOW(), NOW());
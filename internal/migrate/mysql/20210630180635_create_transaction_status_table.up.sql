@@ -0,0 +1,12 @@
+CREATE TABLE transaction_statuses (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB;
+
+INSERT INTO transaction_statuses (name) VALUES ('Pending');
+INSERT INTO transaction_statuses (name) VALUES ('Cleared');
+INSERT INTO transaction_statuses (name) VALUES ('Declined');
+INSERT INTO transaction_statuses (name) VALUES ('Refunded');
+INSERT INTO transaction_statuses (name) VALUES ('Partially refunded');
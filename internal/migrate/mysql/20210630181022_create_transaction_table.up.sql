@@ -0,0 +1,12 @@
+CREATE TABLE transactions (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    amount INT NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    last_four VARCHAR(255) NOT NULL,
+    bank_return_code VARCHAR(255) NOT NULL,
+    transaction_status_id INT UNSIGNED NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT transactions_transaction_status_id_fk FOREIGN KEY (transaction_status_id)
+        REFERENCES transaction_statuses (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB;
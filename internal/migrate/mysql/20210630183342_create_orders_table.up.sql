@@ -0,0 +1,14 @@
+CREATE TABLE orders (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    widget_id INT UNSIGNED NOT NULL,
+    transaction_id INT UNSIGNED NOT NULL,
+    status_id INT UNSIGNED NOT NULL,
+    quantity INT NOT NULL,
+    amount INT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT orders_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT orders_transaction_id_fk FOREIGN KEY (transaction_id)
+        REFERENCES transactions (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB;
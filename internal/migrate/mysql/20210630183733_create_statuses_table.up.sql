@@ -0,0 +1,13 @@
+CREATE TABLE statuses (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB;
+
+INSERT INTO statuses (name) VALUES ('Cleared');
+INSERT INTO statuses (name) VALUES ('Refunded');
+INSERT INTO statuses (name) VALUES ('Cancelled');
+
+ALTER TABLE orders ADD CONSTRAINT orders_status_id_fk FOREIGN KEY (status_id)
+    REFERENCES statuses (id) ON DELETE CASCADE ON UPDATE CASCADE;
@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN expiry_month INT NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN expiry_year INT NOT NULL DEFAULT 0;
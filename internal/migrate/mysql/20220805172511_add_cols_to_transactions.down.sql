@@ -0,0 +1,2 @@
+ALTER TABLE transactions DROP COLUMN payment_intent;
+ALTER TABLE transactions DROP COLUMN payment_method;
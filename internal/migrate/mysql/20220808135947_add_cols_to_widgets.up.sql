@@ -0,0 +1,2 @@
+ALTER TABLE widgets ADD COLUMN is_recurring BOOL NOT NULL DEFAULT 0;
+ALTER TABLE widgets ADD COLUMN plan_id VARCHAR(255) NOT NULL DEFAULT '';
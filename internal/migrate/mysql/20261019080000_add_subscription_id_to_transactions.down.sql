@@ -0,0 +1,2 @@
+ALTER TABLE transactions DROP INDEX transactions_subscription_id_idx;
+ALTER TABLE transactions DROP COLUMN subscription_id;
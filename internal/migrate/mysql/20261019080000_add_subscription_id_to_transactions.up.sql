@@ -0,0 +1,4 @@
+-- the stripe subscription a transaction pays for, so a subscription can be
+-- traced to its order; empty for one-off payments
+ALTER TABLE transactions ADD COLUMN subscription_id VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE transactions ADD KEY transactions_subscription_id_idx (subscription_id);
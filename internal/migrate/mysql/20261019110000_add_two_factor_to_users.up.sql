@@ -0,0 +1,24 @@
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(255) NULL;
+ALTER TABLE users ADD COLUMN totp_enabled_at TIMESTAMP NULL;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NULL;
+
+-- wrong codes are counted per user, so that starting a new login or calling
+-- the api does not reset the limit
+ALTER TABLE users ADD COLUMN totp_failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_locked_until TIMESTAMP NULL;
+
+ALTER TABLE roles ADD COLUMN requires_2fa BOOL NOT NULL DEFAULT FALSE;
+
+UPDATE roles SET requires_2fa = TRUE WHERE name IN ('admin', 'terminal-operator');
+
+CREATE TABLE recovery_codes (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY recovery_codes_user_id_code_hash_idx (user_id, code_hash),
+    CONSTRAINT recovery_codes_user_id_fk FOREIGN KEY (user_id)
+        REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB;
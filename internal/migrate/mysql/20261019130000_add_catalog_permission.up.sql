@@ -0,0 +1,4 @@
+INSERT INTO permissions (name, description) VALUES ('catalog:manage', 'Create, edit and delete widgets');
+
+INSERT INTO role_permissions (role_id, permission_id, created_at, updated_at)
+SELECT r.id, p.id, NOW(), NOW() FROM roles r, permissions p WHERE r.name = 'admin' AND p.name = 'catalog:manage';
@@ -0,0 +1,30 @@
+-- reserved_level counts the units held by unexpired reservations; a widget
+-- can be sold while inventory_level - reserved_level is positive
+ALTER TABLE widgets ADD COLUMN reserved_level INT NOT NULL DEFAULT 0;
+
+CREATE TABLE inventory_reservations (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    widget_id INT UNSIGNED NOT NULL,
+    quantity INT NOT NULL,
+    payment_intent VARCHAR(255) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY inventory_reservations_payment_intent_idx (payment_intent),
+    KEY inventory_reservations_expires_at_idx (expires_at),
+    CONSTRAINT inventory_reservations_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB;
+
+-- every change to inventory_level, with quantity negative for stock leaving
+CREATE TABLE inventory_movements (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    widget_id INT UNSIGNED NOT NULL,
+    quantity INT NOT NULL,
+    reason VARCHAR(32) NOT NULL,
+    reference VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY inventory_movements_widget_id_idx (widget_id, created_at),
+    KEY inventory_movements_reference_idx (reference),
+    CONSTRAINT inventory_movements_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB;
@@ -0,0 +1,4 @@
+ALTER TABLE inventory_reservations
+    DROP INDEX inventory_reservations_payment_intent_idx,
+    ADD UNIQUE KEY inventory_reservations_payment_intent_idx (payment_intent);
+DROP TABLE order_items;
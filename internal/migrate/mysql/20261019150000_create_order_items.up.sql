@@ -0,0 +1,30 @@
+-- the lines of an order; price is the unit price charged and amount is
+-- price times quantity, both in cents
+CREATE TABLE order_items (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    order_id INT UNSIGNED NOT NULL,
+    widget_id INT UNSIGNED NOT NULL,
+    quantity INT NOT NULL,
+    price INT NOT NULL,
+    amount INT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY order_items_order_id_idx (order_id),
+    KEY order_items_widget_id_idx (widget_id),
+    CONSTRAINT order_items_order_id_fk FOREIGN KEY (order_id)
+        REFERENCES orders (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT order_items_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB;
+
+-- orders placed before carts bought a single widget
+INSERT INTO order_items (order_id, widget_id, quantity, price, amount, created_at, updated_at)
+SELECT id, widget_id, quantity,
+    CASE WHEN quantity > 0 THEN amount DIV quantity ELSE amount END,
+    amount, created_at, updated_at
+FROM orders;
+
+-- a payment intent now holds one reservation per widget in the cart
+ALTER TABLE inventory_reservations
+    DROP INDEX inventory_reservations_payment_intent_idx,
+    ADD UNIQUE KEY inventory_reservations_payment_intent_idx (payment_intent, widget_id);
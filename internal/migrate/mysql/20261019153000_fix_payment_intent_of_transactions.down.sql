@@ -0,0 +1,14 @@
+-- the payment ids stay in their right columns: the code before this
+-- migration read them from there and only wrote them swapped
+ALTER TABLE transactions
+    DROP INDEX transactions_payment_intent_lookup_idx,
+    DROP INDEX transactions_payment_intent_idx,
+    DROP COLUMN payment_intent_key;
+
+-- the duplicates get their payment intent back
+UPDATE transactions SET payment_intent = (
+    SELECT payment_intent FROM duplicate_payment_intents
+    WHERE transaction_id = transactions.id
+)
+WHERE id IN (SELECT transaction_id FROM duplicate_payment_intents);
+DROP TABLE duplicate_payment_intents;
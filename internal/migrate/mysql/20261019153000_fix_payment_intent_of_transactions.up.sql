@@ -0,0 +1,41 @@
+-- transactions were recorded with the payment intent and the payment method
+-- in each other's columns; stripe ids start with pi_ and pm_ respectively
+ALTER TABLE transactions ADD COLUMN swapped_payment_method VARCHAR(255) NOT NULL DEFAULT '';
+UPDATE transactions SET swapped_payment_method = payment_intent
+WHERE SUBSTR(payment_method, 1, 3) = 'pi_' OR SUBSTR(payment_intent, 1, 3) = 'pm_';
+UPDATE transactions SET payment_intent = payment_method, payment_method = swapped_payment_method
+WHERE SUBSTR(payment_method, 1, 3) = 'pi_' OR SUBSTR(payment_intent, 1, 3) = 'pm_';
+ALTER TABLE transactions DROP COLUMN swapped_payment_method;
+
+-- a resubmitted payment form recorded its payment intent more than once;
+-- the payment stays on its first transaction only. The later ones are kept
+-- here with the payment intent they had, for staff to reconcile, and the
+-- down migration puts it back.
+CREATE TABLE duplicate_payment_intents (
+    transaction_id INT UNSIGNED NOT NULL PRIMARY KEY,
+    payment_intent VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT duplicate_payment_intents_transaction_id_fk FOREIGN KEY (transaction_id)
+        REFERENCES transactions (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB;
+
+INSERT INTO duplicate_payment_intents (transaction_id, payment_intent)
+SELECT id, payment_intent FROM transactions
+WHERE payment_intent <> ''
+    AND id NOT IN (
+        SELECT id FROM (
+            SELECT MIN(id) AS id FROM transactions
+            WHERE payment_intent <> ''
+            GROUP BY payment_intent
+        ) firsts
+    );
+
+UPDATE transactions SET payment_intent = ''
+WHERE id IN (SELECT transaction_id FROM duplicate_payment_intents);
+
+-- a payment intent is recorded once; subscriptions have none, and MySQL
+-- has no partial indexes, so the unique key is on the non-empty ones
+ALTER TABLE transactions
+    ADD COLUMN payment_intent_key VARCHAR(255) AS (NULLIF(payment_intent, '')) VIRTUAL,
+    ADD UNIQUE KEY transactions_payment_intent_idx (payment_intent_key),
+    ADD KEY transactions_payment_intent_lookup_idx (payment_intent);
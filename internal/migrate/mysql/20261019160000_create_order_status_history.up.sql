@@ -0,0 +1,29 @@
+-- every change of the status of an order; from_status_id is NULL for the
+-- entry recorded when the order is placed, user_id is NULL when no staff
+-- user made the change and source names what did
+CREATE TABLE order_status_history (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    order_id INT UNSIGNED NOT NULL,
+    from_status_id INT UNSIGNED NULL,
+    to_status_id INT UNSIGNED NOT NULL,
+    user_id INT UNSIGNED NULL,
+    source VARCHAR(64) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY order_status_history_order_id_idx (order_id),
+    CONSTRAINT order_status_history_order_id_fk FOREIGN KEY (order_id)
+        REFERENCES orders (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT order_status_history_from_status_id_fk FOREIGN KEY (from_status_id)
+        REFERENCES statuses (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT order_status_history_to_status_id_fk FOREIGN KEY (to_status_id)
+        REFERENCES statuses (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT order_status_history_user_id_fk FOREIGN KEY (user_id)
+        REFERENCES users (id) ON DELETE SET NULL ON UPDATE CASCADE
+) ENGINE=InnoDB;
+
+-- orders placed before the history was kept, with the last change of
+-- those that left the status they were placed in
+INSERT INTO order_status_history (order_id, from_status_id, to_status_id, source, created_at)
+SELECT id, NULL, 1, 'backfill', created_at FROM orders;
+
+INSERT INTO order_status_history (order_id, from_status_id, to_status_id, source, created_at)
+SELECT id, 1, status_id, 'backfill', updated_at FROM orders WHERE status_id <> 1;
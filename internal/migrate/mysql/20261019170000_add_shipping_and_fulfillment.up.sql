@@ -0,0 +1,50 @@
+-- the billing and shipping addresses given for an order, linked to the
+-- customer who gave them; an order has at most one of each kind
+CREATE TABLE addresses (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    customer_id INT UNSIGNED NULL,
+    order_id INT UNSIGNED NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    line1 VARCHAR(255) NOT NULL,
+    line2 VARCHAR(255) NOT NULL DEFAULT '',
+    city VARCHAR(255) NOT NULL,
+    region VARCHAR(255) NOT NULL DEFAULT '',
+    postal_code VARCHAR(32) NOT NULL DEFAULT '',
+    country CHAR(2) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY addresses_order_id_kind_idx (order_id, kind),
+    KEY addresses_customer_id_idx (customer_id),
+    CONSTRAINT addresses_customer_id_fk FOREIGN KEY (customer_id)
+        REFERENCES customers (id) ON DELETE SET NULL ON UPDATE CASCADE,
+    CONSTRAINT addresses_order_id_fk FOREIGN KEY (order_id)
+        REFERENCES orders (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB;
+
+-- the rules shipping is priced by: a flat rule adds amount to every order,
+-- a weight rule adds amount per started kilogram of widgets and a
+-- free_over rule waives shipping on orders whose widgets cost at least
+-- threshold; no rules means shipping is free
+CREATE TABLE shipping_rates (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    amount INT NOT NULL DEFAULT 0,
+    threshold INT NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB;
+
+-- weight in grams, for weight rules
+ALTER TABLE widgets ADD COLUMN weight INT NOT NULL DEFAULT 0;
+
+-- shipping_amount is the part of amount charged for shipping
+ALTER TABLE orders ADD COLUMN shipping_amount INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN fulfillment_status VARCHAR(16) NOT NULL DEFAULT 'unfulfilled';
+ALTER TABLE orders ADD COLUMN tracking_number VARCHAR(255) NOT NULL DEFAULT '';
+
+INSERT INTO permissions (name, description) VALUES ('orders:fulfill', 'Mark orders shipped or delivered');
+
+INSERT INTO role_permissions (role_id, permission_id, created_at, updated_at)
+SELECT r.id, p.id, NOW(), NOW() FROM roles r, permissions p WHERE r.name IN ('admin', 'support') AND p.name = 'orders:fulfill';
@@ -0,0 +1,12 @@
+CREATE TABLE widgets (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    inventory_level INTEGER NOT NULL,
+    price INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO widgets (name, description, inventory_level, price, created_at, updated_at)
+VALUES ('Widget', 'A very nice widget.', 10, 1000, NOW(), NOW());
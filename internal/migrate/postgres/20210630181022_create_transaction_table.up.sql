@@ -0,0 +1,12 @@
+CREATE TABLE transactions (
+    id SERIAL PRIMARY KEY,
+    amount INTEGER NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    last_four VARCHAR(255) NOT NULL,
+    bank_return_code VARCHAR(255) NOT NULL,
+    transaction_status_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT transactions_transaction_status_id_fk FOREIGN KEY (transaction_status_id)
+        REFERENCES transaction_statuses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
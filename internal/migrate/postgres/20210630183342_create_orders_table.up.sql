@@ -0,0 +1,14 @@
+CREATE TABLE orders (
+    id SERIAL PRIMARY KEY,
+    widget_id INTEGER NOT NULL,
+    transaction_id INTEGER NOT NULL,
+    status_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT orders_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT orders_transaction_id_fk FOREIGN KEY (transaction_id)
+        REFERENCES transactions (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,2 @@
+ALTER TABLE orders DROP CONSTRAINT orders_status_id_fk;
+DROP TABLE statuses;
@@ -0,0 +1,13 @@
+CREATE TABLE statuses (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO statuses (name) VALUES ('Cleared');
+INSERT INTO statuses (name) VALUES ('Refunded');
+INSERT INTO statuses (name) VALUES ('Cancelled');
+
+ALTER TABLE orders ADD CONSTRAINT orders_status_id_fk FOREIGN KEY (status_id)
+    REFERENCES statuses (id) ON DELETE CASCADE ON UPDATE CASCADE;
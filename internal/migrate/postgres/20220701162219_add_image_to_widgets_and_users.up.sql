@@ -0,0 +1,2 @@
+ALTER TABLE widgets ADD COLUMN image VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN image VARCHAR(255) NOT NULL DEFAULT '';
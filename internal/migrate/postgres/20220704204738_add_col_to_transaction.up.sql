@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN expiry_month INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN expiry_year INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+DROP INDEX transactions_subscription_id_idx;
+ALTER TABLE transactions DROP COLUMN subscription_id;
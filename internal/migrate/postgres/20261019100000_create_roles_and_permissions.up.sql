@@ -0,0 +1,69 @@
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX roles_name_idx ON roles (name);
+
+CREATE TABLE permissions (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX permissions_name_idx ON permissions (name);
+
+CREATE TABLE role_permissions (
+    id SERIAL PRIMARY KEY,
+    role_id INTEGER NOT NULL,
+    permission_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CONSTRAINT role_permissions_role_id_fk FOREIGN KEY (role_id)
+        REFERENCES roles (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT role_permissions_permission_id_fk FOREIGN KEY (permission_id)
+        REFERENCES permissions (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE UNIQUE INDEX role_permissions_role_id_permission_id_idx ON role_permissions (role_id, permission_id);
+
+CREATE TABLE user_roles (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    role_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CONSTRAINT user_roles_user_id_fk FOREIGN KEY (user_id)
+        REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT user_roles_role_id_fk FOREIGN KEY (role_id)
+        REFERENCES roles (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE UNIQUE INDEX user_roles_user_id_role_id_idx ON user_roles (user_id, role_id);
+
+INSERT INTO roles (name, description) VALUES ('admin', 'Full access, including user management');
+INSERT INTO roles (name, description) VALUES ('terminal-operator', 'Charges cards through the virtual terminal');
+INSERT INTO roles (name, description) VALUES ('support', 'Looks up orders and issues refunds');
+INSERT INTO roles (name, description) VALUES ('read-only', 'Views reports and orders');
+
+INSERT INTO permissions (name, description) VALUES ('terminal:charge', 'Charge cards through the virtual terminal');
+INSERT INTO permissions (name, description) VALUES ('payments:refund', 'Refund orders');
+INSERT INTO permissions (name, description) VALUES ('users:manage', 'Manage users and their roles');
+INSERT INTO permissions (name, description) VALUES ('reports:view', 'View orders, customers and reports');
+
+INSERT INTO role_permissions (role_id, permission_id, created_at, updated_at)
+SELECT r.id, p.id, NOW(), NOW() FROM roles r, permissions p WHERE r.name = 'admin';
+INSERT INTO role_permissions (role_id, permission_id, created_at, updated_at)
+SELECT r.id, p.id, NOW(), NOW() FROM roles r, permissions p WHERE r.name = 'terminal-operator' AND p.name IN ('terminal:charge', 'reports:view');
+INSERT INTO role_permissions (role_id, permission_id, created_at, updated_at)
+SELECT r.id, p.id, NOW(), NOW() FROM roles r, permissions p WHERE r.name = 'support' AND p.name IN ('payments:refund', 'reports:view');
+INSERT INTO role_permissions (role_id, permission_id, created_at, updated_at)
+SELECT r.id, p.id, NOW(), NOW() FROM roles r, permissions p WHERE r.name = 'read-only' AND p.name = 'reports:view';
+
+INSERT INTO user_roles (user_id, role_id, created_at, updated_at)
+SELECT u.id, r.id, NOW(), NOW() FROM users u, roles r WHERE u.email = 'admin@example.com' AND r.name = 'admin';
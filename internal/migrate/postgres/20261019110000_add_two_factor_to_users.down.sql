@@ -0,0 +1,7 @@
+DROP TABLE recovery_codes;
+ALTER TABLE roles DROP COLUMN requires_2fa;
+ALTER TABLE users DROP COLUMN totp_locked_until;
+ALTER TABLE users DROP COLUMN totp_failed_attempts;
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_enabled_at;
+ALTER TABLE users DROP COLUMN totp_secret;
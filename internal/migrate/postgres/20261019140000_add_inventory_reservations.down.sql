@@ -0,0 +1,3 @@
+DROP TABLE inventory_movements;
+DROP TABLE inventory_reservations;
+ALTER TABLE widgets DROP COLUMN reserved_level;
@@ -0,0 +1,30 @@
+-- the lines of an order; price is the unit price charged and amount is
+-- price times quantity, both in cents
+CREATE TABLE order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    widget_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL,
+    price INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT order_items_order_id_fk FOREIGN KEY (order_id)
+        REFERENCES orders (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT order_items_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX order_items_order_id_idx ON order_items (order_id);
+CREATE INDEX order_items_widget_id_idx ON order_items (widget_id);
+
+-- orders placed before carts bought a single widget
+INSERT INTO order_items (order_id, widget_id, quantity, price, amount, created_at, updated_at)
+SELECT id, widget_id, quantity,
+    CASE WHEN quantity > 0 THEN amount / quantity ELSE amount END,
+    amount, created_at, updated_at
+FROM orders;
+
+-- a payment intent now holds one reservation per widget in the cart
+DROP INDEX inventory_reservations_payment_intent_idx;
+CREATE UNIQUE INDEX inventory_reservations_payment_intent_idx ON inventory_reservations (payment_intent, widget_id);
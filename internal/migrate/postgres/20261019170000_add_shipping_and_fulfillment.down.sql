@@ -0,0 +1,10 @@
+DELETE FROM role_permissions WHERE permission_id IN (SELECT id FROM permissions WHERE name = 'orders:fulfill');
+DELETE FROM permissions WHERE name = 'orders:fulfill';
+
+ALTER TABLE orders DROP COLUMN tracking_number;
+ALTER TABLE orders DROP COLUMN fulfillment_status;
+ALTER TABLE orders DROP COLUMN shipping_amount;
+ALTER TABLE widgets DROP COLUMN weight;
+
+DROP TABLE shipping_rates;
+DROP TABLE addresses;
@@ -0,0 +1,12 @@
+CREATE TABLE transaction_statuses (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO transaction_statuses (name) VALUES ('Pending');
+INSERT INTO transaction_statuses (name) VALUES ('Cleared');
+INSERT INTO transaction_statuses (name) VALUES ('Declined');
+INSERT INTO transaction_statuses (name) VALUES ('Refunded');
+INSERT INTO transaction_statuses (name) VALUES ('Partially refunded');
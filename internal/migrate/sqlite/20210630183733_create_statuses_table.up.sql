@@ -0,0 +1,10 @@
+CREATE TABLE statuses (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO statuses (name) VALUES ('Cleared');
+INSERT INTO statuses (name) VALUES ('Refunded');
+INSERT INTO statuses (name) VALUES ('Cancelled');
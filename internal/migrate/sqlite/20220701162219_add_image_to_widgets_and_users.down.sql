@@ -0,0 +1,2 @@
+ALTER TABLE widgets DROP COLUMN image;
+ALTER TABLE users DROP COLUMN image;
@@ -0,0 +1,2 @@
+ALTER TABLE transactions DROP COLUMN expiry_month;
+ALTER TABLE transactions DROP COLUMN expiry_year;
@@ -0,0 +1,23 @@
+-- SQLite cannot drop a foreign key column, so orders is rebuilt without it
+CREATE TABLE orders_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    widget_id INTEGER NOT NULL,
+    transaction_id INTEGER NOT NULL,
+    status_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT orders_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT orders_transaction_id_fk FOREIGN KEY (transaction_id)
+        REFERENCES transactions (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT orders_status_id_fk FOREIGN KEY (status_id)
+        REFERENCES statuses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO orders_new (id, widget_id, transaction_id, status_id, quantity, amount, created_at, updated_at)
+SELECT id, widget_id, transaction_id, status_id, quantity, amount, created_at, updated_at FROM orders;
+
+DROP TABLE orders;
+ALTER TABLE orders_new RENAME TO orders;
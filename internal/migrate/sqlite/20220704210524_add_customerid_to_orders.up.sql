@@ -0,0 +1,3 @@
+-- SQLite only adds a foreign key column that may be NULL
+ALTER TABLE orders ADD COLUMN customer_id INTEGER
+    CONSTRAINT orders_customer_id_fk REFERENCES customers (id) ON DELETE CASCADE ON UPDATE CASCADE;
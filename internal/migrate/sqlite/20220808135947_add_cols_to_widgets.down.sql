@@ -0,0 +1,2 @@
+ALTER TABLE widgets DROP COLUMN is_recurring;
+ALTER TABLE widgets DROP COLUMN plan_id;
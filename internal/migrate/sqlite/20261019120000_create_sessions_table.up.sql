@@ -0,0 +1,8 @@
+-- the layout the scs sqlite3store expects; expiry is a julian day
+CREATE TABLE sessions (
+    token TEXT PRIMARY KEY,
+    data BLOB NOT NULL,
+    expiry REAL NOT NULL
+);
+
+CREATE INDEX sessions_expiry_idx ON sessions (expiry);
@@ -0,0 +1,32 @@
+-- reserved_level counts the units held by unexpired reservations; a widget
+-- can be sold while inventory_level - reserved_level is positive
+ALTER TABLE widgets ADD COLUMN reserved_level INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE inventory_reservations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    widget_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL,
+    payment_intent VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT inventory_reservations_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE UNIQUE INDEX inventory_reservations_payment_intent_idx ON inventory_reservations (payment_intent);
+CREATE INDEX inventory_reservations_expires_at_idx ON inventory_reservations (expires_at);
+
+-- every change to inventory_level, with quantity negative for stock leaving
+CREATE TABLE inventory_movements (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    widget_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL,
+    reason VARCHAR(32) NOT NULL,
+    reference VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT inventory_movements_widget_id_fk FOREIGN KEY (widget_id)
+        REFERENCES widgets (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX inventory_movements_widget_id_idx ON inventory_movements (widget_id, created_at);
+CREATE INDEX inventory_movements_reference_idx ON inventory_movements (reference);
@@ -0,0 +1,3 @@
+DROP INDEX inventory_reservations_payment_intent_idx;
+CREATE UNIQUE INDEX inventory_reservations_payment_intent_idx ON inventory_reservations (payment_intent);
+DROP TABLE order_items;
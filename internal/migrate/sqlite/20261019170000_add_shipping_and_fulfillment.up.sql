@@ -0,0 +1,51 @@
+-- the billing and shipping addresses given for an order, linked to the
+-- customer who gave them; an order has at most one of each kind
+CREATE TABLE addresses (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    customer_id INTEGER NULL,
+    order_id INTEGER NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    line1 VARCHAR(255) NOT NULL,
+    line2 VARCHAR(255) NOT NULL DEFAULT '',
+    city VARCHAR(255) NOT NULL,
+    region VARCHAR(255) NOT NULL DEFAULT '',
+    postal_code VARCHAR(32) NOT NULL DEFAULT '',
+    country CHAR(2) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT addresses_customer_id_fk FOREIGN KEY (customer_id)
+        REFERENCES customers (id) ON DELETE SET NULL ON UPDATE CASCADE,
+    CONSTRAINT addresses_order_id_fk FOREIGN KEY (order_id)
+        REFERENCES orders (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE UNIQUE INDEX addresses_order_id_kind_idx ON addresses (order_id, kind);
+CREATE INDEX addresses_customer_id_idx ON addresses (customer_id);
+
+-- the rules shipping is priced by: a flat rule adds amount to every order,
+-- a weight rule adds amount per started kilogram of widgets and a
+-- free_over rule waives shipping on orders whose widgets cost at least
+-- threshold; no rules means shipping is free
+CREATE TABLE shipping_rates (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    amount INTEGER NOT NULL DEFAULT 0,
+    threshold INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- weight in grams, for weight rules
+ALTER TABLE widgets ADD COLUMN weight INTEGER NOT NULL DEFAULT 0;
+
+-- shipping_amount is the part of amount charged for shipping
+ALTER TABLE orders ADD COLUMN shipping_amount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN fulfillment_status VARCHAR(16) NOT NULL DEFAULT 'unfulfilled';
+ALTER TABLE orders ADD COLUMN tracking_number VARCHAR(255) NOT NULL DEFAULT '';
+
+INSERT INTO permissions (name, description) VALUES ('orders:fulfill', 'Mark orders shipped or delivered');
+
+INSERT INTO role_permissions (role_id, permission_id, created_at, updated_at)
+SELECT r.id, p.id, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP FROM roles r, permissions p WHERE r.name IN ('admin', 'support') AND p.name = 'orders:fulfill';
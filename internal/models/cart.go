@@ -0,0 +1,180 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caleberi/gostripe/internal/validator"
+)
+
+// limits on what a single cart can hold
+const (
+	// MaxCartLines keeps the lines of a cart within the 500 characters
+	// stripe allows for a metadata value
+	MaxCartLines = 20
+	// MaxLineQuantity is the most units of one widget a cart can hold
+	MaxLineQuantity = 99
+)
+
+// CartMetadataKey is the payment intent metadata key the lines of the cart
+// it charges for are stored under
+const CartMetadataKey = "cart"
+
+// CartLine is a quantity of a widget a customer wants to buy
+type CartLine struct {
+	WidgetID int `json:"widget_id"`
+	Quantity int `json:"quantity"`
+}
+
+// OrderItem is a line of an order, or of a cart before it is ordered
+type OrderItem struct {
+	ID       int    `json:"id"`
+	OrderID  int    `json:"order_id"`
+	WidgetID int    `json:"widget_id"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+	// Price is the unit price charged, and Amount is Price times Quantity
+	Price  int `json:"price"`
+	Amount int `json:"amount"`
+}
+
+// Cart is a set of lines priced at the current widget prices
+type Cart struct {
+	Items []OrderItem `json:"items"`
+	// Subtotal is what the items cost, Shipping what shipping them costs
+	// once WithShipping is applied, and Total the two added together
+	Subtotal int `json:"subtotal"`
+	Shipping int `json:"shipping"`
+	Total    int `json:"total"`
+	// Weight is the weight of the items in grams
+	Weight int `json:"weight"`
+}
+
+// Lines returns the widgets and quantities of c
+func (c Cart) Lines() []CartLine {
+	lines := make([]CartLine, len(c.Items))
+	for i, item := range c.Items {
+		lines[i] = CartLine{WidgetID: item.WidgetID, Quantity: item.Quantity}
+	}
+	return lines
+}
+
+// Units returns the number of units in c
+func (c Cart) Units() int {
+	n := 0
+	for _, item := range c.Items {
+		n += item.Quantity
+	}
+	return n
+}
+
+// CartOf returns a cart holding one unit of w, priced without shipping, as
+// a widget is bought on its own
+func CartOf(w Widget) Cart {
+	return Cart{
+		Items:    []OrderItem{{WidgetID: w.ID, Name: w.Name, Quantity: 1, Price: w.Price, Amount: w.Price}},
+		Subtotal: w.Price,
+		Total:    w.Price,
+		Weight:   w.Weight,
+	}
+}
+
+// MergeCartLines returns lines with the quantities of repeated widgets
+// added together, in the order the widgets first appear
+func MergeCartLines(lines []CartLine) []CartLine {
+	var merged []CartLine
+	at := make(map[int]int, len(lines))
+	for _, l := range lines {
+		if i, ok := at[l.WidgetID]; ok {
+			merged[i].Quantity += l.Quantity
+			continue
+		}
+		at[l.WidgetID] = len(merged)
+		merged = append(merged, l)
+	}
+	return merged
+}
+
+// PriceCart prices lines at the current widget prices after merging
+// repeated widgets, without shipping. Lines that cannot be bought are
+// recorded in v under items[i], i being the index of the merged line;
+// widgets that do not exist are left out of the cart, the others are
+// priced either way.
+func PriceCart(ctx context.Context, widgets WidgetRepository, lines []CartLine, v *validator.Validator) (Cart, error) {
+	lines = MergeCartLines(lines)
+	v.Check(len(lines) > 0, "items", "must not be empty")
+	v.Check(len(lines) <= MaxCartLines, "items", "must not have more than "+strconv.Itoa(MaxCartLines)+" lines")
+
+	var cart Cart
+	for i, l := range lines {
+		key := fmt.Sprintf("items[%d]", i)
+		w, err := widgets.GetWidget(ctx, l.WidgetID)
+		if errors.Is(err, sql.ErrNoRows) {
+			v.AddError(key, "does not exist")
+			continue
+		}
+		if err != nil {
+			return Cart{}, err
+		}
+
+		v.Check(l.Quantity > 0 && l.Quantity <= MaxLineQuantity, key, "quantity must be between 1 and "+strconv.Itoa(MaxLineQuantity))
+		v.Check(!w.IsRecurring, key, "is a subscription and must be bought on its own")
+		switch available := w.Available(); {
+		case available == 0:
+			v.AddError(key, "is out of stock")
+		case available < l.Quantity:
+			v.AddError(key, "has only "+strconv.Itoa(available)+" left")
+		}
+
+		item := OrderItem{
+			WidgetID: w.ID,
+			Name:     w.Name,
+			Quantity: l.Quantity,
+			Price:    w.Price,
+			Amount:   w.Price * l.Quantity,
+		}
+		cart.Items = append(cart.Items, item)
+		cart.Subtotal += item.Amount
+		cart.Weight += w.Weight * l.Quantity
+	}
+
+	if len(cart.Items) > 0 {
+		v.Check(validator.AmountInRange(cart.Subtotal), "items", "must total between 50 and 99999999")
+	}
+	cart.Total = cart.Subtotal
+	return cart, nil
+}
+
+// FormatCartItems encodes the widget, quantity and unit price of items as
+// widget:quantity:price lines separated by commas, for the payment intent
+// metadata
+func FormatCartItems(items []OrderItem) string {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = fmt.Sprintf("%d:%d:%d", item.WidgetID, item.Quantity, item.Price)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseCartItems decodes items encoded by FormatCartItems. The names are
+// left empty.
+func ParseCartItems(s string) ([]OrderItem, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var items []OrderItem
+	for _, part := range strings.Split(s, ",") {
+		var item OrderItem
+		if _, err := fmt.Sscanf(part, "%d:%d:%d", &item.WidgetID, &item.Quantity, &item.Price); err != nil {
+			return nil, fmt.Errorf("models: bad cart item %q: %w", part, err)
+		}
+		item.Amount = item.Price * item.Quantity
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,313 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrOutOfStock is returned when a widget has fewer units available than
+// a reservation or sale needs
+var ErrOutOfStock = errors.New("models: not enough inventory")
+
+// reasons inventory movements are recorded for
+const (
+	// MovementSale is stock leaving with a paid order
+	MovementSale = "sale"
+	// MovementAdjustment is staff setting the inventory level of a widget
+	MovementAdjustment = "adjustment"
+)
+
+// InventoryMovement is one change to the inventory level of a widget
+type InventoryMovement struct {
+	ID       int `json:"id"`
+	WidgetID int `json:"widget_id"`
+	// Quantity is negative for stock leaving
+	Quantity int    `json:"quantity"`
+	Reason   string `json:"reason"`
+	// Reference identifies what caused the movement, such as the payment
+	// intent of a sale
+	Reference string    `json:"reference"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Available returns the units of w that can still be reserved
+func (w Widget) Available() int {
+	if n := w.InventoryLevel - w.ReservedLevel; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// ReserveInventory holds the units of every line for the payment intent
+// until expiresAt. Either all lines are reserved or, when a widget has
+// fewer units available than its line needs, none are and ErrOutOfStock is
+// returned. Reserving again for the same payment intent does nothing.
+func (m *DBModel) ReserveInventory(ctx context.Context, paymentIntent string, lines []CartLine, expiresAt time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a retried request gets the payment intent it created before, which
+	// already holds its units
+	var held int
+	err = m.queryRow(ctx, tx, `SELECT COUNT(*) FROM inventory_reservations WHERE payment_intent = ?`, paymentIntent).Scan(&held)
+	if err != nil {
+		return err
+	}
+	if held > 0 {
+		return nil
+	}
+
+	for _, l := range MergeCartLines(lines) {
+		// the condition makes the check and the hold one atomic step, so two
+		// checkouts cannot both take the last unit
+		res, err := m.exec(ctx, tx, `
+			UPDATE widgets SET reserved_level = reserved_level + ?
+			WHERE id = ? AND inventory_level - reserved_level >= ?`,
+			l.Quantity, l.WidgetID, l.Quantity)
+		if err != nil {
+			return err
+		}
+		if err := outOfStock(res); err != nil {
+			return fmt.Errorf("%w: widget %d", err, l.WidgetID)
+		}
+
+		_, err = m.exec(ctx, tx, `
+			INSERT INTO inventory_reservations
+				(widget_id, quantity, payment_intent, expires_at, created_at)
+			VALUES (?, ?, ?, ?, ?)`,
+			l.WidgetID, l.Quantity, paymentIntent, expiresAt, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CommitReservation takes the units of every line out of stock for a paid
+// payment intent and logs the sales. The units its reservations hold are
+// used; when a reservation already expired they are taken from the
+// available stock instead. Lines without enough stock are left out and
+// reported with ErrOutOfStock once the others are committed. Committing a
+// payment intent again does nothing.
+func (m *DBModel) CommitReservation(ctx context.Context, paymentIntent string, lines []CartLine) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the sale movements record that the payment intent was committed, so
+	// a resubmitted payment form does not sell the units twice
+	var sold int
+	err = m.queryRow(ctx, tx, `
+		SELECT COUNT(*) FROM inventory_movements
+		WHERE reference = ? AND reason = ?`,
+		paymentIntent, MovementSale).Scan(&sold)
+	if err != nil {
+		return err
+	}
+	if sold > 0 {
+		return nil
+	}
+
+	var short []error
+	for _, l := range MergeCartLines(lines) {
+		err := m.commitLine(ctx, tx, paymentIntent, l)
+		if errors.Is(err, ErrOutOfStock) {
+			short = append(short, fmt.Errorf("%w: widget %d", err, l.WidgetID))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return errors.Join(short...)
+}
+
+// commitLine takes the units of one line out of stock within tx, from the
+// reservation of the payment intent when it still has one
+func (m *DBModel) commitLine(ctx context.Context, tx querier, paymentIntent string, l CartLine) error {
+	var reserved int
+	err := m.queryRow(ctx, tx, `
+		SELECT quantity FROM inventory_reservations
+		WHERE payment_intent = ? AND widget_id = ?`,
+		paymentIntent, l.WidgetID).Scan(&reserved)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if reserved > 0 {
+		// claiming the reservation by deleting it means a concurrent sweep
+		// or a second commit of the same payment intent cannot use it too
+		res, err := m.exec(ctx, tx, `
+			DELETE FROM inventory_reservations
+			WHERE payment_intent = ? AND widget_id = ?`,
+			paymentIntent, l.WidgetID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			reserved = 0
+		}
+	}
+
+	var res sql.Result
+	if reserved > 0 {
+		res, err = m.exec(ctx, tx, `
+			UPDATE widgets SET
+				inventory_level = inventory_level - ?,
+				reserved_level = reserved_level - ?,
+				updated_at = ?
+			WHERE id = ? AND inventory_level >= ?`,
+			l.Quantity, reserved, time.Now(), l.WidgetID, l.Quantity)
+	} else {
+		res, err = m.exec(ctx, tx, `
+			UPDATE widgets SET
+				inventory_level = inventory_level - ?,
+				updated_at = ?
+			WHERE id = ? AND inventory_level - reserved_level >= ?`,
+			l.Quantity, time.Now(), l.WidgetID, l.Quantity)
+	}
+	if err != nil {
+		return err
+	}
+	if err := outOfStock(res); err != nil {
+		return err
+	}
+
+	return m.logMovement(ctx, tx, l.WidgetID, -l.Quantity, MovementSale, paymentIntent)
+}
+
+// ReleaseExpiredReservations returns the units held by reservations that
+// expired before now to the available stock, and reports how many
+// reservations were released
+func (m *DBModel) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := m.query(ctx, tx, `
+		SELECT id, widget_id, quantity FROM inventory_reservations
+		WHERE expires_at < ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	type reservation struct{ id, widgetID, quantity int }
+	var expired []reservation
+	for rows.Next() {
+		var r reservation
+		if err := rows.Scan(&r.id, &r.widgetID, &r.quantity); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, r := range expired {
+		// a commit may have claimed the reservation since it was read
+		res, err := m.exec(ctx, tx, `DELETE FROM inventory_reservations WHERE id = ?`, r.id)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+
+		_, err = m.exec(ctx, tx, `
+			UPDATE widgets SET reserved_level = reserved_level - ?
+			WHERE id = ?`, r.quantity, r.widgetID)
+		if err != nil {
+			return 0, err
+		}
+		released++
+	}
+
+	return released, tx.Commit()
+}
+
+// ListInventoryMovements returns the latest limit movements of a widget,
+// newest first
+func (m *DBModel) ListInventoryMovements(ctx context.Context, widgetID, limit int) ([]InventoryMovement, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, m.reader(), `
+		SELECT id, widget_id, quantity, reason, reference, created_at
+		FROM inventory_movements
+		WHERE widget_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?`, widgetID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movements []InventoryMovement
+	for rows.Next() {
+		var mv InventoryMovement
+		err := rows.Scan(&mv.ID, &mv.WidgetID, &mv.Quantity, &mv.Reason, &mv.Reference, &mv.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		movements = append(movements, mv)
+	}
+	return movements, rows.Err()
+}
+
+// logMovement records a change of quantity to the inventory of a widget
+func (m *DBModel) logMovement(ctx context.Context, q querier, widgetID, quantity int, reason, reference string) error {
+	_, err := m.exec(ctx, q, `
+		INSERT INTO inventory_movements (widget_id, quantity, reason, reference, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		widgetID, quantity, reason, reference, time.Now())
+	return err
+}
+
+// outOfStock turns a conditional stock update that matched no row into
+// ErrOutOfStock
+func outOfStock(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrOutOfStock
+	}
+	return nil
+}
@@ -0,0 +1,1109 @@
+// Package memory implements the model repositories in memory, for tests
+// and for running handlers without a database. It mirrors the behaviour of
+// the SQL implementation, including sql.ErrNoRows for missing rows.
+package memory
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Store holds every aggregate in maps keyed by id. It is safe for
+// concurrent use.
+type Store struct {
+	mu sync.Mutex
+
+	widgets      map[int]models.Widget
+	orders       map[int]models.Order
+	customers    map[int]models.Customer
+	transactions map[int]models.Transaction
+	users        map[int]*user
+	roles        map[int]*role
+	tokens       map[string]models.Token
+	reservations map[reservationKey]reservation
+	movements    []models.InventoryMovement
+	history      []models.StatusChange
+	rates        []models.ShippingRate
+
+	nextID int
+}
+
+// reservationKey identifies the reservation of a widget for a payment intent
+type reservationKey struct {
+	paymentIntent string
+	widgetID      int
+}
+
+// reservation holds units of a widget for a payment intent
+type reservation struct {
+	quantity  int
+	expiresAt time.Time
+}
+
+// user is a stored user with the state the SQL implementation keeps in
+// columns and join tables
+type user struct {
+	models.User
+	roleIDs       []int
+	totpSecret    string
+	totpEnabled   bool
+	totpLastStep  *int64
+	totpFailures  int
+	totpLocked    time.Time       // two-factor logins are locked until then
+	recoveryCodes map[string]bool // normalized code to used
+}
+
+type role struct {
+	models.Role
+	permissions []string
+}
+
+var (
+	_ models.WidgetRepository      = (*Store)(nil)
+	_ models.InventoryRepository   = (*Store)(nil)
+	_ models.OrderRepository       = (*Store)(nil)
+	_ models.ShippingRepository    = (*Store)(nil)
+	_ models.CustomerRepository    = (*Store)(nil)
+	_ models.TransactionRepository = (*Store)(nil)
+	_ models.UserRepository        = (*Store)(nil)
+)
+
+// New returns an empty store
+func New() *Store {
+	return &Store{
+		widgets:      make(map[int]models.Widget),
+		orders:       make(map[int]models.Order),
+		customers:    make(map[int]models.Customer),
+		transactions: make(map[int]models.Transaction),
+		users:        make(map[int]*user),
+		roles:        make(map[int]*role),
+		tokens:       make(map[string]models.Token),
+		reservations: make(map[reservationKey]reservation),
+	}
+}
+
+// Models returns the repositories backed by s
+func (s *Store) Models() models.Models {
+	return models.Models{
+		Widgets:      s,
+		Inventory:    s,
+		Orders:       s,
+		Shipping:     s,
+		Customers:    s,
+		Transactions: s,
+		Users:        s,
+	}
+}
+
+// id returns the next id; ids are unique across the store
+func (s *Store) id() int {
+	s.nextID++
+	return s.nextID
+}
+
+// AddWidget stores w and returns its id
+func (s *Store) AddWidget(w models.Widget) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.ID = s.id()
+	w.CreatedAt, w.UpdatedAt = time.Now(), time.Now()
+	s.widgets[w.ID] = w
+	return w.ID
+}
+
+// AddShippingRate stores r and returns its id
+func (s *Store) AddShippingRate(r models.ShippingRate) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = s.id()
+	s.rates = append(s.rates, r)
+	return r.ID
+}
+
+// AddRole stores r granting permissions and returns its id
+func (s *Store) AddRole(r models.Role, permissions ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = s.id()
+	r.CreatedAt, r.UpdatedAt = time.Now(), time.Now()
+	s.roles[r.ID] = &role{Role: r, permissions: permissions}
+	return r.ID
+}
+
+// AddUser stores u with a bcrypt hash of password and the given roles and
+// returns its id
+func (s *Store) AddUser(u models.User, password string, roleIDs ...int) (int, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u.ID = s.id()
+	u.Email = strings.ToLower(u.Email)
+	u.Password = string(hash)
+	u.Roles = nil
+	u.CreatedAt, u.UpdatedAt = time.Now(), time.Now()
+	s.users[u.ID] = &user{User: u, roleIDs: roleIDs}
+	return u.ID, nil
+}
+
+// GetWidget returns a widget by id
+func (s *Store) GetWidget(ctx context.Context, id int) (models.Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.widgets[id]
+	if !ok {
+		return w, sql.ErrNoRows
+	}
+	return w, nil
+}
+
+// ListWidgets returns a page of the widgets matching f and the metadata of
+// the page
+func (s *Store) ListWidgets(ctx context.Context, f models.WidgetFilter) ([]models.Widget, models.Metadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	search := strings.ToLower(strings.TrimSpace(f.Search))
+	var matched []models.Widget
+	for _, w := range s.widgets {
+		switch {
+		case search != "" && !strings.Contains(strings.ToLower(w.Name), search) && !strings.Contains(strings.ToLower(w.Description), search):
+		case f.Recurring != nil && w.IsRecurring != *f.Recurring:
+		case f.InStock && w.Available() <= 0:
+		case f.MinPrice > 0 && w.Price < f.MinPrice:
+		case f.MaxPrice > 0 && w.Price > f.MaxPrice:
+		default:
+			matched = append(matched, w)
+		}
+	}
+
+	desc := strings.HasPrefix(f.Sort, "-")
+	key := strings.TrimPrefix(f.Sort, "-")
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if desc {
+			a, b = b, a
+		}
+		switch {
+		case key == "name" && a.Name != b.Name:
+			return a.Name < b.Name
+		case key == "price" && a.Price != b.Price:
+			return a.Price < b.Price
+		case key == "inventory_level" && a.InventoryLevel != b.InventoryLevel:
+			return a.InventoryLevel < b.InventoryLevel
+		case key == "created_at" && !a.CreatedAt.Equal(b.CreatedAt):
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+
+	page, size := f.Paging()
+	total := len(matched)
+	start := (page - 1) * size
+	if start > total {
+		start = total
+	}
+	end := start + size
+	if end > total {
+		end = total
+	}
+
+	return matched[start:end], models.NewMetadata(total, page, size), nil
+}
+
+// InsertWidget stores w and returns its id, logging its initial stock as
+// an adjustment
+func (s *Store) InsertWidget(ctx context.Context, w models.Widget) (int, error) {
+	id := s.AddWidget(w)
+	if w.InventoryLevel != 0 {
+		s.mu.Lock()
+		s.logMovement(id, w.InventoryLevel, models.MovementAdjustment, "")
+		s.mu.Unlock()
+	}
+	return id, nil
+}
+
+// UpdateWidget replaces the fields of a widget and adds adjustment to its
+// inventory level, returning models.ErrOutOfStock when the level would drop
+// below its reserved units and sql.ErrNoRows when there is no widget with
+// its id
+func (s *Store) UpdateWidget(ctx context.Context, w models.Widget, adjustment int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.widgets[w.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if old.InventoryLevel+adjustment < old.ReservedLevel {
+		return models.ErrOutOfStock
+	}
+	w.InventoryLevel = old.InventoryLevel + adjustment
+	w.ReservedLevel = old.ReservedLevel
+	w.CreatedAt, w.UpdatedAt = old.CreatedAt, time.Now()
+	s.widgets[w.ID] = w
+	if adjustment != 0 {
+		s.logMovement(w.ID, adjustment, models.MovementAdjustment, "")
+	}
+	return nil
+}
+
+// SetWidgetImage replaces the image of a widget, returning sql.ErrNoRows
+// when there is none with that id
+func (s *Store) SetWidgetImage(ctx context.Context, id int, image string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.widgets[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	w.Image, w.UpdatedAt = image, time.Now()
+	s.widgets[id] = w
+	return nil
+}
+
+// DeleteWidget deletes a widget nobody ordered, returning
+// models.ErrWidgetInUse for a widget with orders
+func (s *Store) DeleteWidget(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.widgets[id]; !ok {
+		return sql.ErrNoRows
+	}
+	for _, o := range s.orders {
+		for _, item := range o.Items {
+			if item.WidgetID == id {
+				return models.ErrWidgetInUse
+			}
+		}
+	}
+	delete(s.widgets, id)
+
+	// the database cascades the delete to reservations and movements
+	for k := range s.reservations {
+		if k.widgetID == id {
+			delete(s.reservations, k)
+		}
+	}
+	movements := s.movements[:0]
+	for _, mv := range s.movements {
+		if mv.WidgetID != id {
+			movements = append(movements, mv)
+		}
+	}
+	s.movements = movements
+	return nil
+}
+
+// ReserveInventory holds the units of every line for the payment intent
+// until expiresAt, returning models.ErrOutOfStock and reserving nothing
+// when a widget has fewer available than its line needs. Reserving again
+// for the same payment intent does nothing.
+func (s *Store) ReserveInventory(ctx context.Context, paymentIntent string, lines []models.CartLine, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k := range s.reservations {
+		if k.paymentIntent == paymentIntent {
+			return nil
+		}
+	}
+
+	lines = models.MergeCartLines(lines)
+	for _, l := range lines {
+		w, ok := s.widgets[l.WidgetID]
+		if !ok || w.Available() < l.Quantity {
+			return fmt.Errorf("%w: widget %d", models.ErrOutOfStock, l.WidgetID)
+		}
+	}
+	for _, l := range lines {
+		w := s.widgets[l.WidgetID]
+		w.ReservedLevel += l.Quantity
+		s.widgets[l.WidgetID] = w
+		s.reservations[reservationKey{paymentIntent, l.WidgetID}] = reservation{quantity: l.Quantity, expiresAt: expiresAt}
+	}
+	return nil
+}
+
+// CommitReservation takes the units of every line out of stock for a paid
+// payment intent, from its reservations when they have not expired. Lines
+// without enough stock are left out and reported with models.ErrOutOfStock.
+// Committing a payment intent again does nothing.
+func (s *Store) CommitReservation(ctx context.Context, paymentIntent string, lines []models.CartLine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, mv := range s.movements {
+		if mv.Reason == models.MovementSale && mv.Reference == paymentIntent {
+			return nil
+		}
+	}
+
+	var short []error
+	for _, l := range models.MergeCartLines(lines) {
+		w, ok := s.widgets[l.WidgetID]
+		key := reservationKey{paymentIntent, l.WidgetID}
+		r, reserved := s.reservations[key]
+		switch {
+		case !ok, reserved && w.InventoryLevel < l.Quantity, !reserved && w.Available() < l.Quantity:
+			short = append(short, fmt.Errorf("%w: widget %d", models.ErrOutOfStock, l.WidgetID))
+			continue
+		case reserved:
+			delete(s.reservations, key)
+			w.ReservedLevel -= r.quantity
+		}
+
+		w.InventoryLevel -= l.Quantity
+		w.UpdatedAt = time.Now()
+		s.widgets[l.WidgetID] = w
+		s.logMovement(l.WidgetID, -l.Quantity, models.MovementSale, paymentIntent)
+	}
+	return errors.Join(short...)
+}
+
+// ReleaseExpiredReservations returns the units held by reservations that
+// expired before now to the available stock
+func (s *Store) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	released := 0
+	for k, r := range s.reservations {
+		if !r.expiresAt.Before(now) {
+			continue
+		}
+		delete(s.reservations, k)
+		if w, ok := s.widgets[k.widgetID]; ok {
+			w.ReservedLevel -= r.quantity
+			s.widgets[k.widgetID] = w
+		}
+		released++
+	}
+	return released, nil
+}
+
+// ListInventoryMovements returns the latest limit movements of a widget,
+// newest first
+func (s *Store) ListInventoryMovements(ctx context.Context, widgetID, limit int) ([]models.InventoryMovement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var movements []models.InventoryMovement
+	for i := len(s.movements) - 1; i >= 0 && len(movements) < limit; i-- {
+		if s.movements[i].WidgetID == widgetID {
+			movements = append(movements, s.movements[i])
+		}
+	}
+	return movements, nil
+}
+
+// logMovement appends a movement; s.mu must be held
+func (s *Store) logMovement(widgetID, quantity int, reason, reference string) {
+	s.movements = append(s.movements, models.InventoryMovement{
+		ID:        s.id(),
+		WidgetID:  widgetID,
+		Quantity:  quantity,
+		Reason:    reason,
+		Reference: reference,
+		CreatedAt: time.Now(),
+	})
+}
+
+// InsertOrder stores order with its items and addresses, records it being
+// placed by by and returns its id
+func (s *Store) InsertOrder(ctx context.Context, order models.Order, by models.Actor) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insertOrder(order, by), nil
+}
+
+// PlaceOrder stores txn, customer and order, linked to the other two, and
+// returns the id of the order. Like the database it stores none of them
+// when the payment intent of txn is already recorded.
+func (s *Store) PlaceOrder(ctx context.Context, order models.Order, txn models.Transaction, customer models.Customer, by models.Actor) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	order.TransactionID, err = s.insertTransaction(txn)
+	if err != nil {
+		return 0, err
+	}
+	order.CustomerID = s.insertCustomer(customer)
+	return s.insertOrder(order, by), nil
+}
+
+// insertOrder stores order and returns its id; s.mu must be held
+func (s *Store) insertOrder(order models.Order, by models.Actor) int {
+	order = order.WithItems()
+	order.ID = s.id()
+	order.Fulfillment, order.TrackingNumber = models.Unfulfilled, ""
+	order.CreatedAt, order.UpdatedAt = time.Now(), time.Now()
+	order.Items = append([]models.OrderItem(nil), order.Items...)
+	for i := range order.Items {
+		order.Items[i].ID = s.id()
+		order.Items[i].OrderID = order.ID
+	}
+	for _, a := range []**models.Address{&order.BillingAddress, &order.ShippingAddress} {
+		if *a == nil {
+			continue
+		}
+		stored := **a
+		stored.ID = s.id()
+		stored.CustomerID, stored.OrderID = order.CustomerID, order.ID
+		stored.CreatedAt, stored.UpdatedAt = time.Now(), time.Now()
+		*a = &stored
+	}
+	s.orders[order.ID] = order
+	s.recordStatusChange(order.ID, 0, order.StatusID, by)
+	return order.ID
+}
+
+// GetOrder returns an order by id
+func (s *Store) GetOrder(ctx context.Context, id int) (models.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[id]
+	if !ok {
+		return o, sql.ErrNoRows
+	}
+
+	// the SQL implementation joins the widget names
+	o.Items = append([]models.OrderItem(nil), o.Items...)
+	for i := range o.Items {
+		o.Items[i].Name = s.widgets[o.Items[i].WidgetID].Name
+	}
+	return copyAddresses(o), nil
+}
+
+// UpdateOrderStatus moves an order and its transaction to new statuses
+// together and records the change, rejecting moves the lifecycles do not
+// allow with an error wrapping models.ErrIllegalTransition
+func (s *Store) UpdateOrderStatus(ctx context.Context, order models.Order, status models.OrderStatus, txnStatus models.TxnStatus, by models.Actor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[order.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	t, ok := s.transactions[o.TransactionID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if err := o.StatusID.Transition(status); err != nil {
+		return err
+	}
+	if err := t.TransactionStatusID.Transition(txnStatus); err != nil {
+		return err
+	}
+
+	from := o.StatusID
+	o.StatusID = status
+	o.UpdatedAt = time.Now()
+	s.orders[o.ID] = o
+	t.TransactionStatusID = txnStatus
+	t.UpdatedAt = time.Now()
+	s.transactions[t.ID] = t
+	s.recordStatusChange(o.ID, from, status, by)
+	return nil
+}
+
+// UpdateFulfillment moves an order to a new fulfillment status, rejecting
+// moves that are not allowed with an error wrapping
+// models.ErrIllegalTransition. An empty tracking number keeps the one
+// stored.
+func (s *Store) UpdateFulfillment(ctx context.Context, orderID int, u models.FulfillmentUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[orderID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if err := o.FulfillmentTransition(u.Status); err != nil {
+		return err
+	}
+
+	o.Fulfillment = u.Status
+	if u.TrackingNumber != "" {
+		o.TrackingNumber = u.TrackingNumber
+	}
+	o.UpdatedAt = time.Now()
+	s.orders[o.ID] = o
+	return nil
+}
+
+// ListShippingRates returns the shipping rates ordered by id
+func (s *Store) ListShippingRates(ctx context.Context) ([]models.ShippingRate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]models.ShippingRate(nil), s.rates...), nil
+}
+
+// recordStatusChange appends an entry to the status history of an order;
+// s.mu must be held
+func (s *Store) recordStatusChange(orderID int, from, to models.OrderStatus, by models.Actor) {
+	s.history = append(s.history, models.StatusChange{
+		ID:        s.id(),
+		OrderID:   orderID,
+		From:      from,
+		To:        to,
+		Actor:     by,
+		CreatedAt: time.Now(),
+	})
+}
+
+// ListOrders returns a page of the orders matching f, newest first, and the
+// cursor of the next page
+func (s *Store) ListOrders(ctx context.Context, f models.OrderFilter) ([]models.OrderSummary, models.CursorMetadata, error) {
+	after, err := f.After()
+	if err != nil {
+		return nil, models.CursorMetadata{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email := strings.ToLower(f.Email)
+	var matched []models.OrderSummary
+	for _, o := range s.orders {
+		sum := s.summary(o)
+		switch {
+		case after > 0 && o.ID >= after:
+		case f.StatusID > 0 && o.StatusID != f.StatusID:
+		case f.Fulfillment != "" && o.Fulfillment != f.Fulfillment:
+		case !f.From.IsZero() && o.CreatedAt.Before(f.From):
+		case !f.To.IsZero() && !o.CreatedAt.Before(f.To.AddDate(0, 0, 1)):
+		case email != "" && !strings.Contains(strings.ToLower(sum.Customer.Email), email):
+		case f.WidgetID > 0 && !hasWidget(o, f.WidgetID):
+		case f.MinAmount > 0 && o.Amount < f.MinAmount:
+		case f.MaxAmount > 0 && o.Amount > f.MaxAmount:
+		default:
+			sum.Items, sum.History = nil, nil
+			sum.BillingAddress, sum.ShippingAddress = nil, nil
+			matched = append(matched, sum)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID > matched[j].ID })
+
+	size := f.Size()
+	metadata := models.CursorMetadata{PageSize: size}
+	if len(matched) > size {
+		matched = matched[:size]
+		metadata.NextCursor = models.OrderCursor(matched[size-1].ID)
+	}
+	return matched, metadata, nil
+}
+
+// GetOrderSummary returns an order by id with its customer, transaction,
+// statuses, items and status history
+func (s *Store) GetOrderSummary(ctx context.Context, id int) (models.OrderSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[id]
+	if !ok {
+		return models.OrderSummary{}, sql.ErrNoRows
+	}
+	return s.summary(o), nil
+}
+
+// AllStatuses returns every order status ordered by id
+func (s *Store) AllStatuses(ctx context.Context) ([]models.Status, error) {
+	var list []models.Status
+	for _, status := range []models.OrderStatus{models.OrderCleared, models.OrderRefunded, models.OrderCancelled} {
+		list = append(list, models.Status{ID: int(status), Status: status.String()})
+	}
+	return list, nil
+}
+
+// summary joins an order with its customer, transaction, statuses, item
+// names, addresses and status history; s.mu must be held
+func (s *Store) summary(o models.Order) models.OrderSummary {
+	sum := models.OrderSummary{
+		Order:       copyAddresses(o),
+		Status:      o.StatusID.String(),
+		Customer:    s.customers[o.CustomerID],
+		Transaction: s.transactions[o.TransactionID],
+		WidgetName:  s.widgets[o.WidgetID].Name,
+		ItemCount:   len(o.Items),
+	}
+	sum.TransactionStatus = sum.Transaction.TransactionStatusID.String()
+	sum.Items = append([]models.OrderItem(nil), o.Items...)
+	for i := range sum.Items {
+		sum.Items[i].Name = s.widgets[sum.Items[i].WidgetID].Name
+	}
+	for _, c := range s.history {
+		if c.OrderID != o.ID {
+			continue
+		}
+		if u, ok := s.users[c.UserID]; ok {
+			c.UserEmail = u.Email
+		}
+		sum.History = append(sum.History, c)
+	}
+	return sum
+}
+
+// copyAddresses gives o copies of its addresses, so callers cannot change
+// the stored ones
+func copyAddresses(o models.Order) models.Order {
+	for _, a := range []**models.Address{&o.BillingAddress, &o.ShippingAddress} {
+		if *a != nil {
+			c := **a
+			*a = &c
+		}
+	}
+	return o
+}
+
+// hasWidget reports whether an order has an item for the widget
+func hasWidget(o models.Order, widgetID int) bool {
+	for _, item := range o.Items {
+		if item.WidgetID == widgetID {
+			return true
+		}
+	}
+	return false
+}
+
+// InsertCustomer stores customer and returns its id
+func (s *Store) InsertCustomer(ctx context.Context, customer models.Customer) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insertCustomer(customer), nil
+}
+
+// insertCustomer stores customer and returns its id; s.mu must be held
+func (s *Store) insertCustomer(customer models.Customer) int {
+	customer.ID = s.id()
+	customer.CreatedAt, customer.UpdatedAt = time.Now(), time.Now()
+	s.customers[customer.ID] = customer
+	return customer.ID
+}
+
+// GetCustomer returns a customer by id
+func (s *Store) GetCustomer(ctx context.Context, id int) (models.Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.customers[id]
+	if !ok {
+		return c, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+// InsertTransaction stores txn and returns its id, failing for a payment
+// intent already recorded as the unique index of the database does
+func (s *Store) InsertTransaction(ctx context.Context, txn models.Transaction) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insertTransaction(txn)
+}
+
+// insertTransaction stores txn and returns its id; s.mu must be held
+func (s *Store) insertTransaction(txn models.Transaction) (int, error) {
+	if _, ok := s.transactionFor(txn.PaymenyIntent); ok {
+		return 0, fmt.Errorf("memory: payment intent %s is already recorded", txn.PaymenyIntent)
+	}
+
+	txn.ID = s.id()
+	txn.CreatedAt, txn.UpdatedAt = time.Now(), time.Now()
+	s.transactions[txn.ID] = txn
+	return txn.ID, nil
+}
+
+// GetTransaction returns a transaction by id
+func (s *Store) GetTransaction(ctx context.Context, id int) (models.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.transactions[id]
+	if !ok {
+		return t, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+// GetTransactionByPaymentIntent returns the transaction recording a payment
+// intent, or sql.ErrNoRows when it was not recorded
+func (s *Store) GetTransactionByPaymentIntent(ctx context.Context, paymentIntent string) (models.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.transactionFor(paymentIntent)
+	if !ok {
+		return t, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+// transactionFor finds the transaction of a payment intent; s.mu must be held
+func (s *Store) transactionFor(paymentIntent string) (models.Transaction, bool) {
+	if paymentIntent == "" {
+		return models.Transaction{}, false
+	}
+	for _, t := range s.transactions {
+		if t.PaymenyIntent == paymentIntent {
+			return t, true
+		}
+	}
+	return models.Transaction{}, false
+}
+
+// GetUser returns a user by id, including the password hash
+func (s *Store) GetUser(ctx context.Context, id int) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return models.User{}, sql.ErrNoRows
+	}
+	return u.User, nil
+}
+
+// GetUserByEmail returns the user with the given email, including the password hash
+func (s *Store) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == strings.ToLower(email) {
+			return u.User, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+// Authenticate checks email and password and returns the user id, or
+// models.ErrInvalidCredentials
+func (s *Store) Authenticate(ctx context.Context, email, password string) (int, error) {
+	u, err := s.GetUserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, models.ErrInvalidCredentials
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return 0, models.ErrInvalidCredentials
+	}
+	if err != nil {
+		return 0, err
+	}
+	return u.ID, nil
+}
+
+// UpdatePasswordForUser stores a new hash for u and revokes their tokens
+func (s *Store) UpdatePasswordForUser(ctx context.Context, u models.User, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.users[u.ID]; ok {
+		stored.Password = hash
+		stored.UpdatedAt = time.Now()
+	}
+	for h, t := range s.tokens {
+		if t.UserID == u.ID {
+			delete(s.tokens, h)
+		}
+	}
+	return nil
+}
+
+// InsertToken stores the hash of a token for u
+func (s *Store) InsertToken(ctx context.Context, t *models.Token, u models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[t.Hash] = models.Token{UserID: u.ID, Hash: t.Hash, Expiry: t.Expiry}
+	return nil
+}
+
+// GetUserForToken returns the user owning an unexpired token
+func (s *Store) GetUserForToken(ctx context.Context, plainText string) (models.User, error) {
+	sum := sha256.Sum256([]byte(plainText))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[hex.EncodeToString(sum[:])]
+	if !ok || !t.Expiry.After(time.Now()) {
+		return models.User{}, sql.ErrNoRows
+	}
+	u, ok := s.users[t.UserID]
+	if !ok {
+		return models.User{}, sql.ErrNoRows
+	}
+
+	// the SQL implementation does not select the password
+	user := u.User
+	user.Password = ""
+	return user, nil
+}
+
+// DeleteExpiredTokens removes tokens past their expiry
+func (s *Store) DeleteExpiredTokens(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for h, t := range s.tokens {
+		if !t.Expiry.After(time.Now()) {
+			delete(s.tokens, h)
+		}
+	}
+	return nil
+}
+
+// PermissionsForUser returns the names of all permissions granted to a user through their roles
+func (s *Store) PermissionsForUser(ctx context.Context, userID int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+	var perms []string
+	for _, id := range u.roleIDs {
+		r, ok := s.roles[id]
+		if !ok {
+			continue
+		}
+		for _, p := range r.permissions {
+			if !seen[p] {
+				seen[p] = true
+				perms = append(perms, p)
+			}
+		}
+	}
+	return perms, nil
+}
+
+// AllRoles returns every role ordered by id
+func (s *Store) AllRoles(ctx context.Context) ([]models.Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedRoles(nil), nil
+}
+
+// sortedRoles returns the roles with the given ids, or all roles when ids
+// is nil, ordered by id
+func (s *Store) sortedRoles(ids []int) []models.Role {
+	var roles []models.Role
+	for id, r := range s.roles {
+		if ids != nil && !contains(ids, id) {
+			continue
+		}
+		roles = append(roles, r.Role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].ID < roles[j].ID })
+	return roles
+}
+
+// AllUsers returns every user with their roles, ordered by last name
+func (s *Store) AllUsers(ctx context.Context) ([]models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]models.User, 0, len(s.users))
+	for _, u := range s.users {
+		user := u.User
+		user.Password = ""
+		user.TwoFactorEnabled = u.totpEnabled
+		if len(u.roleIDs) > 0 {
+			user.Roles = s.sortedRoles(u.roleIDs)
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastName != users[j].LastName {
+			return users[i].LastName < users[j].LastName
+		}
+		if users[i].FirstName != users[j].FirstName {
+			return users[i].FirstName < users[j].FirstName
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+// SetUserRoles replaces the roles of a user with roleIDs
+func (s *Store) SetUserRoles(ctx context.Context, userID int, roleIDs []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.roleIDs = append([]int(nil), roleIDs...)
+	}
+	return nil
+}
+
+// GetTwoFactor returns the two-factor state of a user
+func (s *Store) GetTwoFactor(ctx context.Context, userID int) (models.TwoFactor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return models.TwoFactor{}, sql.ErrNoRows
+	}
+
+	tf := models.TwoFactor{Secret: u.totpSecret, Enabled: u.totpEnabled, Locked: time.Now().Before(u.totpLocked)}
+	for _, id := range u.roleIDs {
+		if r, ok := s.roles[id]; ok && r.RequiresTwoFactor {
+			tf.Required = true
+		}
+	}
+	return tf, nil
+}
+
+// SetPendingTOTPSecret stores an encrypted secret for a user who has not
+// completed enrollment yet
+func (s *Store) SetPendingTOTPSecret(ctx context.Context, userID int, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok && !u.totpEnabled {
+		u.totpSecret = secret
+	}
+	return nil
+}
+
+// ConsumeTOTPStep records step as used by userID, returning false when the
+// same or a later step was already accepted
+func (s *Store) ConsumeTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok || (u.totpLastStep != nil && *u.totpLastStep >= step) {
+		return false, nil
+	}
+	u.totpLastStep = &step
+	return true, nil
+}
+
+// RecordTwoFactorFailure counts a wrong two-factor code against a user,
+// locking their two-factor logins at models.MaxTwoFactorAttempts in a row
+func (s *Store) RecordTwoFactorFailure(ctx context.Context, userID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return false, nil
+	}
+	u.totpFailures++
+	if u.totpFailures < models.MaxTwoFactorAttempts {
+		return false, nil
+	}
+	u.totpFailures, u.totpLocked = 0, time.Now().Add(models.TwoFactorLockout)
+	return true, nil
+}
+
+// ClearTwoFactorFailures forgets the wrong two-factor codes of a user
+func (s *Store) ClearTwoFactorFailures(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.totpFailures, u.totpLocked = 0, time.Time{}
+	}
+	return nil
+}
+
+// EnableTOTP completes enrollment for a user and replaces their recovery codes
+func (s *Store) EnableTOTP(ctx context.Context, userID int, recoveryCodes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil
+	}
+	u.totpEnabled = true
+	u.recoveryCodes = make(map[string]bool, len(recoveryCodes))
+	for _, c := range recoveryCodes {
+		u.recoveryCodes[normalize(c)] = false
+	}
+	return nil
+}
+
+// ResetTOTP removes the secret and recovery codes of a user so they must enroll again
+func (s *Store) ResetTOTP(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.totpSecret, u.totpEnabled, u.totpLastStep, u.recoveryCodes = "", false, nil, nil
+		u.totpFailures, u.totpLocked = 0, time.Time{}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code of a user as used and
+// reports whether there was one
+func (s *Store) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return false, nil
+	}
+	used, ok := u.recoveryCodes[normalize(code)]
+	if !ok || used {
+		return false, nil
+	}
+	u.recoveryCodes[normalize(code)] = true
+	return true, nil
+}
+
+// normalize makes a recovery code typed with other casing or spacing compare equal
+func normalize(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func contains(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -2,54 +2,113 @@ package models
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/caleberi/gostripe/internal/driver"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrInvalidCredentials is returned when an email and password do not match a user
+var ErrInvalidCredentials = errors.New("models: invalid credentials")
+
 // DBModel is the type for database connection values
 type DBModel struct {
 	DB *sql.DB
+	// Dialect selects the placeholder syntax and how inserted ids are read
+	// back; the zero value is MySQL
+	Dialect driver.Dialect
+	// Reads, when set, picks a replica for read-only queries that tolerate
+	// replication lag; they run on DB otherwise
+	Reads interface{ Reader() *sql.DB }
+	// Timeout bounds every model method, DefaultQueryTimeout when zero.
+	// Methods also stop when the context passed to them is cancelled.
+	Timeout time.Duration
+	// Observer, when set, is called after every statement with the context
+	// of the calling method
+	Observer func(ctx context.Context, e QueryEvent)
+}
+
+// reader returns the pool for a read-only query
+func (m *DBModel) reader() *sql.DB {
+	if m.Reads == nil {
+		return m.DB
+	}
+	return m.Reads.Reader()
 }
 
-// Models is the wrapper for all models
-type Models struct {
-	DB DBModel
+// rebind rewrites the ? placeholders of query for the database dialect
+func (m *DBModel) rebind(query string) string {
+	return m.Dialect.Rebind(query)
 }
 
-// NewModels returns a model type  with database connection pool
-func NewModels(db *sql.DB) Models {
-	return Models{
-		DB: DBModel{
-			DB: db,
-		},
+// insert runs an INSERT statement on q and returns the id of the new row.
+// Postgres has no LastInsertId, so the id is read back with RETURNING.
+func (m *DBModel) insert(ctx context.Context, q querier, query string, args ...interface{}) (int, error) {
+	if m.Dialect == driver.Postgres {
+		var id int
+		err := m.queryRow(ctx, q, query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := m.exec(ctx, q, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
 	}
+
+	return int(id), nil
 }
 
 // Widget model for a database storage
 type Widget struct {
-	ID             int       `json:"id"`
-	Name           string    `json:"name"`
-	Description    string    `json:"description"`
-	InventoryLevel int       `json:"inventory_level"`
-	IsRecurring    bool      `json:"is_recurring"`
-	PlanID         string    `json:"plan_id"`
-	Image          string    `json:"image"`
-	Price          int       `json:"price"`
-	CreatedAt      time.Time `json:"-"`
-	UpdatedAt      time.Time `json:"-"`
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	InventoryLevel int    `json:"inventory_level"`
+	// ReservedLevel is the part of InventoryLevel held for checkouts in progress
+	ReservedLevel int    `json:"reserved_level"`
+	IsRecurring   bool   `json:"is_recurring"`
+	PlanID        string `json:"plan_id"`
+	Image         string `json:"image"`
+	Price         int    `json:"price"`
+	// Weight is the shipping weight of a unit in grams
+	Weight    int       `json:"weight"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
 }
 
 // Order is the type for all order
 type Order struct {
-	ID            int       `json:"id"`
-	WidgetID      int       `json:"widget_id"`
-	TransactionID int       `json:"transaction_id"`
-	CustomerID    int       `json:"customer_id"`
-	StatusID      int       `json:"status_id"`
-	Quantity      int       `json:"quantity"`
-	Amount        int       `json:"amount"`
-	CreatedAt     time.Time `json:"-"`
-	UpdatedAt     time.Time `json:"-"`
+	ID int `json:"id"`
+	// WidgetID is the widget of the first item and Quantity the units of
+	// all items, as recorded on orders before they had items
+	WidgetID      int         `json:"widget_id"`
+	TransactionID int         `json:"transaction_id"`
+	CustomerID    int         `json:"customer_id"`
+	StatusID      OrderStatus `json:"status_id"`
+	Quantity      int         `json:"quantity"`
+	// Amount is what was charged, ShippingAmount included
+	Amount         int         `json:"amount"`
+	ShippingAmount int         `json:"shipping_amount"`
+	Items          []OrderItem `json:"items"`
+	// Fulfillment is unfulfilled until staff ship the order, recording
+	// its TrackingNumber
+	Fulfillment     Fulfillment `json:"fulfillment_status"`
+	TrackingNumber  string      `json:"tracking_number"`
+	BillingAddress  *Address    `json:"billing_address,omitempty"`
+	ShippingAddress *Address    `json:"shipping_address,omitempty"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
 }
 
 // Status is the type for all order statues
@@ -78,22 +137,26 @@ type Transaction struct {
 	ExpiryYear          int       `json:"expiry_year"`
 	PaymentMethod       string    `json:"payment_method"`
 	PaymenyIntent       string    `json:"payment_intent"`
+	SubscriptionID      string    `json:"subscription_id"`
 	BankReturnCode      string    `json:"bank_return_code"`
-	TransactionStatusID int       `json:"transaction_status_id"`
+	TransactionStatusID TxnStatus `json:"transaction_status_id"`
 	CreatedAt           time.Time `json:"-"`
 	UpdatedAt           time.Time `json:"-"`
 }
 
 // User is the type for all users
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	Lastname  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Image     string    `json:"image"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Image     string `json:"image"`
+	Password  string `json:"-"`
+	Roles     []Role `json:"roles,omitempty"`
+	// TwoFactorEnabled reports whether the user completed TOTP enrollment
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
 }
 
 // Customer is the type for all customer
@@ -106,15 +169,14 @@ type Customer struct {
 	UpdatedAt time.Time `json:"-"`
 }
 
-func (m *DBModel) GetWidget(id int) (Widget, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-
+func (m *DBModel) GetWidget(ctx context.Context, id int) (Widget, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var widget Widget
-	row := m.DB.QueryRowContext(ctx, `
+	row := m.queryRow(ctx, m.reader(), `
 		SELECT 
-			id, name, description, inventory_level, price, image,
+			id, name, description, inventory_level, reserved_level, price, weight, image,
 			plan_id, is_recurring, created_at, updated_at
 		FROM 
 			widgets 
@@ -124,7 +186,9 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 		&widget.Name,
 		&widget.Description,
 		&widget.InventoryLevel,
+		&widget.ReservedLevel,
 		&widget.Price,
+		&widget.Weight,
 		&widget.Image,
 		&widget.PlanID,
 		&widget.IsRecurring,
@@ -139,105 +203,478 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 	return widget, nil
 }
 
-// InsertTransaction inserts new transaction  and returns its id
-func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// InsertTransaction inserts new transaction  and returns its id. A
+// payment intent can be recorded only once; look it up with
+// GetTransactionByPaymentIntent first.
+func (m *DBModel) InsertTransaction(ctx context.Context, txn Transaction) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
+	return m.insertTransaction(ctx, m.DB, txn)
+}
+
+// insertTransaction inserts txn on q and returns its id
+func (m *DBModel) insertTransaction(ctx context.Context, q querier, txn Transaction) (int, error) {
 	query := `
 		INSERT INTO transactions
 			( amount, currency, last_four, bank_return_code, expiry_month, expiry_year, payment_intent, payment_method,
-				transaction_status_id, created_at, updated_at)
-		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				subscription_id, transaction_status_id, created_at, updated_at)
+		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	result, err := m.DB.ExecContext(ctx, query,
+	return m.insert(ctx, q, query,
 		txn.Amount,
 		txn.Currency,
 		txn.LastFour,
 		txn.BankReturnCode,
 		txn.ExpiryMonth,
 		txn.ExpiryYear,
-		txn.PaymentMethod,
 		txn.PaymenyIntent,
+		txn.PaymentMethod,
+		txn.SubscriptionID,
 		txn.TransactionStatusID,
 		time.Now(),
 		time.Now(),
 	)
+}
+
+// InsertOrder inserts a new order with its items and addresses and returns
+// its id. An order without items is stored with one item for its widget.
+// The status history starts with the order being placed by by.
+func (m *DBModel) InsertOrder(ctx context.Context, order Order, by Actor) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
+	defer tx.Rollback()
 
-	id, err := result.LastInsertId()
-
+	id, err := m.insertOrder(ctx, tx, order, by)
 	if err != nil {
 		return 0, err
 	}
 
-	return int(id), nil
+	return id, tx.Commit()
 }
 
-// InsertOrder inserts new order  and returns its id
-func (m *DBModel) InsertOrder(order Order) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// PlaceOrder records a paid checkout: it inserts txn, customer and order,
+// linked to the other two, in one database transaction and returns the id
+// of the order. Either all three are stored or none is, so a checkout that
+// fails part way can be retried with the same payment intent.
+func (m *DBModel) PlaceOrder(ctx context.Context, order Order, txn Transaction, customer Customer, by Actor) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	query := `
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	order.TransactionID, err = m.insertTransaction(ctx, tx, txn)
+	if err != nil {
+		return 0, err
+	}
+
+	order.CustomerID, err = m.insertCustomer(ctx, tx, customer)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := m.insertOrder(ctx, tx, order, by)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// insertOrder inserts order with its items, addresses and first status on
+// q and returns its id; q should be a transaction
+func (m *DBModel) insertOrder(ctx context.Context, q querier, order Order, by Actor) (int, error) {
+	order = order.WithItems()
+
+	id, err := m.insert(ctx, q, `
 		INSERT INTO orders
 			( widget_id, transaction_id, status_id, quantity, customer_id,
-				amount, created_at, updated_at) 
-		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?)
-	`
-	result, err := m.DB.ExecContext(ctx, query,
+				amount, shipping_amount, created_at, updated_at) 
+		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
 		order.WidgetID,
 		order.TransactionID,
 		order.StatusID,
 		order.Quantity,
 		order.CustomerID,
 		order.Amount,
+		order.ShippingAmount,
 		time.Now(),
 		time.Now(),
 	)
-
 	if err != nil {
 		return 0, err
 	}
 
-	id, err := result.LastInsertId()
+	for _, item := range order.Items {
+		_, err := m.exec(ctx, q, `
+			INSERT INTO order_items
+				(order_id, widget_id, quantity, price, amount, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, item.WidgetID, item.Quantity, item.Price, item.Amount, time.Now(), time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
 
-	if err != nil {
+	order.ID = id
+	if err := m.insertAddresses(ctx, q, order); err != nil {
 		return 0, err
 	}
 
-	return int(id), nil
+	if err := m.recordStatusChange(ctx, q, id, 0, order.StatusID, by); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// WithItems completes the summary fields of an order from its items, or
+// gives an order without items a single one for its widget
+func (o Order) WithItems() Order {
+	if len(o.Items) == 0 {
+		amount := o.Amount - o.ShippingAmount
+		price := amount
+		if o.Quantity > 0 {
+			price = amount / o.Quantity
+		}
+		o.Items = []OrderItem{{WidgetID: o.WidgetID, Quantity: o.Quantity, Price: price, Amount: amount}}
+		return o
+	}
+
+	o.WidgetID = o.Items[0].WidgetID
+	o.Quantity = 0
+	for _, item := range o.Items {
+		o.Quantity += item.Quantity
+	}
+	return o
 }
 
-func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) InsertCustomer(ctx context.Context, customer Customer) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
+	return m.insertCustomer(ctx, m.DB, customer)
+}
+
+// insertCustomer inserts customer on q and returns its id
+func (m *DBModel) insertCustomer(ctx context.Context, q querier, customer Customer) (int, error) {
 	query := `
 		INSERT INTO customers
 			( first_name, last_name, email, created_at, updated_at)
 		VALUES ( ?, ?, ?, ?, ?)
 	`
-	result, err := m.DB.ExecContext(ctx, query,
+	return m.insert(ctx, q, query,
 		customer.FirstName,
 		customer.LastName,
 		customer.Email,
 		time.Now(),
 		time.Now(),
 	)
+}
+
+// GetCustomer returns a customer by id
+func (m *DBModel) GetCustomer(ctx context.Context, id int) (Customer, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var customer Customer
+	row := m.queryRow(ctx, m.DB, `
+		SELECT
+			id, first_name, last_name, email, created_at, updated_at
+		FROM
+			customers
+		WHERE id = ?`, id)
+	err := row.Scan(
+		&customer.ID,
+		&customer.FirstName,
+		&customer.LastName,
+		&customer.Email,
+		&customer.CreatedAt,
+		&customer.UpdatedAt,
+	)
 
 	if err != nil {
-		return 0, err
+		return customer, err
 	}
 
-	id, err := result.LastInsertId()
+	return customer, nil
+}
 
+// GetOrder returns an order by id. It reads from the primary because
+// refunds decide on the status it returns.
+func (m *DBModel) GetOrder(ctx context.Context, id int) (Order, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var order Order
+	row := m.queryRow(ctx, m.DB, `
+		SELECT
+			id, widget_id, transaction_id, customer_id, status_id, quantity,
+			amount, shipping_amount, fulfillment_status, tracking_number,
+			created_at, updated_at
+		FROM
+			orders
+		WHERE id = ?`, id)
+	err := row.Scan(
+		&order.ID,
+		&order.WidgetID,
+		&order.TransactionID,
+		&order.CustomerID,
+		&order.StatusID,
+		&order.Quantity,
+		&order.Amount,
+		&order.ShippingAmount,
+		&order.Fulfillment,
+		&order.TrackingNumber,
+		&order.CreatedAt,
+		&order.UpdatedAt,
+	)
+
+	if err != nil {
+		return order, err
+	}
+
+	order.Items, err = m.orderItems(ctx, m.DB, order.ID)
+	if err != nil {
+		return order, err
+	}
+
+	err = m.loadAddresses(ctx, m.DB, &order)
+	return order, err
+}
+
+// orderItems returns the items of an order with the names of their widgets
+func (m *DBModel) orderItems(ctx context.Context, q querier, orderID int) ([]OrderItem, error) {
+	rows, err := m.query(ctx, q, `
+		SELECT
+			oi.id, oi.order_id, oi.widget_id, w.name, oi.quantity, oi.price, oi.amount
+		FROM
+			order_items oi
+			JOIN widgets w ON w.id = oi.widget_id
+		WHERE oi.order_id = ?
+		ORDER BY oi.id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []OrderItem
+	for rows.Next() {
+		var item OrderItem
+		err := rows.Scan(&item.ID, &item.OrderID, &item.WidgetID, &item.Name, &item.Quantity, &item.Price, &item.Amount)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// GetUserByEmail returns the user with the given email, including the password hash
+func (m *DBModel) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var user User
+	row := m.queryRow(ctx, m.DB, `
+		SELECT
+			id, first_name, last_name, email, image, password, created_at, updated_at
+		FROM
+			users
+		WHERE email = ?`, strings.ToLower(email))
+	err := row.Scan(
+		&user.ID,
+		&user.FirstName,
+		&user.LastName,
+		&user.Email,
+		&user.Image,
+		&user.Password,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// Authenticate checks email and password against the users table and returns
+// the user id. ErrInvalidCredentials is returned for an unknown email or a
+// wrong password alike.
+func (m *DBModel) Authenticate(ctx context.Context, email, password string) (int, error) {
+	user, err := m.GetUserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidCredentials
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	return int(id), nil
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return 0, ErrInvalidCredentials
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return user.ID, nil
+}
+
+// PasswordFingerprint identifies the user's current password hash without
+// revealing it. Embedding it in a reset link makes the link single use,
+// because it stops matching as soon as the password changes.
+func (u User) PasswordFingerprint() string {
+	sum := sha256.Sum256([]byte(u.Password))
+	return hex.EncodeToString(sum[:8])
+}
+
+// UpdatePasswordForUser stores a new bcrypt hash for user and revokes all of
+// their bearer tokens
+func (m *DBModel) UpdatePasswordForUser(ctx context.Context, u User, hash string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = m.exec(ctx, tx, `UPDATE users SET password = ?, updated_at = ? WHERE id = ?`, hash, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.exec(ctx, tx, `DELETE FROM tokens WHERE user_id = ?`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetTransaction returns a transaction by id
+func (m *DBModel) GetTransaction(ctx context.Context, id int) (Transaction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var txn Transaction
+	row := m.queryRow(ctx, m.DB, `
+		SELECT
+			id, amount, currency, last_four, expiry_month, expiry_year,
+			payment_method, payment_intent, subscription_id, bank_return_code, transaction_status_id,
+			created_at, updated_at
+		FROM
+			transactions
+		WHERE id = ?`, id)
+	err := row.Scan(
+		&txn.ID,
+		&txn.Amount,
+		&txn.Currency,
+		&txn.LastFour,
+		&txn.ExpiryMonth,
+		&txn.ExpiryYear,
+		&txn.PaymentMethod,
+		&txn.PaymenyIntent,
+		&txn.SubscriptionID,
+		&txn.BankReturnCode,
+		&txn.TransactionStatusID,
+		&txn.CreatedAt,
+		&txn.UpdatedAt,
+	)
+
+	if err != nil {
+		return txn, err
+	}
+
+	return txn, nil
+}
+
+// GetTransactionByPaymentIntent returns the transaction recording a payment
+// intent, or sql.ErrNoRows when it was not recorded
+func (m *DBModel) GetTransactionByPaymentIntent(ctx context.Context, paymentIntent string) (Transaction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var id int
+	err := m.queryRow(ctx, m.DB, `SELECT id FROM transactions WHERE payment_intent = ? AND payment_intent <> ''`, paymentIntent).Scan(&id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return m.GetTransaction(ctx, id)
+}
+
+// UpdateOrderStatus moves an order and its transaction to new statuses
+// together and records the change in the order status history. Moves the
+// lifecycles do not allow, judged against the statuses stored rather than
+// those of order, return an error wrapping ErrIllegalTransition, as does a
+// change made by someone else since they were read.
+func (m *DBModel) UpdateOrderStatus(ctx context.Context, order Order, status OrderStatus, txnStatus TxnStatus, by Actor) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current OrderStatus
+	var currentTxn TxnStatus
+	err = m.queryRow(ctx, tx, `
+		SELECT o.status_id, t.transaction_status_id
+		FROM orders o JOIN transactions t ON t.id = o.transaction_id
+		WHERE o.id = ?`, order.ID).Scan(&current, &currentTxn)
+	if err != nil {
+		return err
+	}
+	if err := current.Transition(status); err != nil {
+		return err
+	}
+	if err := currentTxn.Transition(txnStatus); err != nil {
+		return err
+	}
+
+	// the status in the WHERE clause catches a change committed since the
+	// statuses were read
+	res, err := m.exec(ctx, tx, `UPDATE orders SET status_id = ?, updated_at = ? WHERE id = ? AND status_id = ?`,
+		status, time.Now(), order.ID, current)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: order %d is no longer %s", ErrIllegalTransition, order.ID, current)
+	}
+
+	res, err = m.exec(ctx, tx, `UPDATE transactions SET transaction_status_id = ?, updated_at = ? WHERE id = ? AND transaction_status_id = ?`,
+		txnStatus, time.Now(), order.TransactionID, currentTxn)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: transaction %d is no longer %s", ErrIllegalTransition, order.TransactionID, currentTxn)
+	}
+
+	if err := m.recordStatusChange(ctx, tx, order.ID, current, status, by); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
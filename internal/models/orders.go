@@ -0,0 +1,326 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/validator"
+)
+
+// dateLayout is how the from and to order filters are written
+const dateLayout = "2006-01-02"
+
+// OrderSummary is an order joined with its customer, transaction and
+// statuses, as support staff look orders up
+type OrderSummary struct {
+	Order
+	Status            string      `json:"status"`
+	Customer          Customer    `json:"customer"`
+	Transaction       Transaction `json:"transaction"`
+	TransactionStatus string      `json:"transaction_status"`
+	// WidgetName is the name of the widget of the first item, and ItemCount
+	// the number of items
+	WidgetName string `json:"widget_name"`
+	ItemCount  int    `json:"item_count"`
+	// History is the status history, oldest first; lists leave it out
+	History []StatusChange `json:"history,omitempty"`
+}
+
+// OrderFilter selects and pages the orders ListOrders returns, newest
+// first. Zero fields do not filter.
+type OrderFilter struct {
+	StatusID    OrderStatus
+	Fulfillment Fulfillment
+	// From and To bound the day the order was placed on, both inclusive
+	From time.Time
+	To   time.Time
+	// Email matches part of the customer email, ignoring case
+	Email string
+	// WidgetID keeps orders with an item for the widget
+	WidgetID  int
+	MinAmount int
+	MaxAmount int
+	// Cursor is the NextCursor of the page before, empty for the first page
+	Cursor   string
+	PageSize int
+}
+
+// CursorMetadata describes a page of a list paged by cursor
+type CursorMetadata struct {
+	PageSize int `json:"page_size"`
+	// NextCursor fetches the page after this one; it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ParseOrderFilter reads a filter from the query parameters status_id,
+// fulfillment_status, from, to, email, widget_id, min_amount, max_amount,
+// cursor and page_size, recording malformed and out of range values in v
+func ParseOrderFilter(q url.Values, v *validator.Validator) OrderFilter {
+	f := OrderFilter{
+		Fulfillment: Fulfillment(q.Get("fulfillment_status")),
+		Email:       strings.TrimSpace(q.Get("email")),
+		Cursor:      q.Get("cursor"),
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"from", &f.From},
+		{"to", &f.To},
+	} {
+		if s := q.Get(p.name); s != "" {
+			t, err := time.Parse(dateLayout, s)
+			v.Check(err == nil, p.name, "must be a date such as 2026-01-31")
+			*p.dst = t
+		}
+	}
+
+	var statusID int
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{
+		{"status_id", &statusID},
+		{"widget_id", &f.WidgetID},
+		{"min_amount", &f.MinAmount},
+		{"max_amount", &f.MaxAmount},
+		{"page_size", &f.PageSize},
+	} {
+		if s := q.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			v.Check(err == nil, p.name, "must be a whole number")
+			*p.dst = n
+		}
+	}
+	f.StatusID = OrderStatus(statusID)
+
+	f.Validate(v)
+	return f
+}
+
+// Validate checks the filter values a client sent
+func (f OrderFilter) Validate(v *validator.Validator) {
+	v.Check(f.StatusID == 0 || f.StatusID.Valid(), "status_id", "must be an order status")
+	v.Check(f.Fulfillment == "" || f.Fulfillment.Valid(), "fulfillment_status", "must be unfulfilled, shipped or delivered")
+	v.Check(f.WidgetID >= 0, "widget_id", "must not be negative")
+	v.Check(f.To.IsZero() || !f.To.Before(f.From), "to", "must not be before from")
+	v.Check(f.MinAmount >= 0, "min_amount", "must not be negative")
+	v.Check(f.MaxAmount >= 0, "max_amount", "must not be negative")
+	v.Check(f.MaxAmount == 0 || f.MinAmount <= f.MaxAmount, "max_amount", "must not be less than min_amount")
+	v.Check(f.PageSize >= 0 && f.PageSize <= MaxPageSize, "page_size", fmt.Sprintf("must be between 1 and %d", MaxPageSize))
+	_, err := f.After()
+	v.Check(err == nil, "cursor", "is not a cursor returned by this endpoint")
+}
+
+// Size returns the page size with the default applied
+func (f OrderFilter) Size() int {
+	if f.PageSize < 1 || f.PageSize > MaxPageSize {
+		return DefaultPageSize
+	}
+	return f.PageSize
+}
+
+// After returns the id of the order the cursor continues after, 0 for the
+// first page
+func (f OrderFilter) After() (int, error) {
+	if f.Cursor == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(f.Cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(string(b), "order:"))
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("models: bad order cursor %q", f.Cursor)
+	}
+	return id, nil
+}
+
+// OrderCursor returns the cursor of the page after the order with id
+func OrderCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("order:" + strconv.Itoa(id)))
+}
+
+// orderSummaryQuery selects the columns scanSummary reads. Orders are paged
+// by id, which grows with the time they were placed, so a page stays put
+// while new orders arrive.
+const orderSummaryQuery = `
+	SELECT
+		o.id, o.widget_id, o.transaction_id, COALESCE(o.customer_id, 0), o.status_id,
+		o.quantity, o.amount, o.shipping_amount, o.fulfillment_status, o.tracking_number,
+		o.created_at, o.updated_at,
+		s.name,
+		COALESCE(c.first_name, ''), COALESCE(c.last_name, ''), COALESCE(c.email, ''),
+		t.amount, t.currency, t.last_four, t.payment_intent, t.payment_method,
+		t.subscription_id, t.bank_return_code, t.transaction_status_id, ts.name,
+		w.name,
+		(SELECT COUNT(*) FROM order_items oi WHERE oi.order_id = o.id)
+	FROM
+		orders o
+		JOIN statuses s ON s.id = o.status_id
+		JOIN transactions t ON t.id = o.transaction_id
+		JOIN transaction_statuses ts ON ts.id = t.transaction_status_id
+		JOIN widgets w ON w.id = o.widget_id
+		LEFT JOIN customers c ON c.id = o.customer_id`
+
+// scanSummary reads a row of orderSummaryQuery
+func scanSummary(row interface{ Scan(...interface{}) error }) (OrderSummary, error) {
+	var o OrderSummary
+	err := row.Scan(
+		&o.ID, &o.WidgetID, &o.TransactionID, &o.CustomerID, &o.StatusID,
+		&o.Quantity, &o.Amount, &o.ShippingAmount, &o.Fulfillment, &o.TrackingNumber,
+		&o.CreatedAt, &o.UpdatedAt,
+		&o.Status,
+		&o.Customer.FirstName, &o.Customer.LastName, &o.Customer.Email,
+		&o.Transaction.Amount, &o.Transaction.Currency, &o.Transaction.LastFour,
+		&o.Transaction.PaymenyIntent, &o.Transaction.PaymentMethod,
+		&o.Transaction.SubscriptionID, &o.Transaction.BankReturnCode, &o.Transaction.TransactionStatusID, &o.TransactionStatus,
+		&o.WidgetName,
+		&o.ItemCount,
+	)
+	o.Customer.ID = o.CustomerID
+	o.Transaction.ID = o.TransactionID
+	return o, err
+}
+
+// ListOrders returns a page of the orders matching f, newest first, and the
+// cursor of the next page. It reads from a replica, so the newest orders
+// may be missing for as long as the replica lags.
+func (m *DBModel) ListOrders(ctx context.Context, f OrderFilter) ([]OrderSummary, CursorMetadata, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	after, err := f.After()
+	if err != nil {
+		return nil, CursorMetadata{}, err
+	}
+
+	var where []string
+	var args []interface{}
+	if after > 0 {
+		where = append(where, "o.id < ?")
+		args = append(args, after)
+	}
+	if f.StatusID > 0 {
+		where = append(where, "o.status_id = ?")
+		args = append(args, f.StatusID)
+	}
+	if f.Fulfillment != "" {
+		where = append(where, "o.fulfillment_status = ?")
+		args = append(args, f.Fulfillment)
+	}
+	if !f.From.IsZero() {
+		where = append(where, "o.created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		where = append(where, "o.created_at < ?")
+		args = append(args, f.To.AddDate(0, 0, 1))
+	}
+	if f.Email != "" {
+		where = append(where, "LOWER(c.email) LIKE ? ESCAPE '!'")
+		args = append(args, likePattern(f.Email))
+	}
+	if f.WidgetID > 0 {
+		where = append(where, "EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = o.id AND oi.widget_id = ?)")
+		args = append(args, f.WidgetID)
+	}
+	if f.MinAmount > 0 {
+		where = append(where, "o.amount >= ?")
+		args = append(args, f.MinAmount)
+	}
+	if f.MaxAmount > 0 {
+		where = append(where, "o.amount <= ?")
+		args = append(args, f.MaxAmount)
+	}
+
+	clause := ""
+	if len(where) > 0 {
+		clause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	// one row more than the page tells whether there is a next page
+	size := f.Size()
+	rows, err := m.query(ctx, m.reader(), orderSummaryQuery+`
+		`+clause+`
+		ORDER BY o.id DESC
+		LIMIT ?`, append(args, size+1)...)
+	if err != nil {
+		return nil, CursorMetadata{}, err
+	}
+	defer rows.Close()
+
+	var orders []OrderSummary
+	for rows.Next() {
+		o, err := scanSummary(rows)
+		if err != nil {
+			return nil, CursorMetadata{}, err
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, CursorMetadata{}, err
+	}
+
+	metadata := CursorMetadata{PageSize: size}
+	if len(orders) > size {
+		orders = orders[:size]
+		metadata.NextCursor = OrderCursor(orders[size-1].ID)
+	}
+	return orders, metadata, nil
+}
+
+// GetOrderSummary returns an order by id with its customer, transaction,
+// statuses, items, addresses and status history. It reads from the
+// primary, so a change staff just made is always shown.
+func (m *DBModel) GetOrderSummary(ctx context.Context, id int) (OrderSummary, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	o, err := scanSummary(m.queryRow(ctx, m.DB, orderSummaryQuery+`
+		WHERE o.id = ?`, id))
+	if err != nil {
+		return o, err
+	}
+
+	o.Items, err = m.orderItems(ctx, m.DB, o.ID)
+	if err != nil {
+		return o, err
+	}
+
+	if err := m.loadAddresses(ctx, m.DB, &o.Order); err != nil {
+		return o, err
+	}
+
+	o.History, err = m.orderHistory(ctx, m.DB, o.ID)
+	return o, err
+}
+
+// AllStatuses returns every order status ordered by id
+func (m *DBModel) AllStatuses(ctx context.Context) ([]Status, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, m.reader(), `SELECT id, name, created_at, updated_at FROM statuses ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []Status
+	for rows.Next() {
+		var s Status
+		if err := rows.Scan(&s.ID, &s.Status, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
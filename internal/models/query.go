@@ -0,0 +1,135 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// DefaultQueryTimeout bounds each model method when DBModel.Timeout is zero
+const DefaultQueryTimeout = 3 * time.Second
+
+// QueryEvent describes one finished statement
+type QueryEvent struct {
+	// Method is the model method that ran the statement, e.g. GetWidget
+	Method   string
+	Query    string
+	Duration time.Duration
+	Err      error
+	// Canceled reports whether the statement stopped because its context
+	// was cancelled, typically by a client that went away
+	Canceled bool
+	// TimedOut reports whether the statement ran past its deadline
+	TimedOut bool
+}
+
+// querier is implemented by *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// withTimeout bounds ctx by the query timeout of the model. A deadline
+// already on ctx wins when it is sooner.
+func (m *DBModel) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// exec runs a statement on q with the placeholders of the dialect
+func (m *DBModel) exec(ctx context.Context, q querier, query string, args ...interface{}) (sql.Result, error) {
+	query = m.rebind(query)
+	start := time.Now()
+	res, err := q.ExecContext(ctx, query, args...)
+	m.observe(ctx, query, start, err)
+	return res, err
+}
+
+// query runs a query returning rows on q with the placeholders of the dialect
+func (m *DBModel) query(ctx context.Context, q querier, query string, args ...interface{}) (*sql.Rows, error) {
+	query = m.rebind(query)
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args...)
+	m.observe(ctx, query, start, err)
+	return rows, err
+}
+
+// queryRow runs a query returning at most one row on q with the
+// placeholders of the dialect
+func (m *DBModel) queryRow(ctx context.Context, q querier, query string, args ...interface{}) *sql.Row {
+	query = m.rebind(query)
+	start := time.Now()
+	row := q.QueryRowContext(ctx, query, args...)
+	err := row.Err()
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	m.observe(ctx, query, start, err)
+	return row
+}
+
+// observe reports a finished statement to m.Observer
+func (m *DBModel) observe(ctx context.Context, query string, start time.Time, err error) {
+	if m.Observer == nil {
+		return
+	}
+
+	m.Observer(ctx, QueryEvent{
+		Method:   callerMethod(),
+		Query:    strings.Join(strings.Fields(query), " "),
+		Duration: time.Since(start),
+		Err:      err,
+		Canceled: errors.Is(err, context.Canceled),
+		TimedOut: errors.Is(err, context.DeadlineExceeded),
+	})
+}
+
+// callerMethod returns the name of the first exported DBModel method on
+// the stack, skipping the query helpers
+func callerMethod() string {
+	pcs := make([]uintptr, 8)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function[strings.LastIndex(frame.Function, ".")+1:]
+		if strings.Contains(frame.Function, "(*DBModel).") && name != "" && name[0] >= 'A' && name[0] <= 'Z' {
+			return name
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// LogQueries returns an observer that logs statements slower than slow and
+// statements stopped by cancellation or a timeout. requestID labels each
+// line with the request that ran the statement, when it returns one.
+func LogQueries(logger *log.Logger, slow time.Duration, requestID func(context.Context) string) func(context.Context, QueryEvent) {
+	return func(ctx context.Context, e QueryEvent) {
+		var what string
+		switch {
+		case e.Canceled:
+			what = "canceled query"
+		case e.TimedOut:
+			what = "timed out query"
+		case slow > 0 && e.Duration >= slow:
+			what = "slow query"
+		default:
+			return
+		}
+
+		if id := requestID(ctx); id != "" {
+			what += " [" + id + "]"
+		}
+		logger.Printf("%s %s took %s: %s", what, e.Method, e.Duration.Round(time.Microsecond), e.Query)
+	}
+}
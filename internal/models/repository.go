@@ -0,0 +1,120 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// WidgetRepository stores the widget catalog
+type WidgetRepository interface {
+	GetWidget(ctx context.Context, id int) (Widget, error)
+	ListWidgets(ctx context.Context, f WidgetFilter) ([]Widget, Metadata, error)
+	InsertWidget(ctx context.Context, w Widget) (int, error)
+	UpdateWidget(ctx context.Context, w Widget, adjustment int) error
+	SetWidgetImage(ctx context.Context, id int, image string) error
+	DeleteWidget(ctx context.Context, id int) error
+}
+
+// InventoryRepository reserves and sells widget stock and keeps the log of
+// its movements
+type InventoryRepository interface {
+	ReserveInventory(ctx context.Context, paymentIntent string, lines []CartLine, expiresAt time.Time) error
+	CommitReservation(ctx context.Context, paymentIntent string, lines []CartLine) error
+	ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error)
+	ListInventoryMovements(ctx context.Context, widgetID, limit int) ([]InventoryMovement, error)
+}
+
+// OrderRepository stores orders with their items, addresses, status
+// history and fulfillment
+type OrderRepository interface {
+	InsertOrder(ctx context.Context, order Order, by Actor) (int, error)
+	PlaceOrder(ctx context.Context, order Order, txn Transaction, customer Customer, by Actor) (int, error)
+	GetOrder(ctx context.Context, id int) (Order, error)
+	UpdateOrderStatus(ctx context.Context, order Order, status OrderStatus, txnStatus TxnStatus, by Actor) error
+	UpdateFulfillment(ctx context.Context, orderID int, u FulfillmentUpdate) error
+
+	ListOrders(ctx context.Context, f OrderFilter) ([]OrderSummary, CursorMetadata, error)
+	GetOrderSummary(ctx context.Context, id int) (OrderSummary, error)
+	AllStatuses(ctx context.Context) ([]Status, error)
+}
+
+// ShippingRepository stores the rates shipping is priced by
+type ShippingRepository interface {
+	ListShippingRates(ctx context.Context) ([]ShippingRate, error)
+}
+
+// CustomerRepository stores customers
+type CustomerRepository interface {
+	InsertCustomer(ctx context.Context, customer Customer) (int, error)
+	GetCustomer(ctx context.Context, id int) (Customer, error)
+}
+
+// TransactionRepository stores payment transactions
+type TransactionRepository interface {
+	InsertTransaction(ctx context.Context, txn Transaction) (int, error)
+	GetTransaction(ctx context.Context, id int) (Transaction, error)
+	GetTransactionByPaymentIntent(ctx context.Context, paymentIntent string) (Transaction, error)
+}
+
+// UserRepository stores staff users with their credentials, bearer
+// tokens, roles and two-factor state
+type UserRepository interface {
+	GetUser(ctx context.Context, id int) (User, error)
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	Authenticate(ctx context.Context, email, password string) (int, error)
+	UpdatePasswordForUser(ctx context.Context, u User, hash string) error
+
+	InsertToken(ctx context.Context, t *Token, u User) error
+	GetUserForToken(ctx context.Context, plainText string) (User, error)
+	DeleteExpiredTokens(ctx context.Context) error
+
+	PermissionsForUser(ctx context.Context, userID int) ([]string, error)
+	AllRoles(ctx context.Context) ([]Role, error)
+	AllUsers(ctx context.Context) ([]User, error)
+	SetUserRoles(ctx context.Context, userID int, roleIDs []int) error
+
+	GetTwoFactor(ctx context.Context, userID int) (TwoFactor, error)
+	SetPendingTOTPSecret(ctx context.Context, userID int, secret string) error
+	ConsumeTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	RecordTwoFactorFailure(ctx context.Context, userID int) (bool, error)
+	ClearTwoFactorFailures(ctx context.Context, userID int) error
+	EnableTOTP(ctx context.Context, userID int, recoveryCodes []string) error
+	ResetTOTP(ctx context.Context, userID int) error
+	UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error)
+}
+
+// Models holds a repository per aggregate. Handlers depend on it rather
+// than on a storage, so they run against the database or the in-memory
+// store in models/memory alike.
+type Models struct {
+	Widgets      WidgetRepository
+	Inventory    InventoryRepository
+	Orders       OrderRepository
+	Shipping     ShippingRepository
+	Customers    CustomerRepository
+	Transactions TransactionRepository
+	Users        UserRepository
+}
+
+var (
+	_ WidgetRepository      = (*DBModel)(nil)
+	_ InventoryRepository   = (*DBModel)(nil)
+	_ OrderRepository       = (*DBModel)(nil)
+	_ ShippingRepository    = (*DBModel)(nil)
+	_ CustomerRepository    = (*DBModel)(nil)
+	_ TransactionRepository = (*DBModel)(nil)
+	_ UserRepository        = (*DBModel)(nil)
+)
+
+// NewModels returns the repositories backed by the database of m
+func NewModels(m *DBModel) Models {
+	return Models{
+		Widgets:      m,
+		Inventory:    m,
+		Orders:       m,
+		Shipping:     m,
+		Customers:    m,
+		Transactions: m,
+		Users:        m,
+	}
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Role is a named set of permissions assigned to users
+type Role struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// RequiresTwoFactor makes TOTP enrollment mandatory for holders of the role
+	RequiresTwoFactor bool      `json:"requires_two_factor"`
+	CreatedAt         time.Time `json:"-"`
+	UpdatedAt         time.Time `json:"-"`
+}
+
+// PermissionsForUser returns the names of all permissions granted to a user through their roles
+func (m *DBModel) PermissionsForUser(ctx context.Context, userID int) ([]string, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, m.DB, `
+		SELECT DISTINCT
+			p.name
+		FROM
+			permissions p
+			INNER JOIN role_permissions rp ON rp.permission_id = p.id
+			INNER JOIN user_roles ur ON ur.role_id = rp.role_id
+		WHERE ur.user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var perms []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		perms = append(perms, name)
+	}
+
+	return perms, rows.Err()
+}
+
+// AllRoles returns every role ordered by id
+func (m *DBModel) AllRoles(ctx context.Context) ([]Role, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, m.DB, `
+		SELECT
+			id, name, description, requires_2fa, created_at, updated_at
+		FROM
+			roles
+		ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var r Role
+		if err := rows.Scan(&r.ID, &r.Name, &r.Description, &r.RequiresTwoFactor, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+
+	return roles, rows.Err()
+}
+
+// AllUsers returns every user with their roles, ordered by last name
+func (m *DBModel) AllUsers(ctx context.Context) ([]User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, m.DB, `
+		SELECT
+			id, first_name, last_name, email, image, totp_enabled_at IS NOT NULL, created_at, updated_at
+		FROM
+			users
+		ORDER BY last_name, first_name, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	index := make(map[int]int)
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Image, &u.TwoFactorEnabled, &u.CreatedAt, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+		index[u.ID] = len(users)
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	roleRows, err := m.query(ctx, m.DB, `
+		SELECT
+			ur.user_id, r.id, r.name, r.description, r.requires_2fa, r.created_at, r.updated_at
+		FROM
+			user_roles ur
+			INNER JOIN roles r ON r.id = ur.role_id
+		ORDER BY r.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer roleRows.Close()
+
+	for roleRows.Next() {
+		var userID int
+		var r Role
+		if err := roleRows.Scan(&userID, &r.ID, &r.Name, &r.Description, &r.RequiresTwoFactor, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if i, ok := index[userID]; ok {
+			users[i].Roles = append(users[i].Roles, r)
+		}
+	}
+
+	return users, roleRows.Err()
+}
+
+// SetUserRoles replaces the roles of a user with roleIDs
+func (m *DBModel) SetUserRoles(ctx context.Context, userID int, roleIDs []int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := m.exec(ctx, tx, `DELETE FROM user_roles WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	for _, roleID := range roleIDs {
+		_, err := m.exec(ctx, tx, `
+			INSERT INTO user_roles
+				( user_id, role_id, created_at, updated_at)
+			VALUES ( ?, ?, ?, ?)`, userID, roleID, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
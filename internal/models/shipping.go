@@ -0,0 +1,293 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/validator"
+)
+
+// ShippingMetadataKey is the payment intent metadata key the shipping
+// charged, in cents, is stored under
+const ShippingMetadataKey = "shipping"
+
+// AddressKind tells the billing and shipping addresses of an order apart
+type AddressKind string
+
+const (
+	AddressBilling  AddressKind = "billing"
+	AddressShipping AddressKind = "shipping"
+)
+
+// Address is a postal address given for an order
+type Address struct {
+	ID         int         `json:"id"`
+	CustomerID int         `json:"customer_id"`
+	OrderID    int         `json:"order_id"`
+	Kind       AddressKind `json:"kind"`
+	Name       string      `json:"name"`
+	Line1      string      `json:"line1"`
+	Line2      string      `json:"line2"`
+	City       string      `json:"city"`
+	Region     string      `json:"region"`
+	PostalCode string      `json:"postal_code"`
+	// Country is an ISO 3166-1 alpha-2 code in upper case
+	Country   string    `json:"country"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// Validate checks the fields of an address, recording errors under the
+// field names prefixed with prefix
+func (a Address) Validate(v *validator.Validator, prefix string) {
+	v.Check(validator.NotBlank(a.Name), prefix+"name", "must be provided")
+	v.Check(validator.MaxChars(a.Name, validator.MaxNameLength), prefix+"name", "must not be more than 255 characters")
+	v.Check(validator.NotBlank(a.Line1), prefix+"line1", "must be provided")
+	v.Check(validator.MaxChars(a.Line1, 255), prefix+"line1", "must not be more than 255 characters")
+	v.Check(validator.MaxChars(a.Line2, 255), prefix+"line2", "must not be more than 255 characters")
+	v.Check(validator.NotBlank(a.City), prefix+"city", "must be provided")
+	v.Check(validator.MaxChars(a.City, 255), prefix+"city", "must not be more than 255 characters")
+	v.Check(validator.MaxChars(a.Region, 255), prefix+"region", "must not be more than 255 characters")
+	v.Check(validator.MaxChars(a.PostalCode, 32), prefix+"postal_code", "must not be more than 32 characters")
+	v.Check(validator.IsCountry(a.Country), prefix+"country", "must be a two letter country code such as US")
+}
+
+// Normalize trims the fields of a and upper cases its country
+func (a Address) Normalize() Address {
+	for _, f := range []*string{&a.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country} {
+		*f = strings.TrimSpace(*f)
+	}
+	a.Country = strings.ToUpper(a.Country)
+	return a
+}
+
+// ShippingRateKind selects how a shipping rate is applied
+type ShippingRateKind string
+
+const (
+	// RateFlat adds Amount to every order
+	RateFlat ShippingRateKind = "flat"
+	// RateWeight adds Amount per started kilogram of widgets
+	RateWeight ShippingRateKind = "weight"
+	// RateFreeOver waives shipping on orders whose widgets cost at least
+	// Threshold
+	RateFreeOver ShippingRateKind = "free_over"
+)
+
+// ShippingRate is a rule shipping is priced by
+type ShippingRate struct {
+	ID        int              `json:"id"`
+	Name      string           `json:"name"`
+	Kind      ShippingRateKind `json:"kind"`
+	Amount    int              `json:"amount"`
+	Threshold int              `json:"threshold"`
+}
+
+// QuoteShipping returns the shipping charged on widgets costing subtotal
+// and weighing weight grams: the flat and weight rates added together, or
+// nothing when a free_over rate applies. With no rates shipping is free.
+func QuoteShipping(rates []ShippingRate, subtotal, weight int) int {
+	shipping := 0
+	for _, r := range rates {
+		switch r.Kind {
+		case RateFlat:
+			shipping += r.Amount
+		case RateWeight:
+			kilos := (weight + 999) / 1000
+			shipping += r.Amount * kilos
+		case RateFreeOver:
+			if subtotal >= r.Threshold {
+				return 0
+			}
+		}
+	}
+	return shipping
+}
+
+// WithShipping returns c with the shipping of rates added to its total
+func (c Cart) WithShipping(rates []ShippingRate) Cart {
+	if len(c.Items) == 0 {
+		return c
+	}
+	c.Shipping = QuoteShipping(rates, c.Subtotal, c.Weight)
+	c.Total = c.Subtotal + c.Shipping
+	return c
+}
+
+// ListShippingRates returns the shipping rates ordered by id
+func (m *DBModel) ListShippingRates(ctx context.Context) ([]ShippingRate, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, m.reader(), `SELECT id, name, kind, amount, threshold FROM shipping_rates ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []ShippingRate
+	for rows.Next() {
+		var r ShippingRate
+		if err := rows.Scan(&r.ID, &r.Name, &r.Kind, &r.Amount, &r.Threshold); err != nil {
+			return nil, err
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
+
+// Fulfillment is how far an order is on its way to the customer
+type Fulfillment string
+
+const (
+	Unfulfilled Fulfillment = "unfulfilled"
+	Shipped     Fulfillment = "shipped"
+	Delivered   Fulfillment = "delivered"
+)
+
+// fulfillmentTransitions lists the fulfillment statuses each can move to.
+// A shipped order can be shipped again to correct its tracking number.
+var fulfillmentTransitions = map[Fulfillment][]Fulfillment{
+	Unfulfilled: {Shipped},
+	Shipped:     {Shipped, Delivered},
+}
+
+// Valid reports whether f is a fulfillment status
+func (f Fulfillment) Valid() bool {
+	return f == Unfulfilled || f == Shipped || f == Delivered
+}
+
+// Transition returns an error wrapping ErrIllegalTransition unless an order
+// can move from f to status to
+func (f Fulfillment) Transition(to Fulfillment) error {
+	for _, next := range fulfillmentTransitions[f] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: fulfillment %s to %s", ErrIllegalTransition, f, to)
+}
+
+// FulfillmentUpdate is a change staff make to the fulfillment of an order
+type FulfillmentUpdate struct {
+	Status Fulfillment
+	// TrackingNumber is required to ship; left empty it keeps the one
+	// stored
+	TrackingNumber string
+}
+
+// Validate checks the fields of an update a client sent
+func (u FulfillmentUpdate) Validate(v *validator.Validator) {
+	v.Check(u.Status == Shipped || u.Status == Delivered, "status", "must be shipped or delivered")
+	if u.Status == Shipped {
+		v.Check(validator.NotBlank(u.TrackingNumber), "tracking_number", "must be provided to ship an order")
+	}
+	v.Check(validator.MaxChars(u.TrackingNumber, 255), "tracking_number", "must not be more than 255 characters")
+}
+
+// UpdateFulfillment moves an order to a new fulfillment status. Only
+// cleared orders are shipped, and moves that are not allowed, or a change
+// made by someone else since the order was read, return an error wrapping
+// ErrIllegalTransition. sql.ErrNoRows is returned when there is no order
+// with that id.
+func (m *DBModel) UpdateFulfillment(ctx context.Context, orderID int, u FulfillmentUpdate) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status OrderStatus
+	var current Fulfillment
+	var tracking string
+	err = m.queryRow(ctx, tx, `SELECT status_id, fulfillment_status, tracking_number FROM orders WHERE id = ?`, orderID).
+		Scan(&status, &current, &tracking)
+	if err != nil {
+		return err
+	}
+	if err := (Order{StatusID: status, Fulfillment: current}).FulfillmentTransition(u.Status); err != nil {
+		return err
+	}
+	if u.TrackingNumber != "" {
+		tracking = u.TrackingNumber
+	}
+
+	res, err := m.exec(ctx, tx, `
+		UPDATE orders SET fulfillment_status = ?, tracking_number = ?, updated_at = ?
+		WHERE id = ? AND fulfillment_status = ?`,
+		u.Status, tracking, time.Now(), orderID, current)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: order %d is no longer %s", ErrIllegalTransition, orderID, current)
+	}
+
+	return tx.Commit()
+}
+
+// FulfillmentTransition returns an error wrapping ErrIllegalTransition
+// unless o can move to fulfillment status to. Only cleared orders ship.
+func (o Order) FulfillmentTransition(to Fulfillment) error {
+	if to == Shipped && o.StatusID != OrderCleared {
+		return fmt.Errorf("%w: a %s order cannot be shipped", ErrIllegalTransition, o.StatusID)
+	}
+	return o.Fulfillment.Transition(to)
+}
+
+// insertAddresses stores the billing and shipping addresses of an order
+func (m *DBModel) insertAddresses(ctx context.Context, q querier, order Order) error {
+	for _, a := range []*Address{order.BillingAddress, order.ShippingAddress} {
+		if a == nil {
+			continue
+		}
+		_, err := m.exec(ctx, q, `
+			INSERT INTO addresses
+				(customer_id, order_id, kind, name, line1, line2, city, region,
+					postal_code, country, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			nullInt(order.CustomerID), order.ID, a.Kind, a.Name, a.Line1, a.Line2, a.City, a.Region,
+			a.PostalCode, a.Country, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAddresses sets the billing and shipping addresses of an order
+func (m *DBModel) loadAddresses(ctx context.Context, q querier, order *Order) error {
+	rows, err := m.query(ctx, q, `
+		SELECT
+			id, COALESCE(customer_id, 0), order_id, kind, name, line1, line2, city,
+			region, postal_code, country, created_at, updated_at
+		FROM addresses
+		WHERE order_id = ?`, order.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Address
+		err := rows.Scan(&a.ID, &a.CustomerID, &a.OrderID, &a.Kind, &a.Name, &a.Line1, &a.Line2, &a.City,
+			&a.Region, &a.PostalCode, &a.Country, &a.CreatedAt, &a.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		switch a.Kind {
+		case AddressBilling:
+			order.BillingAddress = &a
+		case AddressShipping:
+			order.ShippingAddress = &a
+		}
+	}
+	return rows.Err()
+}
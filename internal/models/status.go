@@ -0,0 +1,183 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrIllegalTransition is returned when a status change is not one of the
+// moves the order and transaction lifecycles allow
+var ErrIllegalTransition = errors.New("models: illegal status transition")
+
+// OrderStatus is the id of a row of the statuses table
+type OrderStatus int
+
+// the rows the statuses migration seeds
+const (
+	OrderCleared   OrderStatus = 1
+	OrderRefunded  OrderStatus = 2
+	OrderCancelled OrderStatus = 3
+)
+
+// orderStatusNames are the names of the seeded statuses rows
+var orderStatusNames = map[OrderStatus]string{
+	OrderCleared:   "Cleared",
+	OrderRefunded:  "Refunded",
+	OrderCancelled: "Cancelled",
+}
+
+// orderTransitions lists the statuses each order status can move to.
+// Refunded and cancelled orders are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderCleared: {OrderRefunded, OrderCancelled},
+}
+
+// Valid reports whether s is a seeded order status
+func (s OrderStatus) Valid() bool {
+	_, ok := orderStatusNames[s]
+	return ok
+}
+
+// String returns the name of s as seeded in the statuses table
+func (s OrderStatus) String() string {
+	if name, ok := orderStatusNames[s]; ok {
+		return name
+	}
+	return "OrderStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Transition returns an error wrapping ErrIllegalTransition unless an order
+// can move from s to status to
+func (s OrderStatus) Transition(to OrderStatus) error {
+	for _, next := range orderTransitions[s] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: order %s to %s", ErrIllegalTransition, s, to)
+}
+
+// TxnStatus is the id of a row of the transaction_statuses table
+type TxnStatus int
+
+// the rows the transaction_statuses migration seeds
+const (
+	TxnPending           TxnStatus = 1
+	TxnCleared           TxnStatus = 2
+	TxnDeclined          TxnStatus = 3
+	TxnRefunded          TxnStatus = 4
+	TxnPartiallyRefunded TxnStatus = 5
+)
+
+// txnStatusNames are the names of the seeded transaction_statuses rows
+var txnStatusNames = map[TxnStatus]string{
+	TxnPending:           "Pending",
+	TxnCleared:           "Cleared",
+	TxnDeclined:          "Declined",
+	TxnRefunded:          "Refunded",
+	TxnPartiallyRefunded: "Partially refunded",
+}
+
+// txnTransitions lists the statuses each transaction status can move to. A
+// partially refunded transaction can be refunded in part again.
+var txnTransitions = map[TxnStatus][]TxnStatus{
+	TxnPending:           {TxnCleared, TxnDeclined},
+	TxnCleared:           {TxnRefunded, TxnPartiallyRefunded},
+	TxnPartiallyRefunded: {TxnPartiallyRefunded, TxnRefunded},
+}
+
+// Valid reports whether s is a seeded transaction status
+func (s TxnStatus) Valid() bool {
+	_, ok := txnStatusNames[s]
+	return ok
+}
+
+// String returns the name of s as seeded in the transaction_statuses table
+func (s TxnStatus) String() string {
+	if name, ok := txnStatusNames[s]; ok {
+		return name
+	}
+	return "TxnStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Transition returns an error wrapping ErrIllegalTransition unless a
+// transaction can move from s to status to
+func (s TxnStatus) Transition(to TxnStatus) error {
+	for _, next := range txnTransitions[s] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: transaction %s to %s", ErrIllegalTransition, s, to)
+}
+
+// Actor is who or what changed the status of an order
+type Actor struct {
+	// UserID is the staff user who made the change, 0 when no one signed in
+	// did, such as a customer checking out
+	UserID int `json:"user_id,omitempty"`
+	// Source names the part of the system that made the change, such as
+	// "checkout" or "refund"
+	Source string `json:"source"`
+}
+
+// StatusChange is an entry of the status history of an order
+type StatusChange struct {
+	ID      int `json:"id"`
+	OrderID int `json:"order_id"`
+	// From is 0 for the entry recorded when the order was placed
+	From OrderStatus `json:"from_status_id,omitempty"`
+	To   OrderStatus `json:"to_status_id"`
+	Actor
+	// UserEmail is the email of the user who made the change, if any
+	UserEmail string    `json:"user_email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recordStatusChange appends an entry to the status history of an order;
+// from is 0 when the order is placed
+func (m *DBModel) recordStatusChange(ctx context.Context, q querier, orderID int, from, to OrderStatus, by Actor) error {
+	_, err := m.exec(ctx, q, `
+		INSERT INTO order_status_history
+			(order_id, from_status_id, to_status_id, user_id, source, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		orderID, nullInt(int(from)), to, nullInt(by.UserID), by.Source, time.Now())
+	return err
+}
+
+// orderHistory returns the status history of an order, oldest first
+func (m *DBModel) orderHistory(ctx context.Context, q querier, orderID int) ([]StatusChange, error) {
+	rows, err := m.query(ctx, q, `
+		SELECT
+			h.id, h.order_id, COALESCE(h.from_status_id, 0), h.to_status_id,
+			COALESCE(h.user_id, 0), COALESCE(u.email, ''), h.source, h.created_at
+		FROM
+			order_status_history h
+			LEFT JOIN users u ON u.id = h.user_id
+		WHERE h.order_id = ?
+		ORDER BY h.id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []StatusChange
+	for rows.Next() {
+		var c StatusChange
+		err := rows.Scan(&c.ID, &c.OrderID, &c.From, &c.To, &c.UserID, &c.UserEmail, &c.Source, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+// nullInt stores 0 as NULL, for optional foreign keys
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
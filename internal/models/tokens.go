@@ -0,0 +1,102 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"time"
+)
+
+// Token is a bearer token issued to a user. Only the SHA-256 hash of the
+// plain text is stored, so a leaked tokens table cannot be replayed.
+type Token struct {
+	PlainText string    `json:"token"`
+	UserID    int       `json:"-"`
+	Hash      string    `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// GenerateToken creates a random token for userID valid for ttl
+func GenerateToken(userID int, ttl time.Duration) (*Token, error) {
+	token := &Token{
+		UserID: userID,
+		Expiry: time.Now().Add(ttl),
+	}
+
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+
+	token.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	token.Hash = hashToken(token.PlainText)
+	return token, nil
+}
+
+// hashToken returns the hex encoded SHA-256 of a plain text token
+func hashToken(plainText string) string {
+	hash := sha256.Sum256([]byte(plainText))
+	return hex.EncodeToString(hash[:])
+}
+
+// InsertToken stores the hash of a token for user
+func (m *DBModel) InsertToken(ctx context.Context, t *Token, u User) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO tokens
+			( user_id, token_hash, expiry, created_at, updated_at)
+		VALUES ( ?, ?, ?, ?, ?)
+	`
+	_, err := m.exec(ctx, m.DB, query,
+		u.ID,
+		t.Hash,
+		t.Expiry,
+		time.Now(),
+		time.Now(),
+	)
+
+	return err
+}
+
+// GetUserForToken returns the user owning an unexpired token
+func (m *DBModel) GetUserForToken(ctx context.Context, plainText string) (User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var user User
+	row := m.queryRow(ctx, m.DB, `
+		SELECT
+			u.id, u.first_name, u.last_name, u.email, u.image, u.created_at, u.updated_at
+		FROM
+			users u
+			INNER JOIN tokens t ON t.user_id = u.id
+		WHERE t.token_hash = ? AND t.expiry > ?`, hashToken(plainText), time.Now())
+	err := row.Scan(
+		&user.ID,
+		&user.FirstName,
+		&user.LastName,
+		&user.Email,
+		&user.Image,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// DeleteExpiredTokens removes tokens past their expiry
+func (m *DBModel) DeleteExpiredTokens(ctx context.Context) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.exec(ctx, m.DB, `DELETE FROM tokens WHERE expiry <= ?`, time.Now())
+	return err
+}
@@ -0,0 +1,262 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// RecoveryCodeCount is how many recovery codes are issued on enrollment
+const RecoveryCodeCount = 10
+
+// MaxTwoFactorAttempts is how many wrong codes in a row lock the two-factor
+// logins of a user for TwoFactorLockout
+const MaxTwoFactorAttempts = 5
+
+// TwoFactorLockout is how long two-factor logins stay locked
+const TwoFactorLockout = 15 * time.Minute
+
+// TwoFactor is the two-factor state of a user
+type TwoFactor struct {
+	// Secret is the encrypted TOTP secret, pending until Enabled
+	Secret string
+	// Enabled reports whether the user completed enrollment
+	Enabled bool
+	// Required reports whether any of the user's roles requires two-factor authentication
+	Required bool
+	// Locked reports whether too many wrong codes suspended the user's two-factor logins
+	Locked bool
+}
+
+// GetUser returns a user by id
+func (m *DBModel) GetUser(ctx context.Context, id int) (User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var user User
+	row := m.queryRow(ctx, m.DB, `
+		SELECT
+			id, first_name, last_name, email, image, password, created_at, updated_at
+		FROM
+			users
+		WHERE id = ?`, id)
+	err := row.Scan(
+		&user.ID,
+		&user.FirstName,
+		&user.LastName,
+		&user.Email,
+		&user.Image,
+		&user.Password,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// GetTwoFactor returns the two-factor state of a user
+func (m *DBModel) GetTwoFactor(ctx context.Context, userID int) (TwoFactor, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var tf TwoFactor
+	row := m.queryRow(ctx, m.DB, `
+		SELECT
+			coalesce(u.totp_secret, ''),
+			u.totp_enabled_at IS NOT NULL,
+			EXISTS (
+				SELECT 1
+				FROM user_roles ur INNER JOIN roles r ON r.id = ur.role_id
+				WHERE ur.user_id = u.id AND r.requires_2fa
+			),
+			u.totp_locked_until IS NOT NULL AND u.totp_locked_until > ?
+		FROM
+			users u
+		WHERE u.id = ?`, time.Now(), userID)
+	err := row.Scan(&tf.Secret, &tf.Enabled, &tf.Required, &tf.Locked)
+	if err != nil {
+		return tf, err
+	}
+
+	return tf, nil
+}
+
+// SetPendingTOTPSecret stores an encrypted secret for a user who has not
+// completed enrollment yet
+func (m *DBModel) SetPendingTOTPSecret(ctx context.Context, userID int, secret string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.exec(ctx, m.DB, `
+		UPDATE users SET totp_secret = ?, updated_at = ?
+		WHERE id = ? AND totp_enabled_at IS NULL`, secret, time.Now(), userID)
+	return err
+}
+
+// ConsumeTOTPStep records step as used by userID. It returns false when a
+// code from the same or a later step was already accepted, which stops a
+// code from being replayed within its validity window.
+func (m *DBModel) ConsumeTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	res, err := m.exec(ctx, m.DB, `
+		UPDATE users SET totp_last_step = ?
+		WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RecordTwoFactorFailure counts a wrong two-factor code against a user. The
+// MaxTwoFactorAttempts-th wrong code in a row locks their two-factor logins
+// for TwoFactorLockout and starts the count again; it reports whether this
+// one did.
+func (m *DBModel) RecordTwoFactorFailure(ctx context.Context, userID int) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = m.exec(ctx, tx, `UPDATE users SET totp_failed_attempts = totp_failed_attempts + 1 WHERE id = ?`, userID)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := m.exec(ctx, tx, `
+		UPDATE users SET totp_failed_attempts = 0, totp_locked_until = ?
+		WHERE id = ? AND totp_failed_attempts >= ?`, time.Now().Add(TwoFactorLockout), userID, MaxTwoFactorAttempts)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, tx.Commit()
+}
+
+// ClearTwoFactorFailures forgets the wrong two-factor codes of a user after
+// they supplied a right one
+func (m *DBModel) ClearTwoFactorFailures(ctx context.Context, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.exec(ctx, m.DB, `
+		UPDATE users SET totp_failed_attempts = 0, totp_locked_until = NULL
+		WHERE id = ?`, userID)
+	return err
+}
+
+// EnableTOTP completes enrollment for a user and replaces their recovery codes
+func (m *DBModel) EnableTOTP(ctx context.Context, userID int, recoveryCodes []string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = m.exec(ctx, tx, `UPDATE users SET totp_enabled_at = ?, updated_at = ? WHERE id = ?`, time.Now(), time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.exec(ctx, tx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err := m.exec(ctx, tx, `
+			INSERT INTO recovery_codes
+				( user_id, code_hash, created_at, updated_at)
+			VALUES ( ?, ?, ?, ?)`, userID, hashToken(normalizeRecoveryCode(code)), time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ResetTOTP removes the secret and recovery codes of a user so they must enroll again
+func (m *DBModel) ResetTOTP(ctx context.Context, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = m.exec(ctx, tx, `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL,
+			totp_failed_attempts = 0, totp_locked_until = NULL, updated_at = ?
+		WHERE id = ?`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.exec(ctx, tx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code of a user as used and
+// reports whether there was one
+func (m *DBModel) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	res, err := m.exec(ctx, m.DB, `
+		UPDATE recovery_codes SET used_at = ?, updated_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		time.Now(), time.Now(), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// GenerateRecoveryCodes returns RecoveryCodeCount random codes formatted as
+// xxxxx-xxxxx. Only their hashes are stored, so they are shown once.
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode makes a code typed with other casing or spacing hash the same
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,431 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caleberi/gostripe/internal/validator"
+)
+
+// ErrWidgetInUse is returned when deleting a widget that orders refer to
+var ErrWidgetInUse = errors.New("models: widget has orders")
+
+// page size limits of ListWidgets
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// widget limits the database columns and Stripe accept
+const (
+	MaxDescriptionLength = 65535
+	MaxInventoryLevel    = 1000000
+	// MaxWeight is the heaviest widget in grams, a tonne
+	MaxWeight = 1000000
+)
+
+// WidgetSorts maps the sort keys of WidgetFilter to their columns
+var WidgetSorts = map[string]string{
+	"id":              "id",
+	"name":            "name",
+	"price":           "price",
+	"inventory_level": "inventory_level",
+	"created_at":      "created_at",
+}
+
+// WidgetFilter selects, orders and pages the widgets ListWidgets returns.
+// Zero fields do not filter.
+type WidgetFilter struct {
+	// Search matches name or description, ignoring case
+	Search    string
+	Recurring *bool
+	// InStock keeps widgets with units available to reserve
+	InStock  bool
+	MinPrice int
+	MaxPrice int
+	// Sort is a key of WidgetSorts, prefixed with - for descending order;
+	// widgets are sorted by id by default
+	Sort     string
+	Page     int
+	PageSize int
+}
+
+// ParseWidgetFilter reads a filter from the query parameters search,
+// recurring, in_stock, min_price, max_price, sort, page and page_size,
+// recording malformed and out of range values in v
+func ParseWidgetFilter(q url.Values, v *validator.Validator) WidgetFilter {
+	f := WidgetFilter{
+		Search: q.Get("search"),
+		Sort:   q.Get("sort"),
+	}
+
+	if s := q.Get("recurring"); s != "" {
+		b, err := strconv.ParseBool(s)
+		v.Check(err == nil, "recurring", "must be true or false")
+		f.Recurring = &b
+	}
+	if s := q.Get("in_stock"); s != "" {
+		b, err := strconv.ParseBool(s)
+		v.Check(err == nil, "in_stock", "must be true or false")
+		f.InStock = b
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{
+		{"min_price", &f.MinPrice},
+		{"max_price", &f.MaxPrice},
+		{"page", &f.Page},
+		{"page_size", &f.PageSize},
+	} {
+		if s := q.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			v.Check(err == nil, p.name, "must be a whole number")
+			*p.dst = n
+		}
+	}
+
+	f.Validate(v)
+	return f
+}
+
+// Validate checks the filter values a client sent
+func (f WidgetFilter) Validate(v *validator.Validator) {
+	_, ok := WidgetSorts[strings.TrimPrefix(f.Sort, "-")]
+	v.Check(f.Sort == "" || ok, "sort", "must be one of id, name, price, inventory_level or created_at, optionally prefixed with -")
+	v.Check(f.Page >= 0, "page", "must not be negative")
+	v.Check(f.PageSize >= 0 && f.PageSize <= MaxPageSize, "page_size", fmt.Sprintf("must be between 1 and %d", MaxPageSize))
+	v.Check(f.MinPrice >= 0, "min_price", "must not be negative")
+	v.Check(f.MaxPrice >= 0, "max_price", "must not be negative")
+	v.Check(f.MaxPrice == 0 || f.MinPrice <= f.MaxPrice, "max_price", "must not be less than min_price")
+}
+
+// Paging returns the 1-based page and the page size with defaults applied
+func (f WidgetFilter) Paging() (page, size int) {
+	page, size = f.Page, f.PageSize
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > MaxPageSize {
+		size = DefaultPageSize
+	}
+	return page, size
+}
+
+// orderBy returns the ORDER BY clause of the sort, breaking ties by id
+func (f WidgetFilter) orderBy() string {
+	dir := "ASC"
+	key := f.Sort
+	if strings.HasPrefix(key, "-") {
+		dir = "DESC"
+		key = key[1:]
+	}
+	col, ok := WidgetSorts[key]
+	if !ok {
+		col = "id"
+	}
+	if col == "id" {
+		return "id " + dir
+	}
+	return col + " " + dir + ", id " + dir
+}
+
+// Metadata describes the page of a paginated list
+type Metadata struct {
+	CurrentPage  int `json:"current_page"`
+	PageSize     int `json:"page_size"`
+	FirstPage    int `json:"first_page"`
+	LastPage     int `json:"last_page"`
+	TotalRecords int `json:"total_records"`
+}
+
+// NewMetadata returns the metadata of page of size out of total records
+func NewMetadata(total, page, size int) Metadata {
+	if total == 0 {
+		return Metadata{}
+	}
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     size,
+		FirstPage:    1,
+		LastPage:     (total + size - 1) / size,
+		TotalRecords: total,
+	}
+}
+
+// Validate checks the fields staff can set on a widget
+func (w Widget) Validate(v *validator.Validator) {
+	v.Check(validator.NotBlank(w.Name), "name", "must be provided")
+	v.Check(validator.MaxChars(w.Name, 255), "name", "must not be more than 255 characters")
+	v.Check(validator.MaxChars(w.Description, MaxDescriptionLength), "description", "is too long")
+	v.Check(validator.AmountInRange(w.Price), "price", fmt.Sprintf("must be between %d and %d cents", validator.MinAmount, validator.MaxAmount))
+	v.Check(w.InventoryLevel >= 0, "inventory_level", "must not be negative")
+	v.Check(w.InventoryLevel <= MaxInventoryLevel, "inventory_level", fmt.Sprintf("must not be more than %d", MaxInventoryLevel))
+	v.Check(w.Weight >= 0, "weight", "must not be negative")
+	v.Check(w.Weight <= MaxWeight, "weight", fmt.Sprintf("must not be more than %d grams", MaxWeight))
+	v.Check(validator.MaxChars(w.PlanID, 255), "plan_id", "must not be more than 255 characters")
+	if w.IsRecurring {
+		v.Check(validator.NotBlank(w.PlanID), "plan_id", "must be provided for a recurring widget")
+	} else {
+		v.Check(w.PlanID == "", "plan_id", "must be empty unless the widget is recurring")
+	}
+}
+
+// likePattern escapes the wildcards of s for a LIKE ... ESCAPE '!' match
+// anywhere in a lower cased column
+func likePattern(s string) string {
+	s = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(s))
+	return "%" + s + "%"
+}
+
+// ListWidgets returns a page of the widgets matching f and the metadata of
+// the page
+func (m *DBModel) ListWidgets(ctx context.Context, f WidgetFilter) ([]Widget, Metadata, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var where []string
+	var args []interface{}
+	if s := strings.TrimSpace(f.Search); s != "" {
+		where = append(where, `(LOWER(name) LIKE ? ESCAPE '!' OR LOWER(description) LIKE ? ESCAPE '!')`)
+		args = append(args, likePattern(s), likePattern(s))
+	}
+	if f.Recurring != nil {
+		where = append(where, "is_recurring = ?")
+		args = append(args, *f.Recurring)
+	}
+	if f.InStock {
+		where = append(where, "inventory_level > reserved_level")
+	}
+	if f.MinPrice > 0 {
+		where = append(where, "price >= ?")
+		args = append(args, f.MinPrice)
+	}
+	if f.MaxPrice > 0 {
+		where = append(where, "price <= ?")
+		args = append(args, f.MaxPrice)
+	}
+
+	clause := ""
+	if len(where) > 0 {
+		clause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	db := m.reader()
+
+	var total int
+	err := m.queryRow(ctx, db, `SELECT COUNT(*) FROM widgets `+clause, args...).Scan(&total)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	page, size := f.Paging()
+	rows, err := m.query(ctx, db, `
+		SELECT
+			id, name, description, inventory_level, reserved_level, price, weight, image,
+			plan_id, is_recurring, created_at, updated_at
+		FROM
+			widgets
+		`+clause+`
+		ORDER BY `+f.orderBy()+`
+		LIMIT ? OFFSET ?`, append(args, size, (page-1)*size)...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var widgets []Widget
+	for rows.Next() {
+		var w Widget
+		err := rows.Scan(
+			&w.ID,
+			&w.Name,
+			&w.Description,
+			&w.InventoryLevel,
+			&w.ReservedLevel,
+			&w.Price,
+			&w.Weight,
+			&w.Image,
+			&w.PlanID,
+			&w.IsRecurring,
+			&w.CreatedAt,
+			&w.UpdatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		widgets = append(widgets, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return widgets, NewMetadata(total, page, size), nil
+}
+
+// InsertWidget inserts a new widget and returns its id. Its initial stock
+// is logged as an adjustment.
+func (m *DBModel) InsertWidget(ctx context.Context, w Widget) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO widgets
+			( name, description, inventory_level, price, weight, image, plan_id, is_recurring,
+				created_at, updated_at)
+		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	id, err := m.insert(ctx, tx, query,
+		w.Name,
+		w.Description,
+		w.InventoryLevel,
+		w.Price,
+		w.Weight,
+		w.Image,
+		w.PlanID,
+		w.IsRecurring,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if w.InventoryLevel != 0 {
+		if err := m.logMovement(ctx, tx, id, w.InventoryLevel, MovementAdjustment, ""); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+// UpdateWidget replaces the fields of a widget other than its inventory
+// level, to which adjustment is added and logged as an adjustment. Adding
+// to the current level rather than overwriting it keeps units sold while
+// the widget was being edited sold. ErrOutOfStock is returned when the
+// level would drop below the units reserved for pending orders, and
+// sql.ErrNoRows when there is no widget with its id.
+func (m *DBModel) UpdateWidget(ctx context.Context, w Widget, adjustment int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = m.queryRow(ctx, tx, `SELECT COUNT(*) FROM widgets WHERE id = ?`, w.ID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return sql.ErrNoRows
+	}
+
+	// the condition makes the check and the change one atomic step, like a
+	// reservation's
+	res, err := m.exec(ctx, tx, `
+		UPDATE widgets SET
+			name = ?, description = ?, inventory_level = inventory_level + ?, price = ?, weight = ?,
+			image = ?, plan_id = ?, is_recurring = ?, updated_at = ?
+		WHERE id = ? AND inventory_level + ? >= reserved_level`,
+		w.Name,
+		w.Description,
+		adjustment,
+		w.Price,
+		w.Weight,
+		w.Image,
+		w.PlanID,
+		w.IsRecurring,
+		time.Now(),
+		w.ID,
+		adjustment,
+	)
+	if err != nil {
+		return err
+	}
+	if err := outOfStock(res); err != nil {
+		return err
+	}
+
+	if adjustment != 0 {
+		if err := m.logMovement(ctx, tx, w.ID, adjustment, MovementAdjustment, ""); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SetWidgetImage replaces the image of a widget, leaving its other fields
+// alone. sql.ErrNoRows is returned when there is no widget with that id.
+func (m *DBModel) SetWidgetImage(ctx context.Context, id int, image string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	res, err := m.exec(ctx, m.DB, `UPDATE widgets SET image = ?, updated_at = ? WHERE id = ?`, image, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteWidget deletes a widget nobody ordered. ErrWidgetInUse is returned
+// for a widget with orders, and sql.ErrNoRows when there is no such widget.
+func (m *DBModel) DeleteWidget(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orders int
+	if err := m.queryRow(ctx, tx, `SELECT COUNT(*) FROM order_items WHERE widget_id = ?`, id).Scan(&orders); err != nil {
+		return err
+	}
+	if orders > 0 {
+		return ErrWidgetInUse
+	}
+
+	res, err := m.exec(ctx, tx, `DELETE FROM widgets WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,87 @@
+// Package rbac holds the permissions staff users can be granted through
+// their roles, and the middleware both binaries use to enforce them.
+package rbac
+
+import (
+	"context"
+	"net/http"
+)
+
+// Permission names an action guarded by role based access control. The
+// values match the rows seeded in the permissions table.
+type Permission string
+
+const (
+	// ChargeTerminal allows charging cards through the virtual terminal
+	ChargeTerminal Permission = "terminal:charge"
+	// RefundPayments allows refunding orders
+	RefundPayments Permission = "payments:refund"
+	// ManageUsers allows managing users and their roles
+	ManageUsers Permission = "users:manage"
+	// ViewReports allows reading orders, customers and reports
+	ViewReports Permission = "reports:view"
+	// ManageCatalog allows creating, editing and deleting widgets
+	ManageCatalog Permission = "catalog:manage"
+	// FulfillOrders allows marking orders shipped or delivered
+	FulfillOrders Permission = "orders:fulfill"
+)
+
+// Store looks up the permissions granted to a user through their roles
+type Store interface {
+	PermissionsForUser(ctx context.Context, userID int) ([]string, error)
+}
+
+// UserFunc returns the id of the user making r, and false for an anonymous request
+type UserFunc func(r *http.Request) (int, bool)
+
+// Handlers renders the responses of a rejected request
+type Handlers struct {
+	// Unauthenticated is served when there is no user
+	Unauthenticated http.Handler
+	// Forbidden is served when the user lacks the permission
+	Forbidden http.Handler
+	// Error is served when the permissions could not be loaded
+	Error func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Require returns middleware that lets a request through only when the user
+// identified by user holds perm
+func Require(store Store, user UserFunc, h Handlers, perm Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, ok := user(r)
+			if !ok {
+				h.Unauthenticated.ServeHTTP(w, r)
+				return
+			}
+
+			granted, err := Has(r.Context(), store, id, perm)
+			if err != nil {
+				h.Error(w, r, err)
+				return
+			}
+
+			if !granted {
+				h.Forbidden.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Has reports whether the user holds perm
+func Has(ctx context.Context, store Store, userID int, perm Permission) (bool, error) {
+	perms, err := store.PermissionsForUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range perms {
+		if Permission(p) == perm {
+			return true, nil
+		}
+	}
+	return false, nil
+}
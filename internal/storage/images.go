@@ -0,0 +1,124 @@
+// Package storage keeps uploaded widget images on the local filesystem
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	// ErrTooLarge is returned for an upload over Images.MaxSize
+	ErrTooLarge = errors.New("storage: image is too large")
+	// ErrUnsupportedType is returned for an upload that is not a PNG, JPEG,
+	// GIF or WebP image
+	ErrUnsupportedType = errors.New("storage: image must be a png, jpeg, gif or webp file")
+)
+
+// extensions maps the sniffed content types accepted to the extension of
+// the stored file
+var extensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// nameRX matches the names Save generates, so a stored name can never
+// point outside the directory
+var nameRX = regexp.MustCompile(`^[0-9a-f]{32}\.(png|jpg|gif|webp)$`)
+
+// Images stores images under Dir with random names
+type Images struct {
+	Dir string
+	// MaxSize is the largest image accepted, in bytes
+	MaxSize int64
+}
+
+// Save stores the image read from r and returns its name. The type is
+// sniffed from the content, never taken from the client's file name.
+func (s Images) Save(r io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, s.MaxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > s.MaxSize {
+		return "", ErrTooLarge
+	}
+
+	ext, ok := extensions[http.DetectContentType(data)]
+	if !ok {
+		return "", ErrUnsupportedType
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(b) + ext
+
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first so a reader never sees half an image
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.Dir, name)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Remove deletes a stored image. Names Save did not generate, such as the
+// empty name of a widget without an image, are ignored.
+func (s Images) Remove(name string) error {
+	if !nameRX.MatchString(name) {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Handler serves the stored images by name, without directory listings
+func (s Images) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Base(r.URL.Path)
+		if !nameRX.MatchString(name) {
+			http.NotFound(w, r)
+			return
+		}
+		// names are random and never reused, so images can be cached forever
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeFile(w, r, filepath.Join(s.Dir, name))
+	})
+}
+
+// URL returns the path the web frontend serves a stored image on
+func URL(name string) string {
+	return "/images/" + name
+}
@@ -0,0 +1,158 @@
+package validator
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// limits for amounts expressed in the smallest currency unit (cents)
+const (
+	MinAmount = 50
+	MaxAmount = 99999999
+)
+
+// MaxNameLength is the longest first or last name the database columns accept
+const MaxNameLength = 255
+
+// password length limits; bcrypt ignores everything past 72 bytes
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+// EmailRX is the pattern an email address must match
+var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+// Errors maps a field name to the first error reported for it
+type Errors map[string]string
+
+// Error implements the error interface so validation failures can travel
+// through ordinary error returns
+func (e Errors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var b strings.Builder
+	b.WriteString("validation failed:")
+	for _, field := range fields {
+		b.WriteString(" ")
+		b.WriteString(field)
+		b.WriteString(" ")
+		b.WriteString(e[field])
+		b.WriteString(";")
+	}
+	return b.String()
+}
+
+// Validator collects per-field errors while a payload is checked
+type Validator struct {
+	Errors Errors
+}
+
+// New returns a validator with no errors
+func New() *Validator {
+	return &Validator{Errors: make(Errors)}
+}
+
+// Valid reports whether no errors were recorded
+func (v *Validator) Valid() bool {
+	return len(v.Errors) == 0
+}
+
+// AddError records message for field unless the field already has an error
+func (v *Validator) AddError(field, message string) {
+	if _, exists := v.Errors[field]; !exists {
+		v.Errors[field] = message
+	}
+}
+
+// Check records message for field when ok is false
+func (v *Validator) Check(ok bool, field, message string) {
+	if !ok {
+		v.AddError(field, message)
+	}
+}
+
+// Err returns the recorded errors as an error, or nil when the validator is valid
+func (v *Validator) Err() error {
+	if v.Valid() {
+		return nil
+	}
+	return v.Errors
+}
+
+// NotBlank reports whether value contains something other than whitespace
+func NotBlank(value string) bool {
+	return strings.TrimSpace(value) != ""
+}
+
+// MaxChars reports whether value has at most n characters
+func MaxChars(value string, n int) bool {
+	return utf8.RuneCountInString(value) <= n
+}
+
+// MinChars reports whether value has at least n characters
+func MinChars(value string, n int) bool {
+	return utf8.RuneCountInString(value) >= n
+}
+
+// IsEmail reports whether value looks like a deliverable email address
+func IsEmail(value string) bool {
+	return len(value) <= 254 && EmailRX.MatchString(value)
+}
+
+// IsCurrency reports whether code is an active ISO 4217 currency code,
+// in either case since Stripe expects lower case
+func IsCurrency(code string) bool {
+	_, ok := currencies[strings.ToUpper(code)]
+	return ok
+}
+
+// IsCountry reports whether code is shaped like an upper case ISO 3166-1
+// alpha-2 country code
+func IsCountry(code string) bool {
+	return len(code) == 2 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= 'A' && code[1] <= 'Z'
+}
+
+// AmountInRange reports whether amount lies within the chargeable limits
+func AmountInRange(amount int) bool {
+	return amount >= MinAmount && amount <= MaxAmount
+}
+
+// ValidExpiry reports whether a card expiry month and year is plausible
+// and has not passed at the time now
+func ValidExpiry(month, year int, now time.Time) bool {
+	if month < 1 || month > 12 {
+		return false
+	}
+	if year < now.Year() || year > now.Year()+20 {
+		return false
+	}
+	return year > now.Year() || month >= int(now.Month())
+}
+
+// currencies holds the active ISO 4217 alphabetic codes
+var currencies = map[string]struct{}{
+	"AED": {}, "AFN": {}, "ALL": {}, "AMD": {}, "ANG": {}, "AOA": {}, "ARS": {}, "AUD": {}, "AWG": {}, "AZN": {},
+	"BAM": {}, "BBD": {}, "BDT": {}, "BGN": {}, "BHD": {}, "BIF": {}, "BMD": {}, "BND": {}, "BOB": {}, "BRL": {},
+	"BSD": {}, "BTN": {}, "BWP": {}, "BYN": {}, "BZD": {}, "CAD": {}, "CDF": {}, "CHF": {}, "CLP": {}, "CNY": {},
+	"COP": {}, "CRC": {}, "CUP": {}, "CVE": {}, "CZK": {}, "DJF": {}, "DKK": {}, "DOP": {}, "DZD": {}, "EGP": {},
+	"ERN": {}, "ETB": {}, "EUR": {}, "FJD": {}, "FKP": {}, "GBP": {}, "GEL": {}, "GHS": {}, "GIP": {}, "GMD": {},
+	"GNF": {}, "GTQ": {}, "GYD": {}, "HKD": {}, "HNL": {}, "HTG": {}, "HUF": {}, "IDR": {}, "ILS": {}, "INR": {},
+	"IQD": {}, "IRR": {}, "ISK": {}, "JMD": {}, "JOD": {}, "JPY": {}, "KES": {}, "KGS": {}, "KHR": {}, "KMF": {},
+	"KPW": {}, "KRW": {}, "KWD": {}, "KYD": {}, "KZT": {}, "LAK": {}, "LBP": {}, "LKR": {}, "LRD": {}, "LSL": {},
+	"LYD": {}, "MAD": {}, "MDL": {}, "MGA": {}, "MKD": {}, "MMK": {}, "MNT": {}, "MOP": {}, "MRU": {}, "MUR": {},
+	"MVR": {}, "MWK": {}, "MXN": {}, "MYR": {}, "MZN": {}, "NAD": {}, "NGN": {}, "NIO": {}, "NOK": {}, "NPR": {},
+	"NZD": {}, "OMR": {}, "PAB": {}, "PEN": {}, "PGK": {}, "PHP": {}, "PKR": {}, "PLN": {}, "PYG": {}, "QAR": {},
+	"RON": {}, "RSD": {}, "RUB": {}, "RWF": {}, "SAR": {}, "SBD": {}, "SCR": {}, "SDG": {}, "SEK": {}, "SGD": {},
+	"SHP": {}, "SLE": {}, "SOS": {}, "SRD": {}, "SSP": {}, "STN": {}, "SVC": {}, "SYP": {}, "SZL": {}, "THB": {},
+	"TJS": {}, "TMT": {}, "TND": {}, "TOP": {}, "TRY": {}, "TTD": {}, "TWD": {}, "TZS": {}, "UAH": {}, "UGX": {},
+	"USD": {}, "UYU": {}, "UZS": {}, "VES": {}, "VND": {}, "VUV": {}, "WST": {}, "XAF": {}, "XCD": {}, "XOF": {},
+	"XPF": {}, "YER": {}, "ZAR": {}, "ZMW": {}, "ZWL": {},
+}
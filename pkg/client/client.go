@@ -0,0 +1,432 @@
+// Package client is a typed Go client for the gostripe API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIPrefix is the path of the API version this client speaks
+const APIPrefix = "/api/v1"
+
+// retry and timeout defaults used by New
+const (
+	defaultMaxRetries = 3
+	defaultRetryWait  = 200 * time.Millisecond
+	defaultTimeout    = 15 * time.Second
+)
+
+// Client calls the gostripe API. The zero value is not usable; create one with New.
+type Client struct {
+	// BaseURL is the scheme and host of the API, e.g. http://localhost:4000
+	BaseURL string
+	// HTTPClient performs the requests
+	HTTPClient *http.Client
+	// MaxRetries is how many times an idempotent request is retried after a
+	// network error, a 429 or a 5xx response
+	MaxRetries int
+	// RetryWait is the base delay between retries, doubled on every attempt
+	RetryWait time.Duration
+	// UserAgent is sent with every request
+	UserAgent string
+	// Token is sent as a bearer token when set; obtain one with Authenticate
+	Token string
+}
+
+// New returns a client for the API served at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: defaultTimeout},
+		MaxRetries: defaultMaxRetries,
+		RetryWait:  defaultRetryWait,
+		UserAgent:  "gostripe-go-client",
+	}
+}
+
+// GetWidget fetches a widget by id
+func (c *Client) GetWidget(ctx context.Context, id int) (*Widget, error) {
+	var widget Widget
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/widgets/%d", id), nil, &widget, true)
+	if err != nil {
+		return nil, err
+	}
+	return &widget, nil
+}
+
+// ListWidgets returns a page of the catalog selected and ordered by filter
+func (c *Client) ListWidgets(ctx context.Context, filter WidgetFilter) (*WidgetList, error) {
+	path := "/widgets"
+	if q := filter.query().Encode(); q != "" {
+		path += "?" + q
+	}
+
+	var list WidgetList
+	err := c.do(ctx, http.MethodGet, path, nil, &list, true)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// CreateWidget adds a widget to the catalog. It requires c.Token for a user
+// with the catalog:manage permission and is not retried, since the API
+// would add a duplicate.
+func (c *Client) CreateWidget(ctx context.Context, payload WidgetPayload) (*Widget, error) {
+	var widget Widget
+	err := c.do(ctx, http.MethodPost, "/admin/widgets", payload, &widget, false)
+	if err != nil {
+		return nil, err
+	}
+	return &widget, nil
+}
+
+// UpdateWidget replaces the fields of a widget, keeping its image. It
+// requires c.Token for a user with the catalog:manage permission. Set
+// update.InventorySeen to the inventory level the edit started from so
+// units sold meanwhile stay sold. The update is then not retried, since
+// the change to the level would be applied on every attempt.
+func (c *Client) UpdateWidget(ctx context.Context, id int, update WidgetUpdate) (*Widget, error) {
+	var widget Widget
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/admin/widgets/%d", id), update, &widget, update.InventorySeen == nil)
+	if err != nil {
+		return nil, err
+	}
+	return &widget, nil
+}
+
+// DeleteWidget deletes a widget that was never ordered, failing with a 409
+// for one that was. It requires c.Token for a user with the
+// catalog:manage permission.
+func (c *Client) DeleteWidget(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/admin/widgets/%d", id), nil, nil, true)
+}
+
+// UploadWidgetImage replaces the image of a widget with a png, jpeg, gif or
+// webp file read from image. It requires c.Token for a user with the
+// catalog:manage permission.
+func (c *Client) UploadWidgetImage(ctx context.Context, id int, filename string, image io.Reader) (*Widget, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, image); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	var widget Widget
+	err = c.doBody(ctx, http.MethodPut, fmt.Sprintf("/admin/widgets/%d/image", id), form.FormDataContentType(), body.Bytes(), &widget, true)
+	if err != nil {
+		return nil, err
+	}
+	return &widget, nil
+}
+
+// ListInventoryMovements returns the latest changes to the stock of a
+// widget, newest first. It requires c.Token for a user with the
+// catalog:manage permission.
+func (c *Client) ListInventoryMovements(ctx context.Context, widgetID int) ([]InventoryMovement, error) {
+	var movements []InventoryMovement
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/admin/widgets/%d/inventory-movements", widgetID), nil, &movements, true)
+	if err != nil {
+		return nil, err
+	}
+	return movements, nil
+}
+
+// ListOrders returns a page of the orders selected by filter, newest
+// first; set filter.Cursor to the NextCursor of a page to fetch the one
+// after it. It requires c.Token for a user with the reports:view permission.
+func (c *Client) ListOrders(ctx context.Context, filter OrderFilter) (*OrderList, error) {
+	path := "/orders"
+	if q := filter.query().Encode(); q != "" {
+		path += "?" + q
+	}
+
+	var list OrderList
+	err := c.do(ctx, http.MethodGet, path, nil, &list, true)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetOrder fetches an order by id. It requires c.Token for a user with the reports:view permission.
+func (c *Client) GetOrder(ctx context.Context, id int) (*Order, error) {
+	var order Order
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/orders/%d", id), nil, &order, true)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetCustomer fetches a customer by id. It requires c.Token for a user with the reports:view permission.
+func (c *Client) GetCustomer(ctx context.Context, id int) (*Customer, error) {
+	var customer Customer
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/customers/%d", id), nil, &customer, true)
+	if err != nil {
+		return nil, err
+	}
+	return &customer, nil
+}
+
+// CreateCustomer stores a new customer. It is not retried since the API
+// would store a duplicate.
+func (c *Client) CreateCustomer(ctx context.Context, payload CustomerPayload) (*Customer, error) {
+	var customer Customer
+	err := c.do(ctx, http.MethodPost, "/customers", payload, &customer, false)
+	if err != nil {
+		return nil, err
+	}
+	return &customer, nil
+}
+
+// PriceCart prices cart lines at the current widget prices
+func (c *Client) PriceCart(ctx context.Context, lines []CartLine) (*Cart, error) {
+	var cart Cart
+	err := c.do(ctx, http.MethodPost, "/cart", CartPayload{Items: lines}, &cart, true)
+	if err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// CreatePaymentIntent asks stripe for a payment intent. Retries reuse the
+// same Idempotency-Key, so stripe creates at most one intent per call.
+func (c *Client) CreatePaymentIntent(ctx context.Context, payload PaymentPayload) (*PaymentIntent, error) {
+	var pi PaymentIntent
+	err := c.do(ctx, http.MethodPost, "/payment-intents", payload, &pi, true)
+	if err != nil {
+		return nil, err
+	}
+	return &pi, nil
+}
+
+// CreateSubscription creates a stripe customer and subscribes them to
+// payload.Plan. It is not retried since the API records the order.
+func (c *Client) CreateSubscription(ctx context.Context, payload PaymentPayload) (*Response, error) {
+	var resp Response
+	err := c.do(ctx, http.MethodPost, "/subscriptions", payload, &resp, false)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Authenticate exchanges an email and password for a bearer token.
+// Set the returned token's PlainText on c.Token to call protected endpoints.
+func (c *Client) Authenticate(ctx context.Context, email, password string) (*Token, error) {
+	var token Token
+	err := c.do(ctx, http.MethodPost, "/authenticate", Credentials{Email: email, Password: password}, &token, false)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RecordTerminalPayment stores a payment confirmed through the virtual
+// terminal. It requires c.Token and is not retried.
+func (c *Client) RecordTerminalPayment(ctx context.Context, payment TerminalPayment) (*Transaction, error) {
+	var txn Transaction
+	err := c.do(ctx, http.MethodPost, "/admin/virtual-terminal-payments", payment, &txn, false)
+	if err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
+
+// RefundOrder refunds a cleared order in full. It requires c.Token for a
+// user with the payments:refund permission. Retries reuse the same
+// Idempotency-Key, so stripe refunds at most once per call.
+func (c *Client) RefundOrder(ctx context.Context, id int) (*Response, error) {
+	var resp Response
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/admin/orders/%d/refund", id), nil, &resp, true)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdateFulfillment marks an order shipped or delivered. It requires
+// c.Token for a user with the orders:fulfill permission and is retried,
+// since applying the same update twice leaves the order as it was.
+func (c *Client) UpdateFulfillment(ctx context.Context, id int, payload FulfillmentPayload) (*Order, error) {
+	var order Order
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/admin/orders/%d/fulfillment", id), payload, &order, true)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// ForgotPassword asks the API to mail a password reset link to email. It
+// succeeds whether or not the email belongs to a user.
+func (c *Client) ForgotPassword(ctx context.Context, email string) error {
+	return c.do(ctx, http.MethodPost, "/forgot-password", ForgotPasswordPayload{Email: email}, nil, false)
+}
+
+// ResetPassword sets a new password using the link from a reset email
+func (c *Client) ResetPassword(ctx context.Context, link, password string) error {
+	return c.do(ctx, http.MethodPost, "/reset-password", ResetPasswordPayload{Link: link, Password: password}, nil, false)
+}
+
+// GetDatabaseStats reports the health, replication lag and connection pool
+// of the primary database and each replica. It requires c.Token for a user
+// with the reports:view permission.
+func (c *Client) GetDatabaseStats(ctx context.Context) ([]DatabaseNode, error) {
+	var nodes []DatabaseNode
+	err := c.do(ctx, http.MethodGet, "/admin/database", nil, &nodes, true)
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// OpenAPI fetches the OpenAPI 3 document describing the API
+func (c *Client) OpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var doc json.RawMessage
+	err := c.do(ctx, http.MethodGet, "/openapi.json", nil, &doc, true)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// do sends a request and decodes a 2xx JSON response into out. Every
+// request carries an Idempotency-Key that stays the same across retries;
+// only requests marked idempotent are retried.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}, idempotent bool) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	return c.doBody(ctx, method, path, "application/json", body, out, idempotent)
+}
+
+// doBody is do for a body already encoded as contentType
+func (c *Client) doBody(ctx context.Context, method, path, contentType string, body []byte, out interface{}, idempotent bool) error {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return err
+	}
+
+	attempts := 1
+	if idempotent {
+		attempts += c.MaxRetries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := c.wait(ctx, attempt); err != nil {
+				return err
+			}
+		}
+
+		var retry bool
+		retry, lastErr = c.send(ctx, method, path, key, contentType, body, out)
+		if lastErr == nil || !retry {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// send performs a single attempt and reports whether a failure may be retried
+func (c *Client) send(ctx context.Context, method, path, key, contentType string, body []byte, out interface{}) (bool, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+APIPrefix+path, reader)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		// a cancelled or expired context will not succeed on retry
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var envelope Response
+		if json.Unmarshal(data, &envelope) == nil {
+			apiErr.Message = envelope.Message
+			apiErr.Errors = envelope.Errors
+		}
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, apiErr
+	}
+
+	if out == nil || len(data) == 0 {
+		return false, nil
+	}
+	return false, json.Unmarshal(data, out)
+}
+
+// wait sleeps for an exponential backoff with jitter, or until ctx is done
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	backoff := time.Duration(float64(c.RetryWait) * math.Pow(2, float64(attempt-1)))
+	backoff += time.Duration(mrand.Int63n(int64(c.RetryWait) + 1))
+
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// newIdempotencyKey returns a random 128 bit key in hex
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
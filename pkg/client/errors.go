@@ -0,0 +1,66 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Error is returned for any response with a non 2xx status code, decoded
+// from the API error envelope when the body contains one
+type Error struct {
+	StatusCode int
+	Message    string
+	// Errors holds per-field validation failures keyed by field name
+	Errors map[string]string
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("gostripe: %d %s", e.StatusCode, msg)
+	}
+
+	fields := make([]string, 0, len(e.Errors))
+	for field, problem := range e.Errors {
+		fields = append(fields, field+" "+problem)
+	}
+	sort.Strings(fields)
+	return fmt.Sprintf("gostripe: %d %s: %s", e.StatusCode, msg, strings.Join(fields, "; "))
+}
+
+// IsNotFound reports whether err is an API error for a missing resource
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsUnauthorized reports whether err is an API error for missing, invalid or expired credentials
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// IsForbidden reports whether err is an API error for a user lacking a required permission
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+// IsValidation reports whether err is an API error carrying field validation failures
+func IsValidation(err error) bool {
+	return hasStatus(err, http.StatusUnprocessableEntity)
+}
+
+// IsPaymentFailed reports whether err is an API error for a declined card or failed charge
+func IsPaymentFailed(err error) bool {
+	return hasStatus(err, http.StatusPaymentRequired)
+}
+
+func hasStatus(err error, status int) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
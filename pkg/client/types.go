@@ -0,0 +1,397 @@
+package client
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// PaymentPayload is the body accepted by the payment intent and subscription endpoints.
+// Amount is in the smallest currency unit.
+type PaymentPayload struct {
+	// Currency is an ISO 4217 code. Widgets are charged in the currency
+	// they are priced in, which it must match when given.
+	Currency      string `json:"currency"`
+	Amount        int    `json:"amount"`
+	PaymentMethod string `json:"payment_method"`
+	Email         string `json:"email"`
+	LastFour      string `json:"last_four"`
+	Plan          string `json:"plan"`
+	ExpiryMonth   int    `json:"exp_month"`
+	ExpiryYear    int    `json:"exp_year"`
+	CardBrand     string `json:"card_brand"`
+	ProductID     int    `json:"product_id"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	// Items, when given, are the cart a payment intent charges for; the
+	// amount charged is their total at the current widget prices plus
+	// shipping
+	Items []CartLine `json:"items,omitempty"`
+	// ShippingAddress is required to buy widgets; BillingAddress is
+	// optional
+	ShippingAddress *Address `json:"shipping_address,omitempty"`
+	BillingAddress  *Address `json:"billing_address,omitempty"`
+}
+
+// Address is a postal address. Country is an ISO 3166-1 alpha-2 code.
+type Address struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"`
+}
+
+// CartLine is a quantity of a widget in a cart
+type CartLine struct {
+	WidgetID int `json:"widget_id"`
+	Quantity int `json:"quantity"`
+}
+
+// CartPayload is the body accepted when pricing a cart
+type CartPayload struct {
+	Items []CartLine `json:"items"`
+}
+
+// Cart is a cart priced at the current widget prices. Total is Subtotal,
+// what the items cost, plus Shipping.
+type Cart struct {
+	Items    []OrderItem `json:"items"`
+	Subtotal int         `json:"subtotal"`
+	Shipping int         `json:"shipping"`
+	Total    int         `json:"total"`
+	// Weight is the weight of the items in grams
+	Weight int `json:"weight"`
+}
+
+// CustomerPayload is the body accepted when creating a customer
+type CustomerPayload struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+}
+
+// Response is the envelope the API uses for results without a resource body and for errors
+type Response struct {
+	OK      bool              `json:"ok"`
+	Message string            `json:"message,omitempty"`
+	Content string            `json:"content,omitempty"`
+	ID      string            `json:"id,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// PaymentIntent is the part of a stripe payment intent needed to confirm a payment
+type PaymentIntent struct {
+	ID           string `json:"id"`
+	ClientSecret string `json:"client_secret"`
+	Amount       int    `json:"amount"`
+	Currency     string `json:"currency"`
+	Status       string `json:"status"`
+}
+
+// Widget is a product that can be bought once or subscribed to
+type Widget struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	InventoryLevel int    `json:"inventory_level"`
+	IsRecurring    bool   `json:"is_recurring"`
+	PlanID         string `json:"plan_id"`
+	Image          string `json:"image"`
+	Price          int    `json:"price"`
+	// Weight is the shipping weight of a unit in grams
+	Weight int `json:"weight"`
+}
+
+// WidgetFilter selects, orders and pages the widgets ListWidgets returns.
+// Zero fields do not filter.
+type WidgetFilter struct {
+	// Search matches name or description, ignoring case
+	Search    string
+	Recurring *bool
+	// InStock keeps widgets with units available to reserve
+	InStock  bool
+	MinPrice int
+	MaxPrice int
+	// Sort is id, name, price, inventory_level or created_at, prefixed
+	// with - for descending order; widgets are sorted by id by default
+	Sort     string
+	Page     int
+	PageSize int
+}
+
+// query encodes the filter as the query parameters of the list endpoint
+func (f WidgetFilter) query() url.Values {
+	q := url.Values{}
+	if f.Search != "" {
+		q.Set("search", f.Search)
+	}
+	if f.Recurring != nil {
+		q.Set("recurring", strconv.FormatBool(*f.Recurring))
+	}
+	if f.InStock {
+		q.Set("in_stock", "true")
+	}
+	for name, n := range map[string]int{"min_price": f.MinPrice, "max_price": f.MaxPrice, "page": f.Page, "page_size": f.PageSize} {
+		if n != 0 {
+			q.Set(name, strconv.Itoa(n))
+		}
+	}
+	if f.Sort != "" {
+		q.Set("sort", f.Sort)
+	}
+	return q
+}
+
+// WidgetList is a page of widgets
+type WidgetList struct {
+	Widgets  []Widget `json:"widgets"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// Metadata describes the page a list is and how many records there are
+type Metadata struct {
+	CurrentPage  int `json:"current_page"`
+	PageSize     int `json:"page_size"`
+	FirstPage    int `json:"first_page"`
+	LastPage     int `json:"last_page"`
+	TotalRecords int `json:"total_records"`
+}
+
+// WidgetPayload is the body accepted when creating a widget. The image is
+// uploaded separately with UploadWidgetImage.
+type WidgetPayload struct {
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	Price          int    `json:"price"`
+	InventoryLevel int    `json:"inventory_level"`
+	IsRecurring    bool   `json:"is_recurring"`
+	PlanID         string `json:"plan_id"`
+	// Weight is the shipping weight of a unit in grams
+	Weight int `json:"weight"`
+}
+
+// WidgetUpdate is the body accepted when updating a widget
+type WidgetUpdate struct {
+	WidgetPayload
+	// InventorySeen is the inventory level the edit started from. The
+	// difference between it and InventoryLevel is added to the current
+	// level; when it is nil, the edit starts from the current level.
+	InventorySeen *int `json:"inventory_seen,omitempty"`
+}
+
+// InventoryMovement is one change to the inventory level of a widget
+type InventoryMovement struct {
+	ID       int `json:"id"`
+	WidgetID int `json:"widget_id"`
+	// Quantity is negative for stock leaving
+	Quantity int `json:"quantity"`
+	// Reason is sale or adjustment
+	Reason string `json:"reason"`
+	// Reference identifies what caused the movement, such as the payment
+	// intent of a sale
+	Reference string    `json:"reference"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Order is a purchase of widgets by a customer
+type Order struct {
+	ID            int `json:"id"`
+	WidgetID      int `json:"widget_id"`
+	TransactionID int `json:"transaction_id"`
+	CustomerID    int `json:"customer_id"`
+	StatusID      int `json:"status_id"`
+	Quantity      int `json:"quantity"`
+	// Amount is what was charged, ShippingAmount included
+	Amount         int         `json:"amount"`
+	ShippingAmount int         `json:"shipping_amount"`
+	Items          []OrderItem `json:"items"`
+	// FulfillmentStatus is unfulfilled, shipped or delivered
+	FulfillmentStatus string    `json:"fulfillment_status"`
+	TrackingNumber    string    `json:"tracking_number"`
+	BillingAddress    *Address  `json:"billing_address,omitempty"`
+	ShippingAddress   *Address  `json:"shipping_address,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// OrderSummary is an order with its customer, transaction and the names of
+// its statuses, as the order endpoints return it
+type OrderSummary struct {
+	Order
+	Status            string      `json:"status"`
+	Customer          Customer    `json:"customer"`
+	Transaction       Transaction `json:"transaction"`
+	TransactionStatus string      `json:"transaction_status"`
+	// WidgetName is the name of the widget of the first item, and ItemCount
+	// the number of items
+	WidgetName string `json:"widget_name"`
+	ItemCount  int    `json:"item_count"`
+	// History is the status history, oldest first; lists leave it out
+	History []StatusChange `json:"history,omitempty"`
+}
+
+// StatusChange is an entry in the status history of an order
+type StatusChange struct {
+	ID      int `json:"id"`
+	OrderID int `json:"order_id"`
+	// FromStatusID is 0 for the entry recorded when the order was placed
+	FromStatusID int `json:"from_status_id,omitempty"`
+	ToStatusID   int `json:"to_status_id"`
+	// UserID is the staff user who made the change, 0 when no one signed
+	// in did, and Source the part of the system that made it
+	UserID    int       `json:"user_id,omitempty"`
+	Source    string    `json:"source"`
+	UserEmail string    `json:"user_email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrderFilter selects and pages the orders ListOrders returns, newest
+// first. Zero fields do not filter.
+type OrderFilter struct {
+	StatusID int
+	// FulfillmentStatus is unfulfilled, shipped or delivered
+	FulfillmentStatus string
+	// From and To bound the day the order was placed on, both inclusive
+	From time.Time
+	To   time.Time
+	// Email matches part of the customer email, ignoring case
+	Email string
+	// WidgetID keeps orders with an item for the widget
+	WidgetID  int
+	MinAmount int
+	MaxAmount int
+	// Cursor is the NextCursor of the page before, empty for the first page
+	Cursor   string
+	PageSize int
+}
+
+// query encodes the filter as the query parameters of the list endpoint
+func (f OrderFilter) query() url.Values {
+	q := url.Values{}
+	for name, s := range map[string]string{"fulfillment_status": f.FulfillmentStatus, "email": f.Email, "cursor": f.Cursor} {
+		if s != "" {
+			q.Set(name, s)
+		}
+	}
+	for name, t := range map[string]time.Time{"from": f.From, "to": f.To} {
+		if !t.IsZero() {
+			q.Set(name, t.Format("2006-01-02"))
+		}
+	}
+	for name, n := range map[string]int{"status_id": f.StatusID, "widget_id": f.WidgetID, "min_amount": f.MinAmount, "max_amount": f.MaxAmount, "page_size": f.PageSize} {
+		if n != 0 {
+			q.Set(name, strconv.Itoa(n))
+		}
+	}
+	return q
+}
+
+// OrderList is a page of orders
+type OrderList struct {
+	Orders   []OrderSummary `json:"orders"`
+	Metadata CursorMetadata `json:"metadata"`
+}
+
+// CursorMetadata describes a page of a list paged by cursor
+type CursorMetadata struct {
+	PageSize int `json:"page_size"`
+	// NextCursor fetches the page after this one; it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// OrderItem is a line of an order or of a priced cart
+type OrderItem struct {
+	ID       int    `json:"id"`
+	OrderID  int    `json:"order_id"`
+	WidgetID int    `json:"widget_id"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+	Price    int    `json:"price"`
+	Amount   int    `json:"amount"`
+}
+
+// Customer is a person who has bought or subscribed to a widget
+type Customer struct {
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+}
+
+// Credentials is the body accepted by the authenticate endpoint
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Code is a current TOTP code or an unused recovery code, required for
+	// users who enrolled in two-factor authentication
+	Code string `json:"code,omitempty"`
+}
+
+// Token is a bearer token issued by the authenticate endpoint
+type Token struct {
+	PlainText string    `json:"token"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// TerminalPayment records a card payment already confirmed through the virtual terminal
+type TerminalPayment struct {
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Email         string `json:"email"`
+	Amount        int    `json:"amount"`
+	Currency      string `json:"currency"`
+	PaymentIntent string `json:"payment_intent"`
+	PaymentMethod string `json:"payment_method"`
+}
+
+// Transaction is a recorded card payment
+type Transaction struct {
+	ID                  int    `json:"id"`
+	Amount              int    `json:"amount"`
+	Currency            string `json:"currency"`
+	LastFour            string `json:"last_four"`
+	ExpiryMonth         int    `json:"expiry_month"`
+	ExpiryYear          int    `json:"expiry_year"`
+	PaymentMethod       string `json:"payment_method"`
+	PaymentIntent       string `json:"payment_intent"`
+	SubscriptionID      string `json:"subscription_id"`
+	BankReturnCode      string `json:"bank_return_code"`
+	TransactionStatusID int    `json:"transaction_status_id"`
+}
+
+// FulfillmentPayload is the body accepted when marking an order shipped or
+// delivered. TrackingNumber is required to ship; left empty when an order
+// is delivered, the one it shipped with is kept.
+type FulfillmentPayload struct {
+	Status         string `json:"status"`
+	TrackingNumber string `json:"tracking_number,omitempty"`
+}
+
+// ForgotPasswordPayload asks for a password reset link to be mailed
+type ForgotPasswordPayload struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordPayload sets a new password using a mailed reset link
+type ResetPasswordPayload struct {
+	// Link is the signed reset URL, or its path and query
+	Link     string `json:"link"`
+	Password string `json:"password"`
+}
+
+// DatabaseNode is the health and pool statistics of the primary database or
+// of a read replica
+type DatabaseNode struct {
+	Name    string `json:"name"`
+	Primary bool   `json:"primary"`
+	Healthy bool   `json:"healthy"`
+	// LagSeconds is the replication lag of a replica at the last check
+	LagSeconds float64     `json:"lag_seconds"`
+	Checked    time.Time   `json:"checked_at"`
+	Error      string      `json:"error,omitempty"`
+	Pool       sql.DBStats `json:"pool"`
+}